@@ -5,50 +5,343 @@ import (
 	"context"
 	"encoding/binary"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/memcache"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// CacheStore stores values in memcache, under keys namespaced by Prefix.
+//
+// Keys also include a generation number, held in memcache alongside them, so that Flush can invalidate every
+// key under the prefix at once by moving to a new generation. Entries from old generations are no longer read,
+// and are left for memcache to evict. Each operation reads the generation first, costing an extra round trip.
 type CacheStore struct {
 	Prefix string
-	Codec  memcache.Codec
+
+	// Codec used to serialize values. If unset, GobMemcacheCodec is used.
+	Codec memcache.Codec
 }
 
 func (cs *CacheStore) Get(ctx context.Context, key string, v interface{}) error {
 	l := ctxlogrus.Get(ctx)
 	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("cache get")
 
-	_, err := cs.Codec.Get(ctx, cs.Prefix+key, v)
-	return errors.Wrap(err, "")
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.codec().Get(ctx, fullKey, v)
+	return cacheError(err)
+}
+
+func (cs *CacheStore) GetMulti(ctx context.Context, keys []string, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "keys": keys}).Debug("cache get multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	prefixedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		prefixedKeys[i] = keyPrefix + key
+	}
+
+	items, err := memcache.GetMulti(ctx, prefixedKeys)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+	for i, key := range prefixedKeys {
+		item, ok := items[key]
+		if !ok {
+			errs[i] = data.ErrCacheMiss
+			failed = true
+			continue
+		}
+
+		err := cs.codec().Unmarshal(item.Value, v[i])
+		if err != nil {
+			errs[i] = errors.Wrap(err, "")
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
 }
 
 func (cs *CacheStore) Set(ctx context.Context, key string, v interface{}) error {
+	return cs.SetWithTTL(ctx, key, 0, v)
+}
+
+func (cs *CacheStore) SetWithTTL(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("cache set")
+
+	item, err := cs.item(ctx, key, ttl, v)
+	if err != nil {
+		return err
+	}
+	return cacheError(cs.codec().Set(ctx, item))
+}
+
+func (cs *CacheStore) SetMulti(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "keys": keys, "ttl": ttl}).Debug("cache set multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	items := make([]*memcache.Item, len(keys))
+	for i, key := range keys {
+		items[i] = &memcache.Item{
+			Key:        keyPrefix + key,
+			Object:     v[i],
+			Expiration: memcacheExpiration(ttl),
+		}
+	}
+
+	return cacheError(cs.codec().SetMulti(ctx, items))
+}
+
+func (cs *CacheStore) Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("cache add")
+
+	item, err := cs.item(ctx, key, ttl, v)
+	if err != nil {
+		return err
+	}
+	return cacheError(cs.codec().Add(ctx, item))
+}
+
+func (cs *CacheStore) GetForCAS(ctx context.Context, key string, v interface{}) (data.CASToken, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("cache get for cas")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err := cs.codec().Get(ctx, fullKey, v)
+	if err != nil {
+		return nil, cacheError(err)
+	}
+	return item, nil
+}
+
+func (cs *CacheStore) CompareAndSwap(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("cache compare and swap")
+
+	// The item returned by the get holds the CAS ID memcache needs to detect changes.
+	item, ok := token.(*memcache.Item)
+	if !ok || !strings.HasPrefix(item.Key, cs.Prefix) || !strings.HasSuffix(item.Key, "/"+key) {
+		return errors.Errorf("cas token was not read for key '%s'", key)
+	}
+
+	// If the cache was flushed since the value was read, the value has been removed.
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if item.Key != fullKey {
+		return data.ErrCacheNotStored
+	}
+	item.Object = v
+	item.Expiration = memcacheExpiration(ttl)
+
+	return cacheError(cs.codec().CompareAndSwap(ctx, item))
+}
+
+func (cs *CacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return cs.IncrementWithTTL(ctx, key, 0, delta, initialValue)
+}
+
+// memcache can't give counters it creates an expiry, so counters with a TTL are first added as values,
+// in the decimal form memcache holds counters in, then incremented.
+func (cs *CacheStore) IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "delta": delta}).Debug("cache increment")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if ttl == 0 {
+		newValue, err := memcache.Increment(ctx, fullKey, delta, initialValue)
+		return newValue, cacheError(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = cacheError(memcache.Add(ctx, &memcache.Item{
+			Key:        fullKey,
+			Value:      []byte(strconv.FormatUint(initialValue, 10)),
+			Expiration: memcacheExpiration(ttl),
+		}))
+		if err != nil && err != data.ErrCacheNotStored {
+			return 0, err
+		}
+
+		// The counter may be evicted before it is incremented, in which case it is added again.
+		newValue, err := memcache.IncrementExisting(ctx, fullKey, delta)
+		err = cacheError(err)
+		if err != data.ErrCacheMiss {
+			return newValue, err
+		}
+	}
+	return 0, errors.Errorf("counter '%s' was evicted each time before it could be incremented", key)
+}
+
+func (cs *CacheStore) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
 	l := ctxlogrus.Get(ctx)
-	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("cache set")
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "delta": delta}).Debug("cache increment existing")
 
-	cacheItem := &memcache.Item{
-		Key:    cs.Prefix + key,
-		Object: v,
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return 0, err
 	}
 
-	return errors.Wrap(cs.Codec.Set(ctx, cacheItem), "")
+	newValue, err := memcache.IncrementExisting(ctx, fullKey, delta)
+	return newValue, cacheError(err)
 }
 
 func (cs *CacheStore) Delete(ctx context.Context, key string) error {
 	l := ctxlogrus.Get(ctx)
 	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("cache delete")
 
-	return memcache.Delete(ctx, cs.Prefix+key)
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return cacheError(memcache.Delete(ctx, fullKey))
 }
 
+// Invalidates every value and counter under the prefix, leaving other users of memcache unaffected.
 func (cs *CacheStore) Flush(ctx context.Context) error {
 	l := ctxlogrus.Get(ctx)
-	l.Debug("cache clear - full purge")
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix}).Debug("cache flush")
 
-	return memcache.Flush(ctx)
+	_, err := memcache.Increment(ctx, cs.generationKey(), 1, initialGeneration())
+	return cacheError(err)
 }
 
+// Returns the prefix for keys in the current generation.
+func (cs *CacheStore) keyPrefix(ctx context.Context) (string, error) {
+	generation, err := memcache.Increment(ctx, cs.generationKey(), 0, initialGeneration())
+	if err != nil {
+		return "", errors.Wrap(cacheError(err), "unable to read cache generation")
+	}
+	return cs.Prefix + strconv.FormatUint(generation, 36) + "/", nil
+}
+
+func (cs *CacheStore) fullKey(ctx context.Context, key string) (string, error) {
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return "", err
+	}
+	return keyPrefix + key, nil
+}
+
+func (cs *CacheStore) generationKey() string {
+	return cs.Prefix + "#generation"
+}
+
+// If the generation is evicted, it restarts from the current time, so it does not return to an old generation
+// whose values may still be present.
+func initialGeneration() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+func (cs *CacheStore) codec() memcache.Codec {
+	if cs.Codec.Marshal == nil {
+		return GobMemcacheCodec
+	}
+	return cs.Codec
+}
+
+func (cs *CacheStore) item(ctx context.Context, key string, ttl time.Duration, v interface{}) (*memcache.Item, error) {
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &memcache.Item{
+		Key:        fullKey,
+		Object:     v,
+		Expiration: memcacheExpiration(ttl),
+	}, nil
+}
+
+// Memcache has second precision, and treats an expiration under a second as already expired,
+// so positive TTLs are rounded up to at least a second.
+func memcacheExpiration(ttl time.Duration) time.Duration {
+	if ttl > 0 && ttl < time.Second {
+		return time.Second
+	}
+	return ttl
+}
+
+// Maps memcache errors to their data package equivalents, so callers needn't depend on memcache.
+func cacheError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case memcache.ErrCacheMiss:
+		return data.ErrCacheMiss
+	case memcache.ErrNotStored:
+		return data.ErrCacheNotStored
+	case memcache.ErrCASConflict:
+		return data.ErrCacheCASConflict
+	}
+
+	if errs, ok := err.(appengine.MultiError); ok {
+		mapped := make(data.MultiError, len(errs))
+		for i, err := range errs {
+			mapped[i] = cacheError(err)
+		}
+		return mapped
+	}
+	return errors.Wrap(err, "")
+}
+
+// Adapts a data.Codec for use with memcache.
+func MemcacheCodec(codec data.Codec) memcache.Codec {
+	return memcache.Codec{
+		Marshal:   codec.Marshal,
+		Unmarshal: codec.Unmarshal,
+	}
+}
+
+var JSONMemcacheCodec = MemcacheCodec(data.JSONCodec{})
+
+var GobMemcacheCodec = MemcacheCodec(data.GobCodec{})
+
 // Can only marshal fixed-size data as defined by the encoding/binary package.
 var BinaryMemcacheCodec = memcache.Codec{
 	Marshal:   binaryMarshal,
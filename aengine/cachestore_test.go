@@ -1,10 +1,14 @@
 package aengine
 
 import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/memcache"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestCacheStore_Delete(t *testing.T) {
@@ -18,36 +22,79 @@ func TestCacheStore_Delete(t *testing.T) {
 	}
 	defer done()
 
-	cacheItem := &memcache.Item{
-		Key:    "FooBar",
-		Object: "bluh",
+	cs := &CacheStore{
+		Prefix: "Foo",
+		Codec:  memcache.JSON,
+	}
+	err = cs.Set(ctx, "Bar", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	err = cs.Delete(ctx, "Bar")
+	if err != nil {
+		t.Errorf("Unexpected error from Delete: %s", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Bar", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error after Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_Flush(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
 	}
-	err = memcache.JSON.Set(ctx, cacheItem)
+
+	ctx, done, err := aetest.NewContext()
 	if err != nil {
-		t.Fatalf("Unexpected error adding to memcache: %s", err)
+		t.Fatal(err)
 	}
+	defer done()
 
 	cs := &CacheStore{
 		Prefix: "Foo",
 		Codec:  memcache.JSON,
 	}
-	err = cs.Delete(ctx, "Bar")
+	other := &CacheStore{
+		Prefix: "Other",
+		Codec:  memcache.JSON,
+	}
+	for _, store := range []*CacheStore{cs, other} {
+		err = store.Set(ctx, "Bar", "bluh")
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+	_, err = cs.Increment(ctx, "Counter", 1, 0)
 	if err != nil {
-		t.Errorf("Unexpected error from Delete: %s", err)
+		t.Fatalf("Unexpected error from Increment: %s", err)
 	}
 
-	var data string
-	_, err = memcache.JSON.Get(ctx, "FooBar", &data)
-	if err != memcache.ErrCacheMiss {
-		if err == nil {
-			t.Errorf("Found memcache data still present, expected deleted")
-		} else {
-			t.Errorf("Expected cache miss error, got: %s", err)
-		}
+	err = cs.Flush(ctx)
+	if err != nil {
+		t.Errorf("Unexpected error from Flush: %s", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Bar", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error after Flush, got: %v", err)
+	}
+	_, err = cs.IncrementExisting(ctx, "Counter", 1)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error for counter after Flush, got: %v", err)
+	}
+
+	err = other.Get(ctx, "Bar", &value)
+	if err != nil {
+		t.Errorf("Expected value under other prefix to be unaffected by Flush, got: %v", err)
 	}
 }
 
-func TestCacheStore_Flush(t *testing.T) {
+func TestCacheStore_Get(t *testing.T) {
 	if testing.Short() {
 		t.Skip("AppEngine dev server testing is expensive")
 	}
@@ -58,36 +105,169 @@ func TestCacheStore_Flush(t *testing.T) {
 	}
 	defer done()
 
-	cacheItem := &memcache.Item{
-		Key:    "FooBar",
-		Object: "bluh",
+	cs := &CacheStore{
+		Prefix: "Foo",
+		Codec:  memcache.JSON,
+	}
+
+	setStr := "bluh"
+	err = cs.Set(ctx, "Bar", &setStr)
+	if err != nil {
+		t.Errorf("Unexpected error from Set: %s", err)
 	}
-	err = memcache.JSON.Set(ctx, cacheItem)
+
+	var value string
+	err = cs.Get(ctx, "Bar", &value)
 	if err != nil {
-		t.Fatalf("Unexpected error adding to memcache: %s", err)
+		t.Errorf("Unexpected error from Get: %s", err)
 	}
+	if value != "bluh" {
+		t.Errorf("Data read from memcache was incorrect; expected %s, was %s", "bluh", value)
+	}
+}
+
+func TestCacheStore_Set(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	testCases := []struct {
+		Label string
+		Set   func(ctx context.Context, cs *CacheStore, v interface{}) error
+	}{
+		{
+			Label: "Set",
+			Set: func(ctx context.Context, cs *CacheStore, v interface{}) error {
+				return cs.Set(ctx, "Bar", v)
+			},
+		},
+		{
+			Label: "SetWithTTL",
+			Set: func(ctx context.Context, cs *CacheStore, v interface{}) error {
+				return cs.SetWithTTL(ctx, "Bar", time.Hour, v)
+			},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			ctx, done, err := aetest.NewContext()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer done()
+
+			cs := &CacheStore{
+				Prefix: "Foo",
+				Codec:  memcache.JSON,
+			}
+
+			setStr := "bluh"
+			err = testCase.Set(ctx, cs, &setStr)
+			if err != nil {
+				t.Errorf("Unexpected error from %s: %s", testCase.Label, err)
+			}
+
+			// The value must be written under the current generation's prefix, where Get and Flush expect it.
+			prefix, err := cs.keyPrefix(ctx)
+			if err != nil {
+				t.Fatalf("Unexpected error reading key prefix: %s", err)
+			}
+
+			var value string
+			_, err = memcache.JSON.Get(ctx, prefix+"Bar", &value)
+			if err != nil {
+				t.Errorf("Error reading data written to memcache: %s", err)
+			}
+			if value != "bluh" {
+				t.Errorf("Data written to memcache was incorrect; expected %s, was %s", "bluh", value)
+			}
+		})
+	}
+}
+
+func TestCacheStore_Get_CacheMiss(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
 
 	cs := &CacheStore{
 		Prefix: "Foo",
 		Codec:  memcache.JSON,
 	}
+
+	var value string
+	err = cs.Get(ctx, "Bar", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get, got: %v", err)
+	}
+}
+
+func TestCacheStore_Delete_Missing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	cs := &CacheStore{
+		Prefix: "Foo",
+		Codec:  memcache.JSON,
+	}
+	err = cs.Delete(ctx, "Bar")
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_CompareAndSwap_Flushed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	cs := &CacheStore{
+		Prefix: "Foo",
+	}
+	err = cs.Set(ctx, "Bar", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var value string
+	token, err := cs.GetForCAS(ctx, "Bar", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+
 	err = cs.Flush(ctx)
 	if err != nil {
-		t.Errorf("Unexpected error from Delete: %s", err)
+		t.Fatalf("Unexpected error from Flush: %s", err)
 	}
 
-	var data string
-	_, err = memcache.JSON.Get(ctx, "FooBar", &data)
-	if err != memcache.ErrCacheMiss {
-		if err == nil {
-			t.Errorf("Found memcache data still present, expected deleted")
-		} else {
-			t.Errorf("Expected cache miss error, got: %s", err)
-		}
+	err = cs.CompareAndSwap(ctx, "Bar", token, 0, "updated")
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from CompareAndSwap after Flush, got: %v", err)
 	}
 }
 
-func TestCacheStore_Get(t *testing.T) {
+func TestCacheStore_GetMulti(t *testing.T) {
 	if testing.Short() {
 		t.Skip("AppEngine dev server testing is expensive")
 	}
@@ -98,31 +278,60 @@ func TestCacheStore_Get(t *testing.T) {
 	}
 	defer done()
 
-	cacheItem := &memcache.Item{
-		Key:    "FooBar",
-		Object: "bluh",
+	cs := &CacheStore{
+		Prefix: "Foo",
+		Codec:  JSONMemcacheCodec,
+	}
+	err = cs.SetMulti(ctx, []string{"A", "B"}, time.Minute, []interface{}{"a", "b"})
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	var a, b, c string
+	err = cs.GetMulti(ctx, []string{"A", "B", "C"}, []interface{}{&a, &b, &c})
+	expectedErr := data.MultiError{nil, nil, data.ErrCacheMiss}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error %v from GetMulti, got %v", expectedErr, err)
+	}
+	if a != "a" || b != "b" {
+		t.Errorf("Values read from memcache were incorrect; expected %s and %s, were %s and %s", "a", "b", a, b)
+	}
+}
+
+func TestCacheStore_Add(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
 	}
-	err = memcache.JSON.Set(ctx, cacheItem)
+
+	ctx, done, err := aetest.NewContext()
 	if err != nil {
-		t.Fatalf("Unexpected error adding to memcache: %s", err)
+		t.Fatal(err)
 	}
+	defer done()
 
 	cs := &CacheStore{
 		Prefix: "Foo",
-		Codec:  memcache.JSON,
+	}
+	err = cs.Add(ctx, "Bar", time.Minute, "first")
+	if err != nil {
+		t.Errorf("Unexpected error from first Add: %s", err)
+	}
+	err = cs.Add(ctx, "Bar", time.Minute, "second")
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from second Add, got: %v", err)
 	}
 
-	var data string
-	err = cs.Get(ctx, "Bar", &data)
+	var value string
+	err = cs.Get(ctx, "Bar", &value)
 	if err != nil {
 		t.Errorf("Unexpected error from Get: %s", err)
 	}
-	if data != "bluh" {
-		t.Errorf("Data read from memcache was incorrect; expected %s, was %s", "bluh", data)
+	if value != "first" {
+		t.Errorf("Expected value %s, was %s", "first", value)
 	}
 }
 
-func TestCacheStore_Get_CacheMiss(t *testing.T) {
+func TestCacheStore_CompareAndSwap(t *testing.T) {
 	if testing.Short() {
 		t.Skip("AppEngine dev server testing is expensive")
 	}
@@ -135,17 +344,41 @@ func TestCacheStore_Get_CacheMiss(t *testing.T) {
 
 	cs := &CacheStore{
 		Prefix: "Foo",
-		Codec:  memcache.JSON,
+	}
+	err = cs.Set(ctx, "Bar", int64(1))
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
 	}
 
-	var data string
-	err = cs.Get(ctx, "Bar", &data)
-	if err == nil {
-		t.Errorf("Expected non-nil error from Get, got nil")
+	var value int64
+	token, err := cs.GetForCAS(ctx, "Bar", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+	staleToken, err := cs.GetForCAS(ctx, "Bar", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+
+	err = cs.CompareAndSwap(ctx, "Bar", token, 0, value+1)
+	if err != nil {
+		t.Errorf("Unexpected error from CompareAndSwap: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Bar", staleToken, 0, value+1)
+	if err != data.ErrCacheCASConflict {
+		t.Errorf("Expected conflict error from stale CompareAndSwap, got: %v", err)
+	}
+
+	err = cs.Get(ctx, "Bar", &value)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected value %d, was %d", 2, value)
 	}
 }
 
-func TestCacheStore_Set(t *testing.T) {
+func TestCacheStore_Increment(t *testing.T) {
 	if testing.Short() {
 		t.Skip("AppEngine dev server testing is expensive")
 	}
@@ -158,22 +391,126 @@ func TestCacheStore_Set(t *testing.T) {
 
 	cs := &CacheStore{
 		Prefix: "Foo",
-		Codec:  memcache.JSON,
+	}
+	_, err = cs.IncrementExisting(ctx, "Bar", 1)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from IncrementExisting, got: %v", err)
 	}
 
-	setStr := "bluh"
-	err = cs.Set(ctx, "Bar", &setStr)
+	value, err := cs.Increment(ctx, "Bar", 2, 10)
 	if err != nil {
-		t.Errorf("Unexpected error from Set: %s", err)
+		t.Errorf("Unexpected error from Increment: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, was %d", 12, value)
 	}
 
-	var data string
-	_, err = memcache.JSON.Get(ctx, "FooBar", &data)
+	value, err = cs.IncrementExisting(ctx, "Bar", -20)
+	if err != nil {
+		t.Errorf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected decrement below zero to leave value %d, was %d", 0, value)
+	}
+}
+
+func TestCacheStore_IncrementWithTTL(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	cs := &CacheStore{
+		Prefix: "Foo",
+	}
+	value, err := cs.IncrementWithTTL(ctx, "Bar", time.Hour, 2, 10)
+	if err != nil {
+		t.Errorf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, was %d", 12, value)
+	}
+
+	value, err = cs.IncrementWithTTL(ctx, "Bar", time.Hour, -1, 10)
+	if err != nil {
+		t.Errorf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+	if value != 11 {
+		t.Errorf("Expected value %d, was %d", 11, value)
+	}
+}
+
+func TestCacheStore_CompareAndSwap_WrongKey(t *testing.T) {
+	t.Parallel()
+
+	cs := &CacheStore{
+		Prefix: "Foo",
+	}
+	err := cs.CompareAndSwap(context.Background(), "Bar", &memcache.Item{Key: "FooBaz"}, 0, "bluh")
+	if err == nil {
+		t.Error("Expected error from CompareAndSwap with token for another key, got nil error")
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	t.Parallel()
+
+	cases := map[time.Duration]time.Duration{
+		0:                             0,
+		time.Millisecond:              time.Second,
+		time.Second:                   time.Second,
+		90 * time.Second:              90 * time.Second,
+		time.Second + time.Nanosecond: time.Second + time.Nanosecond,
+	}
+	for ttl, expected := range cases {
+		if actual := memcacheExpiration(ttl); actual != expected {
+			t.Errorf("Expected expiration %s for TTL %s, got %s", expected, ttl, actual)
+		}
+	}
+}
+
+func TestCacheError(t *testing.T) {
+	t.Parallel()
+
+	cases := map[error]error{
+		nil:                     nil,
+		memcache.ErrCacheMiss:   data.ErrCacheMiss,
+		memcache.ErrNotStored:   data.ErrCacheNotStored,
+		memcache.ErrCASConflict: data.ErrCacheCASConflict,
+	}
+	for err, expected := range cases {
+		if actual := cacheError(err); actual != expected {
+			t.Errorf("Expected error %v for %v, got %v", expected, err, actual)
+		}
+	}
+
+	err := cacheError(appengine.MultiError{nil, memcache.ErrNotStored})
+	expected := data.MultiError{nil, data.ErrCacheNotStored}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected error %v, got %v", expected, err)
+	}
+}
+
+func TestGobMemcacheCodec(t *testing.T) {
+	t.Parallel()
+
+	b, err := GobMemcacheCodec.Marshal(map[string]int64{"foo": 1})
+	if err != nil {
+		t.Fatalf("Unexpected error from Marshal: %s", err)
+	}
+
+	var value map[string]int64
+	err = GobMemcacheCodec.Unmarshal(b, &value)
 	if err != nil {
-		t.Errorf("Error reading data written to memcache: %s", err)
+		t.Fatalf("Unexpected error from Unmarshal: %s", err)
 	}
-	if data != "bluh" {
-		t.Errorf("Data written to memcache was incorrect; expected %s, was %s", "bluh", data)
+	if value["foo"] != 1 {
+		t.Errorf("Expected round tripped value %d, got %d", 1, value["foo"])
 	}
 }
 
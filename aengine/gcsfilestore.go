@@ -1,64 +1,370 @@
 package aengine
 
 import (
+	"bytes"
 	"cloud.google.com/go/storage"
 	"context"
+	"crypto/md5"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
 type GcsFileStore struct {
 	Bucket string
 	Prefix string
+
+	// Client is used for all storage calls if set.
+	// Otherwise, a client is created on first use and reused for the life of the store.
+	Client *storage.Client
+
+	// Number of attempts made for operations failing with transient errors.
+	// If zero, three attempts are made.
+	MaxAttempts int
+
+	// Delay before the first retry, doubling with each subsequent retry.
+	// If zero, 100ms is used.
+	RetryDelay time.Duration
+
+	clientLock sync.Mutex
+}
+
+type FileAttrs struct {
+	// Path is relative to the store's prefix.
+	Path        string
+	ContentType string
+	Metadata    map[string]string
+	Generation  int64
+	Size        int64
+	Updated     time.Time
+}
+
+type FileWriteOptions struct {
+	ContentType string
+	Metadata    map[string]string
+
+	// If non-zero, the write only succeeds if the existing file is at this generation.
+	IfGenerationMatch int64
+
+	// If true, the write only succeeds if no file exists at the path.
+	IfNotExists bool
 }
 
 func (fs *GcsFileStore) Load(ctx context.Context, path string) ([]byte, error) {
-	l := ctxlogrus.Get(ctx)
-	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "path": path}).Debug("file load")
+	var content []byte
+	err := fs.retry(ctx, func() error {
+		rc, err := fs.NewReader(ctx, path)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
 
-	storageService, err := storage.NewClient(ctx)
+		content, err = ioutil.ReadAll(rc)
+		return fileStoreError(err)
+	})
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, err
 	}
+	return content, nil
+}
+
+func (fs *GcsFileStore) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "path": path}).Debug("file load")
 
-	rc, err := storageService.Bucket(fs.Bucket).Object(fs.Prefix + path).NewReader(ctx)
+	client, err := fs.client(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, err
 	}
-	defer rc.Close()
 
-	data, err := ioutil.ReadAll(rc)
+	rc, err := client.Bucket(fs.Bucket).Object(fs.Prefix + path).NewReader(ctx)
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, fileStoreError(err)
 	}
-	return data, nil
+	return rc, nil
 }
 
 func (fs *GcsFileStore) Save(ctx context.Context, path string, content []byte) error {
+	return fs.SaveWithOptions(ctx, path, content, nil)
+}
+
+// The written object's checksums are verified against the content before returning.
+//
+// A write failing with a transient error may still have been committed. Before a conditional write is retried,
+// the file is checked to see whether it already holds the content, so a committed write isn't retried
+// and reported as failing its precondition.
+func (fs *GcsFileStore) SaveWithOptions(ctx context.Context, path string, content []byte, opts *FileWriteOptions) error {
+	crc := crc32.Checksum(content, crc32cTable)
+	md5Sum := md5.Sum(content)
+
+	conditional := opts != nil && (opts.IfGenerationMatch != 0 || opts.IfNotExists)
+	attempted := false
+	return fs.retry(ctx, func() error {
+		if conditional && attempted {
+			landed, err := fs.conditionalWriteLanded(ctx, path, opts, crc)
+			if err != nil {
+				return err
+			}
+			if landed {
+				return nil
+			}
+		}
+		attempted = true
+
+		w, err := fs.newWriter(ctx, path, opts)
+		if err != nil {
+			return err
+		}
+		w.CRC32C = crc
+		w.SendCRC32C = true
+
+		_, err = w.Write(content)
+		if err != nil {
+			w.Close()
+			return fileStoreError(err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			return fileStoreError(err)
+		}
+
+		attrs := w.Attrs()
+		if attrs.CRC32C != crc {
+			return errChecksumMismatch
+		}
+		if len(attrs.MD5) != 0 && !bytes.Equal(attrs.MD5, md5Sum[:]) {
+			return errChecksumMismatch
+		}
+		return nil
+	})
+}
+
+// The write is only committed when the returned writer is successfully closed.
+func (fs *GcsFileStore) NewWriter(ctx context.Context, path string, opts *FileWriteOptions) (io.WriteCloser, error) {
+	return fs.newWriter(ctx, path, opts)
+}
+
+func (fs *GcsFileStore) newWriter(ctx context.Context, path string, opts *FileWriteOptions) (*storage.Writer, error) {
 	l := ctxlogrus.Get(ctx)
 	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "path": path}).Debug("file save")
 
-	storageService, err := storage.NewClient(ctx)
+	client, err := fs.client(ctx)
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	o := client.Bucket(fs.Bucket).Object(fs.Prefix + path)
+	if opts != nil && (opts.IfGenerationMatch != 0 || opts.IfNotExists) {
+		o = o.If(storage.Conditions{
+			GenerationMatch: opts.IfGenerationMatch,
+			DoesNotExist:    opts.IfNotExists,
+		})
+	}
+
+	w := o.NewWriter(ctx)
+	if opts != nil {
+		w.ContentType = opts.ContentType
+		w.Metadata = opts.Metadata
 	}
+	return w, nil
+}
 
-	w := storageService.Bucket(fs.Bucket).Object(fs.Prefix + path).NewWriter(ctx)
+// Checks whether an earlier attempt at a conditional write was committed.
+// It was if the file no longer meets the write's precondition, and holds content with the written checksum.
+// Otherwise, either the precondition still holds and the write can be retried,
+// or the file was changed by another writer and retrying will fail its precondition.
+func (fs *GcsFileStore) conditionalWriteLanded(ctx context.Context, path string, opts *FileWriteOptions, crc uint32) (bool, error) {
+	client, err := fs.client(ctx)
 	if err != nil {
-		return nil
+		return false, err
+	}
+
+	attrs, err := client.Bucket(fs.Bucket).Object(fs.Prefix + path).Attrs(ctx)
+	if err != nil {
+		err = fileStoreError(err)
+		if err == data.ErrNoSuchFile {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if opts.IfGenerationMatch != 0 && attrs.Generation == opts.IfGenerationMatch {
+		return false, nil
+	}
+	return attrs.CRC32C == crc, nil
+}
+
+func (fs *GcsFileStore) Attrs(ctx context.Context, path string) (*FileAttrs, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "path": path}).Debug("file attrs")
+
+	client, err := fs.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var attrs *storage.ObjectAttrs
+	err = fs.retry(ctx, func() error {
+		var err error
+		attrs, err = client.Bucket(fs.Bucket).Object(fs.Prefix + path).Attrs(ctx)
+		return fileStoreError(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs.fileAttrsFromStorage(attrs), nil
+}
+
+// Lists all files whose path begins with the given prefix, in lexicographic order.
+func (fs *GcsFileStore) List(ctx context.Context, prefix string) ([]FileAttrs, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "list-prefix": prefix}).Debug("file list")
+
+	client, err := fs.client(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = w.Write(content)
+	var files []FileAttrs
+	err = fs.retry(ctx, func() error {
+		files = nil
+		it := client.Bucket(fs.Bucket).Objects(ctx, &storage.Query{Prefix: fs.Prefix + prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return fileStoreError(err)
+			}
+			files = append(files, *fs.fileAttrsFromStorage(attrs))
+		}
+	})
 	if err != nil {
-		w.Close()
-		return errors.Wrap(err, "")
+		return nil, err
 	}
+	return files, nil
+}
+
+func (fs *GcsFileStore) Delete(ctx context.Context, path string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"bucket": fs.Bucket, "prefix": fs.Prefix, "path": path}).Debug("file delete")
 
-	err = w.Close()
+	client, err := fs.client(ctx)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return err
+	}
+
+	return fs.retry(ctx, func() error {
+		return fileStoreError(client.Bucket(fs.Bucket).Object(fs.Prefix + path).Delete(ctx))
+	})
+}
+
+func (fs *GcsFileStore) client(ctx context.Context) (*storage.Client, error) {
+	fs.clientLock.Lock()
+	defer fs.clientLock.Unlock()
+
+	if fs.Client == nil {
+		// The client outlives the request that happened to create it, so must not be bound to its context.
+		client, err := storage.NewClient(context.Background())
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		fs.Client = client
+	}
+	return fs.Client, nil
+}
+
+func (fs *GcsFileStore) fileAttrsFromStorage(attrs *storage.ObjectAttrs) *FileAttrs {
+	return &FileAttrs{
+		Path:        strings.TrimPrefix(attrs.Name, fs.Prefix),
+		ContentType: attrs.ContentType,
+		Metadata:    attrs.Metadata,
+		Generation:  attrs.Generation,
+		Size:        attrs.Size,
+		Updated:     attrs.Updated,
+	}
+}
+
+func (fs *GcsFileStore) retry(ctx context.Context, f func() error) error {
+	attempts := fs.MaxAttempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+	delay := fs.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			ctxlogrus.Get(ctx).WithFields(logrus.Fields{"attempt": i + 1, "error": err}).Warn("retrying file operation")
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return errors.Wrap(ctx.Err(), "")
+			}
+			delay *= 2
+		}
+
+		err = f()
+		if err == nil || !isTransientFileStoreError(err) {
+			return err
+		}
+	}
+	return err
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errChecksumMismatch = errors.New("written file checksum did not match content")
+
+// Translates storage errors which callers may wish to branch on into their data package equivalents.
+// Other errors are wrapped.
+func fileStoreError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == storage.ErrObjectNotExist || err == storage.ErrBucketNotExist {
+		return data.ErrNoSuchFile
+	}
+
+	if apiErr, ok := errors.Cause(err).(*googleapi.Error); ok {
+		switch apiErr.Code {
+		case 404:
+			return data.ErrNoSuchFile
+		case 412:
+			return data.ErrPreconditionFailed
+		case 401, 403:
+			return data.ErrPermissionDenied
+		}
+	}
+	return errors.Wrap(err, "")
+}
+
+func isTransientFileStoreError(err error) bool {
+	cause := errors.Cause(err)
+	if cause == errChecksumMismatch || cause == io.ErrUnexpectedEOF {
+		return true
+	}
+	if apiErr, ok := cause.(*googleapi.Error); ok {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+	if netErr, ok := cause.(net.Error); ok {
+		return netErr.Timeout()
 	}
-	return nil
+	return false
 }
@@ -0,0 +1,372 @@
+package aengine
+
+import (
+	"context"
+	"errors"
+	"github.com/fsouza/fake-gcs-server/fakestorage"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"google.golang.org/api/googleapi"
+	"hash/crc32"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestGcsFileStore(t *testing.T) (*GcsFileStore, *fakestorage.Server) {
+	server, err := fakestorage.NewServerWithOptions(fakestorage.Options{
+		NoListener: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.CreateBucket("bucket")
+
+	fs := &GcsFileStore{
+		Bucket:     "bucket",
+		Prefix:     "Foo/",
+		Client:     server.Client(),
+		RetryDelay: time.Millisecond,
+	}
+	return fs, server
+}
+
+func TestGcsFileStore_Save(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	err := fs.Save(context.Background(), "Bar", []byte("bluh"))
+	if err != nil {
+		t.Errorf("Unexpected error from Save: %s", err)
+	}
+
+	o, err := server.GetObject("bucket", "Foo/Bar")
+	if err != nil {
+		t.Fatalf("Error reading object written to storage: %s", err)
+	}
+	if string(o.Content) != "bluh" {
+		t.Errorf("Object written to storage was incorrect; expected %s, was %s", "bluh", o.Content)
+	}
+}
+
+func TestGcsFileStore_SaveWithOptions(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	expectedMetadata := map[string]string{"a": "b"}
+	err := fs.SaveWithOptions(context.Background(), "Bar", []byte("bluh"), &FileWriteOptions{
+		ContentType: "text/plain",
+		Metadata:    expectedMetadata,
+	})
+	if err != nil {
+		t.Errorf("Unexpected error from SaveWithOptions: %s", err)
+	}
+
+	attrs, err := fs.Attrs(context.Background(), "Bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from Attrs: %s", err)
+	}
+	if attrs.Path != "Bar" {
+		t.Errorf("Expected path '%s', got '%s'", "Bar", attrs.Path)
+	}
+	if attrs.ContentType != "text/plain" {
+		t.Errorf("Expected content type '%s', got '%s'", "text/plain", attrs.ContentType)
+	}
+	if !reflect.DeepEqual(attrs.Metadata, expectedMetadata) {
+		t.Errorf("Expected metadata %v, got %v", expectedMetadata, attrs.Metadata)
+	}
+	if attrs.Size != 4 {
+		t.Errorf("Expected size %d, got %d", 4, attrs.Size)
+	}
+}
+
+func TestGcsFileStore_Load(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	server.CreateObject(fakestorage.Object{
+		BucketName: "bucket",
+		Name:       "Foo/Bar",
+		Content:    []byte("bluh"),
+	})
+
+	content, err := fs.Load(context.Background(), "Bar")
+	if err != nil {
+		t.Errorf("Unexpected error from Load: %s", err)
+	}
+	if string(content) != "bluh" {
+		t.Errorf("Loaded content was incorrect; expected %s, was %s", "bluh", content)
+	}
+}
+
+func TestGcsFileStore_Load_NoFile(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	_, err := fs.Load(context.Background(), "Bar")
+	if err != data.ErrNoSuchFile {
+		t.Errorf("Expected error '%s' from Load, got '%s'", data.ErrNoSuchFile, err)
+	}
+}
+
+func TestGcsFileStore_List(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	for _, name := range []string{"Foo/Bar/1", "Foo/Bar/2", "Foo/Baz", "Bar/1"} {
+		server.CreateObject(fakestorage.Object{
+			BucketName: "bucket",
+			Name:       name,
+			Content:    []byte("bluh"),
+		})
+	}
+
+	files, err := fs.List(context.Background(), "Bar/")
+	if err != nil {
+		t.Errorf("Unexpected error from List: %s", err)
+	}
+
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	expectedPaths := []string{"Bar/1", "Bar/2"}
+	if !reflect.DeepEqual(paths, expectedPaths) {
+		t.Errorf("Expected listed paths %v, got %v", expectedPaths, paths)
+	}
+}
+
+func TestGcsFileStore_Delete(t *testing.T) {
+	t.Parallel()
+
+	fs, server := newTestGcsFileStore(t)
+	defer server.Stop()
+
+	server.CreateObject(fakestorage.Object{
+		BucketName: "bucket",
+		Name:       "Foo/Bar",
+		Content:    []byte("bluh"),
+	})
+
+	err := fs.Delete(context.Background(), "Bar")
+	if err != nil {
+		t.Errorf("Unexpected error from Delete: %s", err)
+	}
+
+	_, err = fs.Load(context.Background(), "Bar")
+	if err != data.ErrNoSuchFile {
+		t.Errorf("Expected error '%s' from Load after Delete, got '%s'", data.ErrNoSuchFile, err)
+	}
+}
+
+func TestGcsFileStore_retry(t *testing.T) {
+	t.Parallel()
+
+	fs := &GcsFileStore{
+		MaxAttempts: 3,
+		RetryDelay:  time.Millisecond,
+	}
+
+	callCount := 0
+	err := fs.retry(context.Background(), func() error {
+		callCount++
+		if callCount < 3 {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from retry, got '%s'", err)
+	}
+	if callCount != 3 {
+		t.Errorf("Expected call count to be %d, was %d", 3, callCount)
+	}
+}
+
+func TestGcsFileStore_retry_Exhausted(t *testing.T) {
+	t.Parallel()
+
+	fs := &GcsFileStore{
+		MaxAttempts: 2,
+		RetryDelay:  time.Millisecond,
+	}
+
+	callCount := 0
+	expectedErr := &googleapi.Error{Code: 503}
+	err := fs.retry(context.Background(), func() error {
+		callCount++
+		return expectedErr
+	})
+	if err != expectedErr {
+		t.Errorf("Expected error '%s' from retry, got '%s'", expectedErr, err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected call count to be %d, was %d", 2, callCount)
+	}
+}
+
+func TestGcsFileStore_retry_NotTransient(t *testing.T) {
+	t.Parallel()
+
+	fs := &GcsFileStore{
+		RetryDelay: time.Millisecond,
+	}
+
+	callCount := 0
+	err := fs.retry(context.Background(), func() error {
+		callCount++
+		return data.ErrPreconditionFailed
+	})
+	if err != data.ErrPreconditionFailed {
+		t.Errorf("Expected error '%s' from retry, got '%s'", data.ErrPreconditionFailed, err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected call count to be %d, was %d", 1, callCount)
+	}
+}
+
+func TestFileStoreError(t *testing.T) {
+	testCases := []struct {
+		Label       string
+		Err         error
+		ExpectedErr error
+	}{
+		{
+			Label:       "NotFound",
+			Err:         &googleapi.Error{Code: 404},
+			ExpectedErr: data.ErrNoSuchFile,
+		},
+		{
+			Label:       "PreconditionFailed",
+			Err:         &googleapi.Error{Code: 412},
+			ExpectedErr: data.ErrPreconditionFailed,
+		},
+		{
+			Label:       "Unauthorized",
+			Err:         &googleapi.Error{Code: 401},
+			ExpectedErr: data.ErrPermissionDenied,
+		},
+		{
+			Label:       "Forbidden",
+			Err:         &googleapi.Error{Code: 403},
+			ExpectedErr: data.ErrPermissionDenied,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			err := fileStoreError(testCase.Err)
+			if err != testCase.ExpectedErr {
+				t.Errorf("Expected error '%s', got '%s'", testCase.ExpectedErr, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreError_Other(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	err := fileStoreError(expectedErr)
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestGcsFileStore_conditionalWriteLanded(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label    string
+		Existing string
+		Opts     func(generation int64) *FileWriteOptions
+		Expected bool
+	}{
+		{
+			Label:    "NotExistsMissing",
+			Opts:     func(generation int64) *FileWriteOptions { return &FileWriteOptions{IfNotExists: true} },
+			Expected: false,
+		},
+		{
+			Label:    "NotExistsWritten",
+			Existing: "bluh",
+			Opts:     func(generation int64) *FileWriteOptions { return &FileWriteOptions{IfNotExists: true} },
+			Expected: true,
+		},
+		{
+			Label:    "NotExistsOtherContent",
+			Existing: "other",
+			Opts:     func(generation int64) *FileWriteOptions { return &FileWriteOptions{IfNotExists: true} },
+			Expected: false,
+		},
+		{
+			Label:    "GenerationUnchanged",
+			Existing: "bluh",
+			Opts: func(generation int64) *FileWriteOptions {
+				return &FileWriteOptions{IfGenerationMatch: generation}
+			},
+			Expected: false,
+		},
+		{
+			Label:    "GenerationWritten",
+			Existing: "bluh",
+			Opts: func(generation int64) *FileWriteOptions {
+				return &FileWriteOptions{IfGenerationMatch: generation - 1}
+			},
+			Expected: true,
+		},
+		{
+			Label:    "GenerationOtherContent",
+			Existing: "other",
+			Opts: func(generation int64) *FileWriteOptions {
+				return &FileWriteOptions{IfGenerationMatch: generation - 1}
+			},
+			Expected: false,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			fs, server := newTestGcsFileStore(t)
+			defer server.Stop()
+
+			var generation int64
+			if testCase.Existing != "" {
+				err := fs.Save(context.Background(), "Bar", []byte(testCase.Existing))
+				if err != nil {
+					t.Fatalf("Unexpected error from Save: %s", err)
+				}
+				attrs, err := fs.Attrs(context.Background(), "Bar")
+				if err != nil {
+					t.Fatalf("Unexpected error from Attrs: %s", err)
+				}
+				generation = attrs.Generation
+			}
+
+			crc := crc32.Checksum([]byte("bluh"), crc32cTable)
+			landed, err := fs.conditionalWriteLanded(context.Background(), "Bar", testCase.Opts(generation), crc)
+			if err != nil {
+				t.Errorf("Unexpected error from conditionalWriteLanded: %s", err)
+			}
+			if landed != testCase.Expected {
+				t.Errorf("Expected landed to be %v, was %v", testCase.Expected, landed)
+			}
+		})
+	}
+}
@@ -2,28 +2,45 @@ package aengine
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/datastoreutil"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"strings"
+	"time"
 )
 
 type PersistentStore struct {
 	Prefix            string
 	PermissionChecker PermissionChecker
 	Namespace         string
+
+	// Key used to sign query cursors handed out to clients.
+	// Queries requiring a cursor fail if unset.
+	CursorKey []byte
+
+	// Controls how content is serialized, and how content written under older schemas is migrated on read.
+	ContentFormat data.ContentFormat
 }
 
+type transactionKey struct{}
+
 func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content interface{}) ([]data.Property, error) {
+	properties, _, err := ps.GetWithVersion(ctx, kind, key, content)
+	return properties, err
+}
+
+// Gets an entity along with its current version, for use with SetIfVersion.
+// Entities last written before versions were introduced have version zero.
+func (ps *PersistentStore) GetWithVersion(ctx context.Context, kind, key string, content interface{}) ([]data.Property, int64, error) {
 	if ps.Namespace != "" {
 		var err error
 		ctx, err = appengine.Namespace(ctx, ps.Namespace)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 	}
 
@@ -33,13 +50,13 @@ func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content in
 	if ps.PermissionChecker != nil {
 		ok, err := ps.PermissionChecker.CheckRead(ctx, kind, key)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
 
 		// If permission is denied we simulate the non-existence of the entity.
 		// This provides robustness against enumeration attacks by default.
 		if !ok {
-			return nil, data.ErrNoSuchEntity
+			return nil, 0, data.ErrNoSuchEntity
 		}
 	}
 
@@ -48,41 +65,294 @@ func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content in
 	err := datastore.Get(ctx, k, &aeProperties)
 	if err != nil {
 		if err == datastore.ErrNoSuchEntity {
-			return nil, data.ErrNoSuchEntity
+			return nil, 0, data.ErrNoSuchEntity
 		}
-		return nil, errors.Wrap(err, "")
+		return nil, 0, errors.Wrap(err, "")
 	}
 
-	foundContent := false
-	for i := len(aeProperties) - 1; i >= 0; i-- {
-		if aeProperties[i].Name == "Content" {
-			foundContent = true
-			if content == nil {
-				return nil, errors.New("entity contained content to deserialize, but content param was not set")
+	return entityFromAppEngine(ps.ContentFormat, kind, key, aeProperties, content)
+}
+
+func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties []data.Property, content interface{}) error {
+	return ps.SetWithExpiry(ctx, kind, key, time.Time{}, properties, content)
+}
+
+// Sets an entity which is treated as not existing once expiry has passed, until it is removed by DeleteExpired.
+// A zero expiry never expires.
+func (ps *PersistentStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, content interface{}) error {
+	if ps.Namespace != "" {
+		var err error
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key, "expiry": expiry}).Debug("datastore set")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	version, err := data.NewVersion()
+	if err != nil {
+		return err
+	}
+	aeProperties, err := entityToAppEngine(ps.ContentFormat, kind, key, properties, content, version, expiry)
+	if err != nil {
+		return err
+	}
+
+	k := ps.makeKey(ctx, kind, key)
+	_, err = datastore.Put(ctx, k, &aeProperties)
+	return errors.Wrap(err, "")
+}
+
+// Sets an entity only if its current version is the expected version, returning its new version.
+// An expected version of zero requires that the entity not exist, or have been last written before versions were introduced.
+// If the version does not match, a *data.VersionConflictError is returned.
+func (ps *PersistentStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, content interface{}) (int64, error) {
+	if ps.Namespace != "" {
+		var err error
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key, "version": version}).Debug("datastore set if version")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			return 0, data.ErrWriteAccessDenied
+		}
+	}
+
+	newVersion, err := data.NewVersion()
+	if err != nil {
+		return 0, err
+	}
+	aeProperties, err := entityToAppEngine(ps.ContentFormat, kind, key, properties, content, newVersion, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	k := ps.makeKey(ctx, kind, key)
+	err = ps.runInTransaction(ctx, func(ctx context.Context) error {
+		var current datastore.PropertyList
+		err := datastore.Get(ctx, k, &current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		stored := propertiesFromAppEngine(current)
+		actual := datastoreutil.Version(stored)
+		if datastoreutil.Expired(stored, time.Now()) {
+			actual = 0
+		}
+		if actual != version {
+			return &data.VersionConflictError{
+				Kind:     kind,
+				Key:      key,
+				Expected: version,
+				Actual:   actual,
+			}
+		}
+
+		_, err = datastore.Put(ctx, k, &aeProperties)
+		return err
+	})
+	if err != nil {
+		if _, ok := err.(*data.VersionConflictError); ok {
+			return 0, err
+		}
+		return 0, errors.Wrap(err, "")
+	}
+	return newVersion, nil
+}
+
+// Gets multiple entities in a single batch.
+// contents must be nil, or have one element per key, each being nil or a value to deserialize content into.
+// If any key fails, a data.MultiError is returned holding each key's error, alongside the results of those which succeeded.
+func (ps *PersistentStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	if contents != nil && len(contents) != len(keys) {
+		return nil, errors.New("contents param must be nil or the same length as keys")
+	}
+
+	if ps.Namespace != "" {
+		var err error
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "count": len(keys)}).Debug("datastore get multi")
+
+	results := make([][]data.Property, len(keys))
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	var aeKeys []*datastore.Key
+	var indexes []int
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, k.Kind, k.Key)
+			if err != nil {
+				errs[i] = err
+				failed = true
+				continue
 			}
 
-			contentBytes, ok := aeProperties[i].Value.([]byte)
+			// As in Get, denied entities appear not to exist.
 			if !ok {
-				return nil, errors.New("entity contained content property with incorrect type")
+				errs[i] = data.ErrNoSuchEntity
+				failed = true
+				continue
+			}
+		}
+
+		aeKeys = append(aeKeys, ps.makeKey(ctx, k.Kind, k.Key))
+		indexes = append(indexes, i)
+	}
+
+	aeProperties := make([]datastore.PropertyList, len(aeKeys))
+	err := datastore.GetMulti(ctx, aeKeys, aeProperties)
+	aeErrs, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, errors.Wrap(err, "")
+	}
+
+	for j, i := range indexes {
+		if aeErrs != nil && aeErrs[j] != nil {
+			if aeErrs[j] == datastore.ErrNoSuchEntity {
+				errs[i] = data.ErrNoSuchEntity
+			} else {
+				errs[i] = errors.Wrap(aeErrs[j], "")
 			}
-			err = json.Unmarshal(contentBytes, content)
+			failed = true
+			continue
+		}
+
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		results[i], _, errs[i] = entityFromAppEngine(ps.ContentFormat, keys[i].Kind, keys[i].Key, aeProperties[j], content)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Sets multiple entities in a single batch.
+// properties and contents must each be nil, or have one element per key.
+// If any key fails, a data.MultiError is returned holding each key's error; entities for other keys are still written.
+func (ps *PersistentStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, contents []interface{}) error {
+	if properties != nil && len(properties) != len(keys) {
+		return errors.New("properties param must be nil or the same length as keys")
+	}
+	if contents != nil && len(contents) != len(keys) {
+		return errors.New("contents param must be nil or the same length as keys")
+	}
+
+	if ps.Namespace != "" {
+		var err error
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "count": len(keys)}).Debug("datastore set multi")
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	var aeKeys []*datastore.Key
+	var aeEntities []datastore.PropertyList
+	var indexes []int
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckWrite(ctx, k.Kind, k.Key)
 			if err != nil {
-				return nil, errors.Wrap(err, "unable to deserialize entity content")
+				errs[i] = err
+				failed = true
+				continue
 			}
 
-			// Splice this property out
-			aeProperties = append(aeProperties[:i], aeProperties[i+1:]...)
-			break
+			if !ok {
+				errs[i] = data.ErrWriteAccessDenied
+				failed = true
+				continue
+			}
+		}
+
+		var entityProperties []data.Property
+		if properties != nil {
+			entityProperties = properties[i]
+		}
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		version, err := data.NewVersion()
+		if err != nil {
+			return err
+		}
+		aeEntity, err := entityToAppEngine(ps.ContentFormat, k.Kind, k.Key, entityProperties, content, version, time.Time{})
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
 		}
+
+		aeKeys = append(aeKeys, ps.makeKey(ctx, k.Kind, k.Key))
+		aeEntities = append(aeEntities, aeEntity)
+		indexes = append(indexes, i)
 	}
-	if !foundContent && content != nil {
-		return nil, errors.New("entity did not contain content to deserialize, but content param was set")
+
+	_, err := datastore.PutMulti(ctx, aeKeys, aeEntities)
+	aeErrs, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return errors.Wrap(err, "")
 	}
 
-	return propertiesFromAppEngine(aeProperties), nil
+	for j, i := range indexes {
+		if aeErrs != nil && aeErrs[j] != nil {
+			errs[i] = errors.Wrap(aeErrs[j], "")
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
 }
 
-func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties []data.Property, content interface{}) error {
+func (ps *PersistentStore) Delete(ctx context.Context, kind, key string) error {
 	if ps.Namespace != "" {
 		var err error
 		ctx, err = appengine.Namespace(ctx, ps.Namespace)
@@ -92,7 +362,7 @@ func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties
 	}
 
 	l := ctxlogrus.Get(ctx)
-	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key}).Debug("datastore set")
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key}).Debug("datastore delete")
 
 	if ps.PermissionChecker != nil {
 		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
@@ -105,88 +375,241 @@ func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties
 		}
 	}
 
-	aeProperties, err := propertiesToAppEngine(properties)
+	k := ps.makeKey(ctx, kind, key)
+	return errors.Wrap(datastore.Delete(ctx, k), "")
+}
+
+// Deletes entities of a kind whose expiry has passed, returning how many were deleted.
+// Expired entities are found and deleted batchSize at a time, until none remain or the context is done.
+// Entities outside the store's prefix, or which the PermissionChecker denies writing, are left in place.
+// Deletion is not transactional, so expiry should be used for entities which are not rewritten once expired.
+func (ps *PersistentStore) DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, errors.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	if ps.Namespace != "" {
+		var err error
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind}).Debug("datastore delete expired")
+
+	aeQuery := datastore.NewQuery(kind).Filter("Expiry <=", time.Now()).KeysOnly()
+	it := aeQuery.Run(ctx)
+	deleted := 0
+	for {
+		var batch []*datastore.Key
+		done := false
+		for len(batch) < batchSize {
+			k, err := it.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return deleted, errors.Wrap(err, "")
+			}
+
+			if !strings.HasPrefix(k.StringID(), ps.Prefix) {
+				continue
+			}
+			if ps.PermissionChecker != nil {
+				ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, strings.TrimPrefix(k.StringID(), ps.Prefix))
+				if err != nil {
+					return deleted, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			batch = append(batch, k)
+		}
+
+		if len(batch) > 0 {
+			err := datastore.DeleteMulti(ctx, batch)
+			if err != nil {
+				return deleted, errors.Wrap(err, "")
+			}
+			deleted += len(batch)
+			l.WithFields(logrus.Fields{"kind": kind, "count": len(batch)}).Debug("deleted expired batch")
+		}
+
+		if done {
+			return deleted, nil
+		}
+		if ctx.Err() != nil {
+			return deleted, errors.Wrap(ctx.Err(), "")
+		}
+	}
+}
+
+// Runs a query against entities of a kind, returning matching entities without their content,
+// along with a cursor to continue from, or an empty cursor if there are no more results.
+// Entities outside the store's prefix, or which the PermissionChecker denies reading, are omitted.
+func (ps *PersistentStore) Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+	err := q.Validate()
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+
+	if ps.Namespace != "" {
+		ctx, err = appengine.Namespace(ctx, ps.Namespace)
+		if err != nil {
+			return nil, "", err
+		}
 	}
-	if content != nil {
-		opaque := &opaqueContent{}
-		err := opaque.Marshal(content)
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": q.Kind}).Debug("datastore query")
+
+	aeQuery := datastore.NewQuery(q.Kind)
+	for _, f := range q.Filters {
+		aeQuery = aeQuery.Filter(f.Property+" "+string(f.Op), f.Value)
+	}
+	for _, o := range q.Orders {
+		if o.Descending {
+			aeQuery = aeQuery.Order("-" + o.Property)
+		} else {
+			aeQuery = aeQuery.Order(o.Property)
+		}
+	}
+	if q.Cursor != "" {
+		c, err := ps.decodeCursor(q.Kind, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		aeQuery = aeQuery.Start(c)
+	}
+
+	// Results are filtered after retrieval, so we can't have the datastore apply the limit.
+	now := time.Now()
+	var results []data.QueryResult
+	it := aeQuery.Run(ctx)
+	for q.Limit == 0 || len(results) < q.Limit {
+		var aeProperties datastore.PropertyList
+		k, err := it.Next(&aeProperties)
+		if err == datastore.Done {
+			return results, "", nil
+		}
 		if err != nil {
-			return errors.Wrap(err, "")
+			return nil, "", errors.Wrap(err, "")
+		}
+
+		stored := propertiesFromAppEngine(aeProperties)
+		if !strings.HasPrefix(k.StringID(), ps.Prefix) || datastoreutil.Expired(stored, now) {
+			continue
+		}
+		key := strings.TrimPrefix(k.StringID(), ps.Prefix)
+
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, q.Kind, key)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				continue
+			}
 		}
 
-		aeProperties = append(aeProperties, datastore.Property{
-			Name:    "Content",
-			Value:   opaque.Content,
-			NoIndex: true,
+		results = append(results, data.QueryResult{
+			Key:        key,
+			Properties: datastoreutil.UserProperties(stored),
 		})
 	}
 
-	k := ps.makeKey(ctx, kind, key)
-	_, err = datastore.Put(ctx, k, &aeProperties)
-	return errors.Wrap(err, "")
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "")
+	}
+	cursor, err := ps.encodeCursor(q.Kind, c)
+	if err != nil {
+		return nil, "", err
+	}
+	return results, cursor, nil
 }
 
 func (ps *PersistentStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return ps.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+// Runs f in a transaction with the given options.
+// If the transaction still conflicts after its attempts, data.ErrConcurrentTransaction is returned.
+func (ps *PersistentStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
 	l := ctxlogrus.Get(ctx)
 	l.Debug("datastore transaction start")
 
-	err := datastore.RunInTransaction(ctx, f, &datastore.TransactionOptions{
-		XG: true,
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		return f(context.WithValue(ctx, transactionKey{}, true))
+	}, &datastore.TransactionOptions{
+		XG:       !opts.SingleGroup,
+		Attempts: opts.Attempts,
+		ReadOnly: opts.ReadOnly,
 	})
 
 	l.Debug("datastore transaction end")
 
+	if err == datastore.ErrConcurrentTransaction {
+		return data.ErrConcurrentTransaction
+	}
 	return errors.Wrap(err, "")
 }
 
-func (ps *PersistentStore) makeKey(ctx context.Context, kind, key string) *datastore.Key {
-	return datastore.NewKey(ctx, kind, ps.Prefix+key, 0, nil)
+// Runs f in a transaction, or directly if the context is already within a transaction started by Transact.
+func (ps *PersistentStore) runInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if ctx.Value(transactionKey{}) != nil {
+		return f(ctx)
+	}
+	err := datastore.RunInTransaction(ctx, f, nil)
+	if err == datastore.ErrConcurrentTransaction {
+		return data.ErrConcurrentTransaction
+	}
+	return err
 }
 
-type opaqueContent struct {
-	Content []byte
+func (ps *PersistentStore) makeKey(ctx context.Context, kind, key string) *datastore.Key {
+	return datastore.NewKey(ctx, kind, ps.Prefix+key, 0, nil)
 }
 
-func (o *opaqueContent) Marshal(v interface{}) error {
-	var err error
-	o.Content, err = json.Marshal(v)
-	return errors.Wrap(err, "")
+// Splits the serialized content and reserved metadata properties out of an entity, deserializing content into content.
+// If the entity has expired, data.ErrNoSuchEntity is returned.
+func entityFromAppEngine(format data.ContentFormat, kind, key string, aeProperties datastore.PropertyList, content interface{}) ([]data.Property, int64, error) {
+	return datastoreutil.EntityFromProperties(format, kind, key, propertiesFromAppEngine(aeProperties), content)
 }
 
-func (o *opaqueContent) Unmarshal(v interface{}) error {
-	return errors.Wrap(json.Unmarshal(o.Content, v), "")
+// Builds an entity from properties and its version, serializing content into a reserved property if non-nil.
+func entityToAppEngine(format data.ContentFormat, kind, key string, properties []data.Property, content interface{}, version int64, expiry time.Time) (datastore.PropertyList, error) {
+	stored, err := datastoreutil.EntityToProperties(format, kind, key, properties, content, version, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return propertiesToAppEngine(stored), nil
 }
 
 func propertiesFromAppEngine(from datastore.PropertyList) (to []data.Property) {
 	for _, v := range from {
 		to = append(to, data.Property{
-			Name:  v.Name,
-			Value: v.Value,
+			Name:     v.Name,
+			Value:    v.Value,
+			NoIndex:  v.NoIndex,
+			Multiple: v.Multiple,
 		})
 	}
 	return
 }
 
-func propertiesToAppEngine(from []data.Property) (to datastore.PropertyList, err error) {
+// Properties must already have been validated.
+func propertiesToAppEngine(from []data.Property) (to datastore.PropertyList) {
 	for _, v := range from {
-		switch v.Value.(type) {
-		case int64:
-		case bool:
-		case string:
-		case float64:
-		default:
-			return nil, fmt.Errorf("property '%s' had invalid type: %T", v.Name, v.Value)
-		}
-
-		if v.Name == "Content" {
-			return nil, fmt.Errorf("property '%s' had reserved name", v.Name)
-		}
-
 		to = append(to, datastore.Property{
-			Name:  v.Name,
-			Value: v.Value,
+			Name:     v.Name,
+			Value:    v.Value,
+			NoIndex:  !v.Indexed(),
+			Multiple: v.Multiple,
 		})
 	}
 	return
@@ -4,42 +4,55 @@ import (
 	"context"
 	"errors"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/datastoreutil"
+	"github.com/jbeshir/moonbird-auth-frontend/storetest"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
 	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/datastore"
 	"math"
 	"reflect"
-	"strings"
+	"strconv"
 	"testing"
+	"time"
 )
 
-func makeTestProperties() (properties []data.Property) {
-	properties = append(properties, data.Property{
-		Name:  "Foo1",
-		Value: "Bar",
-	})
-	properties = append(properties, data.Property{
-		Name:  "Foo2",
-		Value: int64(7),
-	})
-	properties = append(properties, data.Property{
-		Name:  "Foo3",
-		Value: true,
+// Runs the conformance suite against one dev server instance, with each test's stores in namespaces of their own.
+func TestPersistentStore_Conformance(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AppEngine dev server testing is expensive")
+	}
+
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		inst.Close()
 	})
-	properties = append(properties, data.Property{
-		Name:  "Foo4",
-		Value: float64(0.3),
+
+	storetest.Run(t, func(t *testing.T) (context.Context, func(opts storetest.Options) storeutil.PersistentStore) {
+		req, err := inst.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		namespace := "test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		return appengine.NewContext(req), func(opts storetest.Options) storeutil.PersistentStore {
+			return &PersistentStore{
+				Prefix:            opts.Prefix,
+				PermissionChecker: opts.PermissionChecker,
+				Namespace:         namespace + "-" + opts.Namespace,
+				CursorKey:         []byte("bluh"),
+			}
+		}
 	})
-	return
 }
 
 func TestPropertiesToAppEngine(t *testing.T) {
-	from := makeTestProperties()
-	to, err := propertiesToAppEngine(from)
-	if err != nil {
-		t.Errorf("Unexpected error converting properties to appengine format: %s", err)
-	}
+	from := storetest.Properties()
+	to := propertiesToAppEngine(from)
 	if len(to) != len(from) {
 		t.Errorf("Made a list of %d properties, expected %d", len(to), len(from))
 	}
@@ -61,29 +74,27 @@ func TestPropertiesToAppEngine(t *testing.T) {
 	}
 }
 
-func TestPropertiesToAppEngine_InvalidValue(t *testing.T) {
-	from := makeTestProperties()
-	from[1].Value = 7
+func TestPropertiesToAppEngine_RichValues(t *testing.T) {
+	from := storetest.RichProperties()
+	to := propertiesToAppEngine(from)
 
-	to, err := propertiesToAppEngine(from)
-	if err == nil || !strings.Contains(err.Error(), "property 'Foo2' had invalid type: int") {
-		t.Errorf("Did not receive expected error from conversion of properties to appengine format")
-	}
-	if len(to) != 0 {
-		t.Errorf("Expected zero-length properties output with error, got non-zero-length properties list")
+	expectedNoIndex := []bool{false, true, true, false, false}
+	expectedMultiple := []bool{false, false, false, true, true}
+	for i := range to {
+		if to[i].NoIndex != expectedNoIndex[i] {
+			t.Errorf("Property %d had no index %v, expected %v", i, to[i].NoIndex, expectedNoIndex[i])
+		}
+		if to[i].Multiple != expectedMultiple[i] {
+			t.Errorf("Property %d had multiple %v, expected %v", i, to[i].Multiple, expectedMultiple[i])
+		}
 	}
-}
-
-func TestPropertiesToAppEngine_InvalidName(t *testing.T) {
-	from := makeTestProperties()
-	from[2].Name = "Content"
 
-	to, err := propertiesToAppEngine(from)
-	if err == nil || !strings.Contains(err.Error(), "property 'Content' had reserved name") {
-		t.Errorf("Did not receive expected error from conversion of properties to appengine format")
-	}
-	if len(to) != 0 {
-		t.Errorf("Expected zero-length properties output with error, got non-zero-length properties list")
+	// []byte values are always unindexed, so come back with NoIndex set.
+	expected := storetest.RichProperties()
+	expected[1].NoIndex = true
+	roundTripped := propertiesFromAppEngine(to)
+	if !reflect.DeepEqual(roundTripped, expected) {
+		t.Errorf("Expected properties %v after round trip, got %v", expected, roundTripped)
 	}
 }
 
@@ -102,8 +113,8 @@ func TestPersistentStore_Get(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -148,8 +159,8 @@ func TestPersistentStore_GetNamespace(t *testing.T) {
 		Namespace: "Blah",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -198,8 +209,8 @@ func TestPersistentStore_GetNamespaceBadContext(t *testing.T) {
 		Namespace: "Blah",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -241,8 +252,8 @@ func TestPersistentStore_Get_NoContent(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 	_, err = datastore.Put(ctx, k, &aeProperties)
@@ -274,8 +285,8 @@ func TestPersistentStore_Get_ContentParamWithNoContent(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 	_, err = datastore.Put(ctx, k, &aeProperties)
@@ -305,8 +316,8 @@ func TestPersistentStore_Get_ContentWithNoContentParam(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -340,8 +351,8 @@ func TestPersistentStore_Get_ContentNotBytes(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   true,
@@ -376,8 +387,8 @@ func TestPersistentStore_Get_ContentNotJSON(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 	aeProperties = append(aeProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`bluh`),
@@ -439,8 +450,8 @@ func TestPersistentStore_Get_Permission(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 	_, err = datastore.Put(ctx, k, &aeProperties)
@@ -474,8 +485,8 @@ func TestPersistentStore_Get_NoPermission(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 	_, err = datastore.Put(ctx, k, &aeProperties)
@@ -510,8 +521,8 @@ func TestPersistentStore_Get_PermissionError(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	expectedProperties := makeTestProperties()
-	aeProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	aeProperties := propertiesToAppEngine(expectedProperties)
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 	_, err = datastore.Put(ctx, k, &aeProperties)
@@ -540,7 +551,7 @@ func TestPersistentStore_Set(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), &map[string]interface{}{
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), &map[string]interface{}{
 		"Foo": "Bar",
 	})
 	if err != nil {
@@ -549,8 +560,8 @@ func TestPersistentStore_Set(t *testing.T) {
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 
-	expectedProperties := makeTestProperties()
-	expectedAEProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	expectedAEProperties := propertiesToAppEngine(expectedProperties)
 	expectedAEProperties = append(expectedAEProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -563,6 +574,16 @@ func TestPersistentStore_Set(t *testing.T) {
 		t.Errorf("Unexpected error reading data from datastore: %s", err)
 	}
 
+	version := datastoreutil.Version(propertiesFromAppEngine(aeProperties))
+	if version == 0 {
+		t.Error("Expected set entity to have a non-zero version")
+	}
+	expectedAEProperties = append(expectedAEProperties, datastore.Property{
+		Name:    "Version",
+		Value:   version,
+		NoIndex: true,
+	})
+
 	if !reflect.DeepEqual(aeProperties, expectedAEProperties) {
 		t.Errorf("Set entity did not match expected data")
 	}
@@ -584,15 +605,15 @@ func TestPersistentStore_SetNamespace(t *testing.T) {
 		Namespace: "Blah",
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), &map[string]interface{}{
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), &map[string]interface{}{
 		"Foo": "Bar",
 	})
 	if err != nil {
 		t.Errorf("Unexpected error from Set: %s", err)
 	}
 
-	expectedProperties := makeTestProperties()
-	expectedAEProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	expectedAEProperties := propertiesToAppEngine(expectedProperties)
 	expectedAEProperties = append(expectedAEProperties, datastore.Property{
 		Name:    "Content",
 		Value:   []byte(`{"Foo":"Bar"}`),
@@ -607,6 +628,16 @@ func TestPersistentStore_SetNamespace(t *testing.T) {
 		t.Errorf("Unexpected error reading data from datastore: %s", err)
 	}
 
+	version := datastoreutil.Version(propertiesFromAppEngine(aeProperties))
+	if version == 0 {
+		t.Error("Expected set entity to have a non-zero version")
+	}
+	expectedAEProperties = append(expectedAEProperties, datastore.Property{
+		Name:    "Version",
+		Value:   version,
+		NoIndex: true,
+	})
+
 	if !reflect.DeepEqual(aeProperties, expectedAEProperties) {
 		t.Errorf("Set entity did not match expected data")
 	}
@@ -629,7 +660,7 @@ func TestPersistentStore_SetNamespaceBadContext(t *testing.T) {
 			t.Errorf("Expected error or panic from Set, got neither")
 		}
 	}()
-	err = ps.Set(context.Background(), "Baz", "Bar", makeTestProperties(), &map[string]interface{}{
+	err = ps.Set(context.Background(), "Baz", "Bar", storetest.Properties(), &map[string]interface{}{
 		"Foo": "Bar",
 	})
 }
@@ -649,15 +680,15 @@ func TestPersistentStore_Set_NoContent(t *testing.T) {
 		Prefix: "Foo",
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), nil)
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
 	if err != nil {
 		t.Errorf("Unexpected error from Set: %s", err)
 	}
 
 	k := ps.makeKey(ctx, "Baz", "Bar")
 
-	expectedProperties := makeTestProperties()
-	expectedAEProperties, _ := propertiesToAppEngine(expectedProperties)
+	expectedProperties := storetest.Properties()
+	expectedAEProperties := propertiesToAppEngine(expectedProperties)
 
 	var aeProperties datastore.PropertyList
 	err = datastore.Get(ctx, k, &aeProperties)
@@ -665,6 +696,16 @@ func TestPersistentStore_Set_NoContent(t *testing.T) {
 		t.Errorf("Unexpected error reading data from datastore: %s", err)
 	}
 
+	version := datastoreutil.Version(propertiesFromAppEngine(aeProperties))
+	if version == 0 {
+		t.Error("Expected set entity to have a non-zero version")
+	}
+	expectedAEProperties = append(expectedAEProperties, datastore.Property{
+		Name:    "Version",
+		Value:   version,
+		NoIndex: true,
+	})
+
 	if !reflect.DeepEqual(aeProperties, expectedAEProperties) {
 		t.Errorf("Set entity did not match expected data")
 	}
@@ -739,7 +780,7 @@ func TestPersistentStore_Set_Permission(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), nil)
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
 	if err != nil {
 		t.Errorf("Expected nil error from Set, got '%s'", err)
 	}
@@ -765,7 +806,7 @@ func TestPersistentStore_Set_NoPermission(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), nil)
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
 	if err != data.ErrWriteAccessDenied {
 		t.Errorf("Expected error '%s' from Set, got '%s'", data.ErrWriteAccessDenied, err)
 	}
@@ -792,7 +833,7 @@ func TestPersistentStore_Set_PermissionError(t *testing.T) {
 		PermissionChecker: pc,
 	}
 
-	err = ps.Set(ctx, "Baz", "Bar", makeTestProperties(), nil)
+	err = ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
 	if err != expectedError {
 		t.Errorf("Expected error '%s' from Set, got '%s'", expectedError, err)
 	}
@@ -819,8 +860,8 @@ func TestPersistentStore_Transact(t *testing.T) {
 	midTransCheckDone := make(chan bool)
 	go func() {
 		<-midTransCheck
-		o := new(opaqueContent)
-		err = datastore.Get(ctx, k, o)
+		var o datastore.PropertyList
+		err = datastore.Get(ctx, k, &o)
 
 		wantErr := datastore.ErrNoSuchEntity
 		if err != wantErr {
@@ -832,8 +873,7 @@ func TestPersistentStore_Transact(t *testing.T) {
 	err = ps.Transact(ctx, func(ctx context.Context) error {
 		callCount++
 
-		o := new(opaqueContent)
-		o.Content = []byte("foo")
+		o := &datastore.PropertyList{{Name: "Foo", Value: "Bar"}}
 		_, _ = datastore.Put(ctx, k, o)
 		midTransCheck <- true
 		<-midTransCheckDone
@@ -870,8 +910,8 @@ func TestPersistentStore_Transact_XG(t *testing.T) {
 	midTransCheckDone := make(chan bool)
 	go func() {
 		<-midTransCheck
-		o := new(opaqueContent)
-		err = datastore.Get(ctx, k, o)
+		var o datastore.PropertyList
+		err = datastore.Get(ctx, k, &o)
 
 		wantErr := datastore.ErrNoSuchEntity
 		if err != wantErr {
@@ -883,8 +923,7 @@ func TestPersistentStore_Transact_XG(t *testing.T) {
 	err = ps.Transact(ctx, func(ctx context.Context) error {
 		callCount++
 
-		o := new(opaqueContent)
-		o.Content = []byte("foo")
+		o := &datastore.PropertyList{{Name: "Foo", Value: "Bar"}}
 		_, err = datastore.Put(ctx, k, o)
 		if err != nil {
 			return err
@@ -954,41 +993,3 @@ func Test_PersistentStore_makeKey(t *testing.T) {
 		t.Errorf("Incorrect key ID, expected %s, was %s", "FooBar", k.StringID())
 	}
 }
-
-func TestOpaqueContent_Marshal(t *testing.T) {
-	t.Parallel()
-
-	o := &opaqueContent{}
-
-	d := map[string]interface{}{
-		"Foo": "Bar",
-	}
-
-	err := o.Marshal(&d)
-	if err != nil {
-		t.Errorf("Unexpected error from Marshal: %s", err)
-	}
-	if string(o.Content) != `{"Foo":"Bar"}` {
-		t.Errorf("Unexpected result of marshalling; expected `%s`, got `%s`", `{"Foo":"Bar"}`, o.Content)
-	}
-}
-
-func TestOpaqueContent_Unmarshal(t *testing.T) {
-	t.Parallel()
-
-	o := &opaqueContent{
-		Content: []byte(`{"Foo":"Bar"}`),
-	}
-
-	expectedData := map[string]interface{}{
-		"Foo": "Bar",
-	}
-	var d map[string]interface{}
-	err := o.Unmarshal(&d)
-	if err != nil {
-		t.Errorf("Unexpected error from Unmarshal: %s", err)
-	}
-	if !reflect.DeepEqual(d, expectedData) {
-		t.Errorf("Unmarshalled data did not equal expected data")
-	}
-}
@@ -2,7 +2,10 @@ package api
 
 import (
 	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"net/url"
 	"time"
 )
@@ -10,82 +13,391 @@ import (
 type EndpointBiller struct {
 	PersistentStore PersistentStore
 	UrlEndpoints    map[string]string
-	NowFunc         func() time.Time
+
+	// Returns the current time, determining the month usage is counted in; if nil, time.Now is used.
+	NowFunc func() time.Time
+
+	// Maps URL paths to endpoints in place of UrlEndpoints, if set, such as an EndpointTable which is reloaded
+	// while in use.
+	Endpoints EndpointMapper
+
+	// How long usage for a month is kept after the month ends, before it expires.
+	// If zero, usage is kept forever.
+	UsageRetention time.Duration
+
+	// Caches limits read when billing, if set. GetLimit always reads the current limit.
+	// Changes made by other processes are not seen until entries expire, so its TTL should be short.
+	LimitCache LocalCache
+
+	// Counts usage in the cache, if set, flushing it to the store in batches of UsageFlushBatch requests,
+	// or once UsageFlushMaxAge has passed since the last flush, rather than updating the store transactionally
+	// on every request. Counts not yet flushed are included in estimated usage, but are lost if evicted from the cache.
+	// Counts are only flushed when billing, so those of a token no longer used remain in the cache until it is next used,
+	// or until they expire, a month plus UsageFlushMaxAge after they were first counted.
+	UsageCounter UsageCounter
+
+	// Number of requests counted in the cache before being flushed to the store together.
+	// If zero, DefaultUsageFlushBatch is used.
+	UsageFlushBatch int64
+
+	// How long requests counted in the cache may go unflushed, if fewer than UsageFlushBatch.
+	// If zero, DefaultUsageFlushMaxAge is used.
+	UsageFlushMaxAge time.Duration
 }
 
+const DefaultUsageFlushBatch = 100
+
+const DefaultUsageFlushMaxAge = time.Minute
+
+// Longest a month can be, which usage counted in the cache must outlive.
+const maxMonthLength = 31 * 24 * time.Hour
+
 type tokenUsage struct {
 	Count int64
 }
 
 func (b *EndpointBiller) Bill(ctx context.Context, token string, url *url.URL) error {
-	endpoint := b.UrlEndpoints[url.Path]
+	endpoint := b.endpoint(url.Path)
 	if endpoint == "" {
 		return data.ErrOutOfCredit
 	}
 
-	properties, err := b.PersistentStore.Get(ctx, "TokenLimit", tokenEndpointKey(token, endpoint), nil)
+	limit, estUsage, err := b.limitAndEstimatedUsage(ctx, token, endpoint)
 	if err != nil {
-		if err == data.ErrNoSuchEntity {
-			return data.ErrOutOfCredit
-		}
 		return err
 	}
-
-	var limit int64
-	for _, v := range properties {
-		if v.Name == "Limit" {
-			limit = v.Value.(int64)
+	if limit != 0 && b.UsageCounter != nil {
+		pending, err := b.pendingUsage(ctx, token, endpoint)
+		if err != nil {
+			return err
 		}
+		estUsage += pending
 	}
-	if limit == 0 {
+	if limit == 0 || estUsage >= limit {
 		return data.ErrOutOfCredit
 	}
 
-	estUsage, err := b.estimateUsage(ctx, token, endpoint)
-	if err != nil {
-		return err
-	}
-	if estUsage >= limit {
-		return data.ErrOutOfCredit
+	if b.UsageCounter != nil {
+		return b.countUsage(ctx, token, endpoint)
 	}
+	now := b.now()
+	return b.addUsage(ctx, usageKeyAt(token, endpoint, now), now, 1)
+}
 
-	return b.incrementUsage(ctx, token, endpoint)
+func (b *EndpointBiller) endpoint(path string) string {
+	if b.Endpoints != nil {
+		return b.Endpoints.Endpoint(path)
+	}
+	return b.UrlEndpoints[path]
 }
 
 func (b *EndpointBiller) SetLimit(ctx context.Context, token, endpoint string, limit int64) error {
 	key := tokenEndpointKey(token, endpoint)
-	properties := []data.Property{
-		{
-			Name:  "Limit",
-			Value: limit,
-		},
+	err := b.PersistentStore.Set(ctx, "TokenLimit", key, limitProperties(limit), nil)
+	b.forgetLimit(key)
+	return err
+}
+
+// Gets the limit for a token on an endpoint, along with its version for use with SetLimitIfVersion.
+// If no limit is set, both the limit and version are zero.
+func (b *EndpointBiller) GetLimit(ctx context.Context, token, endpoint string) (int64, int64, error) {
+	key := tokenEndpointKey(token, endpoint)
+	properties, version, err := b.PersistentStore.GetWithVersion(ctx, "TokenLimit", key, nil)
+	if err != nil {
+		if err == data.ErrNoSuchEntity {
+			return 0, 0, nil
+		}
+		return 0, 0, err
 	}
-	return b.PersistentStore.Set(ctx, "TokenLimit", key, properties, nil)
+	return limitFromProperties(properties), version, nil
+}
+
+// Sets the limit only if it is still at the version read by GetLimit, returning its new version.
+func (b *EndpointBiller) SetLimitIfVersion(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+	key := tokenEndpointKey(token, endpoint)
+	newVersion, err := b.PersistentStore.SetIfVersion(ctx, "TokenLimit", key, version, limitProperties(limit), nil)
+	b.forgetLimit(key)
+	return newVersion, err
 }
 
-// Permitted to be moderately out of date for performance.
-func (b *EndpointBiller) estimateUsage(ctx context.Context, token string, endpoint string) (int64, error) {
-	now := b.NowFunc()
-	nowStr := now.Format("2006-01")
-	key := tokenEndpointKey(token, endpoint) + "/" + nowStr + "/1"
+// Fetches the limit and usage together, in a single batch, to save a round trip per request.
+// Usage is permitted to be moderately out of date for performance.
+func (b *EndpointBiller) limitAndEstimatedUsage(ctx context.Context, token, endpoint string) (int64, int64, error) {
+	if b.LimitCache != nil {
+		return b.cachedLimitAndEstimatedUsage(ctx, token, endpoint)
+	}
+
+	keys := []data.EntityKey{
+		{Kind: "TokenLimit", Key: tokenEndpointKey(token, endpoint)},
+		{Kind: "TokenUsage", Key: b.usageKey(token, endpoint)},
+	}
 
 	var usage tokenUsage
-	_, err := b.PersistentStore.Get(ctx, "TokenUsage", key, &usage)
+	results, err := b.PersistentStore.GetMulti(ctx, keys, []interface{}{nil, &usage})
 	if err != nil {
-		if err == data.ErrNoSuchEntity {
+		errs, ok := err.(data.MultiError)
+		if !ok {
+			return 0, 0, err
+		}
+
+		// With no limit entity, there is no credit.
+		if errs[0] == data.ErrNoSuchEntity {
+			return 0, 0, nil
+		}
+		if errs[0] != nil {
+			return 0, 0, errs[0]
+		}
+
+		if errs[1] == data.ErrNoSuchEntity {
+			usage.Count = 0
+		} else if errs[1] != nil {
+			return 0, 0, errs[1]
+		}
+	}
+
+	return limitFromProperties(results[0]), usage.Count, nil
+}
+
+// Gets the limit from the cache where possible, only reading usage if there is a limit.
+func (b *EndpointBiller) cachedLimitAndEstimatedUsage(ctx context.Context, token, endpoint string) (int64, int64, error) {
+	key := tokenEndpointKey(token, endpoint)
+	limit, err := b.LimitCache.Load(key, func() (interface{}, error) {
+		properties, err := b.PersistentStore.Get(ctx, "TokenLimit", key, nil)
+		if err != nil {
+			if err == data.ErrNoSuchEntity {
+				return int64(0), nil
+			}
+			return nil, err
+		}
+		return limitFromProperties(properties), nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if limit.(int64) == 0 {
+		return 0, 0, nil
+	}
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(ctx, "TokenUsage", b.usageKey(token, endpoint), &usage)
+	if err != nil && err != data.ErrNoSuchEntity {
+		return 0, 0, err
+	}
+	return limit.(int64), usage.Count, nil
+}
+
+func (b *EndpointBiller) forgetLimit(key string) {
+	if b.LimitCache != nil {
+		b.LimitCache.Remove(key)
+	}
+}
+
+// Returns usage counted in the cache which has not yet been flushed to the store.
+func (b *EndpointBiller) pendingUsage(ctx context.Context, token, endpoint string) (int64, error) {
+	pending, err := b.UsageCounter.IncrementExisting(ctx, usageCounterKey(b.usageKey(token, endpoint)), 0)
+	if err != nil {
+		if err == data.ErrCacheMiss {
 			return 0, nil
 		}
 		return 0, err
 	}
-	return usage.Count, nil
+	return int64(pending), nil
 }
 
-func (b *EndpointBiller) incrementUsage(ctx context.Context, token string, endpoint string) error {
-	return b.PersistentStore.Transact(ctx, func(ctx context.Context) error {
-		now := b.NowFunc()
-		nowStr := now.Format("2006-01")
-		key := tokenEndpointKey(token, endpoint) + "/" + nowStr + "/1"
+// Counts a request in the cache, flushing a batch of counted requests to the store once enough have accumulated,
+// or the rest once the counter was last flushed more than UsageFlushMaxAge ago.
+//
+// A batch is flushed by whichever request's count reaches a multiple of the batch size. As each count is
+// reached by exactly one request, concurrent requests never flush the same batch twice. The rest is flushed by
+// whichever request claims the counter's flush, and is only the part of its count beyond a multiple of the
+// batch size, so never includes a batch being flushed by another request. Flushed requests are only removed
+// from the cache once they have been added to the store, so they remain in estimated usage until then.
+// Batches which fail to flush are recorded, and flushed along with the rest.
+//
+// The first request counted in a month also flushes what remains of the previous month's count.
+func (b *EndpointBiller) countUsage(ctx context.Context, token, endpoint string) error {
+	now := b.now()
+	key := usageKeyAt(token, endpoint, now)
+	batch := b.usageFlushBatch()
+
+	count, err := b.UsageCounter.IncrementWithTTL(ctx, usageCounterKey(key), b.usageCounterTTL(), 1, 0)
+	if err != nil {
+		return err
+	}
+
+	// Counters restart from zero after each flush, so the month's start is recorded separately,
+	// and only the request recording it flushes the previous month.
+	if count == 1 {
+		err = b.startMonth(ctx, token, endpoint, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	if count%uint64(batch) == 0 {
+		return b.flushBatch(ctx, key, now, batch)
+	}
+
+	claimed, err := b.claimFlush(ctx, key, now, b.usageFlushMaxAge())
+	if err != nil || !claimed {
+		return err
+	}
+	return b.flushRest(ctx, key, now, int64(count%uint64(batch)))
+}
+
+// Records that usage has been counted in the month containing now, flushing the previous month's if this is the
+// first time. If the previous month's usage can't be flushed, the record is removed so a later request can retry.
+func (b *EndpointBiller) startMonth(ctx context.Context, token, endpoint string, now time.Time) error {
+	monthKey := usageMonthKey(usageKeyAt(token, endpoint, now))
+	err := b.UsageCounter.Add(ctx, monthKey, b.usageCounterTTL(), true)
+	if err == data.ErrCacheNotStored {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = b.flushPreviousMonth(ctx, token, endpoint, now)
+	if err != nil {
+		deleteErr := b.UsageCounter.Delete(ctx, monthKey)
+		if deleteErr != nil && deleteErr != data.ErrCacheMiss {
+			l := ctxlogrus.Get(ctx)
+			l.WithFields(logrus.Fields{"key": monthKey}).Warn(errors.Wrap(deleteErr, "unable to retry previous month's usage flush"))
+		}
+	}
+	return err
+}
+
+// Flushes what remains counted in the cache for the month before now's, as its counter is no longer incremented.
+// This includes any batches which failed to flush.
+func (b *EndpointBiller) flushPreviousMonth(ctx context.Context, token, endpoint string, now time.Time) error {
+	month := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location())
+	key := usageKeyAt(token, endpoint, month)
+
+	pending, err := b.UsageCounter.IncrementExisting(ctx, usageCounterKey(key), 0)
+	if err != nil {
+		if err == data.ErrCacheMiss {
+			return nil
+		}
+		return err
+	}
+	if pending == 0 {
+		return nil
+	}
+
+	claimed, err := b.claimFlush(ctx, key, now, 0)
+	if err != nil || !claimed {
+		return err
+	}
+	return b.flushUsage(ctx, key, month, int64(pending))
+}
+
+// Claims the flush of the requests counted under a usage key, if it was last flushed at least minAge ago,
+// recording that it was flushed now. Only one request can claim each flush.
+// If when it was last flushed is not known, it is recorded as now, and only claimed if minAge is zero.
+func (b *EndpointBiller) claimFlush(ctx context.Context, key string, now time.Time, minAge time.Duration) (bool, error) {
+	flushedKey := usageFlushedKey(key)
+	ttl := b.usageCounterTTL()
+
+	var flushed int64
+	casToken, err := b.UsageCounter.GetForCAS(ctx, flushedKey, &flushed)
+	if err == data.ErrCacheMiss {
+		err = b.UsageCounter.Add(ctx, flushedKey, ttl, now.UnixNano())
+		if err == data.ErrCacheNotStored {
+			return false, nil
+		}
+		return err == nil && minAge == 0, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if now.Sub(time.Unix(0, flushed)) < minAge {
+		return false, nil
+	}
+
+	err = b.UsageCounter.CompareAndSwap(ctx, flushedKey, casToken, ttl, now.UnixNano())
+	if err == data.ErrCacheCASConflict || err == data.ErrCacheNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Flushes the rest of the requests counted in the cache under a usage key for month, along with any batches which
+// failed to flush. The caller must have claimed the counter's flush, so no other request flushes failed batches.
+func (b *EndpointBiller) flushRest(ctx context.Context, key string, month time.Time, rest int64) error {
+	failedKey := usageFailedKey(key)
+	failed, err := b.UsageCounter.IncrementExisting(ctx, failedKey, 0)
+	if err != nil && err != data.ErrCacheMiss {
+		return err
+	}
+
+	err = b.flushUsage(ctx, key, month, rest+int64(failed))
+	if err != nil || failed == 0 {
+		return err
+	}
+
+	_, err = b.UsageCounter.IncrementExisting(ctx, failedKey, -int64(failed))
+	if err != nil && err != data.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+// Flushes a batch of n requests counted in the cache under a usage key for month.
+// If they can't be added to the store, they are recorded as failed, to be flushed along with the rest.
+func (b *EndpointBiller) flushBatch(ctx context.Context, key string, month time.Time, n int64) error {
+	err := b.addUsage(ctx, key, month, n)
+	if err != nil {
+		_, failedErr := b.UsageCounter.IncrementWithTTL(ctx, usageFailedKey(key), b.usageCounterTTL(), n, 0)
+		if failedErr != nil {
+			l := ctxlogrus.Get(ctx)
+			l.WithFields(logrus.Fields{"key": key}).Warn(errors.Wrap(failedErr, "unable to record failed usage flush"))
+		}
+		return err
+	}
+	return b.removeCounted(ctx, key, n)
+}
+
+// Adds n requests counted in the cache under a usage key for month to the store, then removes them from the cache.
+func (b *EndpointBiller) flushUsage(ctx context.Context, key string, month time.Time, n int64) error {
+	err := b.addUsage(ctx, key, month, n)
+	if err != nil {
+		return err
+	}
+	return b.removeCounted(ctx, key, n)
+}
 
+// Removes n requests which have been added to the store from those counted in the cache under a usage key.
+func (b *EndpointBiller) removeCounted(ctx context.Context, key string, n int64) error {
+	_, err := b.UsageCounter.IncrementExisting(ctx, usageCounterKey(key), -n)
+	if err != nil && err != data.ErrCacheMiss {
+		return err
+	}
+	return nil
+}
+
+func (b *EndpointBiller) usageFlushBatch() int64 {
+	if b.UsageFlushBatch <= 0 {
+		return DefaultUsageFlushBatch
+	}
+	return b.UsageFlushBatch
+}
+
+func (b *EndpointBiller) usageFlushMaxAge() time.Duration {
+	if b.UsageFlushMaxAge <= 0 {
+		return DefaultUsageFlushMaxAge
+	}
+	return b.UsageFlushMaxAge
+}
+
+// Returns how long keys used to count usage in the cache are kept, long enough to outlast the month they count.
+func (b *EndpointBiller) usageCounterTTL() time.Duration {
+	return maxMonthLength + b.usageFlushMaxAge()
+}
+
+// Adds n requests to the usage stored under a key for the month containing the given time.
+func (b *EndpointBiller) addUsage(ctx context.Context, key string, month time.Time, n int64) error {
+	return b.PersistentStore.Transact(ctx, func(ctx context.Context) error {
 		var usage tokenUsage
 		_, err := b.PersistentStore.Get(ctx, "TokenUsage", key, &usage)
 		if err != nil {
@@ -96,12 +408,73 @@ func (b *EndpointBiller) incrementUsage(ctx context.Context, token string, endpo
 			}
 		}
 
-		usage.Count++
+		usage.Count += n
 
-		return b.PersistentStore.Set(ctx, "TokenUsage", key, nil, &usage)
+		if b.UsageRetention == 0 {
+			return b.PersistentStore.Set(ctx, "TokenUsage", key, nil, &usage)
+		}
+		return b.PersistentStore.SetWithExpiry(ctx, "TokenUsage", key, b.usageExpiry(month), nil, &usage)
 	})
 }
 
+func (b *EndpointBiller) usageKey(token, endpoint string) string {
+	return usageKeyAt(token, endpoint, b.now())
+}
+
+func (b *EndpointBiller) now() time.Time {
+	if b.NowFunc == nil {
+		return time.Now()
+	}
+	return b.NowFunc()
+}
+
+// Returns when usage for the month containing the given time expires, UsageRetention after the month ends.
+func (b *EndpointBiller) usageExpiry(month time.Time) time.Time {
+	monthEnd := time.Date(month.Year(), month.Month()+1, 1, 0, 0, 0, 0, month.Location())
+	return monthEnd.Add(b.UsageRetention)
+}
+
+func limitProperties(limit int64) []data.Property {
+	return []data.Property{
+		{
+			Name:  "Limit",
+			Value: limit,
+		},
+	}
+}
+
+func limitFromProperties(properties []data.Property) (limit int64) {
+	for _, v := range properties {
+		if v.Name == "Limit" {
+			limit = v.Value.(int64)
+		}
+	}
+	return
+}
+
+func usageKeyAt(token, endpoint string, month time.Time) string {
+	return tokenEndpointKey(token, endpoint) + "/" + month.Format("2006-01") + "/1"
+}
+
+func usageCounterKey(usageKey string) string {
+	return "usage/" + usageKey
+}
+
+// Key recording when the counter for a usage key was last flushed, in nanoseconds since the Unix epoch.
+func usageFlushedKey(usageKey string) string {
+	return "usageflushed/" + usageKey
+}
+
+// Counter of requests counted under a usage key in batches which failed to flush.
+func usageFailedKey(usageKey string) string {
+	return "usagefailed/" + usageKey
+}
+
+// Key recording that usage has been counted under a usage key, and so the previous month's flushed.
+func usageMonthKey(usageKey string) string {
+	return "usagemonth/" + usageKey
+}
+
 func tokenEndpointKey(token, endpoint string) string {
 	return token + "/" + endpoint
 }
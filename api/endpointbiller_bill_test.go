@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/lru"
 	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -30,24 +32,53 @@ func TestEndpointBiller_Bill_NoMatch(t *testing.T) {
 	}
 }
 
-func TestEndpointBiller_Bill_LimitGetErr(t *testing.T) {
+func TestEndpointBiller_Bill_EndpointsOverrideUrlEndpoints(t *testing.T) {
+	t.Parallel()
+
+	endpoints := &EndpointTable{}
+	endpoints.Set(map[string]string{})
+	b := &EndpointBiller{
+		UrlEndpoints: map[string]string{
+			"/api/foo": "bar",
+		},
+		Endpoints: endpoints,
+	}
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	expectedErr := data.ErrOutOfCredit
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != expectedErr {
+		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestEndpointBiller_Bill_GetMultiErr(t *testing.T) {
 	t.Parallel()
 
-	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
 
 	expectedErr := errors.New("bluh")
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCalled = true
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-		expectedKind := "TokenLimit"
-		if kind != expectedKind {
-			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
 		}
 
-		expectedKey := "bluh/bar"
-		if key != expectedKey {
-			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
 		}
 
 		return nil, expectedErr
@@ -63,10 +94,64 @@ func TestEndpointBiller_Bill_LimitGetErr(t *testing.T) {
 		UrlEndpoints: map[string]string{
 			"/api/foo": "bar",
 		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if !getCalled {
-		t.Error("Expected bill to call Get, not called")
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
+	}
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestEndpointBiller_Bill_LimitGetErr(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+
+	expectedErr := errors.New("bluh")
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
+
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
+		}
+
+		return make([][]data.Property, 2), data.MultiError{expectedErr, nil}
+	}
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+		UrlEndpoints: map[string]string{
+			"/api/foo": "bar",
+		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
+	}
+	err = b.Bill(context.Background(), "bluh", u)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
 		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
@@ -76,22 +161,28 @@ func TestEndpointBiller_Bill_LimitGetErr(t *testing.T) {
 func TestEndpointBiller_Bill_NoLimitEntity(t *testing.T) {
 	t.Parallel()
 
-	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCalled = true
 
-		expectedKind := "TokenLimit"
-		if kind != expectedKind {
-			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
+
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
 		}
 
-		expectedKey := "bluh/bar"
-		if key != expectedKey {
-			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
 		}
 
-		return nil, data.ErrNoSuchEntity
+		return make([][]data.Property, 2), data.MultiError{data.ErrNoSuchEntity, data.ErrNoSuchEntity}
 	}
 
 	u, err := url.Parse("https://example.com/api/foo")
@@ -104,10 +195,13 @@ func TestEndpointBiller_Bill_NoLimitEntity(t *testing.T) {
 		UrlEndpoints: map[string]string{
 			"/api/foo": "bar",
 		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if !getCalled {
-		t.Error("Expected bill to call Get, not called")
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	expectedErr := data.ErrOutOfCredit
 	if err != expectedErr {
@@ -118,27 +212,36 @@ func TestEndpointBiller_Bill_NoLimitEntity(t *testing.T) {
 func TestEndpointBiller_Bill_ZeroLimit(t *testing.T) {
 	t.Parallel()
 
-	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCalled = true
 
-		expectedKind := "TokenLimit"
-		if kind != expectedKind {
-			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
+
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
 		}
 
-		expectedKey := "bluh/bar"
-		if key != expectedKey {
-			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
 		}
 
-		return []data.Property{
+		return [][]data.Property{
 			{
-				Name:  "Limit",
-				Value: int64(0),
+				{
+					Name:  "Limit",
+					Value: int64(0),
+				},
 			},
-		}, nil
+			nil,
+		}, data.MultiError{nil, data.ErrNoSuchEntity}
 	}
 
 	u, err := url.Parse("https://example.com/api/foo")
@@ -151,10 +254,13 @@ func TestEndpointBiller_Bill_ZeroLimit(t *testing.T) {
 		UrlEndpoints: map[string]string{
 			"/api/foo": "bar",
 		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if !getCalled {
-		t.Error("Expected bill to call Get, not called")
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	expectedErr := data.ErrOutOfCredit
 	if err != expectedErr {
@@ -165,44 +271,37 @@ func TestEndpointBiller_Bill_ZeroLimit(t *testing.T) {
 func TestEndpointBiller_Bill_EstUsageCheckErr(t *testing.T) {
 	t.Parallel()
 
-	getCallCount := 0
-	expectedErr := errors.New("bluh")
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
+	expectedErr := errors.New("bluh")
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			return []data.Property{
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
+		}
+
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			return nil, expectedErr
-		}
-		t.Error("Unexpected call to Get")
-		return nil, nil
+			},
+			nil,
+		}, data.MultiError{nil, expectedErr}
 	}
 
 	u, err := url.Parse("https://example.com/api/foo")
@@ -220,8 +319,8 @@ func TestEndpointBiller_Bill_EstUsageCheckErr(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 2 {
-		t.Error("Expected bill to call Get twice, not called")
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
 		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
@@ -231,50 +330,39 @@ func TestEndpointBiller_Bill_EstUsageCheckErr(t *testing.T) {
 func TestEndpointBiller_Bill_LimitReached(t *testing.T) {
 	t.Parallel()
 
-	getCallCount := 0
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
+
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		usage, ok := v[1].(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86400
+		}
 
-			return []data.Property{
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86400
-			}
-
-			return nil, nil
-		}
-		t.Error("Unexpected call to Get")
-		return nil, nil
+			},
+			nil,
+		}, nil
 	}
 
 	u, err := url.Parse("https://example.com/api/foo")
@@ -292,8 +380,8 @@ func TestEndpointBiller_Bill_LimitReached(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 2 {
-		t.Error("Expected bill to call Get twice, not called")
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	expectedErr := data.ErrOutOfCredit
 	if err != expectedErr {
@@ -313,68 +401,51 @@ func TestEndpointBiller_Bill_IncrementTransactErr(t *testing.T) {
 		if transactionCallCount != 0 {
 			t.Error("Expected Transact to only be called once")
 		}
+		transactionCallCount++
 		return expectedErr
 	}
 
-	getCallCount := 0
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		if inTransaction {
+			t.Error("Expected get multi call to be outside transaction")
+		}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		usage, ok := v[1].(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86399
+		}
 
-			return []data.Property{
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
-
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86399
-			}
-
-			return nil, nil
-
-		case 3:
-			return nil, nil
-		}
-		t.Error("Unexpected call to Get")
-		return nil, nil
+			},
+			nil,
+		}, nil
 	}
 
 	setCallCount := 0
 	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
 		setCallCount++
+
 		return nil
 	}
 
@@ -393,11 +464,11 @@ func TestEndpointBiller_Bill_IncrementTransactErr(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 2 {
-		t.Errorf("Expected bill to call Get %d times, called %d times", 3, getCallCount)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
 	}
 	if setCallCount != 0 {
-		t.Errorf("Expected bill to call Set %d times, called %d times", 1, setCallCount)
+		t.Errorf("Expected bill to call Set %d times, called %d times", 0, setCallCount)
 	}
 	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
 		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
@@ -424,78 +495,67 @@ func TestEndpointBiller_Bill_IncrementGetErr(t *testing.T) {
 		return err
 	}
 
-	getCallCount := 0
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		if inTransaction {
+			t.Error("Expected get multi call to be outside transaction")
+		}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		usage, ok := v[1].(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86399
+		}
 
-			return []data.Property{
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
-
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86399
-			}
-
-			return nil, nil
+			},
+			nil,
+		}, nil
+	}
 
-		case 3:
-			if !inTransaction {
-				t.Errorf("Expected get call %d to be inside transaction", getCallCount)
-			}
+	getCallCount := 0
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCallCount++
+		if !inTransaction {
+			t.Errorf("Expected get call %d to be inside transaction", getCallCount)
+		}
 
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKind := "TokenUsage"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
 
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-			return nil, expectedErr
+		expectedKey := "bluh/bar/2019-06/1"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
 		}
-		t.Error("Unexpected call to Get")
-		return nil, nil
+
+		return nil, expectedErr
 	}
 
 	setCallCount := 0
 	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
 		setCallCount++
+
 		return nil
 	}
 
@@ -514,11 +574,14 @@ func TestEndpointBiller_Bill_IncrementGetErr(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 3 {
-		t.Errorf("Expected bill to call Get %d times, called %d times", 3, getCallCount)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
+	}
+	if getCallCount != 1 {
+		t.Errorf("Expected bill to call Get %d times, called %d times", 1, getCallCount)
 	}
 	if setCallCount != 0 {
-		t.Errorf("Expected bill to call Set %d times, called %d times", 1, setCallCount)
+		t.Errorf("Expected bill to call Set %d times, called %d times", 0, setCallCount)
 	}
 	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
 		t.Errorf("Expected bill to return error '%s', got '%s'", expectedErr, err)
@@ -545,86 +608,74 @@ func TestEndpointBiller_Bill_IncrementSetErr(t *testing.T) {
 		return err
 	}
 
-	getCallCount := 0
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		if inTransaction {
+			t.Error("Expected get multi call to be outside transaction")
+		}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
 
-			return []data.Property{
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		usage, ok := v[1].(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86399
+		}
+
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
-
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86399
-			}
-
-			return nil, nil
-
-		case 3:
-			if !inTransaction {
-				t.Errorf("Expected get call %d to be inside transaction", getCallCount)
-			}
+			},
+			nil,
+		}, nil
+	}
 
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+	getCallCount := 0
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCallCount++
+		if !inTransaction {
+			t.Errorf("Expected get call %d to be inside transaction", getCallCount)
+		}
 
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
+		expectedKind := "TokenUsage"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
 
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86401
-			}
+		expectedKey := "bluh/bar/2019-06/1"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
 
-			return nil, nil
+		usage, ok := v.(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86401
 		}
-		t.Error("Unexpected call to Get")
+
 		return nil, nil
 	}
 
 	setCallCount := 0
 	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
 		setCallCount++
+
 		return expectedErr
 	}
 
@@ -643,8 +694,11 @@ func TestEndpointBiller_Bill_IncrementSetErr(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 3 {
-		t.Errorf("Expected bill to call Get %d times, called %d times", 3, getCallCount)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
+	}
+	if getCallCount != 1 {
+		t.Errorf("Expected bill to call Get %d times, called %d times", 1, getCallCount)
 	}
 	if setCallCount != 1 {
 		t.Errorf("Expected bill to call Set %d times, called %d times", 1, setCallCount)
@@ -673,80 +727,67 @@ func TestEndpointBiller_Bill(t *testing.T) {
 		return err
 	}
 
-	getCallCount := 0
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		if inTransaction {
+			t.Error("Expected get multi call to be outside transaction")
+		}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
 
-			return []data.Property{
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		usage, ok := v[1].(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86399
+		}
+
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
-
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
-
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
-
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86399
-			}
-
-			return nil, nil
-
-		case 3:
-			if !inTransaction {
-				t.Errorf("Expected get call %d to be inside transaction", getCallCount)
-			}
+			},
+			nil,
+		}, nil
+	}
 
-			expectedKind := "TokenUsage"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+	getCallCount := 0
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCallCount++
+		if !inTransaction {
+			t.Errorf("Expected get call %d to be inside transaction", getCallCount)
+		}
 
-			expectedKey := "bluh/bar/2019-06/1"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
-			}
+		expectedKind := "TokenUsage"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
 
-			usage, ok := v.(*tokenUsage)
-			if !ok {
-				t.Error("Expected token usage struct to unpack into")
-			} else {
-				usage.Count = 86401
-			}
+		expectedKey := "bluh/bar/2019-06/1"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
 
-			return nil, nil
+		usage, ok := v.(*tokenUsage)
+		if !ok {
+			t.Error("Expected token usage struct to unpack into")
+		} else {
+			usage.Count = 86401
 		}
-		t.Error("Unexpected call to Get")
+
 		return nil, nil
 	}
 
@@ -792,8 +833,11 @@ func TestEndpointBiller_Bill(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 3 {
-		t.Errorf("Expected bill to call Get %d times, called %d times", 3, getCallCount)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
+	}
+	if getCallCount != 1 {
+		t.Errorf("Expected bill to call Get %d times, called %d times", 1, getCallCount)
 	}
 	if setCallCount != 1 {
 		t.Errorf("Expected bill to call Set %d times, called %d times", 1, setCallCount)
@@ -822,38 +866,58 @@ func TestEndpointBiller_Bill_FirstUsage(t *testing.T) {
 		return err
 	}
 
-	getCallCount := 0
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
-		getCallCount++
-		switch getCallCount {
-		case 1:
-			if inTransaction {
-				t.Errorf("Expected get call %d to be outside transaction", getCallCount)
-			}
+	getMultiCalled := false
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCalled = true
 
-			expectedKind := "TokenLimit"
-			if kind != expectedKind {
-				t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
-			}
+		if inTransaction {
+			t.Error("Expected get multi call to be outside transaction")
+		}
 
-			expectedKey := "bluh/bar"
-			if key != expectedKey {
-				t.Errorf("Expected key '%s', got '%s'", expectedKind, kind)
-			}
+		expectedKeys := []data.EntityKey{
+			{Kind: "TokenLimit", Key: "bluh/bar"},
+			{Kind: "TokenUsage", Key: "bluh/bar/2019-06/1"},
+		}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
 
-			return []data.Property{
+		if len(v) != 2 || v[0] != nil {
+			t.Fatalf("Expected nil limit content and usage content, got %v", v)
+		}
+		if _, ok := v[1].(*tokenUsage); !ok {
+			t.Error("Expected token usage struct to unpack into")
+		}
+
+		return [][]data.Property{
+			{
 				{
 					Name:  "Limit",
 					Value: int64(86400),
 				},
-			}, nil
-		case 2:
-			fallthrough
-		case 3:
-			return nil, data.ErrNoSuchEntity
+			},
+			nil,
+		}, data.MultiError{nil, data.ErrNoSuchEntity}
+	}
+
+	getCallCount := 0
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCallCount++
+		if !inTransaction {
+			t.Errorf("Expected get call %d to be inside transaction", getCallCount)
 		}
-		t.Error("Unexpected call to Get")
-		return nil, nil
+
+		expectedKind := "TokenUsage"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bluh/bar/2019-06/1"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return nil, data.ErrNoSuchEntity
 	}
 
 	setCallCount := 0
@@ -898,8 +962,11 @@ func TestEndpointBiller_Bill_FirstUsage(t *testing.T) {
 		},
 	}
 	err = b.Bill(context.Background(), "bluh", u)
-	if getCallCount != 3 {
-		t.Errorf("Expected bill to call Get %d times, called %d times", 3, getCallCount)
+	if !getMultiCalled {
+		t.Error("Expected bill to call GetMulti, not called")
+	}
+	if getCallCount != 1 {
+		t.Errorf("Expected bill to call Get %d times, called %d times", 1, getCallCount)
 	}
 	if setCallCount != 1 {
 		t.Errorf("Expected bill to call Set %d times, called %d times", 1, setCallCount)
@@ -908,3 +975,133 @@ func TestEndpointBiller_Bill_FirstUsage(t *testing.T) {
 		t.Errorf("Expected bill to return nil error, got '%s'", err)
 	}
 }
+
+func TestEndpointBiller_Bill_UsageRetention(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		return f(ctx)
+	}
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		return [][]data.Property{
+			{
+				{
+					Name:  "Limit",
+					Value: int64(86400),
+				},
+			},
+			nil,
+		}, nil
+	}
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		return nil, data.ErrNoSuchEntity
+	}
+
+	setWithExpiryCalled := false
+	ps.SetWithExpiryFunc = func(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error {
+		setWithExpiryCalled = true
+
+		expectedKey := "bluh/bar/2019-12/1"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		expectedExpiry := time.Date(2020, 03, 31, 0, 0, 0, 0, time.UTC)
+		if !expiry.Equal(expectedExpiry) {
+			t.Errorf("Expected expiry %s, got %s", expectedExpiry, expiry)
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+		UrlEndpoints: map[string]string{
+			"/api/foo": "bar",
+		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 12, 11, 23, 45, 12, 0, time.UTC)
+		},
+		UsageRetention: 90 * 24 * time.Hour,
+	}
+	err = b.Bill(context.Background(), "bluh", u)
+	if !setWithExpiryCalled {
+		t.Error("Expected bill to call SetWithExpiry, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected bill to return nil error, got '%s'", err)
+	}
+}
+
+func TestEndpointBiller_Bill_CachedLimit(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		return f(ctx)
+	}
+
+	limitGetCount := 0
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		switch kind {
+		case "TokenLimit":
+			limitGetCount++
+			expectedKey := "bluh/bar"
+			if key != expectedKey {
+				t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+			}
+			return limitProperties(2), nil
+		case "TokenUsage":
+			return nil, data.ErrNoSuchEntity
+		default:
+			t.Errorf("Unexpected get of kind '%s'", kind)
+			return nil, nil
+		}
+	}
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		return nil
+	}
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+		UrlEndpoints: map[string]string{
+			"/api/foo": "bar",
+		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
+		LimitCache: &lru.Cache{},
+	}
+	for i := 0; i < 2; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill to return nil error, got '%s'", err)
+		}
+	}
+	if limitGetCount != 1 {
+		t.Errorf("Expected limit to be read %d times, read %d times", 1, limitGetCount)
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 3)
+	if err != nil {
+		t.Errorf("Expected set limit to return nil error, got '%s'", err)
+	}
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != nil {
+		t.Errorf("Expected bill to return nil error, got '%s'", err)
+	}
+	if limitGetCount != 2 {
+		t.Errorf("Expected setting the limit to drop the cached limit, limit read %d times", limitGetCount)
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"testing"
+)
+
+func TestEndpointBiller_GetLimit(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+
+	getCallCount := 0
+	ps.GetWithVersionFunc = func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+		getCallCount++
+
+		expectedKind := "TokenLimit"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bluh/bar"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return []data.Property{
+			{
+				Name:  "Limit",
+				Value: int64(86400),
+			},
+		}, 7, nil
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+	}
+	limit, version, err := b.GetLimit(context.Background(), "bluh", "bar")
+	if err != nil {
+		t.Errorf("Expected nil err from GetLimit, got '%s'", err)
+	}
+	if limit != 86400 {
+		t.Errorf("Expected limit %d, got %d", 86400, limit)
+	}
+	if version != 7 {
+		t.Errorf("Expected version %d, got %d", 7, version)
+	}
+	if getCallCount != 1 {
+		t.Errorf("Expected GetWithVersion to be called %d times, was called %d times", 1, getCallCount)
+	}
+}
+
+func TestEndpointBiller_GetLimit_NoLimitEntity(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetWithVersionFunc = func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+		return nil, 0, data.ErrNoSuchEntity
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+	}
+	limit, version, err := b.GetLimit(context.Background(), "bluh", "bar")
+	if err != nil {
+		t.Errorf("Expected nil err from GetLimit, got '%s'", err)
+	}
+	if limit != 0 {
+		t.Errorf("Expected limit %d, got %d", 0, limit)
+	}
+	if version != 0 {
+		t.Errorf("Expected version %d, got %d", 0, version)
+	}
+}
+
+func TestEndpointBiller_GetLimit_Err(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetWithVersionFunc = func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+		return nil, 0, expectedErr
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+	}
+	_, _, err := b.GetLimit(context.Background(), "bluh", "bar")
+	if err != expectedErr {
+		t.Errorf("Expected err '%s' from GetLimit, got '%s'", expectedErr, err)
+	}
+}
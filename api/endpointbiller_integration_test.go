@@ -0,0 +1,550 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/memstore"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newIntegrationEndpointBiller() *EndpointBiller {
+	return &EndpointBiller{
+		PersistentStore: &memstore.PersistentStore{
+			Datastore:           &memstore.Datastore{},
+			TransactionAttempts: 1000,
+		},
+		UrlEndpoints: map[string]string{
+			"/api/foo": "bar",
+		},
+		NowFunc: func() time.Time {
+			return time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+		},
+	}
+}
+
+func TestEndpointBiller_Integration_BillToLimit(t *testing.T) {
+	t.Parallel()
+
+	b := newIntegrationEndpointBiller()
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != data.ErrOutOfCredit {
+		t.Errorf("Expected bill with no limit set to return error '%s', got '%s'", data.ErrOutOfCredit, err)
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != data.ErrOutOfCredit {
+		t.Errorf("Expected bill beyond limit to return error '%s', got '%s'", data.ErrOutOfCredit, err)
+	}
+
+	err = b.Bill(context.Background(), "other", u)
+	if err != data.ErrOutOfCredit {
+		t.Errorf("Expected bill for other token to return error '%s', got '%s'", data.ErrOutOfCredit, err)
+	}
+}
+
+func TestEndpointBiller_Integration_BillConcurrent(t *testing.T) {
+	t.Parallel()
+
+	b := newIntegrationEndpointBiller()
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 1000)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := b.Bill(context.Background(), "bluh", u)
+			if err != nil {
+				t.Errorf("Expected bill to return nil error, got '%s'", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(context.Background(), "TokenUsage", "bluh/bar/2019-06/1", &usage)
+	if err != nil {
+		t.Errorf("Unexpected error getting usage: %s", err)
+	}
+	if usage.Count != 20 {
+		t.Errorf("Expected usage %d, got %d", 20, usage.Count)
+	}
+}
+
+func TestEndpointBiller_Integration_SetLimitIfVersion(t *testing.T) {
+	t.Parallel()
+
+	b := newIntegrationEndpointBiller()
+
+	limit, version, err := b.GetLimit(context.Background(), "bluh", "bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from GetLimit: %s", err)
+	}
+	if limit != 0 || version != 0 {
+		t.Errorf("Expected limit and version of zero with no limit set, got %d and %d", limit, version)
+	}
+
+	firstVersion, err := b.SetLimitIfVersion(context.Background(), "bluh", "bar", 5, version)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimitIfVersion: %s", err)
+	}
+
+	// A second admin editing from the same starting point must not overwrite the first.
+	_, err = b.SetLimitIfVersion(context.Background(), "bluh", "bar", 10, version)
+	if _, ok := err.(*data.VersionConflictError); !ok {
+		t.Errorf("Expected version conflict error from stale SetLimitIfVersion, got '%s'", err)
+	}
+
+	limit, version, err = b.GetLimit(context.Background(), "bluh", "bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from GetLimit: %s", err)
+	}
+	if limit != 5 {
+		t.Errorf("Expected limit %d, got %d", 5, limit)
+	}
+	if version != firstVersion {
+		t.Errorf("Expected version %d, got %d", firstVersion, version)
+	}
+
+	// An unconditional set must also change the version.
+	err = b.SetLimit(context.Background(), "bluh", "bar", 15)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+	_, err = b.SetLimitIfVersion(context.Background(), "bluh", "bar", 20, firstVersion)
+	if _, ok := err.(*data.VersionConflictError); !ok {
+		t.Errorf("Expected version conflict error after unconditional SetLimit, got '%s'", err)
+	}
+}
+
+// Returns the requests counted in the cache under a usage key, not yet flushed to the store.
+func pendingCount(t *testing.T, counter *memstore.CacheStore, key string) uint64 {
+	pending, err := counter.IncrementExisting(context.Background(), usageCounterKey(key), 0)
+	if err != nil && err != data.ErrCacheMiss {
+		t.Fatalf("Unexpected error reading pending usage: %s", err)
+	}
+	return pending
+}
+
+func TestEndpointBiller_Integration_CountedBillConcurrent(t *testing.T) {
+	t.Parallel()
+
+	counter := &memstore.CacheStore{}
+	b := newIntegrationEndpointBiller()
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 7
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 10000)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				err := b.Bill(context.Background(), "bluh", u)
+				if err != nil {
+					t.Errorf("Unexpected error from Bill: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(context.Background(), "TokenUsage", "bluh/bar/2019-06/1", &usage)
+	if err != nil {
+		t.Fatalf("Unexpected error reading usage: %s", err)
+	}
+	pending := pendingCount(t, counter, "bluh/bar/2019-06/1")
+
+	// Every complete batch must have been flushed exactly once, with the remainder still pending.
+	if usage.Count != 994 {
+		t.Errorf("Expected flushed usage to be %d, was %d", 994, usage.Count)
+	}
+	if pending != 6 {
+		t.Errorf("Expected pending usage to be %d, was %d", 6, pending)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillToLimit(t *testing.T) {
+	t.Parallel()
+
+	b := newIntegrationEndpointBiller()
+	b.UsageCounter = &memstore.CacheStore{}
+	b.UsageFlushBatch = 2
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 3)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	// Usage is split between the store and the cache, and both must count towards the limit.
+	for i := 0; i < 3; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != data.ErrOutOfCredit {
+		t.Errorf("Expected bill beyond limit to return error '%s', got '%s'", data.ErrOutOfCredit, err)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillFlushErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error) {
+		return [][]data.Property{limitProperties(10), nil}, data.MultiError{nil, data.ErrNoSuchEntity}
+	}
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		return expectedErr
+	}
+
+	counter := &memstore.CacheStore{}
+	b := newIntegrationEndpointBiller()
+	b.PersistentStore = ps
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 2
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	for i := 0; i < 3; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+
+		// Only the second bill completes a batch, and so tries to flush it.
+		if i == 1 && err != expectedErr {
+			t.Errorf("Expected bill %d to return error '%s', got '%v'", i+1, expectedErr, err)
+		} else if i != 1 && err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+
+	// A failed flush must leave its batch pending rather than losing it.
+	pending := pendingCount(t, counter, "bluh/bar/2019-06/1")
+	if pending != 3 {
+		t.Errorf("Expected pending usage to be %d, was %d", 3, pending)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillFlushesAged(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	counter := &memstore.CacheStore{}
+	b := newIntegrationEndpointBiller()
+	b.NowFunc = func() time.Time {
+		return now
+	}
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 10
+	b.UsageFlushMaxAge = time.Minute
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+	if pending := pendingCount(t, counter, "bluh/bar/2019-06/1"); pending != 3 {
+		t.Errorf("Expected pending usage before max age to be %d, was %d", 3, pending)
+	}
+
+	// Once the counter has gone unflushed for longer than the max age, the next bill flushes it.
+	now = now.Add(2 * time.Minute)
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != nil {
+		t.Errorf("Expected bill after max age to return nil error, got '%s'", err)
+	}
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(context.Background(), "TokenUsage", "bluh/bar/2019-06/1", &usage)
+	if err != nil {
+		t.Fatalf("Unexpected error reading usage: %s", err)
+	}
+	if usage.Count != 4 {
+		t.Errorf("Expected flushed usage to be %d, was %d", 4, usage.Count)
+	}
+	if pending := pendingCount(t, counter, "bluh/bar/2019-06/1"); pending != 0 {
+		t.Errorf("Expected pending usage after flush to be %d, was %d", 0, pending)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillFlushesPreviousMonth(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 06, 30, 23, 59, 0, 0, time.UTC)
+	counter := &memstore.CacheStore{}
+	b := newIntegrationEndpointBiller()
+	b.NowFunc = func() time.Time {
+		return now
+	}
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 10
+	b.UsageFlushMaxAge = time.Hour
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+
+	// The first bill of the next month flushes the rest of the previous month's count.
+	now = now.Add(2 * time.Minute)
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != nil {
+		t.Errorf("Expected bill in next month to return nil error, got '%s'", err)
+	}
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(context.Background(), "TokenUsage", "bluh/bar/2019-06/1", &usage)
+	if err != nil {
+		t.Fatalf("Unexpected error reading previous month's usage: %s", err)
+	}
+	if usage.Count != 3 {
+		t.Errorf("Expected previous month's flushed usage to be %d, was %d", 3, usage.Count)
+	}
+	if pending := pendingCount(t, counter, "bluh/bar/2019-06/1"); pending != 0 {
+		t.Errorf("Expected previous month's pending usage to be %d, was %d", 0, pending)
+	}
+	if pending := pendingCount(t, counter, "bluh/bar/2019-07/1"); pending != 1 {
+		t.Errorf("Expected this month's pending usage to be %d, was %d", 1, pending)
+	}
+}
+
+// Counter recording how often each key is read or changed with IncrementExisting.
+type recordingCounter struct {
+	*memstore.CacheStore
+
+	lock     sync.Mutex
+	existing map[string]int
+}
+
+func (c *recordingCounter) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	c.lock.Lock()
+	if c.existing == nil {
+		c.existing = make(map[string]int)
+	}
+	c.existing[key]++
+	c.lock.Unlock()
+
+	return c.CacheStore.IncrementExisting(ctx, key, delta)
+}
+
+func TestEndpointBiller_Integration_CountedBillChecksPreviousMonthOnce(t *testing.T) {
+	t.Parallel()
+
+	counter := &recordingCounter{CacheStore: &memstore.CacheStore{}}
+	b := newIntegrationEndpointBiller()
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 2
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	// Each batch flushed restarts the counter, but only the month's first request looks at the previous month.
+	for i := 0; i < 7; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+
+	previousKey := usageCounterKey("bluh/bar/2019-05/1")
+	if checks := counter.existing[previousKey]; checks != 1 {
+		t.Errorf("Expected previous month's count to be checked %d time, was checked %d times", 1, checks)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillRetriesFailedBatch(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	counter := &memstore.CacheStore{}
+	b := newIntegrationEndpointBiller()
+	b.NowFunc = func() time.Time {
+		return now
+	}
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 2
+	b.UsageFlushMaxAge = time.Minute
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	expectedErr := errors.New("bluh")
+	store := b.PersistentStore
+	failing := testhelpers.NewPersistentStore(t)
+	failing.GetMultiFunc = store.GetMulti
+	failing.GetFunc = store.Get
+	failing.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		return expectedErr
+	}
+
+	// The second bill completes a batch, which fails to flush.
+	b.PersistentStore = failing
+	for i := 0; i < 2; i++ {
+		err = b.Bill(context.Background(), "bluh", u)
+		if i == 1 && err != expectedErr {
+			t.Errorf("Expected bill %d to return error '%s', got '%v'", i+1, expectedErr, err)
+		} else if i != 1 && err != nil {
+			t.Errorf("Expected bill %d to return nil error, got '%s'", i+1, err)
+		}
+	}
+	b.PersistentStore = store
+
+	// Once the max age has passed, the failed batch is flushed along with the rest.
+	now = now.Add(2 * time.Minute)
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != nil {
+		t.Errorf("Expected bill after max age to return nil error, got '%s'", err)
+	}
+
+	var usage tokenUsage
+	_, err = b.PersistentStore.Get(context.Background(), "TokenUsage", "bluh/bar/2019-06/1", &usage)
+	if err != nil {
+		t.Fatalf("Unexpected error reading usage: %s", err)
+	}
+	if usage.Count != 3 {
+		t.Errorf("Expected flushed usage to be %d, was %d", 3, usage.Count)
+	}
+	if pending := pendingCount(t, counter, "bluh/bar/2019-06/1"); pending != 0 {
+		t.Errorf("Expected pending usage after flush to be %d, was %d", 0, pending)
+	}
+}
+
+func TestEndpointBiller_Integration_CountedBillExpires(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	counter := &memstore.CacheStore{
+		NowFunc: func() time.Time {
+			return now
+		},
+	}
+	b := newIntegrationEndpointBiller()
+	b.UsageCounter = counter
+	b.UsageFlushBatch = 10
+	b.UsageFlushMaxAge = time.Hour
+
+	u, err := url.Parse("https://example.com/api/foo")
+	if err != nil {
+		t.Fatal("Failed to parse URL")
+	}
+
+	err = b.SetLimit(context.Background(), "bluh", "bar", 100)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+
+	err = b.Bill(context.Background(), "bluh", u)
+	if err != nil {
+		t.Fatalf("Unexpected error from Bill: %s", err)
+	}
+
+	// Counts are kept for longer than a month plus the max age, so they outlast the month they count.
+	keys := []string{
+		usageCounterKey("bluh/bar/2019-06/1"),
+		usageFlushedKey("bluh/bar/2019-06/1"),
+		usageMonthKey("bluh/bar/2019-06/1"),
+	}
+	now = now.Add(31 * 24 * time.Hour)
+	for _, key := range keys {
+		if err := counter.Add(context.Background(), key, 0, true); err != data.ErrCacheNotStored {
+			t.Errorf("Expected key '%s' to remain after a month, got '%v' adding it", key, err)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	for _, key := range keys {
+		if err := counter.Add(context.Background(), key, 0, true); err != nil {
+			t.Errorf("Expected key '%s' to have expired, got '%v' adding it", key, err)
+		}
+	}
+}
@@ -74,3 +74,72 @@ func TestEndpointBiller_SetLimit_Err(t *testing.T) {
 		t.Errorf("Expected Set to be called %d times, was called %d times", 1, setCallCount)
 	}
 }
+
+func TestEndpointBiller_SetLimitIfVersion(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+
+	setCallCount := 0
+	ps.SetIfVersionFunc = func(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error) {
+		setCallCount++
+
+		expectedKind := "TokenLimit"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bluh/bar"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		if version != 7 {
+			t.Errorf("Expected version %d, got %d", 7, version)
+		}
+
+		expectedProperties := []data.Property{
+			{
+				Name:  "Limit",
+				Value: int64(86400),
+			},
+		}
+		if !reflect.DeepEqual(properties, expectedProperties) {
+			t.Errorf("Expected properties %v, got %v", expectedProperties, properties)
+		}
+
+		return 8, nil
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+	}
+	version, err := b.SetLimitIfVersion(context.Background(), "bluh", "bar", 86400, 7)
+	if err != nil {
+		t.Errorf("Expected nil err from SetLimitIfVersion, got '%s'", err)
+	}
+	if version != 8 {
+		t.Errorf("Expected new version %d, got %d", 8, version)
+	}
+	if setCallCount != 1 {
+		t.Errorf("Expected SetIfVersion to be called %d times, was called %d times", 1, setCallCount)
+	}
+}
+
+func TestEndpointBiller_SetLimitIfVersion_Conflict(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := &data.VersionConflictError{Kind: "TokenLimit", Key: "bluh/bar", Expected: 7, Actual: 9}
+	ps := testhelpers.NewPersistentStore(t)
+	ps.SetIfVersionFunc = func(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error) {
+		return 0, expectedErr
+	}
+
+	b := &EndpointBiller{
+		PersistentStore: ps,
+	}
+	_, err := b.SetLimitIfVersion(context.Background(), "bluh", "bar", 86400, 7)
+	if err != expectedErr {
+		t.Errorf("Expected err '%s' from SetLimitIfVersion, got '%s'", expectedErr, err)
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import "sync"
+
+// EndpointTable maps URL paths to the endpoints they are billed as, and may be replaced while in use,
+// so endpoints can be reconfigured without restarting.
+// The zero value maps no paths.
+type EndpointTable struct {
+	lock      sync.RWMutex
+	endpoints map[string]string
+}
+
+// Returns the endpoint for a URL path, or an empty string if the path is not an endpoint.
+func (t *EndpointTable) Endpoint(path string) string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.endpoints[path]
+}
+
+// Replaces every mapping with those in endpoints, which is copied, so may be changed afterwards.
+func (t *EndpointTable) Set(endpoints map[string]string) {
+	copied := make(map[string]string, len(endpoints))
+	for path, endpoint := range endpoints {
+		copied[path] = endpoint
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.endpoints = copied
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestEndpointTable(t *testing.T) {
+	t.Parallel()
+
+	table := &EndpointTable{}
+	if endpoint := table.Endpoint("/foo"); endpoint != "" {
+		t.Errorf("Expected no endpoint from empty table, got '%s'", endpoint)
+	}
+
+	endpoints := map[string]string{"/foo": "foo"}
+	table.Set(endpoints)
+	endpoints["/bar"] = "bar"
+
+	if endpoint := table.Endpoint("/foo"); endpoint != "foo" {
+		t.Errorf("Expected endpoint '%s', got '%s'", "foo", endpoint)
+	}
+	if endpoint := table.Endpoint("/bar"); endpoint != "" {
+		t.Errorf("Expected later changes to the set map not to be seen, got endpoint '%s'", endpoint)
+	}
+
+	table.Set(map[string]string{"/bar": "bar"})
+	if endpoint := table.Endpoint("/foo"); endpoint != "" {
+		t.Errorf("Expected replaced endpoint to be removed, got '%s'", endpoint)
+	}
+	if endpoint := table.Endpoint("/bar"); endpoint != "bar" {
+		t.Errorf("Expected endpoint '%s', got '%s'", "bar", endpoint)
+	}
+}
+
+func TestEndpointTable_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	table := &EndpointTable{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			table.Set(map[string]string{"/foo": "foo"})
+		}()
+		go func() {
+			defer wg.Done()
+			table.Endpoint("/foo")
+		}()
+	}
+	wg.Wait()
+}
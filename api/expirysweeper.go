@@ -0,0 +1,39 @@
+package api
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/sirupsen/logrus"
+)
+
+const DefaultSweepBatchSize = 500
+
+// ExpirySweeper deletes expired entities of a set of kinds, intended to be run periodically.
+type ExpirySweeper struct {
+	PersistentStore PersistentStore
+	Kinds           []string
+
+	// Number of entities deleted per batch; if zero, DefaultSweepBatchSize is used.
+	BatchSize int
+}
+
+// Deletes expired entities of each kind, returning the total number deleted.
+// If a kind fails, entities deleted before the failure are still counted.
+func (s *ExpirySweeper) Sweep(ctx context.Context) (int, error) {
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultSweepBatchSize
+	}
+
+	l := ctxlogrus.Get(ctx)
+	total := 0
+	for _, kind := range s.Kinds {
+		deleted, err := s.PersistentStore.DeleteExpired(ctx, kind, batchSize)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+		l.WithFields(logrus.Fields{"kind": kind, "deleted": deleted}).Info("swept expired entities")
+	}
+	return total, nil
+}
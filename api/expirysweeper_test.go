@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"testing"
+)
+
+func TestExpirySweeper_Sweep(t *testing.T) {
+	t.Parallel()
+
+	var kinds []string
+	ps := testhelpers.NewPersistentStore(t)
+	ps.DeleteExpiredFunc = func(ctx context.Context, kind string, batchSize int) (int, error) {
+		kinds = append(kinds, kind)
+
+		if batchSize != DefaultSweepBatchSize {
+			t.Errorf("Expected batch size %d, got %d", DefaultSweepBatchSize, batchSize)
+		}
+		return len(kinds) * 10, nil
+	}
+
+	s := &ExpirySweeper{
+		PersistentStore: ps,
+		Kinds:           []string{"TokenUsage", "Bluh"},
+	}
+	deleted, err := s.Sweep(context.Background())
+	if err != nil {
+		t.Errorf("Expected nil error from Sweep, got '%s'", err)
+	}
+	if deleted != 30 {
+		t.Errorf("Expected %d deleted, got %d", 30, deleted)
+	}
+
+	expectedKinds := []string{"TokenUsage", "Bluh"}
+	if !reflect.DeepEqual(kinds, expectedKinds) {
+		t.Errorf("Expected kinds %v to be swept, got %v", expectedKinds, kinds)
+	}
+}
+
+func TestExpirySweeper_Sweep_DeleteExpiredErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	callCount := 0
+	ps := testhelpers.NewPersistentStore(t)
+	ps.DeleteExpiredFunc = func(ctx context.Context, kind string, batchSize int) (int, error) {
+		callCount++
+
+		if batchSize != 7 {
+			t.Errorf("Expected batch size %d, got %d", 7, batchSize)
+		}
+		return 3, expectedErr
+	}
+
+	s := &ExpirySweeper{
+		PersistentStore: ps,
+		Kinds:           []string{"TokenUsage", "Bluh"},
+		BatchSize:       7,
+	}
+	deleted, err := s.Sweep(context.Background())
+	if err != expectedErr {
+		t.Errorf("Expected error '%s' from Sweep, got '%s'", expectedErr, err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected %d deleted, got %d", 3, deleted)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected DeleteExpired to be called %d times, called %d times", 1, callCount)
+	}
+}
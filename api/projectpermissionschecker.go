@@ -13,37 +13,101 @@ type ProjectPermissionChecker struct {
 	PersistentStore    PersistentStore
 	UserService        UserService
 	TokenAuthenticator *TokenAuthenticator
+
+	// Caches whether users and tokens are authorised, if set.
+	// Changes made by other processes are not seen until entries expire, so its TTL should be short.
+	AuthCache LocalCache
 }
 
 func (pc *ProjectPermissionChecker) CheckRead(ctx context.Context, kind, key string) (bool, error) {
 	escapedProject := strings.Split(key, "/")[0]
 
+	var keys []data.EntityKey
 	if pc.UserService != nil {
 		user := pc.UserService.ContextUser(ctx)
 		if user != "" {
-			_, err := pc.PersistentStore.Get(ctx, "ProjectAuth", escapedProject+"/user/"+url.PathEscape(user), nil)
-			if err == nil {
-				return true, nil
-			}
-			if err != data.ErrNoSuchEntity {
-				return false, err
-			}
+			keys = append(keys, data.EntityKey{Kind: "ProjectAuth", Key: escapedProject + "/user/" + url.PathEscape(user)})
 		}
 	}
 
 	if pc.TokenAuthenticator != nil {
 		token := pc.TokenAuthenticator.GetToken(ctx)
 		if token != "" {
-			_, err := pc.PersistentStore.Get(ctx, "ProjectAuth", escapedProject+"/token/"+url.PathEscape(token), nil)
-			if err == nil {
-				return true, nil
-			}
-			if err != data.ErrNoSuchEntity {
-				return false, err
+			keys = append(keys, data.EntityKey{Kind: "ProjectAuth", Key: escapedProject + "/token/" + url.PathEscape(token)})
+		}
+	}
+
+	if len(keys) == 0 {
+		return false, nil
+	}
+
+	if pc.AuthCache != nil {
+		return pc.checkCached(ctx, keys)
+	}
+
+	// The user and token are looked up in a single batch; either being authorised is sufficient.
+	_, err := pc.PersistentStore.GetMulti(ctx, keys, nil)
+	if err == nil {
+		return true, nil
+	}
+
+	errs, ok := err.(data.MultiError)
+	if !ok {
+		return false, err
+	}
+	for _, err := range errs {
+		if err == nil {
+			return true, nil
+		}
+	}
+	for _, err := range errs {
+		if err != data.ErrNoSuchEntity {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Checks whether any of the given ProjectAuth entities exist, using the cache where possible.
+// Entities not cached are looked up in a single batch.
+func (pc *ProjectPermissionChecker) checkCached(ctx context.Context, keys []data.EntityKey) (bool, error) {
+	cacheKeys := make([]string, 0, len(keys))
+	for _, k := range keys {
+		cacheKeys = append(cacheKeys, k.Key)
+	}
+
+	authorised, err := pc.AuthCache.LoadMulti(cacheKeys, func(missKeys []string) ([]interface{}, error) {
+		entityKeys := make([]data.EntityKey, 0, len(missKeys))
+		for _, k := range missKeys {
+			entityKeys = append(entityKeys, data.EntityKey{Kind: "ProjectAuth", Key: k})
+		}
+
+		results := make([]interface{}, len(missKeys))
+		_, err := pc.PersistentStore.GetMulti(ctx, entityKeys, nil)
+		errs, ok := err.(data.MultiError)
+		if err != nil && !ok {
+			return nil, err
+		}
+		for i := range results {
+			if errs == nil || errs[i] == nil {
+				results[i] = true
+			} else if errs[i] == data.ErrNoSuchEntity {
+				results[i] = false
+			} else {
+				return nil, errs[i]
 			}
 		}
+		return results, nil
+	})
+	if err != nil {
+		return false, err
 	}
 
+	for _, a := range authorised {
+		if a.(bool) {
+			return true, nil
+		}
+	}
 	return false, nil
 }
 
@@ -60,11 +124,80 @@ func (pc *ProjectPermissionChecker) CreateToken(ctx context.Context, project str
 
 	token := base64.URLEncoding.EncodeToString(rawToken)
 
+	// Tokens are labelled with their project so they can be listed.
+	properties := []data.Property{
+		{
+			Name:  "Project",
+			Value: project,
+		},
+		{
+			Name:  "Type",
+			Value: "token",
+		},
+	}
+
 	escapedProject := url.PathEscape(project)
-	err = pc.PersistentStore.Set(ctx, "ProjectAuth", escapedProject+"/token/"+url.PathEscape(token), nil, nil)
+	err = pc.PersistentStore.Set(ctx, "ProjectAuth", escapedProject+"/token/"+url.PathEscape(token), properties, nil)
+	pc.ForgetToken(project, token)
 	if err != nil {
 		return "", err
 	}
 
 	return token, nil
 }
+
+// Revokes a token's access to a project.
+// Other processes may continue to accept the token until their cached authorisation expires.
+func (pc *ProjectPermissionChecker) RevokeToken(ctx context.Context, project, token string) error {
+	err := pc.PersistentStore.Delete(ctx, "ProjectAuth", url.PathEscape(project)+"/token/"+url.PathEscape(token))
+	pc.ForgetToken(project, token)
+	return err
+}
+
+// Drops any cached authorisation of a token for a project.
+// This must be called whenever a token's authorisation is changed other than through this checker.
+func (pc *ProjectPermissionChecker) ForgetToken(project, token string) {
+	if pc.AuthCache != nil {
+		pc.AuthCache.Remove(url.PathEscape(project) + "/token/" + url.PathEscape(token))
+	}
+}
+
+// Drops any cached authorisation of a user for a project.
+// This must be called whenever a user's authorisation is changed.
+func (pc *ProjectPermissionChecker) ForgetUser(project, user string) {
+	if pc.AuthCache != nil {
+		pc.AuthCache.Remove(url.PathEscape(project) + "/user/" + url.PathEscape(user))
+	}
+}
+
+// Lists the tokens created for a project, a page at a time.
+// Tokens created before tokens were labelled with their project are not listed.
+func (pc *ProjectPermissionChecker) ListTokens(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+	results, nextCursor, err := pc.PersistentStore.Query(ctx, data.Query{
+		Kind: "ProjectAuth",
+		Filters: []data.Filter{
+			{Property: "Project", Op: data.FilterEqual, Value: project},
+			{Property: "Type", Op: data.FilterEqual, Value: "token"},
+		},
+		Limit:  data.PageSize(pageSize),
+		Cursor: cursor,
+	})
+	if err != nil {
+		return data.Page{}, err
+	}
+
+	keyPrefix := url.PathEscape(project) + "/token/"
+	tokens := make([]string, 0, len(results))
+	for _, r := range results {
+		token, err := url.PathUnescape(strings.TrimPrefix(r.Key, keyPrefix))
+		if err != nil {
+			return data.Page{}, err
+		}
+		tokens = append(tokens, token)
+	}
+
+	return data.Page{
+		Items:      tokens,
+		NextCursor: nextCursor,
+	}, nil
+}
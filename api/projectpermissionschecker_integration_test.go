@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/memstore"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestProjectPermissionChecker_Integration_Token(t *testing.T) {
+	t.Parallel()
+
+	ds := &memstore.Datastore{}
+	ta := &TokenAuthenticator{}
+	pc := &ProjectPermissionChecker{
+		PersistentStore: &memstore.PersistentStore{
+			Datastore: ds,
+			Namespace: "auth",
+		},
+		TokenAuthenticator: ta,
+	}
+	projectStore := &memstore.PersistentStore{
+		Datastore:         ds,
+		PermissionChecker: pc,
+	}
+
+	token, err := pc.CreateToken(context.Background(), "foo")
+	if err != nil {
+		t.Fatalf("Unexpected error from CreateToken: %s", err)
+	}
+
+	tokenCtx := func(token string) context.Context {
+		formValues := make(url.Values)
+		formValues.Add("apitoken", token)
+		ctx, err := ta.MakeContext(&http.Request{Form: formValues})
+		if err != nil {
+			t.Fatalf("Unexpected error from MakeContext: %s", err)
+		}
+		return ctx
+	}
+	ctx := tokenCtx(token)
+
+	err = projectStore.Set(ctx, "Data", "foo/bar", nil, nil)
+	if err != nil {
+		t.Errorf("Expected nil error setting entity in token's project, got '%s'", err)
+	}
+	_, err = projectStore.Get(ctx, "Data", "foo/bar", nil)
+	if err != nil {
+		t.Errorf("Expected nil error getting entity in token's project, got '%s'", err)
+	}
+
+	err = projectStore.Set(ctx, "Data", "baz/bar", nil, nil)
+	if err != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' setting entity in other project, got '%s'", data.ErrWriteAccessDenied, err)
+	}
+
+	otherCtx := tokenCtx("bluh")
+	_, err = projectStore.Get(otherCtx, "Data", "foo/bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' getting entity with unknown token, got '%s'", data.ErrNoSuchEntity, err)
+	}
+}
+
+func TestProjectPermissionChecker_Integration_ListTokens(t *testing.T) {
+	t.Parallel()
+
+	pc := &ProjectPermissionChecker{
+		PersistentStore: &memstore.PersistentStore{
+			Datastore: &memstore.Datastore{},
+		},
+	}
+
+	expectedTokens := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		token, err := pc.CreateToken(context.Background(), "foo")
+		if err != nil {
+			t.Fatalf("Unexpected error from CreateToken: %s", err)
+		}
+		expectedTokens[token] = true
+	}
+	_, err := pc.CreateToken(context.Background(), "bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from CreateToken: %s", err)
+	}
+
+	listedTokens := make(map[string]bool)
+	cursor := ""
+	for pages := 1; ; pages++ {
+		page, err := pc.ListTokens(context.Background(), "foo", cursor, 2)
+		if err != nil {
+			t.Fatalf("Unexpected error from ListTokens: %s", err)
+		}
+		for _, token := range page.Items.([]string) {
+			listedTokens[token] = true
+		}
+
+		cursor = page.NextCursor
+		if cursor == "" {
+			if pages != 2 {
+				t.Errorf("Expected %d pages of tokens, got %d", 2, pages)
+			}
+			break
+		}
+	}
+
+	if !reflect.DeepEqual(listedTokens, expectedTokens) {
+		t.Errorf("Expected listed tokens %v, got %v", expectedTokens, listedTokens)
+	}
+}
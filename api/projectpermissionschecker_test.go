@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/lru"
 	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -32,7 +34,7 @@ func TestProjectPermissionsChecker_CheckRead_User_None(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
 		getCalled = true
 		return nil, nil
 	}
@@ -64,7 +66,7 @@ func TestProjectPermissionsChecker_CheckRead_User_None(t *testing.T) {
 	}
 
 	if getCalled {
-		t.Error("Expected get function to not be called, was called")
+		t.Error("Expected get multi function to not be called, was called")
 	}
 
 	if !contextUserCalled {
@@ -79,7 +81,12 @@ func TestProjectPermissionsChecker_CheckRead_User_Ok(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -95,7 +102,7 @@ func TestProjectPermissionsChecker_CheckRead_User_Ok(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
@@ -129,7 +136,7 @@ func TestProjectPermissionsChecker_CheckRead_User_Ok(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 
 	if !contextUserCalled {
@@ -144,7 +151,12 @@ func TestProjectPermissionsChecker_CheckRead_User_Escaped(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -160,7 +172,7 @@ func TestProjectPermissionsChecker_CheckRead_User_Escaped(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
@@ -194,7 +206,7 @@ func TestProjectPermissionsChecker_CheckRead_User_Escaped(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 
 	if !contextUserCalled {
@@ -209,7 +221,12 @@ func TestProjectPermissionsChecker_CheckRead_User_NotOk(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -225,11 +242,11 @@ func TestProjectPermissionsChecker_CheckRead_User_NotOk(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
-		return nil, data.ErrNoSuchEntity
+		return nil, data.MultiError{data.ErrNoSuchEntity}
 	}
 
 	contextUserCalled := false
@@ -259,7 +276,7 @@ func TestProjectPermissionsChecker_CheckRead_User_NotOk(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 
 	if !contextUserCalled {
@@ -275,7 +292,12 @@ func TestProjectPermissionsChecker_CheckRead_User_Err(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -291,11 +313,11 @@ func TestProjectPermissionsChecker_CheckRead_User_Err(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
-		return nil, expectedError
+		return nil, data.MultiError{expectedError}
 	}
 
 	contextUserCalled := false
@@ -325,7 +347,7 @@ func TestProjectPermissionsChecker_CheckRead_User_Err(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 
 	if !contextUserCalled {
@@ -341,7 +363,12 @@ func TestProjectPermissionsChecker_CheckRead_Token_Ok(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -357,7 +384,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_Ok(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
@@ -382,7 +409,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_Ok(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 }
 
@@ -394,7 +421,12 @@ func TestProjectPermissionsChecker_CheckRead_Token_Escaped(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -410,7 +442,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_Escaped(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
@@ -435,7 +467,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_Escaped(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 }
 
@@ -446,7 +478,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_None(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
 		getCalled = true
 		return nil, nil
 	}
@@ -469,7 +501,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_None(t *testing.T) {
 	}
 
 	if getCalled {
-		t.Error("Expected get function to not be called, was called")
+		t.Error("Expected get multi function to not be called, was called")
 	}
 }
 
@@ -481,7 +513,12 @@ func TestProjectPermissionsChecker_CheckRead_Token_NotOk(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -497,11 +534,11 @@ func TestProjectPermissionsChecker_CheckRead_Token_NotOk(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
-		return nil, data.ErrNoSuchEntity
+		return nil, data.MultiError{data.ErrNoSuchEntity}
 	}
 
 	a := &TokenAuthenticator{}
@@ -522,7 +559,7 @@ func TestProjectPermissionsChecker_CheckRead_Token_NotOk(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
 	}
 }
 
@@ -535,7 +572,12 @@ func TestProjectPermissionsChecker_CheckRead_Token_Err(t *testing.T) {
 
 	getCalled := false
 	ps := testhelpers.NewPersistentStore(t)
-	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		if len(keys) != 1 {
+			t.Fatalf("Expected store get of %d keys, was %d", 1, len(keys))
+		}
+		kind, key := keys[0].Kind, keys[0].Key
+
 		if ctx != expectedContext {
 			t.Error("Context was not expected context")
 		}
@@ -551,11 +593,11 @@ func TestProjectPermissionsChecker_CheckRead_Token_Err(t *testing.T) {
 		}
 
 		if v != nil {
-			t.Error("Expected nil content, got non-nil content")
+			t.Error("Expected nil contents, got non-nil contents")
 		}
 
 		getCalled = true
-		return nil, expectedError
+		return nil, data.MultiError{expectedError}
 	}
 
 	a := &TokenAuthenticator{}
@@ -576,7 +618,101 @@ func TestProjectPermissionsChecker_CheckRead_Token_Err(t *testing.T) {
 	}
 
 	if !getCalled {
-		t.Error("Expected get function to be called, was not called")
+		t.Error("Expected get multi function to be called, was not called")
+	}
+}
+
+func TestProjectPermissionsChecker_CheckRead_UserAndToken(t *testing.T) {
+	expectedError := errors.New("bluh")
+
+	testCases := []struct {
+		Label       string
+		Errs        data.MultiError
+		ExpectedOk  bool
+		ExpectedErr error
+	}{
+		{
+			Label:      "BothOk",
+			ExpectedOk: true,
+		},
+		{
+			Label:      "UserOk",
+			Errs:       data.MultiError{nil, data.ErrNoSuchEntity},
+			ExpectedOk: true,
+		},
+		{
+			Label:      "TokenOk",
+			Errs:       data.MultiError{data.ErrNoSuchEntity, nil},
+			ExpectedOk: true,
+		},
+		{
+			Label:      "NeitherOk",
+			Errs:       data.MultiError{data.ErrNoSuchEntity, data.ErrNoSuchEntity},
+			ExpectedOk: false,
+		},
+		{
+			Label:       "TokenErr",
+			Errs:        data.MultiError{data.ErrNoSuchEntity, expectedError},
+			ExpectedOk:  false,
+			ExpectedErr: expectedError,
+		},
+		{
+			Label:      "UserErrTokenOk",
+			Errs:       data.MultiError{expectedError, nil},
+			ExpectedOk: true,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			expectedContext := context.WithValue(context.Background(), "apitoken", "bluh")
+
+			getCallCount := 0
+			ps := testhelpers.NewPersistentStore(t)
+			ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+				getCallCount++
+
+				expectedKeys := []data.EntityKey{
+					{Kind: "ProjectAuth", Key: "bar/user/superman"},
+					{Kind: "ProjectAuth", Key: "bar/token/bluh"},
+				}
+				if !reflect.DeepEqual(keys, expectedKeys) {
+					t.Errorf("Expected store get keys %v, was %v", expectedKeys, keys)
+				}
+
+				if testCase.Errs == nil {
+					return make([][]data.Property, 2), nil
+				}
+				return make([][]data.Property, 2), testCase.Errs
+			}
+
+			us := testhelpers.NewUserService(t)
+			us.ContextUserFunc = func(ctx context.Context) string {
+				return "superman"
+			}
+
+			pc := &ProjectPermissionChecker{
+				PersistentStore:    ps,
+				UserService:        us,
+				TokenAuthenticator: &TokenAuthenticator{},
+			}
+			ok, err := pc.CheckRead(expectedContext, "foo", "bar/baz")
+
+			if ok != testCase.ExpectedOk {
+				t.Errorf("Permission check response was expected to be %v, was %v", testCase.ExpectedOk, ok)
+			}
+
+			if err != testCase.ExpectedErr {
+				t.Errorf("Expected err from check '%v', got '%v'", testCase.ExpectedErr, err)
+			}
+
+			if getCallCount != 1 {
+				t.Errorf("Expected get multi function to be called %d times, was called %d times", 1, getCallCount)
+			}
+		})
 	}
 }
 
@@ -624,6 +760,14 @@ func TestProjectPermissionsChecker_CreateToken_Ok(t *testing.T) {
 			t.Errorf("Expected store set key token to be random 40 hex chars, token was %v", setToken)
 		}
 
+		expectedProperties := []data.Property{
+			{Name: "Project", Value: "bar"},
+			{Name: "Type", Value: "token"},
+		}
+		if !reflect.DeepEqual(properties, expectedProperties) {
+			t.Errorf("Expected store set properties %v, was %v", expectedProperties, properties)
+		}
+
 		setCalled = true
 		return nil
 	}
@@ -707,3 +851,213 @@ func TestProjectPermissionsChecker_CreateToken_Err(t *testing.T) {
 		t.Error("Expected set function to be called, was not called")
 	}
 }
+
+func TestProjectPermissionsChecker_ListTokens_Ok(t *testing.T) {
+	t.Parallel()
+
+	expectedContext := context.Background()
+
+	queryCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+	ps.QueryFunc = func(ctx context.Context, q data.Query) (results []data.QueryResult, cursor string, e error) {
+		if ctx != expectedContext {
+			t.Error("Context was not expected context")
+		}
+
+		expectedQuery := data.Query{
+			Kind: "ProjectAuth",
+			Filters: []data.Filter{
+				{Property: "Project", Op: data.FilterEqual, Value: "a/b"},
+				{Property: "Type", Op: data.FilterEqual, Value: "token"},
+			},
+			Limit:  10,
+			Cursor: "cursor1",
+		}
+		if !reflect.DeepEqual(q, expectedQuery) {
+			t.Errorf("Expected store query %v, was %v", expectedQuery, q)
+		}
+
+		queryCalled = true
+		return []data.QueryResult{
+			{Key: "a%2Fb/token/foo"},
+			{Key: "a%2Fb/token/%2Fbar%2F"},
+		}, "cursor2", nil
+	}
+
+	pc := &ProjectPermissionChecker{
+		PersistentStore: ps,
+	}
+	page, err := pc.ListTokens(expectedContext, "a/b", "cursor1", 10)
+
+	if err != nil {
+		t.Errorf("Unexpected non-nil err from ListTokens: %v", err)
+	}
+
+	expectedPage := data.Page{
+		Items:      []string{"foo", "/bar/"},
+		NextCursor: "cursor2",
+	}
+	if !reflect.DeepEqual(page, expectedPage) {
+		t.Errorf("Expected page %v, got %v", expectedPage, page)
+	}
+
+	if !queryCalled {
+		t.Error("Expected query function to be called, was not called")
+	}
+}
+
+func TestProjectPermissionsChecker_ListTokens_PageSize(t *testing.T) {
+	testCases := []struct {
+		Label         string
+		PageSize      int
+		ExpectedLimit int
+	}{
+		{
+			Label:         "Default",
+			PageSize:      0,
+			ExpectedLimit: data.DefaultPageSize,
+		},
+		{
+			Label:         "Capped",
+			PageSize:      data.MaxPageSize + 1,
+			ExpectedLimit: data.MaxPageSize,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ps := testhelpers.NewPersistentStore(t)
+			ps.QueryFunc = func(ctx context.Context, q data.Query) (results []data.QueryResult, cursor string, e error) {
+				if q.Limit != testCase.ExpectedLimit {
+					t.Errorf("Expected store query limit %d, was %d", testCase.ExpectedLimit, q.Limit)
+				}
+				return nil, "", nil
+			}
+
+			pc := &ProjectPermissionChecker{
+				PersistentStore: ps,
+			}
+			page, err := pc.ListTokens(context.Background(), "bar", "", testCase.PageSize)
+
+			if err != nil {
+				t.Errorf("Unexpected non-nil err from ListTokens: %v", err)
+			}
+
+			expectedPage := data.Page{
+				Items: []string{},
+			}
+			if !reflect.DeepEqual(page, expectedPage) {
+				t.Errorf("Expected page %v, got %v", expectedPage, page)
+			}
+		})
+	}
+}
+
+func TestProjectPermissionsChecker_ListTokens_Err(t *testing.T) {
+	t.Parallel()
+
+	expectedError := errors.New("blah")
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.QueryFunc = func(ctx context.Context, q data.Query) (results []data.QueryResult, cursor string, e error) {
+		return nil, "", expectedError
+	}
+
+	pc := &ProjectPermissionChecker{
+		PersistentStore: ps,
+	}
+	_, err := pc.ListTokens(context.Background(), "bar", "", 0)
+
+	if err != expectedError {
+		t.Errorf("Expected err from ListTokens '%v' got '%v'", expectedError, err)
+	}
+}
+
+func TestProjectPermissionsChecker_CheckRead_Cached(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.WithValue(context.Background(), "apitoken", "bluh")
+
+	getMultiCount := 0
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCount++
+
+		expectedKeys := []data.EntityKey{{Kind: "ProjectAuth", Key: "bar/token/bluh"}}
+		if !reflect.DeepEqual(keys, expectedKeys) {
+			t.Errorf("Expected keys %v, got %v", expectedKeys, keys)
+		}
+		return nil, data.MultiError{data.ErrNoSuchEntity}
+	}
+	ps.DeleteFunc = func(ctx context.Context, kind, key string) error {
+		return nil
+	}
+
+	pc := &ProjectPermissionChecker{
+		PersistentStore:    ps,
+		TokenAuthenticator: &TokenAuthenticator{},
+		AuthCache:          &lru.Cache{},
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, err := pc.CheckRead(ctx, "foo", "bar/baz")
+		if ok {
+			t.Error("Expected permission check to fail")
+		}
+		if err != nil {
+			t.Errorf("Unexpected non-nil err from check: %v", err)
+		}
+	}
+	if getMultiCount != 1 {
+		t.Errorf("Expected get multi to be called %d times, called %d times", 1, getMultiCount)
+	}
+
+	err := pc.RevokeToken(context.Background(), "bar", "bluh")
+	if err != nil {
+		t.Errorf("Unexpected non-nil err from revoke: %v", err)
+	}
+
+	_, err = pc.CheckRead(ctx, "foo", "bar/baz")
+	if err != nil {
+		t.Errorf("Unexpected non-nil err from check: %v", err)
+	}
+	if getMultiCount != 2 {
+		t.Errorf("Expected revocation to drop cached authorisation, get multi called %d times", getMultiCount)
+	}
+}
+
+func TestProjectPermissionsChecker_CheckRead_Cached_Err(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.WithValue(context.Background(), "apitoken", "bluh")
+
+	expectedErr := errors.New("bluh")
+	getMultiCount := 0
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetMultiFunc = func(ctx context.Context, keys []data.EntityKey, v []interface{}) (properties [][]data.Property, e error) {
+		getMultiCount++
+		return nil, data.MultiError{expectedErr}
+	}
+
+	pc := &ProjectPermissionChecker{
+		PersistentStore:    ps,
+		TokenAuthenticator: &TokenAuthenticator{},
+		AuthCache:          &lru.Cache{},
+	}
+
+	for i := 0; i < 2; i++ {
+		ok, err := pc.CheckRead(ctx, "foo", "bar/baz")
+		if ok {
+			t.Error("Expected permission check to fail")
+		}
+		if err != expectedErr {
+			t.Errorf("Expected err %v from check, got %v", expectedErr, err)
+		}
+	}
+	if getMultiCount != 2 {
+		t.Errorf("Expected errors not to be cached, get multi called %d times", getMultiCount)
+	}
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"net/url"
+)
+
+// ProjectValueStore holds named string values belonging to projects, as an example of project-scoped data.
+// Access control is left to PersistentStore, which should check permission with a ProjectPermissionChecker;
+// values are keyed by their project first, so a token may only reach its own project's values.
+type ProjectValueStore struct {
+	PersistentStore PersistentStore
+}
+
+// Gets a project's value. If it doesn't exist, or isn't readable, data.ErrNoSuchEntity is returned.
+func (s *ProjectValueStore) GetValue(ctx context.Context, project, name string) (string, error) {
+	var value string
+	_, err := s.PersistentStore.Get(ctx, "ProjectValue", projectValueKey(project, name), &value)
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// Sets a project's value. If it isn't writable, data.ErrWriteAccessDenied is returned.
+func (s *ProjectValueStore) SetValue(ctx context.Context, project, name, value string) error {
+	return s.PersistentStore.Set(ctx, "ProjectValue", projectValueKey(project, name), nil, &value)
+}
+
+func projectValueKey(project, name string) string {
+	return url.PathEscape(project) + "/" + url.PathEscape(name)
+}
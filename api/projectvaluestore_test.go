@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"testing"
+)
+
+func TestProjectValueStore_GetValue(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error) {
+		if kind != "ProjectValue" {
+			t.Errorf("Expected kind '%s', got '%s'", "ProjectValue", kind)
+		}
+		if key != "foo%2Fbar/baz%2Fbluh" {
+			t.Errorf("Expected key '%s', got '%s'", "foo%2Fbar/baz%2Fbluh", key)
+		}
+		*v.(*string) = "value"
+		return nil, nil
+	}
+
+	s := &ProjectValueStore{PersistentStore: ps}
+	value, err := s.GetValue(context.Background(), "foo/bar", "baz/bluh")
+	if err != nil {
+		t.Errorf("Expected nil error from GetValue, got '%s'", err)
+	}
+	if value != "value" {
+		t.Errorf("Expected value '%s', got '%s'", "value", value)
+	}
+}
+
+func TestProjectValueStore_GetValue_GetErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error) {
+		return nil, expectedErr
+	}
+
+	s := &ProjectValueStore{PersistentStore: ps}
+	_, err := s.GetValue(context.Background(), "foo", "bar")
+	if err != expectedErr {
+		t.Errorf("Expected error '%s' from GetValue, got '%v'", expectedErr, err)
+	}
+}
+
+func TestProjectValueStore_SetValue(t *testing.T) {
+	t.Parallel()
+
+	called := false
+	ps := testhelpers.NewPersistentStore(t)
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		called = true
+		if kind != "ProjectValue" {
+			t.Errorf("Expected kind '%s', got '%s'", "ProjectValue", kind)
+		}
+		if key != "foo/bar" {
+			t.Errorf("Expected key '%s', got '%s'", "foo/bar", key)
+		}
+		if *v.(*string) != "value" {
+			t.Errorf("Expected value '%s', got '%s'", "value", *v.(*string))
+		}
+		return nil
+	}
+
+	s := &ProjectValueStore{PersistentStore: ps}
+	err := s.SetValue(context.Background(), "foo", "bar", "value")
+	if err != nil {
+		t.Errorf("Expected nil error from SetValue, got '%s'", err)
+	}
+	if !called {
+		t.Error("Expected Set to be called, was not called")
+	}
+}
+
+func TestProjectValueStore_SetValue_SetErr(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		return data.ErrWriteAccessDenied
+	}
+
+	s := &ProjectValueStore{PersistentStore: ps}
+	err := s.SetValue(context.Background(), "foo", "bar", "value")
+	if err != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' from SetValue, got '%v'", data.ErrWriteAccessDenied, err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 type ContextMaker interface {
@@ -18,9 +19,41 @@ type UserService interface {
 type PersistentStore interface {
 	Get(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error)
 	Set(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error
+	SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error
+	GetWithVersion(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error)
+	SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error)
+	GetMulti(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error)
+	SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error
+	Delete(ctx context.Context, kind, key string) error
+	DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error)
+	Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error)
 	Transact(ctx context.Context, f func(ctx context.Context) error) error
+	TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error
+}
+
+// UsageCounter holds counters which can be updated atomically, without transactions,
+// along with values which can be replaced atomically, recording when counters were last flushed.
+type UsageCounter interface {
+	IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error)
+	IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error)
+	Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+	Delete(ctx context.Context, key string) error
+	GetForCAS(ctx context.Context, key string, v interface{}) (data.CASToken, error)
+	CompareAndSwap(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error
+}
+
+// EndpointMapper maps URL paths to the endpoints they are billed as, returning an empty string for other paths.
+type EndpointMapper interface {
+	Endpoint(path string) string
 }
 
 type TokenBiller interface {
 	Bill(ctx context.Context, token string, url *url.URL) error
 }
+
+// LocalCache is a process-local cache, deduplicating concurrent loads of the same key.
+type LocalCache interface {
+	Load(key string, load func() (interface{}, error)) (interface{}, error)
+	LoadMulti(keys []string, load func(keys []string) ([]interface{}, error)) ([]interface{}, error)
+	Remove(key string)
+}
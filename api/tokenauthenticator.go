@@ -2,8 +2,8 @@ package api
 
 import (
 	"context"
-	"errors"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"net/http"
 )
 
@@ -26,8 +26,8 @@ func (a *TokenAuthenticator) MakeContext(r *http.Request) (context.Context, erro
 
 	_ = r.ParseForm()
 	if len(r.Form["apitoken"]) != 1 {
-		ctxlogrus.Get(wrappedCtx).Error("expected exactly one api token for an API request")
-		return nil, errors.New("expected exactly one api token for an API request")
+		ctxlogrus.Get(wrappedCtx).Info(data.ErrInvalidApiToken)
+		return nil, data.ErrInvalidApiToken
 	}
 	token := r.Form["apitoken"][0]
 
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
 	"net/http"
 	"net/url"
@@ -57,8 +58,8 @@ func TestTokenAuthenticator_MakeContext_NoToken(t *testing.T) {
 	r := &http.Request{}
 	a := &TokenAuthenticator{}
 	_, err := a.MakeContext(r)
-	if err == nil {
-		t.Error("Expected non-nil error, got nil error")
+	if err != data.ErrInvalidApiToken {
+		t.Errorf("Expected error '%s', got '%v'", data.ErrInvalidApiToken, err)
 	}
 }
 
@@ -72,8 +73,8 @@ func TestTokenAuthenticator_MakeContext_MultipleTokens(t *testing.T) {
 	r := &http.Request{Form: formValues}
 	a := &TokenAuthenticator{}
 	_, err := a.MakeContext(r)
-	if err == nil {
-		t.Error("Expected non-nil error, got nil error")
+	if err != data.ErrInvalidApiToken {
+		t.Errorf("Expected error '%s', got '%v'", data.ErrInvalidApiToken, err)
 	}
 }
 
@@ -0,0 +1,32 @@
+package clouddatastore
+
+import (
+	"cloud.google.com/go/datastore"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/datastoreutil"
+)
+
+// Cursors are signed, so clients can't forge cursors or reuse them against queries of another kind or namespace.
+func (ps *PersistentStore) encodeCursor(kind string, c datastore.Cursor) (string, error) {
+	return ps.cursorSigner().Sign(kind, c.String())
+}
+
+func (ps *PersistentStore) decodeCursor(kind, cursor string) (datastore.Cursor, error) {
+	raw, err := ps.cursorSigner().Verify(kind, cursor)
+	if err != nil {
+		return datastore.Cursor{}, err
+	}
+
+	c, err := datastore.DecodeCursor(raw)
+	if err != nil {
+		return datastore.Cursor{}, data.ErrInvalidCursor
+	}
+	return c, nil
+}
+
+func (ps *PersistentStore) cursorSigner() datastoreutil.CursorSigner {
+	return datastoreutil.CursorSigner{
+		Key:       ps.CursorKey,
+		Namespace: ps.Namespace,
+	}
+}
@@ -0,0 +1,655 @@
+package clouddatastore
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/datastoreutil"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"strings"
+	"time"
+)
+
+// PersistentStore stores entities in Cloud Datastore, for use outside App Engine.
+// It stores entities exactly as aengine.PersistentStore does, so either can read entities written by the other.
+type PersistentStore struct {
+	Client            *datastore.Client
+	Prefix            string
+	PermissionChecker PermissionChecker
+	Namespace         string
+
+	// Key used to sign query cursors handed out to clients.
+	// Queries requiring a cursor fail if unset.
+	CursorKey []byte
+
+	// Controls how content is serialized, and how content written under older schemas is migrated on read.
+	ContentFormat data.ContentFormat
+}
+
+// Holds the *transaction operations within Transact must be made through.
+type transactionKey struct{}
+
+// A transaction, along with the client it was started on, as only stores using that client may take part in it.
+type transaction struct {
+	client *datastore.Client
+	tx     *datastore.Transaction
+}
+
+func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content interface{}) ([]data.Property, error) {
+	properties, _, err := ps.GetWithVersion(ctx, kind, key, content)
+	return properties, err
+}
+
+// Gets an entity along with its current version, for use with SetIfVersion.
+// Entities last written before versions were introduced have version zero.
+func (ps *PersistentStore) GetWithVersion(ctx context.Context, kind, key string, content interface{}) ([]data.Property, int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key}).Debug("datastore get")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckRead(ctx, kind, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// If permission is denied we simulate the non-existence of the entity.
+		// This provides robustness against enumeration attacks by default.
+		if !ok {
+			return nil, 0, data.ErrNoSuchEntity
+		}
+	}
+
+	var dsProperties datastore.PropertyList
+	err := ps.get(ctx, ps.makeKey(kind, key), &dsProperties)
+	if err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, 0, data.ErrNoSuchEntity
+		}
+		return nil, 0, errors.Wrap(err, "")
+	}
+
+	return entityFromDatastore(ps.ContentFormat, kind, key, dsProperties, content)
+}
+
+func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties []data.Property, content interface{}) error {
+	return ps.SetWithExpiry(ctx, kind, key, time.Time{}, properties, content)
+}
+
+// Sets an entity which is treated as not existing once expiry has passed, until it is removed by DeleteExpired.
+// A zero expiry never expires.
+func (ps *PersistentStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, content interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key, "expiry": expiry}).Debug("datastore set")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	version, err := data.NewVersion()
+	if err != nil {
+		return err
+	}
+	dsProperties, err := entityToDatastore(ps.ContentFormat, kind, key, properties, content, version, expiry)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(ps.put(ctx, ps.makeKey(kind, key), dsProperties), "")
+}
+
+// Sets an entity only if its current version is the expected version, returning its new version.
+// An expected version of zero requires that the entity not exist, or have been last written before versions were introduced.
+// If the version does not match, a *data.VersionConflictError is returned.
+func (ps *PersistentStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, content interface{}) (int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key, "version": version}).Debug("datastore set if version")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			return 0, data.ErrWriteAccessDenied
+		}
+	}
+
+	newVersion, err := data.NewVersion()
+	if err != nil {
+		return 0, err
+	}
+	dsProperties, err := entityToDatastore(ps.ContentFormat, kind, key, properties, content, newVersion, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	k := ps.makeKey(kind, key)
+	err = ps.runInTransaction(ctx, func(ctx context.Context) error {
+		var current datastore.PropertyList
+		err := ps.get(ctx, k, &current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		stored := propertiesFromDatastore(current)
+		actual := datastoreutil.Version(stored)
+		if datastoreutil.Expired(stored, time.Now()) {
+			actual = 0
+		}
+		if actual != version {
+			return &data.VersionConflictError{
+				Kind:     kind,
+				Key:      key,
+				Expected: version,
+				Actual:   actual,
+			}
+		}
+
+		return ps.put(ctx, k, dsProperties)
+	})
+	if err != nil {
+		if _, ok := err.(*data.VersionConflictError); ok {
+			return 0, err
+		}
+		if err == data.ErrConcurrentTransaction {
+			return 0, err
+		}
+		return 0, errors.Wrap(err, "")
+	}
+	return newVersion, nil
+}
+
+// Gets multiple entities in a single batch.
+// contents must be nil, or have one element per key, each being nil or a value to deserialize content into.
+// If any key fails, a data.MultiError is returned holding each key's error, alongside the results of those which succeeded.
+func (ps *PersistentStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	if contents != nil && len(contents) != len(keys) {
+		return nil, errors.New("contents param must be nil or the same length as keys")
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "count": len(keys)}).Debug("datastore get multi")
+
+	results := make([][]data.Property, len(keys))
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	var dsKeys []*datastore.Key
+	var indexes []int
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, k.Kind, k.Key)
+			if err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+
+			// As in Get, denied entities appear not to exist.
+			if !ok {
+				errs[i] = data.ErrNoSuchEntity
+				failed = true
+				continue
+			}
+		}
+
+		dsKeys = append(dsKeys, ps.makeKey(k.Kind, k.Key))
+		indexes = append(indexes, i)
+	}
+
+	dsProperties := make([]datastore.PropertyList, len(dsKeys))
+	err := ps.getMulti(ctx, dsKeys, dsProperties)
+	dsErrs, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return nil, errors.Wrap(err, "")
+	}
+
+	for j, i := range indexes {
+		if dsErrs != nil && dsErrs[j] != nil {
+			if dsErrs[j] == datastore.ErrNoSuchEntity {
+				errs[i] = data.ErrNoSuchEntity
+			} else {
+				errs[i] = errors.Wrap(dsErrs[j], "")
+			}
+			failed = true
+			continue
+		}
+
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		results[i], _, errs[i] = entityFromDatastore(ps.ContentFormat, keys[i].Kind, keys[i].Key, dsProperties[j], content)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Sets multiple entities in a single batch.
+// properties and contents must each be nil, or have one element per key.
+// If any key fails, a data.MultiError is returned holding each key's error; entities for other keys are still written.
+func (ps *PersistentStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, contents []interface{}) error {
+	if properties != nil && len(properties) != len(keys) {
+		return errors.New("properties param must be nil or the same length as keys")
+	}
+	if contents != nil && len(contents) != len(keys) {
+		return errors.New("contents param must be nil or the same length as keys")
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "count": len(keys)}).Debug("datastore set multi")
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	var dsKeys []*datastore.Key
+	var dsEntities []datastore.PropertyList
+	var indexes []int
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckWrite(ctx, k.Kind, k.Key)
+			if err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+
+			if !ok {
+				errs[i] = data.ErrWriteAccessDenied
+				failed = true
+				continue
+			}
+		}
+
+		var entityProperties []data.Property
+		if properties != nil {
+			entityProperties = properties[i]
+		}
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		version, err := data.NewVersion()
+		if err != nil {
+			return err
+		}
+		dsEntity, err := entityToDatastore(ps.ContentFormat, k.Kind, k.Key, entityProperties, content, version, time.Time{})
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		dsKeys = append(dsKeys, ps.makeKey(k.Kind, k.Key))
+		dsEntities = append(dsEntities, dsEntity)
+		indexes = append(indexes, i)
+	}
+
+	err := ps.putMulti(ctx, dsKeys, dsEntities)
+	dsErrs, isMulti := err.(datastore.MultiError)
+	if err != nil && !isMulti {
+		return errors.Wrap(err, "")
+	}
+
+	for j, i := range indexes {
+		if dsErrs != nil && dsErrs[j] != nil {
+			errs[i] = errors.Wrap(dsErrs[j], "")
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (ps *PersistentStore) Delete(ctx context.Context, kind, key string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key}).Debug("datastore delete")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	k := ps.makeKey(kind, key)
+	if tx := ps.transaction(ctx); tx != nil {
+		return errors.Wrap(tx.Delete(k), "")
+	}
+	return errors.Wrap(ps.Client.Delete(ctx, k), "")
+}
+
+// Deletes entities of a kind whose expiry has passed, returning how many were deleted.
+// Expired entities are found and deleted batchSize at a time, until none remain or the context is done.
+// Entities outside the store's prefix, or which the PermissionChecker denies writing, are left in place.
+// Deletion is not transactional, so expiry should be used for entities which are not rewritten once expired.
+func (ps *PersistentStore) DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, errors.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind}).Debug("datastore delete expired")
+
+	dsQuery := datastore.NewQuery(kind).Namespace(ps.Namespace).Filter("Expiry <=", time.Now()).KeysOnly()
+	it := ps.Client.Run(ctx, dsQuery)
+	deleted := 0
+	for {
+		var batch []*datastore.Key
+		done := false
+		for len(batch) < batchSize {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return deleted, errors.Wrap(err, "")
+			}
+
+			if !strings.HasPrefix(k.Name, ps.Prefix) {
+				continue
+			}
+			if ps.PermissionChecker != nil {
+				ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, strings.TrimPrefix(k.Name, ps.Prefix))
+				if err != nil {
+					return deleted, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			batch = append(batch, k)
+		}
+
+		if len(batch) > 0 {
+			err := ps.Client.DeleteMulti(ctx, batch)
+			if err != nil {
+				return deleted, errors.Wrap(err, "")
+			}
+			deleted += len(batch)
+			l.WithFields(logrus.Fields{"kind": kind, "count": len(batch)}).Debug("deleted expired batch")
+		}
+
+		if done {
+			return deleted, nil
+		}
+		if ctx.Err() != nil {
+			return deleted, errors.Wrap(ctx.Err(), "")
+		}
+	}
+}
+
+// Runs a query against entities of a kind, returning matching entities without their content,
+// along with a cursor to continue from, or an empty cursor if there are no more results.
+// Entities outside the store's prefix, or which the PermissionChecker denies reading, are omitted.
+// Queries are never part of a transaction, as Cloud Datastore only supports ancestor queries within them.
+func (ps *PersistentStore) Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": q.Kind}).Debug("datastore query")
+
+	dsQuery := datastore.NewQuery(q.Kind).Namespace(ps.Namespace)
+	for _, f := range q.Filters {
+		dsQuery = dsQuery.Filter(f.Property+" "+string(f.Op), f.Value)
+	}
+	for _, o := range q.Orders {
+		if o.Descending {
+			dsQuery = dsQuery.Order("-" + o.Property)
+		} else {
+			dsQuery = dsQuery.Order(o.Property)
+		}
+	}
+	if q.Cursor != "" {
+		c, err := ps.decodeCursor(q.Kind, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		dsQuery = dsQuery.Start(c)
+	}
+
+	// Results are filtered after retrieval, so we can't have the datastore apply the limit.
+	now := time.Now()
+	var results []data.QueryResult
+	it := ps.Client.Run(ctx, dsQuery)
+	for q.Limit == 0 || len(results) < q.Limit {
+		var dsProperties datastore.PropertyList
+		k, err := it.Next(&dsProperties)
+		if err == iterator.Done {
+			return results, "", nil
+		}
+		if err != nil {
+			return nil, "", errors.Wrap(err, "")
+		}
+
+		stored := propertiesFromDatastore(dsProperties)
+		if !strings.HasPrefix(k.Name, ps.Prefix) || datastoreutil.Expired(stored, now) {
+			continue
+		}
+		key := strings.TrimPrefix(k.Name, ps.Prefix)
+
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, q.Kind, key)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		results = append(results, data.QueryResult{
+			Key:        key,
+			Properties: datastoreutil.UserProperties(stored),
+		})
+	}
+
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "")
+	}
+	cursor, err := ps.encodeCursor(q.Kind, c)
+	if err != nil {
+		return nil, "", err
+	}
+	return results, cursor, nil
+}
+
+func (ps *PersistentStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return ps.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+// Runs f in a transaction with the given options.
+// If the transaction still conflicts after its attempts, data.ErrConcurrentTransaction is returned.
+// SingleGroup is ignored, as Cloud Datastore transactions are not limited by entity group.
+// Transactions can't be nested within one started on the same client.
+func (ps *PersistentStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	if ps.transaction(ctx) != nil {
+		return errors.New("nested transactions are not supported")
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.Debug("datastore transaction start")
+
+	var dsOpts []datastore.TransactionOption
+	if opts.Attempts > 0 {
+		dsOpts = append(dsOpts, datastore.MaxAttempts(opts.Attempts))
+	}
+	if opts.ReadOnly {
+		dsOpts = append(dsOpts, datastore.ReadOnly)
+	}
+
+	_, err := ps.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(context.WithValue(ctx, transactionKey{}, &transaction{client: ps.Client, tx: tx}))
+	}, dsOpts...)
+
+	l.Debug("datastore transaction end")
+
+	if err == datastore.ErrConcurrentTransaction {
+		return data.ErrConcurrentTransaction
+	}
+	return errors.Wrap(err, "")
+}
+
+// Runs f in a transaction, or directly if the context is already within a transaction started by Transact.
+func (ps *PersistentStore) runInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if ps.transaction(ctx) != nil {
+		return f(ctx)
+	}
+	_, err := ps.Client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		return f(context.WithValue(ctx, transactionKey{}, &transaction{client: ps.Client, tx: tx}))
+	})
+	if err == datastore.ErrConcurrentTransaction {
+		return data.ErrConcurrentTransaction
+	}
+	return err
+}
+
+// Returns the transaction the context is running in against this store's client, if any.
+func (ps *PersistentStore) transaction(ctx context.Context) *datastore.Transaction {
+	t, _ := ctx.Value(transactionKey{}).(*transaction)
+	if t == nil || t.client != ps.Client {
+		return nil
+	}
+	return t.tx
+}
+
+// Reads and writes go through the context's transaction if it has one, so they are part of it.
+
+func (ps *PersistentStore) get(ctx context.Context, k *datastore.Key, dst *datastore.PropertyList) error {
+	if tx := ps.transaction(ctx); tx != nil {
+		return tx.Get(k, dst)
+	}
+	return ps.Client.Get(ctx, k, dst)
+}
+
+func (ps *PersistentStore) getMulti(ctx context.Context, keys []*datastore.Key, dst []datastore.PropertyList) error {
+	if tx := ps.transaction(ctx); tx != nil {
+		return tx.GetMulti(keys, dst)
+	}
+	return ps.Client.GetMulti(ctx, keys, dst)
+}
+
+func (ps *PersistentStore) put(ctx context.Context, k *datastore.Key, src datastore.PropertyList) error {
+	if tx := ps.transaction(ctx); tx != nil {
+		_, err := tx.Put(k, &src)
+		return err
+	}
+	_, err := ps.Client.Put(ctx, k, &src)
+	return err
+}
+
+func (ps *PersistentStore) putMulti(ctx context.Context, keys []*datastore.Key, src []datastore.PropertyList) error {
+	if tx := ps.transaction(ctx); tx != nil {
+		_, err := tx.PutMulti(keys, src)
+		return err
+	}
+	_, err := ps.Client.PutMulti(ctx, keys, src)
+	return err
+}
+
+func (ps *PersistentStore) makeKey(kind, key string) *datastore.Key {
+	k := datastore.NameKey(kind, ps.Prefix+key, nil)
+	k.Namespace = ps.Namespace
+	return k
+}
+
+// Splits the serialized content and reserved metadata properties out of an entity, deserializing content into content.
+// If the entity has expired, data.ErrNoSuchEntity is returned.
+func entityFromDatastore(format data.ContentFormat, kind, key string, dsProperties datastore.PropertyList, content interface{}) ([]data.Property, int64, error) {
+	return datastoreutil.EntityFromProperties(format, kind, key, propertiesFromDatastore(dsProperties), content)
+}
+
+// Builds an entity from properties and its version, serializing content into a reserved property if non-nil.
+func entityToDatastore(format data.ContentFormat, kind, key string, properties []data.Property, content interface{}, version int64, expiry time.Time) (datastore.PropertyList, error) {
+	stored, err := datastoreutil.EntityToProperties(format, kind, key, properties, content, version, expiry)
+	if err != nil {
+		return nil, err
+	}
+	return propertiesToDatastore(stored), nil
+}
+
+// Multi-valued properties are held as a single property with a []interface{} value,
+// so each value is returned as its own property with Multiple set.
+func propertiesFromDatastore(from datastore.PropertyList) (to []data.Property) {
+	for _, v := range from {
+		values, ok := v.Value.([]interface{})
+		if !ok {
+			to = append(to, data.Property{
+				Name:    v.Name,
+				Value:   v.Value,
+				NoIndex: v.NoIndex,
+			})
+			continue
+		}
+
+		for _, value := range values {
+			to = append(to, data.Property{
+				Name:     v.Name,
+				Value:    value,
+				NoIndex:  v.NoIndex,
+				Multiple: true,
+			})
+		}
+	}
+	return
+}
+
+// Properties with Multiple set are gathered into a single property per name with a []interface{} value,
+// placed where the first of them was. Cloud Datastore indexes every value of a property alike,
+// so a multi-valued property is unindexed if any of its values are.
+// Properties must already have been validated.
+func propertiesToDatastore(from []data.Property) (to datastore.PropertyList) {
+	multiple := make(map[string]int)
+	for _, v := range from {
+		if !v.Multiple {
+			to = append(to, datastore.Property{
+				Name:    v.Name,
+				Value:   v.Value,
+				NoIndex: !v.Indexed(),
+			})
+			continue
+		}
+
+		i, ok := multiple[v.Name]
+		if !ok {
+			i = len(to)
+			multiple[v.Name] = i
+			to = append(to, datastore.Property{
+				Name:  v.Name,
+				Value: []interface{}(nil),
+			})
+		}
+		to[i].Value = append(to[i].Value.([]interface{}), v.Value)
+		to[i].NoIndex = to[i].NoIndex || !v.Indexed()
+	}
+	return
+}
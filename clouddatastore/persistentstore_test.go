@@ -0,0 +1,141 @@
+package clouddatastore
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/storetest"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Runs the conformance suite against the Datastore emulator, skipping if one isn't configured.
+// Each test's stores get namespaces of their own, so tests sharing an emulator don't see each other's entities.
+func TestPersistentStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (context.Context, func(opts storetest.Options) storeutil.PersistentStore) {
+		if testing.Short() {
+			t.Skip("Datastore emulator testing is expensive")
+		}
+		if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+			t.Skip("DATASTORE_EMULATOR_HOST not set")
+		}
+
+		ctx := context.Background()
+		client, err := datastore.NewClient(ctx, "moonbird-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			client.Close()
+		})
+
+		namespace := "test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		return ctx, func(opts storetest.Options) storeutil.PersistentStore {
+			return &PersistentStore{
+				Client:            client,
+				Prefix:            opts.Prefix,
+				PermissionChecker: opts.PermissionChecker,
+				Namespace:         namespace + "-" + opts.Namespace,
+				CursorKey:         []byte("bluh"),
+			}
+		}
+	})
+}
+
+func TestPropertiesToDatastore(t *testing.T) {
+	from := storetest.Properties()
+	to := propertiesToDatastore(from)
+	if len(to) != len(from) {
+		t.Errorf("Made a list of %d properties, expected %d", len(to), len(from))
+	}
+
+	for i := 0; i < len(to); i++ {
+		if to[i].Name != from[i].Name {
+			t.Errorf("Property %d had name '%s', expected '%s'", i, to[i].Name, from[i].Name)
+		}
+		if to[i].Value != from[i].Value {
+			t.Errorf("Property %d had value '%v', expected '%v'", i, to[i].Value, from[i].Value)
+		}
+		if to[i].NoIndex {
+			t.Errorf("Property %d had no index set, this is incorrect", i)
+		}
+	}
+}
+
+func TestPropertiesToDatastore_RichValues(t *testing.T) {
+	from := storetest.RichProperties()
+	to := propertiesToDatastore(from)
+
+	// The values of the multi-valued property are gathered into one.
+	if len(to) != 4 {
+		t.Fatalf("Made a list of %d properties, expected %d", len(to), 4)
+	}
+	expectedNoIndex := []bool{false, true, true, false}
+	for i := range to {
+		if to[i].NoIndex != expectedNoIndex[i] {
+			t.Errorf("Property %d had no index %v, expected %v", i, to[i].NoIndex, expectedNoIndex[i])
+		}
+	}
+	expectedTags := []interface{}{"foo", "bar"}
+	if !reflect.DeepEqual(to[3].Value, expectedTags) {
+		t.Errorf("Expected multi-valued property value %v, got %v", expectedTags, to[3].Value)
+	}
+
+	// []byte values are always unindexed, so come back with NoIndex set.
+	expected := storetest.RichProperties()
+	expected[1].NoIndex = true
+	roundTripped := propertiesFromDatastore(to)
+	if !reflect.DeepEqual(roundTripped, expected) {
+		t.Errorf("Expected properties %v after round trip, got %v", expected, roundTripped)
+	}
+}
+
+func TestPropertiesToDatastore_MultipleNoIndex(t *testing.T) {
+	from := storetest.RichProperties()
+	from[4].NoIndex = true
+
+	to := propertiesToDatastore(from)
+	if !to[3].NoIndex {
+		t.Error("Expected multi-valued property with an unindexed value to be unindexed")
+	}
+}
+
+func Test_PersistentStore_makeKey(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Prefix:    "Foo",
+		Namespace: "Qux",
+	}
+
+	k := ps.makeKey("Baz", "Bar")
+
+	if k.Kind != "Baz" {
+		t.Errorf("Incorrect key kind, expected %s, was %s", "Baz", k.Kind)
+	}
+	if k.Name != "FooBar" {
+		t.Errorf("Incorrect key name, expected %s, was %s", "FooBar", k.Name)
+	}
+	if k.Namespace != "Qux" {
+		t.Errorf("Incorrect key namespace, expected %s, was %s", "Qux", k.Namespace)
+	}
+}
+
+func TestPersistentStore_transaction_OtherClient(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{Client: &datastore.Client{}}
+	other := &PersistentStore{Client: &datastore.Client{}}
+	tx := &datastore.Transaction{}
+	ctx := context.WithValue(context.Background(), transactionKey{}, &transaction{client: ps.Client, tx: tx})
+
+	if ps.transaction(ctx) != tx {
+		t.Error("Expected transaction started on the store's client to be used")
+	}
+	if other.transaction(ctx) != nil {
+		t.Error("Expected transaction started on another client not to be used")
+	}
+}
@@ -0,0 +1,311 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config is the declarative configuration of the server, loaded by a Loader.
+// It is written as YAML or JSON, with field names as in its JSON tags:
+//
+//	serverMode: standalone
+//	adminTokens: ["<token>"]
+//	cursorKey: <key>
+//	store:
+//	  backend: sql
+//	  sqlDriver: sqlite
+//	  sqlDsn: file:auth.db
+//	billing:
+//	  usageRetention: 2160h
+//	endpoints:
+//	  /api/get-value: values
+//	  /api/set-value: values
+//
+// Unset fields take the defaults described on them.
+type Config struct {
+	// Either "appengine" or "standalone"; defaults to "appengine".
+	ServerMode string `json:"serverMode"`
+
+	// Port standalone mode listens on; defaults to "8080".
+	Port string `json:"port"`
+
+	// Bearer tokens admitted to admin handlers in standalone mode, which requires at least one.
+	// On App Engine, admin handlers are restricted to admins by app.yaml instead.
+	AdminTokens []string `json:"adminTokens"`
+
+	// Whether internal error messages are included in error responses, for debugging.
+	ExposeErrors bool `json:"exposeErrors"`
+
+	// Datastore namespace entities are stored in; defaults to "moonbird-auth".
+	Namespace string `json:"namespace"`
+
+	// Key used to sign query cursors handed out to clients. Listing tokens hands out cursors,
+	// so the admin list-tokens handler is only served if it is set.
+	// It should be secret, as anyone knowing it can forge cursors.
+	CursorKey string `json:"cursorKey"`
+
+	// Path of a local key file to encrypt stored content with, as loaded by encryption.LoadLocalKeyProvider.
+	// If unset, content is not encrypted.
+	ContentKeyFile string `json:"contentKeyFile"`
+
+	// Whether content written before encryption was enabled, or before encrypted content was bound to its entity,
+	// is still read. It can be forged by anyone able to write to the store,
+	// so this should only be set while existing content is rewritten.
+	ContentMigrating bool `json:"contentMigrating"`
+
+	Store   StoreConfig   `json:"store"`
+	Cache   CacheConfig   `json:"cache"`
+	Billing BillingConfig `json:"billing"`
+	Auth    AuthConfig    `json:"auth"`
+
+	// Maps URL paths to the endpoints they are billed as. Changes are applied when the configuration is reloaded.
+	// Public API paths not mapped to an endpoint refuse every request.
+	Endpoints map[string]string `json:"endpoints"`
+
+	// How often the configuration is reloaded to pick up endpoint changes; if zero, it is not reloaded.
+	ReloadInterval Duration `json:"reloadInterval"`
+}
+
+type StoreConfig struct {
+	// One of "appengine", "datastore", or "sql".
+	// Defaults to "appengine" in App Engine mode, and "datastore" in standalone mode.
+	Backend string `json:"backend"`
+
+	// Project of the Cloud Datastore backend; if unset, it is detected from the environment's credentials.
+	ProjectID string `json:"projectId"`
+
+	// Driver of the SQL backend, either "sqlite" or "postgres", and the data source name passed to it.
+	SQLDriver string `json:"sqlDriver"`
+	SQLDSN    string `json:"sqlDsn"`
+
+	// Prefix for keys of stored entities, keeping them apart from others' in the same namespace.
+	Prefix string `json:"prefix"`
+}
+
+type CacheConfig struct {
+	// One of "appengine", "memory", or "redis".
+	// Defaults to "appengine" in App Engine mode, and "memory" in standalone mode.
+	Backend string `json:"backend"`
+
+	// URL of the Redis backend, such as "redis://localhost:6379/0".
+	RedisURL string `json:"redisUrl"`
+
+	// Maximum number of values held by the memory backend; defaults to 100000.
+	MaxEntries int `json:"maxEntries"`
+
+	// Prefix for cache keys, keeping them apart from others' in a shared cache.
+	Prefix string `json:"prefix"`
+}
+
+type BillingConfig struct {
+	// How long usage for a month is kept after the month ends, before it expires; if zero, it is kept forever.
+	UsageRetention Duration `json:"usageRetention"`
+
+	// Number of requests counted in the cache before being flushed to the store together.
+	// If zero, usage is updated in the store on every request.
+	UsageFlushBatch int64 `json:"usageFlushBatch"`
+
+	// How long requests counted in the cache may go unflushed, if fewer than usageFlushBatch; defaults to 1m.
+	UsageFlushMaxAge Duration `json:"usageFlushMaxAge"`
+
+	// How long limits are cached in process; defaults to 30s.
+	LimitCacheTTL Duration `json:"limitCacheTtl"`
+}
+
+type AuthConfig struct {
+	// How long project authorizations are cached in process; defaults to 30s.
+	CacheTTL Duration `json:"cacheTtl"`
+
+	// How long project authorizations are cached in the shared cache; defaults to 30s.
+	// A revoked token may be accepted for this long if revoked while being looked up.
+	StoreCacheTTL Duration `json:"storeCacheTtl"`
+}
+
+// Duration is a time.Duration written as a string such as "30s" or "2160h".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return errors.Errorf("duration must be a string such as \"30s\", was %s", b)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Parses a configuration from YAML or JSON. Unknown fields are rejected, so misspelt settings aren't ignored.
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	err := yaml.UnmarshalStrict(b, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to parse configuration")
+	}
+	return c, nil
+}
+
+// Fills unset fields with their defaults.
+func (c *Config) SetDefaults() {
+	if c.ServerMode == "" {
+		c.ServerMode = "appengine"
+	}
+	if c.Port == "" {
+		c.Port = "8080"
+	}
+	if c.Namespace == "" {
+		c.Namespace = "moonbird-auth"
+	}
+
+	if c.Store.Backend == "" {
+		if c.ServerMode == "appengine" {
+			c.Store.Backend = "appengine"
+		} else {
+			c.Store.Backend = "datastore"
+		}
+	}
+	if c.Cache.Backend == "" {
+		if c.ServerMode == "appengine" {
+			c.Cache.Backend = "appengine"
+		} else {
+			c.Cache.Backend = "memory"
+		}
+	}
+	if c.Cache.MaxEntries == 0 {
+		c.Cache.MaxEntries = 100000
+	}
+
+	if c.Billing.LimitCacheTTL == 0 {
+		c.Billing.LimitCacheTTL = Duration(30 * time.Second)
+	}
+	if c.Auth.CacheTTL == 0 {
+		c.Auth.CacheTTL = Duration(30 * time.Second)
+	}
+	if c.Auth.StoreCacheTTL == 0 {
+		c.Auth.StoreCacheTTL = Duration(30 * time.Second)
+	}
+}
+
+// Checks the configuration is complete and consistent, returning an error describing every problem found.
+// Defaults should be set first.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.ServerMode {
+	case "appengine":
+		if c.Store.Backend != "appengine" {
+			add("store backend '%s' is not supported in appengine mode", c.Store.Backend)
+		}
+		if c.Cache.Backend != "appengine" {
+			add("cache backend '%s' is not supported in appengine mode", c.Cache.Backend)
+		}
+	case "standalone":
+		if len(c.AdminTokens) == 0 {
+			add("adminTokens must be set in standalone mode")
+		}
+		if c.Store.Backend == "appengine" || c.Cache.Backend == "appengine" {
+			add("appengine backends are not supported in standalone mode")
+		}
+	default:
+		add("unknown serverMode '%s'", c.ServerMode)
+	}
+	for _, token := range c.AdminTokens {
+		if strings.TrimSpace(token) == "" {
+			add("adminTokens must not be empty")
+			break
+		}
+	}
+
+	switch c.Store.Backend {
+	case "appengine", "datastore":
+	case "sql":
+		if c.Store.SQLDriver != "sqlite" && c.Store.SQLDriver != "postgres" {
+			add("unknown store sqlDriver '%s'", c.Store.SQLDriver)
+		}
+		if c.Store.SQLDSN == "" {
+			add("store sqlDsn must be set for the sql backend")
+		}
+	default:
+		add("unknown store backend '%s'", c.Store.Backend)
+	}
+
+	switch c.Cache.Backend {
+	case "appengine":
+	case "memory":
+		if c.Cache.MaxEntries < 0 {
+			add("cache maxEntries must not be negative")
+		}
+	case "redis":
+		if c.Cache.RedisURL == "" {
+			add("cache redisUrl must be set for the redis backend")
+		}
+	default:
+		add("unknown cache backend '%s'", c.Cache.Backend)
+	}
+
+	if c.Billing.UsageRetention < 0 {
+		add("billing usageRetention must not be negative")
+	}
+	if c.Billing.UsageFlushBatch < 0 {
+		add("billing usageFlushBatch must not be negative")
+	}
+	if c.Billing.UsageFlushMaxAge < 0 {
+		add("billing usageFlushMaxAge must not be negative")
+	}
+	if c.Billing.LimitCacheTTL < 0 {
+		add("billing limitCacheTtl must not be negative")
+	}
+	if c.Auth.CacheTTL < 0 {
+		add("auth cacheTtl must not be negative")
+	}
+	if c.Auth.StoreCacheTTL < 0 {
+		add("auth storeCacheTtl must not be negative")
+	}
+	if c.ReloadInterval < 0 {
+		add("reloadInterval must not be negative")
+	}
+
+	problems = append(problems, validateEndpoints(c.Endpoints)...)
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateEndpoints(endpoints map[string]string) []string {
+	paths := make([]string, 0, len(endpoints))
+	for path := range endpoints {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var problems []string
+	for _, path := range paths {
+		endpoint := endpoints[path]
+		if !strings.HasPrefix(path, "/") {
+			problems = append(problems, fmt.Sprintf("endpoint path '%s' must begin with '/'", path))
+		}
+		// Endpoints are part of the keys limits and usage are stored under, which separate their parts with '/'.
+		if endpoint == "" || strings.Contains(endpoint, "/") {
+			problems = append(problems, fmt.Sprintf("endpoint for path '%s' must be non-empty and not contain '/'", path))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,211 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse_YAML(t *testing.T) {
+	t.Parallel()
+
+	c, err := Parse([]byte(`
+serverMode: standalone
+adminTokens: [foo, bar]
+store:
+  backend: sql
+  sqlDriver: sqlite
+  sqlDsn: file:auth.db
+billing:
+  usageRetention: 2160h
+  usageFlushBatch: 50
+  usageFlushMaxAge: 5m
+endpoints:
+  /api/foo: foo
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error from Parse: %s", err)
+	}
+
+	expected := &Config{
+		ServerMode:  "standalone",
+		AdminTokens: []string{"foo", "bar"},
+		Store: StoreConfig{
+			Backend:   "sql",
+			SQLDriver: "sqlite",
+			SQLDSN:    "file:auth.db",
+		},
+		Billing: BillingConfig{
+			UsageRetention:   Duration(2160 * time.Hour),
+			UsageFlushBatch:  50,
+			UsageFlushMaxAge: Duration(5 * time.Minute),
+		},
+		Endpoints: map[string]string{"/api/foo": "foo"},
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected config %+v, got %+v", expected, c)
+	}
+}
+
+func TestParse_JSON(t *testing.T) {
+	t.Parallel()
+
+	c, err := Parse([]byte(`{"exposeErrors": true, "auth": {"cacheTtl": "1m"}}`))
+	if err != nil {
+		t.Fatalf("Unexpected error from Parse: %s", err)
+	}
+	if !c.ExposeErrors {
+		t.Error("Expected exposeErrors to be set")
+	}
+	if c.Auth.CacheTTL != Duration(time.Minute) {
+		t.Errorf("Expected auth cache TTL %s, got %s", time.Minute, time.Duration(c.Auth.CacheTTL))
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	testCases := []struct {
+		Label string
+		Doc   string
+	}{
+		{
+			Label: "UnknownField",
+			Doc:   `serverMod: standalone`,
+		},
+		{
+			Label: "NumericDuration",
+			Doc:   `reloadInterval: 30`,
+		},
+		{
+			Label: "InvalidDuration",
+			Doc:   `reloadInterval: soon`,
+		},
+		{
+			Label: "NotYAML",
+			Doc:   `{`,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Parse([]byte(testCase.Doc))
+			if err == nil {
+				t.Error("Expected error from Parse, got nil")
+			}
+		})
+	}
+}
+
+func TestConfig_SetDefaults(t *testing.T) {
+	t.Parallel()
+
+	c := &Config{}
+	c.SetDefaults()
+	err := c.Validate()
+	if err != nil {
+		t.Errorf("Expected default config to be valid, got: %s", err)
+	}
+	if c.ServerMode != "appengine" || c.Store.Backend != "appengine" || c.Cache.Backend != "appengine" {
+		t.Errorf("Expected App Engine mode and backends by default, got %+v", c)
+	}
+
+	c = &Config{ServerMode: "standalone", AdminTokens: []string{"foo"}}
+	c.SetDefaults()
+	err = c.Validate()
+	if err != nil {
+		t.Errorf("Expected default standalone config to be valid, got: %s", err)
+	}
+	if c.Store.Backend != "datastore" || c.Cache.Backend != "memory" {
+		t.Errorf("Expected Cloud Datastore and memory backends in standalone mode, got %+v", c)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	testCases := []struct {
+		Label    string
+		Config   Config
+		Problems []string
+	}{
+		{
+			Label:    "UnknownMode",
+			Config:   Config{ServerMode: "bluh"},
+			Problems: []string{"unknown serverMode 'bluh'"},
+		},
+		{
+			Label:    "StandaloneWithoutAdminTokens",
+			Config:   Config{ServerMode: "standalone"},
+			Problems: []string{"adminTokens must be set"},
+		},
+		{
+			Label:    "StandaloneWithAppEngineBackends",
+			Config:   Config{ServerMode: "standalone", AdminTokens: []string{"foo"}, Store: StoreConfig{Backend: "appengine"}},
+			Problems: []string{"appengine backends are not supported"},
+		},
+		{
+			Label:  "AppEngineWithOtherBackends",
+			Config: Config{Store: StoreConfig{Backend: "datastore"}, Cache: CacheConfig{Backend: "redis"}},
+			Problems: []string{
+				"store backend 'datastore' is not supported",
+				"cache backend 'redis' is not supported",
+				"redisUrl must be set",
+			},
+		},
+		{
+			Label:  "IncompleteSQL",
+			Config: Config{ServerMode: "standalone", AdminTokens: []string{"foo"}, Store: StoreConfig{Backend: "sql", SQLDriver: "mysql"}},
+			Problems: []string{
+				"unknown store sqlDriver 'mysql'",
+				"sqlDsn must be set",
+			},
+		},
+		{
+			Label: "InvalidEndpoints",
+			Config: Config{Endpoints: map[string]string{
+				"api/foo":  "foo",
+				"/api/bar": "bar/baz",
+				"/api/baz": "",
+			}},
+			Problems: []string{
+				"endpoint path 'api/foo' must begin with '/'",
+				"endpoint for path '/api/bar' must be non-empty",
+				"endpoint for path '/api/baz' must be non-empty",
+			},
+		},
+		{
+			Label: "NegativeValues",
+			Config: Config{
+				Billing:        BillingConfig{UsageFlushBatch: -1, UsageFlushMaxAge: Duration(-time.Second)},
+				Auth:           AuthConfig{StoreCacheTTL: Duration(-time.Second)},
+				ReloadInterval: Duration(-time.Second),
+			},
+			Problems: []string{
+				"usageFlushBatch must not be negative",
+				"usageFlushMaxAge must not be negative",
+				"storeCacheTtl must not be negative",
+				"reloadInterval must not be negative",
+			},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			c := testCase.Config
+			c.SetDefaults()
+			err := c.Validate()
+			if err == nil {
+				t.Fatal("Expected error from Validate, got nil")
+			}
+			for _, problem := range testCase.Problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("Expected error '%s' to contain '%s'", err, problem)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Overrides fields from environment variables, for settings which differ between deployments or are secret.
+// lookup is called for each variable, as os.LookupEnv is; variables which are unset leave their fields as they were.
+//
+// The variables are SERVER_MODE, PORT, ADMIN_TOKENS (comma-separated), EXPOSE_ERRORS, CURSOR_KEY,
+// CONTENT_KEY_FILE, DATASTORE_PROJECT_ID, SQL_DRIVER and SQL_DSN (selecting the sql store backend),
+// REDIS_URL (selecting the redis cache backend), USAGE_RETENTION, USAGE_FLUSH_BATCH,
+// USAGE_FLUSH_MAX_AGE, and CONFIG_RELOAD_INTERVAL.
+func (c *Config) ApplyEnv(lookup func(name string) (string, bool)) error {
+	get := func(name string, field *string) {
+		if value, ok := lookup(name); ok {
+			*field = value
+		}
+	}
+
+	get("SERVER_MODE", &c.ServerMode)
+	get("PORT", &c.Port)
+	get("CURSOR_KEY", &c.CursorKey)
+	get("CONTENT_KEY_FILE", &c.ContentKeyFile)
+	get("DATASTORE_PROJECT_ID", &c.Store.ProjectID)
+	get("SQL_DSN", &c.Store.SQLDSN)
+
+	if value, ok := lookup("ADMIN_TOKENS"); ok {
+		c.AdminTokens = nil
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" {
+				c.AdminTokens = append(c.AdminTokens, token)
+			}
+		}
+	}
+	if value, ok := lookup("SQL_DRIVER"); ok && value != "" {
+		c.Store.Backend = "sql"
+		c.Store.SQLDriver = value
+	}
+	if value, ok := lookup("REDIS_URL"); ok && value != "" {
+		c.Cache.Backend = "redis"
+		c.Cache.RedisURL = value
+	}
+
+	if value, ok := lookup("EXPOSE_ERRORS"); ok && value != "" {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Wrap(err, "invalid EXPOSE_ERRORS")
+		}
+		c.ExposeErrors = b
+	}
+	if value, ok := lookup("USAGE_FLUSH_BATCH"); ok && value != "" {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.Wrap(err, "invalid USAGE_FLUSH_BATCH")
+		}
+		c.Billing.UsageFlushBatch = i
+	}
+
+	err := getDurationEnv(lookup, "USAGE_RETENTION", &c.Billing.UsageRetention)
+	if err != nil {
+		return err
+	}
+	err = getDurationEnv(lookup, "USAGE_FLUSH_MAX_AGE", &c.Billing.UsageFlushMaxAge)
+	if err != nil {
+		return err
+	}
+	return getDurationEnv(lookup, "CONFIG_RELOAD_INTERVAL", &c.ReloadInterval)
+}
+
+func getDurationEnv(lookup func(name string) (string, bool), name string, field *Duration) error {
+	value, ok := lookup(name)
+	if !ok || value == "" {
+		return nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.Wrapf(err, "invalid %s", name)
+	}
+	*field = Duration(d)
+	return nil
+}
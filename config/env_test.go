@@ -0,0 +1,81 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func makeLookup(env map[string]string) func(name string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+}
+
+func TestConfig_ApplyEnv(t *testing.T) {
+	t.Parallel()
+
+	c := &Config{
+		ServerMode:  "appengine",
+		AdminTokens: []string{"old"},
+		Port:        "9000",
+		Endpoints:   map[string]string{"/api/foo": "foo"},
+	}
+	err := c.ApplyEnv(makeLookup(map[string]string{
+		"SERVER_MODE":            "standalone",
+		"ADMIN_TOKENS":           "foo, bar,",
+		"EXPOSE_ERRORS":          "true",
+		"SQL_DRIVER":             "postgres",
+		"SQL_DSN":                "postgres://localhost/auth",
+		"REDIS_URL":              "redis://localhost:6379/0",
+		"USAGE_RETENTION":        "2160h",
+		"USAGE_FLUSH_BATCH":      "50",
+		"USAGE_FLUSH_MAX_AGE":    "5m",
+		"CONFIG_RELOAD_INTERVAL": "1m",
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error from ApplyEnv: %s", err)
+	}
+
+	expected := &Config{
+		ServerMode:   "standalone",
+		Port:         "9000",
+		AdminTokens:  []string{"foo", "bar"},
+		ExposeErrors: true,
+		Store: StoreConfig{
+			Backend:   "sql",
+			SQLDriver: "postgres",
+			SQLDSN:    "postgres://localhost/auth",
+		},
+		Cache: CacheConfig{
+			Backend:  "redis",
+			RedisURL: "redis://localhost:6379/0",
+		},
+		Billing: BillingConfig{
+			UsageRetention:   Duration(2160 * time.Hour),
+			UsageFlushBatch:  50,
+			UsageFlushMaxAge: Duration(5 * time.Minute),
+		},
+		Endpoints:      map[string]string{"/api/foo": "foo"},
+		ReloadInterval: Duration(time.Minute),
+	}
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("Expected config %+v, got %+v", expected, c)
+	}
+}
+
+func TestConfig_ApplyEnv_Invalid(t *testing.T) {
+	for _, name := range []string{"EXPOSE_ERRORS", "USAGE_RETENTION", "USAGE_FLUSH_BATCH", "USAGE_FLUSH_MAX_AGE", "CONFIG_RELOAD_INTERVAL"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &Config{}
+			err := c.ApplyEnv(makeLookup(map[string]string{name: "bluh"}))
+			if err == nil {
+				t.Errorf("Expected error from ApplyEnv with invalid %s, got nil", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+// Source provides a configuration document, in YAML or JSON.
+type Source interface {
+	Load(ctx context.Context) ([]byte, error)
+}
+
+// FileSource reads configuration from a local file.
+type FileSource struct {
+	Path string
+}
+
+func (s *FileSource) Load(ctx context.Context) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return b, nil
+}
+
+// StoreSource reads configuration from a file store, such as a GcsFileStore,
+// so configuration can be shared by instances and changed without redeploying.
+type StoreSource struct {
+	Store FileLoader
+	Path  string
+}
+
+func (s *StoreSource) Load(ctx context.Context) ([]byte, error) {
+	return s.Store.Load(ctx, s.Path)
+}
+
+// Loader loads configuration from a source, overridden by environment variables.
+type Loader struct {
+	// Source of the configuration document. If nil, configuration comes from defaults and the environment alone.
+	Source Source
+
+	// Looks up environment variables, as os.LookupEnv does. If nil, the environment is not consulted.
+	LookupEnv func(name string) (string, bool)
+}
+
+// Loads and validates the configuration, with defaults set for fields which were unset.
+func (l *Loader) Load(ctx context.Context) (*Config, error) {
+	c := &Config{}
+	if l.Source != nil {
+		b, err := l.Source.Load(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to load configuration")
+		}
+
+		c, err = Parse(b)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if l.LookupEnv != nil {
+		err := c.ApplyEnv(l.LookupEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.SetDefaults()
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+type testFileLoader struct {
+	files map[string][]byte
+}
+
+func (fl *testFileLoader) Load(ctx context.Context, path string) ([]byte, error) {
+	b, ok := fl.files[path]
+	if !ok {
+		return nil, errors.New("no such file")
+	}
+	return b, nil
+}
+
+func TestLoader_Load_FileSource(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(path, []byte("serverMode: standalone\nadminTokens: [foo]\ncursorKey: bluh\nport: \"9000\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loader := &Loader{
+		Source: &FileSource{Path: path},
+		LookupEnv: makeLookup(map[string]string{
+			"PORT": "9001",
+		}),
+	}
+	c, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error from Load: %s", err)
+	}
+
+	// The environment overrides the file, and defaults fill what neither set.
+	if c.ServerMode != "standalone" {
+		t.Errorf("Expected server mode from file, got '%s'", c.ServerMode)
+	}
+	if c.Port != "9001" {
+		t.Errorf("Expected port from environment, got '%s'", c.Port)
+	}
+	if c.Namespace != "moonbird-auth" {
+		t.Errorf("Expected default namespace, got '%s'", c.Namespace)
+	}
+}
+
+func TestLoader_Load_StoreSource(t *testing.T) {
+	t.Parallel()
+
+	loader := &Loader{
+		Source: &StoreSource{
+			Store: &testFileLoader{files: map[string][]byte{
+				"config/auth.json": []byte(`{"cursorKey": "bluh", "endpoints": {"/api/foo": "foo"}}`),
+			}},
+			Path: "config/auth.json",
+		},
+	}
+	c, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error from Load: %s", err)
+	}
+	if c.Endpoints["/api/foo"] != "foo" {
+		t.Errorf("Expected endpoints from store, got %v", c.Endpoints)
+	}
+}
+
+func TestLoader_Load_EnvOnly(t *testing.T) {
+	t.Parallel()
+
+	loader := &Loader{
+		LookupEnv: makeLookup(map[string]string{
+			"SERVER_MODE":  "standalone",
+			"ADMIN_TOKENS": "foo",
+			"CURSOR_KEY":   "bluh",
+		}),
+	}
+	c, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error from Load: %s", err)
+	}
+	if c.ServerMode != "standalone" || c.Store.Backend != "datastore" {
+		t.Errorf("Expected standalone mode with default backends, got %+v", c)
+	}
+}
+
+func TestLoader_Load_Errors(t *testing.T) {
+	testCases := []struct {
+		Label  string
+		Loader *Loader
+	}{
+		{
+			Label:  "MissingFile",
+			Loader: &Loader{Source: &FileSource{Path: filepath.Join(t.TempDir(), "missing.yaml")}},
+		},
+		{
+			Label: "InvalidDocument",
+			Loader: &Loader{Source: &StoreSource{
+				Store: &testFileLoader{files: map[string][]byte{"config.yaml": []byte("bluh: true")}},
+				Path:  "config.yaml",
+			}},
+		},
+		{
+			Label:  "InvalidEnv",
+			Loader: &Loader{LookupEnv: makeLookup(map[string]string{"USAGE_FLUSH_BATCH": "bluh"})},
+		},
+		{
+			Label:  "InvalidConfig",
+			Loader: &Loader{LookupEnv: makeLookup(map[string]string{"SERVER_MODE": "standalone"})},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := testCase.Loader.Load(context.Background())
+			if err == nil {
+				t.Error("Expected error from Load, got nil")
+			}
+		})
+	}
+}
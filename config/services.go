@@ -0,0 +1,8 @@
+package config
+
+import "context"
+
+// FileLoader loads files by path, such as aengine.GcsFileStore.
+type FileLoader interface {
+	Load(ctx context.Context, path string) ([]byte, error)
+}
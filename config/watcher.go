@@ -0,0 +1,48 @@
+package config
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"reflect"
+	"time"
+)
+
+// Watcher reloads configuration periodically, so changes can be applied without restarting.
+type Watcher struct {
+	Loader   *Loader
+	Interval time.Duration
+
+	// Called with each configuration loaded which differs from the last, along with the last.
+	// Configurations which fail to load or validate are logged and skipped, keeping the last in effect.
+	OnChange func(ctx context.Context, previous, current *Config)
+}
+
+// Reloads configuration every Interval until the context is done, starting from the initially loaded configuration.
+func (w *Watcher) Run(ctx context.Context, initial *Config) {
+	l := ctxlogrus.Get(ctx)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	current := initial
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c, err := w.Loader.Load(ctx)
+		if err != nil {
+			l.WithError(err).Error("unable to reload configuration; keeping previous configuration")
+			continue
+		}
+		if reflect.DeepEqual(c, current) {
+			continue
+		}
+
+		l.Info("configuration changed")
+		w.OnChange(ctx, current, c)
+		current = c
+	}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher_Run(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	// Files are replaced by renaming, so the watcher never reads one partially written.
+	write := func(doc string) {
+		err := ioutil.WriteFile(path+".tmp", []byte(doc), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Rename(path+".tmp", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("cursorKey: bluh\nendpoints: {/api/foo: foo}")
+
+	loader := &Loader{Source: &FileSource{Path: path}}
+	initial, err := loader.Load(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error from Load: %s", err)
+	}
+
+	changes := make(chan *Config)
+	w := &Watcher{
+		Loader:   loader,
+		Interval: time.Millisecond,
+		OnChange: func(ctx context.Context, previous, current *Config) {
+			select {
+			case changes <- current:
+			case <-ctx.Done():
+			}
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.Run(ctx, initial)
+		close(done)
+	}()
+
+	// Invalid configurations are skipped, keeping the last in effect until a valid one is written.
+	write("cursorKey: bluh\nendpoints: {api/bar: bar}")
+	time.Sleep(10 * time.Millisecond)
+	write("cursorKey: bluh\nendpoints: {/api/bar: bar}")
+
+	select {
+	case c := <-changes:
+		if c.Endpoints["/api/bar"] != "bar" || c.Endpoints["/api/foo"] != "" {
+			t.Errorf("Expected changed endpoints, got %v", c.Endpoints)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for configuration change")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for watcher to stop")
+	}
+}
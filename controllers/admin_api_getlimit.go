@@ -0,0 +1,50 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type AdminApiGetLimit struct {
+	Biller LimitedEndpointBiller
+}
+
+type AdminApiGetLimitInput struct {
+	Token    string
+	Endpoint string
+}
+
+// The limit's version is returned as an ETag, which may be passed back as If-Match when setting it.
+func (c *AdminApiGetLimit) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		input := AdminApiGetLimitInput{
+			Token:    r.FormValue("token"),
+			Endpoint: r.FormValue("endpoint"),
+		}
+		limit, version, err := c.handle(ctx, input)
+		if err != nil {
+			resp.OnError(ctx, w, err)
+		} else {
+			w.Header().Set("ETag", formatETag(version))
+			resp.OnSuccess(w, limit)
+		}
+	}
+}
+
+func (c *AdminApiGetLimit) handle(ctx context.Context, input AdminApiGetLimitInput) (int64, int64, error) {
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"controller": "AdminApiGetLimit",
+	})
+
+	limit, version, err := c.Biller.GetLimit(ctx, input.Token, input.Endpoint)
+	return limit, version, errors.Wrap(err, "")
+}
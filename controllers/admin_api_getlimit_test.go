@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestAdminApiGetLimit_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	expectedToken := "bluh"
+	expectedEndpoint := "bar"
+
+	calledGetLimit := false
+	b := newTestLimitedEndpointBiller(t)
+	b.GetLimitFunc = func(ctx context.Context, token, endpoint string) (int64, int64, error) {
+		calledGetLimit = true
+
+		if token != expectedToken {
+			t.Errorf("Expected token '%s', got token '%s'", expectedToken, token)
+		}
+		if endpoint != expectedEndpoint {
+			t.Errorf("Expected endpoint '%s', got endpoint '%s'", expectedEndpoint, endpoint)
+		}
+		return 86400, 7, nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		if v != int64(86400) {
+			t.Errorf("Expected limit %d, got %v", 86400, v)
+		}
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiGetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	w := httptest.NewRecorder()
+	handler(w, &http.Request{
+		Form: url.Values{
+			"token":    []string{expectedToken},
+			"endpoint": []string{expectedEndpoint},
+		},
+	})
+
+	if !calledGetLimit {
+		t.Error("Expected GetLimit to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+	if etag := w.Header().Get("ETag"); etag != `"7"` {
+		t.Errorf("Expected ETag '%s', got '%s'", `"7"`, etag)
+	}
+}
+
+func TestAdminApiGetLimit_HandleFunc_GetLimitErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	b := newTestLimitedEndpointBiller(t)
+	b.GetLimitFunc = func(ctx context.Context, token, endpoint string) (int64, int64, error) {
+		return 0, 0, expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiGetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(httptest.NewRecorder(), &http.Request{
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
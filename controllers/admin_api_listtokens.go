@@ -0,0 +1,62 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+type AdminApiListTokens struct {
+	ProjectTokenLister ProjectTokenLister
+}
+
+type AdminApiListTokensInput struct {
+	Project  string
+	Cursor   string
+	PageSize int
+}
+
+func (c *AdminApiListTokens) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		var pageSize int
+		if r.FormValue("page_size") != "" {
+			pageSize, err = strconv.Atoi(r.FormValue("page_size"))
+			if err != nil {
+				resp.OnError(ctx, w, err)
+				return
+			}
+		}
+
+		input := AdminApiListTokensInput{
+			Project:  r.FormValue("project"),
+			Cursor:   r.FormValue("cursor"),
+			PageSize: pageSize,
+		}
+		page, err := c.handle(ctx, input)
+		if err != nil {
+			resp.OnError(ctx, w, err)
+		} else {
+			resp.OnSuccessPage(w, page)
+		}
+	}
+}
+
+func (c *AdminApiListTokens) handle(ctx context.Context, input AdminApiListTokensInput) (data.Page, error) {
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"controller": "AdminApiListTokens",
+	})
+
+	page, err := c.ProjectTokenLister.ListTokens(ctx, input.Project, input.Cursor, input.PageSize)
+
+	return page, errors.Wrap(err, "")
+}
@@ -0,0 +1,173 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestAdminApiListTokens_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	expectedPage := data.Page{
+		Items:      []string{"foo"},
+		NextCursor: "cursor2",
+	}
+
+	calledListTokens := false
+	ptl := newTestProjectTokenLister(t)
+	ptl.ListTokensFunc = func(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+		calledListTokens = true
+
+		if project != "bar" {
+			t.Errorf("Expected project '%s', got project '%s'", "bar", project)
+		}
+		if cursor != "cursor1" {
+			t.Errorf("Expected cursor '%s', got cursor '%s'", "cursor1", cursor)
+		}
+		if pageSize != 10 {
+			t.Errorf("Expected page size %d, got page size %d", 10, pageSize)
+		}
+		return expectedPage, nil
+	}
+
+	calledOnSuccessPage := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessPageFunc = func(w http.ResponseWriter, page data.Page) {
+		if !reflect.DeepEqual(page, expectedPage) {
+			t.Errorf("Expected page %v, got page %v", expectedPage, page)
+		}
+		calledOnSuccessPage = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiListTokens{
+		ProjectTokenLister: ptl,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project":   []string{"bar"},
+			"cursor":    []string{"cursor1"},
+			"page_size": []string{"10"},
+		},
+	})
+
+	if !calledListTokens {
+		t.Error("Expected ListTokens to be called, was not called")
+	}
+	if !calledOnSuccessPage {
+		t.Error("Expected responder's OnSuccessPage method to be called, was not called")
+	}
+}
+
+func TestAdminApiListTokens_HandleFunc_NoPageSize(t *testing.T) {
+	t.Parallel()
+
+	ptl := newTestProjectTokenLister(t)
+	ptl.ListTokensFunc = func(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+		if pageSize != 0 {
+			t.Errorf("Expected page size %d, got page size %d", 0, pageSize)
+		}
+		return data.Page{}, nil
+	}
+
+	calledOnSuccessPage := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessPageFunc = func(w http.ResponseWriter, page data.Page) {
+		calledOnSuccessPage = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiListTokens{
+		ProjectTokenLister: ptl,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{"bar"},
+		},
+	})
+
+	if !calledOnSuccessPage {
+		t.Error("Expected responder's OnSuccessPage method to be called, was not called")
+	}
+}
+
+func TestAdminApiListTokens_HandleFunc_BadPageSize(t *testing.T) {
+	t.Parallel()
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiListTokens{
+		ProjectTokenLister: newTestProjectTokenLister(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project":   []string{"bar"},
+			"page_size": []string{"bluh"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
+
+func TestAdminApiListTokens_HandleFunc_ListTokensErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	ptl := newTestProjectTokenLister(t)
+	ptl.ListTokensFunc = func(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+		return data.Page{}, expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiListTokens{
+		ProjectTokenLister: ptl,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{"bar"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
@@ -0,0 +1,29 @@
+package controllers
+
+import "net/http"
+
+type AdminApiRetryMetrics struct {
+	Metrics RetryMetricsReader
+}
+
+type AdminApiRetryMetricsOutput struct {
+	Retried   int64 `json:"retried"`
+	Exhausted int64 `json:"exhausted"`
+}
+
+// Reports how many transactions have been retried after conflicting, and how many conflicted on every attempt.
+// Counts are held in process memory since it started, so each instance reports its own.
+func (c *AdminApiRetryMetrics) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		resp.OnSuccess(w, AdminApiRetryMetricsOutput{
+			Retried:   c.Metrics.Retried(),
+			Exhausted: c.Metrics.Exhausted(),
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"testing"
+)
+
+func TestAdminApiRetryMetrics_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		expected := AdminApiRetryMetricsOutput{Retried: 3, Exhausted: 1}
+		if v != expected {
+			t.Errorf("Expected output %+v, got %+v", expected, v)
+		}
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiRetryMetrics{
+		Metrics: &testRetryMetricsReader{retried: 3, exhausted: 1},
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+}
+
+func TestAdminApiRetryMetrics_HandleFunc_MakeContextErr(t *testing.T) {
+	t.Parallel()
+
+	calledOnContextError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnContextErrorFunc = func(w http.ResponseWriter, err error) {
+		calledOnContextError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return nil, errors.New("bluh")
+	}
+
+	c := &AdminApiRetryMetrics{
+		Metrics: &testRetryMetricsReader{},
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnContextError {
+		t.Error("Expected responder's OnContextError method to be called, was not called")
+	}
+}
@@ -3,6 +3,7 @@ package controllers
 import (
 	"context"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net/http"
@@ -17,8 +18,16 @@ type AdminApiSetLimitInput struct {
 	Token    string
 	Endpoint string
 	Limit    int64
+
+	// If Conditional, the limit is only set if it is still at Version,
+	// or if AnyVersion, only if a limit is already set.
+	Conditional bool
+	Version     int64
+	AnyVersion  bool
 }
 
+// If an If-Match header is given, the limit is only set if its version still matches,
+// or if the header is "*", only if a limit is already set, and the new version is returned as an ETag.
 func (c *AdminApiSetLimit) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx, err := cm.MakeContext(r)
@@ -34,24 +43,54 @@ func (c *AdminApiSetLimit) HandleFunc(cm ContextMaker, resp WebApiResponder) htt
 		}
 
 		input := AdminApiSetLimitInput{
-			Token: r.FormValue("token"),
+			Token:    r.FormValue("token"),
 			Endpoint: r.FormValue("endpoint"),
-			Limit: limit,
+			Limit:    limit,
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			input.Version, input.AnyVersion, err = parseIfMatch(ifMatch)
+			if err != nil {
+				resp.OnError(ctx, w, err)
+				return
+			}
+			input.Conditional = true
 		}
-		err = c.handle(ctx, input)
+
+		version, err := c.handle(ctx, input)
 		if err != nil {
 			resp.OnError(ctx, w, err)
 		} else {
+			if input.Conditional {
+				w.Header().Set("ETag", formatETag(version))
+			}
 			resp.OnSuccess(w, true)
 		}
 	}
 }
 
-func (c *AdminApiSetLimit) handle(ctx context.Context, input AdminApiSetLimitInput) error {
+func (c *AdminApiSetLimit) handle(ctx context.Context, input AdminApiSetLimitInput) (int64, error) {
 	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
 		"controller": "AdminApiSetLimit",
 	})
 
+	if input.Conditional {
+		expectedVersion := input.Version
+		if input.AnyVersion {
+			// Setting the limit at its current version keeps it from being recreated if concurrently removed.
+			_, currentVersion, err := c.Biller.GetLimit(ctx, input.Token, input.Endpoint)
+			if err != nil {
+				return 0, errors.Wrap(err, "")
+			}
+			if currentVersion == 0 {
+				return 0, errors.Wrap(data.ErrPreconditionFailed, "no limit is set")
+			}
+			expectedVersion = currentVersion
+		}
+
+		version, err := c.Biller.SetLimitIfVersion(ctx, input.Token, input.Endpoint, input.Limit, expectedVersion)
+		return version, errors.Wrap(err, "")
+	}
+
 	err := c.Biller.SetLimit(ctx, input.Token, input.Endpoint, input.Limit)
-	return errors.Wrap(err, "")
+	return 0, errors.Wrap(err, "")
 }
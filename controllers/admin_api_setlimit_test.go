@@ -3,8 +3,11 @@ package controllers
 import (
 	"context"
 	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	pkgerrors "github.com/pkg/errors"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
 	"testing"
@@ -104,3 +107,271 @@ func TestAdminApiSetLimit_HandleFunc_SetLimitErr(t *testing.T) {
 		t.Error("Expected responder's OnError method to be called, was not called")
 	}
 }
+
+func TestAdminApiSetLimit_HandleFunc_IfMatch(t *testing.T) {
+	t.Parallel()
+
+	calledSetLimitIfVersion := false
+	b := newTestLimitedEndpointBiller(t)
+	b.SetLimitIfVersionFunc = func(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+		calledSetLimitIfVersion = true
+
+		if limit != 86400 {
+			t.Errorf("Expected limit %d, got limit %d", 86400, limit)
+		}
+		if version != 7 {
+			t.Errorf("Expected version %d, got version %d", 7, version)
+		}
+		return 8, nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	w := httptest.NewRecorder()
+	handler(w, &http.Request{
+		Header: http.Header{
+			"If-Match": []string{`"7"`},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledSetLimitIfVersion {
+		t.Error("Expected SetLimitIfVersion to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+	if etag := w.Header().Get("ETag"); etag != `"8"` {
+		t.Errorf("Expected ETag '%s', got '%s'", `"8"`, etag)
+	}
+}
+
+func TestAdminApiSetLimit_HandleFunc_IfMatchConflict(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := &data.VersionConflictError{Kind: "TokenLimit", Key: "bluh/bar", Expected: 7, Actual: 9}
+	b := newTestLimitedEndpointBiller(t)
+	b.SetLimitIfVersionFunc = func(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+		return 0, expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		if pkgerrors.Cause(err) != expectedErr {
+			t.Errorf("Expected error '%s', got '%s'", expectedErr, err)
+		}
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(httptest.NewRecorder(), &http.Request{
+		Header: http.Header{
+			"If-Match": []string{`"7"`},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
+
+func TestAdminApiSetLimit_HandleFunc_BadIfMatch(t *testing.T) {
+	t.Parallel()
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		if pkgerrors.Cause(err) != data.ErrInvalidETag {
+			t.Errorf("Expected error '%s', got '%s'", data.ErrInvalidETag, err)
+		}
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: newTestLimitedEndpointBiller(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(httptest.NewRecorder(), &http.Request{
+		Header: http.Header{
+			"If-Match": []string{"7"},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
+
+func TestAdminApiSetLimit_HandleFunc_WeakIfMatch(t *testing.T) {
+	t.Parallel()
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		if pkgerrors.Cause(err) != data.ErrPreconditionFailed {
+			t.Errorf("Expected error '%s', got '%s'", data.ErrPreconditionFailed, err)
+		}
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: newTestLimitedEndpointBiller(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(httptest.NewRecorder(), &http.Request{
+		Header: http.Header{
+			"If-Match": []string{`W/"7"`},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
+
+func TestAdminApiSetLimit_HandleFunc_IfMatchAny(t *testing.T) {
+	t.Parallel()
+
+	b := newTestLimitedEndpointBiller(t)
+	b.GetLimitFunc = func(ctx context.Context, token, endpoint string) (int64, int64, error) {
+		return 10, 7, nil
+	}
+	calledSetLimitIfVersion := false
+	b.SetLimitIfVersionFunc = func(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+		calledSetLimitIfVersion = true
+		if version != 7 {
+			t.Errorf("Expected version %d, got %d", 7, version)
+		}
+		return 8, nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	w := httptest.NewRecorder()
+	handler(w, &http.Request{
+		Header: http.Header{
+			"If-Match": []string{"*"},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledSetLimitIfVersion {
+		t.Error("Expected SetLimitIfVersion to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+	if etag := w.Header().Get("ETag"); etag != `"8"` {
+		t.Errorf("Expected ETag '%s', got '%s'", `"8"`, etag)
+	}
+}
+
+func TestAdminApiSetLimit_HandleFunc_IfMatchAnyNoLimit(t *testing.T) {
+	t.Parallel()
+
+	b := newTestLimitedEndpointBiller(t)
+	b.GetLimitFunc = func(ctx context.Context, token, endpoint string) (int64, int64, error) {
+		return 0, 0, nil
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		if pkgerrors.Cause(err) != data.ErrPreconditionFailed {
+			t.Errorf("Expected error '%s', got '%s'", data.ErrPreconditionFailed, err)
+		}
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSetLimit{
+		Biller: b,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(httptest.NewRecorder(), &http.Request{
+		Header: http.Header{
+			"If-Match": []string{"*"},
+		},
+		Form: url.Values{
+			"token":    []string{"bluh"},
+			"endpoint": []string{"bar"},
+			"limit":    []string{"86400"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
@@ -0,0 +1,41 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type AdminApiSweepExpired struct {
+	Sweeper ExpirySweeper
+}
+
+// Deletes expired entities, returning how many were deleted. Intended to be triggered by cron.
+func (c *AdminApiSweepExpired) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		deleted, err := c.handle(ctx)
+		if err != nil {
+			resp.OnError(ctx, w, err)
+		} else {
+			resp.OnSuccess(w, deleted)
+		}
+	}
+}
+
+func (c *AdminApiSweepExpired) handle(ctx context.Context) (int, error) {
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"controller": "AdminApiSweepExpired",
+	})
+
+	deleted, err := c.Sweeper.Sweep(ctx)
+
+	return deleted, errors.Wrap(err, "")
+}
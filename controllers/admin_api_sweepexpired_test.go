@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"testing"
+)
+
+func TestAdminApiSweepExpired_HandleFunc_MakeContextErr(t *testing.T) {
+	t.Parallel()
+
+	calledOnContextError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnContextErrorFunc = func(w http.ResponseWriter, err error) {
+		calledOnContextError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return nil, errors.New("bluh")
+	}
+
+	c := &AdminApiSweepExpired{
+		Sweeper: newTestExpirySweeper(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnContextError {
+		t.Error("Expected responder's OnContextError method to be called, was not called")
+	}
+}
+
+func TestAdminApiSweepExpired_HandleFunc_SweepErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	s := newTestExpirySweeper(t)
+	s.SweepFunc = func(ctx context.Context) (int, error) {
+		return 3, expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSweepExpired{
+		Sweeper: s,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
+
+func TestAdminApiSweepExpired_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	calledSweep := false
+	s := newTestExpirySweeper(t)
+	s.SweepFunc = func(ctx context.Context) (int, error) {
+		calledSweep = true
+		return 42, nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		if v != 42 {
+			t.Errorf("Expected %d deleted, got %v", 42, v)
+		}
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &AdminApiSweepExpired{
+		Sweeper: s,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledSweep {
+		t.Error("Expected Sweep to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+}
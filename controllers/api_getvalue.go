@@ -0,0 +1,49 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ApiGetValue is an example endpoint for API token holders, getting a value belonging to their project.
+type ApiGetValue struct {
+	ValueStore ProjectValueStore
+}
+
+type ApiGetValueInput struct {
+	Project string
+	Name    string
+}
+
+func (c *ApiGetValue) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		input := ApiGetValueInput{
+			Project: r.FormValue("project"),
+			Name:    r.FormValue("name"),
+		}
+		value, err := c.handle(ctx, input)
+		if err != nil {
+			resp.OnError(ctx, w, err)
+		} else {
+			resp.OnSuccess(w, value)
+		}
+	}
+}
+
+func (c *ApiGetValue) handle(ctx context.Context, input ApiGetValueInput) (string, error) {
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"controller": "ApiGetValue",
+	})
+
+	value, err := c.ValueStore.GetValue(ctx, input.Project, input.Name)
+	return value, errors.Wrap(err, "")
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestApiGetValue_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	expectedProject := "foo"
+	expectedName := "bar"
+	expectedValue := "baz"
+
+	calledGetValue := false
+	vs := newTestProjectValueStore(t)
+	vs.GetValueFunc = func(ctx context.Context, project, name string) (string, error) {
+		calledGetValue = true
+
+		if project != expectedProject {
+			t.Errorf("Expected project '%s', got project '%s'", expectedProject, project)
+		}
+		if name != expectedName {
+			t.Errorf("Expected name '%s', got name '%s'", expectedName, name)
+		}
+		return expectedValue, nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		if v != expectedValue {
+			t.Errorf("Expected value '%s', got value '%v'", expectedValue, v)
+		}
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &ApiGetValue{
+		ValueStore: vs,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{expectedProject},
+			"name":    []string{expectedName},
+		},
+	})
+
+	if !calledGetValue {
+		t.Error("Expected GetValue to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+}
+
+func TestApiGetValue_HandleFunc_MakeContextErr(t *testing.T) {
+	t.Parallel()
+
+	calledOnContextError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnContextErrorFunc = func(w http.ResponseWriter, err error) {
+		calledOnContextError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return nil, errors.New("bluh")
+	}
+
+	c := &ApiGetValue{
+		ValueStore: newTestProjectValueStore(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnContextError {
+		t.Error("Expected responder's OnContextError method to be called, was not called")
+	}
+}
+
+func TestApiGetValue_HandleFunc_GetValueErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	vs := newTestProjectValueStore(t)
+	vs.GetValueFunc = func(ctx context.Context, project, name string) (string, error) {
+		return "", expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &ApiGetValue{
+		ValueStore: vs,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{"foo"},
+			"name":    []string{"bar"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
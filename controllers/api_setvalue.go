@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ApiSetValue is an example endpoint for API token holders, setting a value belonging to their project.
+type ApiSetValue struct {
+	ValueStore ProjectValueStore
+}
+
+type ApiSetValueInput struct {
+	Project string
+	Name    string
+	Value   string
+}
+
+func (c *ApiSetValue) HandleFunc(cm ContextMaker, resp WebApiResponder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, err := cm.MakeContext(r)
+		if err != nil {
+			resp.OnContextError(w, err)
+			return
+		}
+
+		input := ApiSetValueInput{
+			Project: r.FormValue("project"),
+			Name:    r.FormValue("name"),
+			Value:   r.FormValue("value"),
+		}
+		err = c.handle(ctx, input)
+		if err != nil {
+			resp.OnError(ctx, w, err)
+		} else {
+			resp.OnSuccess(w, true)
+		}
+	}
+}
+
+func (c *ApiSetValue) handle(ctx context.Context, input ApiSetValueInput) error {
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"controller": "ApiSetValue",
+	})
+
+	err := c.ValueStore.SetValue(ctx, input.Project, input.Name, input.Value)
+	return errors.Wrap(err, "")
+}
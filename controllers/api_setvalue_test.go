@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestApiSetValue_HandleFunc_Success(t *testing.T) {
+	t.Parallel()
+
+	expectedProject := "foo"
+	expectedName := "bar"
+	expectedValue := "baz"
+
+	calledSetValue := false
+	vs := newTestProjectValueStore(t)
+	vs.SetValueFunc = func(ctx context.Context, project, name, value string) error {
+		calledSetValue = true
+
+		if project != expectedProject {
+			t.Errorf("Expected project '%s', got project '%s'", expectedProject, project)
+		}
+		if name != expectedName {
+			t.Errorf("Expected name '%s', got name '%s'", expectedName, name)
+		}
+		if value != expectedValue {
+			t.Errorf("Expected value '%s', got value '%s'", expectedValue, value)
+		}
+		return nil
+	}
+
+	calledOnSuccess := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnSuccessFunc = func(w http.ResponseWriter, v interface{}) {
+		if v != true {
+			t.Errorf("Expected result %v, got %v", true, v)
+		}
+		calledOnSuccess = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &ApiSetValue{
+		ValueStore: vs,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{expectedProject},
+			"name":    []string{expectedName},
+			"value":   []string{expectedValue},
+		},
+	})
+
+	if !calledSetValue {
+		t.Error("Expected SetValue to be called, was not called")
+	}
+	if !calledOnSuccess {
+		t.Error("Expected responder's OnSuccess method to be called, was not called")
+	}
+}
+
+func TestApiSetValue_HandleFunc_MakeContextErr(t *testing.T) {
+	t.Parallel()
+
+	calledOnContextError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnContextErrorFunc = func(w http.ResponseWriter, err error) {
+		calledOnContextError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return nil, errors.New("bluh")
+	}
+
+	c := &ApiSetValue{
+		ValueStore: newTestProjectValueStore(t),
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{})
+
+	if !calledOnContextError {
+		t.Error("Expected responder's OnContextError method to be called, was not called")
+	}
+}
+
+func TestApiSetValue_HandleFunc_SetValueErr(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	vs := newTestProjectValueStore(t)
+	vs.SetValueFunc = func(ctx context.Context, project, name, value string) error {
+		return expectedErr
+	}
+
+	calledOnError := false
+	r := testhelpers.NewWebApiResponder(t)
+	r.OnErrorFunc = func(ctx context.Context, w http.ResponseWriter, err error) {
+		calledOnError = true
+	}
+
+	cm := testhelpers.NewContextMaker(t)
+	cm.MakeContextFunc = func(r *http.Request) (i context.Context, e error) {
+		return context.Background(), nil
+	}
+
+	c := &ApiSetValue{
+		ValueStore: vs,
+	}
+	handler := c.HandleFunc(cm, r)
+	handler(nil, &http.Request{
+		Form: url.Values{
+			"project": []string{"foo"},
+			"name":    []string{"bar"},
+			"value":   []string{"baz"},
+		},
+	})
+
+	if !calledOnError {
+		t.Error("Expected responder's OnError method to be called, was not called")
+	}
+}
@@ -0,0 +1,42 @@
+package controllers
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// ETags are entity versions, quoted as HTTP requires.
+func formatETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+func parseETag(etag string) (int64, error) {
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil || len(etag) == 0 || etag[0] != '"' {
+		return 0, errors.Wrapf(data.ErrInvalidETag, "'%s'", etag)
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(data.ErrInvalidETag, "'%s'", etag)
+	}
+	return version, nil
+}
+
+// Parses an If-Match header, returning the version it requires, or true if it is "*",
+// which matches any existing entity.
+// If-Match uses strong comparison, which weak ETags never pass, so they fail with data.ErrPreconditionFailed.
+func parseIfMatch(ifMatch string) (int64, bool, error) {
+	ifMatch = strings.TrimSpace(ifMatch)
+	if ifMatch == "*" {
+		return 0, true, nil
+	}
+	if strings.HasPrefix(ifMatch, "W/") {
+		return 0, false, errors.Wrapf(data.ErrPreconditionFailed, "weak etag '%s' in If-Match", ifMatch)
+	}
+
+	version, err := parseETag(ifMatch)
+	return version, false, err
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"testing"
+)
+
+func TestETag(t *testing.T) {
+	t.Parallel()
+
+	etag := formatETag(7)
+	if etag != `"7"` {
+		t.Errorf("Expected ETag '%s', got '%s'", `"7"`, etag)
+	}
+
+	version, err := parseETag(etag)
+	if err != nil {
+		t.Errorf("Unexpected error parsing ETag: %s", err)
+	}
+	if version != 7 {
+		t.Errorf("Expected version %d, got %d", 7, version)
+	}
+}
+
+func TestParseETag_Invalid(t *testing.T) {
+	for _, etag := range []string{"7", `W/"7"`, `"bluh"`, `"`, ""} {
+		etag := etag
+		t.Run(etag, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := parseETag(etag)
+			if errors.Cause(err) != data.ErrInvalidETag {
+				t.Errorf("Expected error '%s' parsing ETag '%s', got '%v'", data.ErrInvalidETag, etag, err)
+			}
+		})
+	}
+}
+
+func TestParseIfMatch(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label           string
+		IfMatch         string
+		ExpectedVersion int64
+		ExpectedAny     bool
+		ExpectedErr     error
+	}{
+		{
+			Label:           "Version",
+			IfMatch:         `"7"`,
+			ExpectedVersion: 7,
+		},
+		{
+			Label:       "Any",
+			IfMatch:     "*",
+			ExpectedAny: true,
+		},
+		{
+			Label:       "Weak",
+			IfMatch:     `W/"7"`,
+			ExpectedErr: data.ErrPreconditionFailed,
+		},
+		{
+			Label:       "Malformed",
+			IfMatch:     "bluh",
+			ExpectedErr: data.ErrInvalidETag,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			version, anyVersion, err := parseIfMatch(testCase.IfMatch)
+			if errors.Cause(err) != testCase.ExpectedErr {
+				t.Errorf("Expected error '%v' from parseIfMatch, got '%v'", testCase.ExpectedErr, err)
+			}
+			if version != testCase.ExpectedVersion {
+				t.Errorf("Expected version %d, got %d", testCase.ExpectedVersion, version)
+			}
+			if anyVersion != testCase.ExpectedAny {
+				t.Errorf("Expected any to be %v, was %v", testCase.ExpectedAny, anyVersion)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"net/http"
 )
 
@@ -10,15 +11,33 @@ type ContextMaker interface {
 }
 
 type LimitedEndpointBiller interface {
+	GetLimit(ctx context.Context, token, endpoint string) (int64, int64, error)
 	SetLimit(ctx context.Context, token, endpoint string, limit int64) error
+	SetLimitIfVersion(ctx context.Context, token, endpoint string, limit, version int64) (int64, error)
+}
+
+type ExpirySweeper interface {
+	Sweep(ctx context.Context) (int, error)
+}
+
+type RetryMetricsReader interface {
+	Retried() int64
+	Exhausted() int64
 }
 
 type ProjectTokenLister interface {
 	CreateToken(ctx context.Context, project string) (string, error)
+	ListTokens(ctx context.Context, project, cursor string, pageSize int) (data.Page, error)
+}
+
+type ProjectValueStore interface {
+	GetValue(ctx context.Context, project, name string) (string, error)
+	SetValue(ctx context.Context, project, name, value string) error
 }
 
 type WebApiResponder interface {
 	OnContextError(w http.ResponseWriter, err error)
 	OnError(ctx context.Context, w http.ResponseWriter, err error)
 	OnSuccess(w http.ResponseWriter, v interface{})
+	OnSuccessPage(w http.ResponseWriter, page data.Page)
 }
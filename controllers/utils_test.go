@@ -2,39 +2,123 @@ package controllers
 
 import (
 	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"testing"
 )
 
 func newTestLimitedEndpointBiller(t *testing.T) *testLimitedEndpointBiller {
 	return &testLimitedEndpointBiller{
+		GetLimitFunc: func(ctx context.Context, token, endpoint string) (int64, int64, error) {
+			t.Error("GetLimit should not be called")
+			return 0, 0, nil
+		},
 		SetLimitFunc: func(ctx context.Context, token, endpoint string, limit int64) error {
 			t.Error("SetLimit should not be called")
 			return nil
 		},
+		SetLimitIfVersionFunc: func(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+			t.Error("SetLimitIfVersion should not be called")
+			return 0, nil
+		},
 	}
 }
 
 type testLimitedEndpointBiller struct {
-	SetLimitFunc func(ctx context.Context, token, endpoint string, limit int64) error
+	GetLimitFunc          func(ctx context.Context, token, endpoint string) (int64, int64, error)
+	SetLimitFunc          func(ctx context.Context, token, endpoint string, limit int64) error
+	SetLimitIfVersionFunc func(ctx context.Context, token, endpoint string, limit, version int64) (int64, error)
+}
+
+func (b *testLimitedEndpointBiller) GetLimit(ctx context.Context, token, endpoint string) (int64, int64, error) {
+	return b.GetLimitFunc(ctx, token, endpoint)
 }
 
 func (b *testLimitedEndpointBiller) SetLimit(ctx context.Context, token, endpoint string, limit int64) error {
 	return b.SetLimitFunc(ctx, token, endpoint, limit)
 }
 
+func (b *testLimitedEndpointBiller) SetLimitIfVersion(ctx context.Context, token, endpoint string, limit, version int64) (int64, error) {
+	return b.SetLimitIfVersionFunc(ctx, token, endpoint, limit, version)
+}
+
 func newTestProjectTokenLister(t *testing.T) *testProjectTokenLister {
 	return &testProjectTokenLister{
 		CreateTokenFunc: func(ctx context.Context, project string) (string, error) {
 			t.Error("CreateToken should not be called")
 			return "", nil
 		},
+		ListTokensFunc: func(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+			t.Error("ListTokens should not be called")
+			return data.Page{}, nil
+		},
 	}
 }
 
 type testProjectTokenLister struct {
 	CreateTokenFunc func(ctx context.Context, project string) (string, error)
+	ListTokensFunc  func(ctx context.Context, project, cursor string, pageSize int) (data.Page, error)
 }
 
 func (ptl *testProjectTokenLister) CreateToken(ctx context.Context, project string) (string, error) {
 	return ptl.CreateTokenFunc(ctx, project)
 }
+
+func (ptl *testProjectTokenLister) ListTokens(ctx context.Context, project, cursor string, pageSize int) (data.Page, error) {
+	return ptl.ListTokensFunc(ctx, project, cursor, pageSize)
+}
+
+func newTestExpirySweeper(t *testing.T) *testExpirySweeper {
+	return &testExpirySweeper{
+		SweepFunc: func(ctx context.Context) (int, error) {
+			t.Error("Sweep should not be called")
+			return 0, nil
+		},
+	}
+}
+
+type testExpirySweeper struct {
+	SweepFunc func(ctx context.Context) (int, error)
+}
+
+func (s *testExpirySweeper) Sweep(ctx context.Context) (int, error) {
+	return s.SweepFunc(ctx)
+}
+
+func newTestProjectValueStore(t *testing.T) *testProjectValueStore {
+	return &testProjectValueStore{
+		GetValueFunc: func(ctx context.Context, project, name string) (string, error) {
+			t.Error("GetValue should not be called")
+			return "", nil
+		},
+		SetValueFunc: func(ctx context.Context, project, name, value string) error {
+			t.Error("SetValue should not be called")
+			return nil
+		},
+	}
+}
+
+type testProjectValueStore struct {
+	GetValueFunc func(ctx context.Context, project, name string) (string, error)
+	SetValueFunc func(ctx context.Context, project, name, value string) error
+}
+
+func (s *testProjectValueStore) GetValue(ctx context.Context, project, name string) (string, error) {
+	return s.GetValueFunc(ctx, project, name)
+}
+
+func (s *testProjectValueStore) SetValue(ctx context.Context, project, name, value string) error {
+	return s.SetValueFunc(ctx, project, name, value)
+}
+
+type testRetryMetricsReader struct {
+	retried   int64
+	exhausted int64
+}
+
+func (m *testRetryMetricsReader) Retried() int64 {
+	return m.retried
+}
+
+func (m *testRetryMetricsReader) Exhausted() int64 {
+	return m.exhausted
+}
@@ -0,0 +1,52 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// CacheStore is a shared cache of values by key, such as memcache.
+// Values may be evicted at any time, so must always be recoverable from elsewhere.
+// A TTL of zero means the value does not expire, though it may still be evicted.
+type CacheStore interface {
+	// Gets a value, returning ErrCacheMiss if not present.
+	Get(ctx context.Context, key string, v interface{}) error
+
+	// Gets several values, returning a MultiError with ErrCacheMiss for each key not present.
+	GetMulti(ctx context.Context, keys []string, v []interface{}) error
+
+	Set(ctx context.Context, key string, v interface{}) error
+	SetWithTTL(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+	SetMulti(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error
+
+	// Sets a value only if the key is not already present, returning ErrCacheNotStored if it is.
+	Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+
+	// Gets a value along with a token for replacing it with CompareAndSwap.
+	GetForCAS(ctx context.Context, key string, v interface{}) (CASToken, error)
+
+	// Replaces a value read with GetForCAS, only if it has not changed since.
+	// Returns ErrCacheCASConflict if it was changed, or ErrCacheNotStored if it was deleted or evicted.
+	CompareAndSwap(ctx context.Context, key string, token CASToken, ttl time.Duration, v interface{}) error
+
+	// Atomically adds delta to a counter, returning its new value.
+	// If the counter is not present, it is first created with initialValue.
+	// Counters share keys with values set by other methods, so a key must be used for only one or the other;
+	// counters are held as decimal strings, as memcache holds them, so cannot be read with Get.
+	// Decrementing a counter below zero leaves it at zero.
+	Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error)
+
+	// Increments a counter as Increment does, creating it with the given TTL if not present.
+	// Incrementing a counter keeps its expiry.
+	IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error)
+
+	// Atomically adds delta to a counter, returning ErrCacheMiss if it is not present.
+	IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error)
+
+	// Deletes a value, returning ErrCacheMiss if not present, as Get does.
+	Delete(ctx context.Context, key string) error
+}
+
+// CASToken identifies the version of a cached value read by GetForCAS.
+// It is opaque, and only valid for the CacheStore and key it was read from.
+type CASToken interface{}
@@ -0,0 +1,215 @@
+package data
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+)
+
+// Codec serializes entity content.
+// Its name is stored alongside content it serializes, so must not change once content has been written with it.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// EntityCodec is a Codec whose serialized content is bound to the entity it is stored in,
+// such as an encrypting codec authenticating the entity's kind and key, so content can't be moved between entities.
+// ContentFormat serializes entity content with these methods in place of Marshal and Unmarshal.
+type EntityCodec interface {
+	Codec
+	MarshalEntity(kind, key string, v interface{}) ([]byte, error)
+	UnmarshalEntity(kind, key string, data []byte, v interface{}) error
+}
+
+// ExclusiveCodec is a Codec which may require that stored content was written with it,
+// such as an encrypting codec, which must not read plaintext content anyone able to write to the store could forge.
+type ExclusiveCodec interface {
+	Codec
+
+	// Returns whether content written with any other codec is rejected.
+	Exclusive() bool
+}
+
+// JSONCodec serializes content as JSON. It is the default codec, and content stored without a codec name is JSON.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	return b, errors.Wrap(err, "")
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return errors.Wrap(json.Unmarshal(data, v), "")
+}
+
+// GobCodec serializes content with encoding/gob.
+type GobCodec struct{}
+
+func (GobCodec) Name() string {
+	return "gob"
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return errors.Wrap(gob.NewDecoder(bytes.NewReader(data)).Decode(v), "")
+}
+
+// ContentMigration upgrades content from one schema version to the next.
+// It is given content serialized with codec, and returns the upgraded content serialized with the same codec.
+type ContentMigration func(codec Codec, content []byte) ([]byte, error)
+
+// ContentSchema is the history of a kind's content format.
+// Migrations[i] upgrades content from schema version i to i+1, and content is written at version len(Migrations).
+// Migrations must only ever be appended to.
+type ContentSchema struct {
+	Migrations []ContentMigration
+}
+
+// Returns the schema version content is currently written at.
+func (s ContentSchema) Version() int64 {
+	return int64(len(s.Migrations))
+}
+
+// EncodedContent is serialized content, along with the codec and schema version it was serialized with.
+type EncodedContent struct {
+	Data []byte
+
+	// Name of the codec; empty for JSON, as used before codecs were selectable.
+	Codec string
+
+	// Schema version; zero for content written before its kind had a schema.
+	Version int64
+}
+
+// ContentFormat controls how a store serializes entity content.
+// The zero value serializes content as JSON, with no schema migrations.
+type ContentFormat struct {
+	// Codec used to serialize content when writing. If nil, JSONCodec is used.
+	// Content previously written with another codec remains readable if it is JSONCodec or GobCodec.
+	Codec Codec
+
+	// Content schemas by kind. Kinds without a schema are written at version zero.
+	Schemas map[string]ContentSchema
+}
+
+// Serializes content of the entity with the given kind and key with the format's codec,
+// at the kind's current schema version.
+// The codec name is left empty for JSONCodec, so content is stored as it was before codecs were selectable.
+func (f ContentFormat) Encode(kind, key string, v interface{}) (EncodedContent, error) {
+	codec := f.codec()
+	b, err := forEntity(codec, kind, key).Marshal(v)
+	if err != nil {
+		return EncodedContent{}, err
+	}
+
+	c := EncodedContent{
+		Data:    b,
+		Version: f.Schemas[kind].Version(),
+	}
+	if codec.Name() != (JSONCodec{}).Name() {
+		c.Codec = codec.Name()
+	}
+	return c, nil
+}
+
+// Deserializes content of the entity with the given kind and key into v,
+// first migrating it to the kind's current schema version if older.
+// Content with a newer schema version than the kind's current one is rejected, as it cannot be read safely.
+func (f ContentFormat) Decode(kind, key string, c EncodedContent, v interface{}) error {
+	codec, err := f.codecByName(c.Codec)
+	if err != nil {
+		return err
+	}
+	codec = forEntity(codec, kind, key)
+
+	schema := f.Schemas[kind]
+	if c.Version > schema.Version() {
+		return errors.Errorf("content of kind '%s' had schema version %d, newer than current version %d", kind, c.Version, schema.Version())
+	}
+	if c.Version < 0 {
+		return errors.Errorf("content of kind '%s' had invalid schema version %d", kind, c.Version)
+	}
+
+	b := c.Data
+	for version := c.Version; version < schema.Version(); version++ {
+		b, err = schema.Migrations[version](codec, b)
+		if err != nil {
+			return errors.Wrapf(err, "unable to migrate content of kind '%s' from schema version %d", kind, version)
+		}
+	}
+
+	return codec.Unmarshal(b, v)
+}
+
+func (f ContentFormat) codec() Codec {
+	if f.Codec == nil {
+		return JSONCodec{}
+	}
+	return f.Codec
+}
+
+// Returns the codec content was written with, by the name stored alongside it.
+// If the format's codec is exclusive, content written with any other codec is rejected.
+func (f ContentFormat) codecByName(name string) (Codec, error) {
+	if f.Codec != nil && f.Codec.Name() == name {
+		return f.Codec, nil
+	}
+	if exclusive, ok := f.Codec.(ExclusiveCodec); ok && exclusive.Exclusive() {
+		return nil, errors.Errorf("content was not written with codec %s", f.Codec.Name())
+	}
+
+	if name == "" {
+		return JSONCodec{}, nil
+	}
+
+	switch name {
+	case (JSONCodec{}).Name():
+		return JSONCodec{}, nil
+	case (GobCodec{}).Name():
+		return GobCodec{}, nil
+	default:
+		return nil, errors.Errorf("content had unknown codec: %s", name)
+	}
+}
+
+// Binds an EntityCodec to an entity, so migrations and deserialization can use it as a plain Codec.
+// Other codecs are returned unchanged.
+func forEntity(codec Codec, kind, key string) Codec {
+	if ec, ok := codec.(EntityCodec); ok {
+		return entityBoundCodec{codec: ec, kind: kind, key: key}
+	}
+	return codec
+}
+
+type entityBoundCodec struct {
+	codec EntityCodec
+	kind  string
+	key   string
+}
+
+func (c entityBoundCodec) Name() string {
+	return c.codec.Name()
+}
+
+func (c entityBoundCodec) Marshal(v interface{}) ([]byte, error) {
+	return c.codec.MarshalEntity(c.kind, c.key, v)
+}
+
+func (c entityBoundCodec) Unmarshal(data []byte, v interface{}) error {
+	return c.codec.UnmarshalEntity(c.kind, c.key, data, v)
+}
@@ -0,0 +1,26 @@
+package data
+
+import "strings"
+
+// Identifies a single entity within a PersistentStore, for batch operations.
+type EntityKey struct {
+	Kind string
+	Key  string
+}
+
+// MultiError is returned by batch operations when any individual operation fails.
+// Each element is the error for the key at the same index, or nil if that key succeeded.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	var msgs []string
+	for _, err := range m {
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	if len(msgs) == 0 {
+		return "no errors"
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,28 @@
+package data
+
+import "github.com/pkg/errors"
+
+// Page is a single page of results from a listing, with a cursor to fetch the next.
+type Page struct {
+	Items interface{} `json:"items"`
+
+	// Opaque cursor to pass to the listing to continue; empty if there are no more results.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+const DefaultPageSize = 50
+
+const MaxPageSize = 500
+
+// Returns the page size to use for a requested size, applying the default and cap.
+func PageSize(requested int) int {
+	if requested <= 0 {
+		return DefaultPageSize
+	}
+	if requested > MaxPageSize {
+		return MaxPageSize
+	}
+	return requested
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
@@ -1,6 +1,9 @@
 package data
 
-import "github.com/pkg/errors"
+import (
+	"github.com/pkg/errors"
+	"time"
+)
 
 type Property struct {
 	Name string
@@ -10,14 +13,93 @@ type Property struct {
 	// - bool
 	// - string
 	// - float64
+	// - time.Time
+	// - []byte (never indexed, regardless of NoIndex)
 	//
 	// If non-nil, it must be exactly one of these types;
 	// it is not sufficient to have the same underlying type.
 	Value interface{}
+
+	// If true, the property is not indexed, so queries cannot filter or order on it.
+	NoIndex bool
+
+	// If true, the property is one value of a multi-valued property.
+	// An entity may have several properties of the same name only if all of them have Multiple set.
+	Multiple bool
+}
+
+// Returns an error if the property has a reserved name, or a value of a type not permitted above.
+func (p Property) Validate() error {
+	switch p.Value.(type) {
+	case int64:
+	case bool:
+	case string:
+	case float64:
+	case time.Time:
+	case []byte:
+	default:
+		return errors.Errorf("property '%s' had invalid type: %T", p.Name, p.Value)
+	}
+
+	if IsReservedPropertyName(p.Name) {
+		return errors.Errorf("property '%s' had reserved name", p.Name)
+	}
+	return nil
+}
+
+// Returns an error if any property is invalid, or several properties share a name without all having Multiple set.
+func ValidateProperties(properties []Property) error {
+	multiple := make(map[string]bool)
+	for _, p := range properties {
+		err := p.Validate()
+		if err != nil {
+			return err
+		}
+
+		if m, ok := multiple[p.Name]; ok && (!m || !p.Multiple) {
+			return errors.Errorf("property '%s' had several values, but Multiple was not set on all of them", p.Name)
+		}
+		multiple[p.Name] = p.Multiple
+	}
+	return nil
+}
+
+// Returns whether the property can be used in query filters and orders.
+func (p Property) Indexed() bool {
+	if _, ok := p.Value.([]byte); ok {
+		return false
+	}
+	return !p.NoIndex
+}
+
+// Returns whether a property name is reserved for a store's own use, holding an entity's content or metadata.
+func IsReservedPropertyName(name string) bool {
+	switch name {
+	case "Content", "ContentCodec", "ContentVersion", "Version", "Expiry":
+		return true
+	default:
+		return false
+	}
 }
 
 var ErrNoSuchEntity = errors.New("no such entity")
 
 var ErrWriteAccessDenied = errors.New("access denied")
 
+var ErrConcurrentTransaction = errors.New("transaction failed due to concurrent modification")
+
 var ErrOutOfCredit = errors.New("no credit available")
+
+var ErrInvalidApiToken = errors.New("expected exactly one api token for an API request")
+
+var ErrNoSuchFile = errors.New("no such file")
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+var ErrCacheMiss = errors.New("cache miss")
+
+var ErrCacheNotStored = errors.New("cache value not stored")
+
+var ErrCacheCASConflict = errors.New("cache value changed since read")
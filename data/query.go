@@ -0,0 +1,249 @@
+package data
+
+import (
+	"github.com/pkg/errors"
+	"strings"
+	"time"
+)
+
+type FilterOp string
+
+const (
+	FilterEqual          FilterOp = "="
+	FilterLessThan       FilterOp = "<"
+	FilterLessOrEqual    FilterOp = "<="
+	FilterGreaterThan    FilterOp = ">"
+	FilterGreaterOrEqual FilterOp = ">="
+)
+
+// Filter restricts a query to entities with a property comparing to Value as Op specifies.
+// Entities without the property never match.
+type Filter struct {
+	Property string
+	Op       FilterOp
+	Value    interface{}
+}
+
+// Order sorts query results by a property, ascending unless Descending is set.
+// Entities without the property are excluded from the results.
+type Order struct {
+	Property   string
+	Descending bool
+}
+
+type Query struct {
+	Kind    string
+	Filters []Filter
+	Orders  []Order
+
+	// Maximum number of results to return; if zero, all matching results are returned.
+	Limit int
+
+	// Cursor returned by a previous query with the same parameters, to continue from.
+	Cursor string
+}
+
+type QueryResult struct {
+	Key        string
+	Properties []Property
+}
+
+// Returns an error if the query has an invalid filter or order.
+func (q Query) Validate() error {
+	if q.Limit < 0 {
+		return errors.Errorf("query had negative limit: %d", q.Limit)
+	}
+
+	for _, f := range q.Filters {
+		switch f.Op {
+		case FilterEqual, FilterLessThan, FilterLessOrEqual, FilterGreaterThan, FilterGreaterOrEqual:
+		default:
+			return errors.Errorf("filter on property '%s' had invalid operator: %s", f.Property, f.Op)
+		}
+
+		err := Property{Name: f.Property, Value: f.Value}.Validate()
+		if err != nil {
+			return err
+		}
+		if _, ok := f.Value.([]byte); ok {
+			return errors.Errorf("filter on property '%s' had unindexable []byte value", f.Property)
+		}
+	}
+
+	for _, o := range q.Orders {
+		if IsReservedPropertyName(o.Property) {
+			return errors.Errorf("order on property '%s' had reserved name", o.Property)
+		}
+	}
+	return nil
+}
+
+// Returns whether an entity's properties match the query's filters, and have a value for each of its orders.
+// As in Datastore, only indexed values are considered. Each equality filter may match any value of a
+// multi-valued property, but the inequality filters on a property must all be satisfied by the same value.
+func (q Query) Matches(properties []Property) bool {
+	inequalities := make(map[string][]Filter)
+	for _, f := range q.Filters {
+		if f.Op != FilterEqual {
+			inequalities[f.Property] = append(inequalities[f.Property], f)
+			continue
+		}
+
+		found := false
+		for _, v := range propertyValues(properties, f.Property) {
+			if compareValues(v, f.Value) == 0 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for name, filters := range inequalities {
+		found := false
+		for _, v := range propertyValues(properties, name) {
+			if matchesFilters(v, filters) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, o := range q.Orders {
+		if len(propertyValues(properties, o.Property)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares entities' properties by the query's orders, returning a negative number if a sorts first,
+// a positive number if b does, and zero if neither does, in which case Datastore orders them by key.
+// Multi-valued properties order by their lowest value ascending, and their highest descending.
+func (q Query) Compare(a, b []Property) int {
+	for _, o := range q.Orders {
+		c := compareValues(orderValue(a, o), orderValue(b, o))
+		if o.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func matchesFilters(v interface{}, filters []Filter) bool {
+	for _, f := range filters {
+		c := compareValues(v, f.Value)
+		ok := false
+		switch f.Op {
+		case FilterEqual:
+			ok = c == 0
+		case FilterLessThan:
+			ok = c < 0
+		case FilterLessOrEqual:
+			ok = c <= 0
+		case FilterGreaterThan:
+			ok = c > 0
+		case FilterGreaterOrEqual:
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the indexed values of a property.
+func propertyValues(properties []Property, name string) []interface{} {
+	var values []interface{}
+	for _, p := range properties {
+		if p.Name == name && p.Indexed() {
+			values = append(values, p.Value)
+		}
+	}
+	return values
+}
+
+// Returns the value of a property an entity is sorted by for an order.
+func orderValue(properties []Property, o Order) interface{} {
+	var result interface{}
+	for i, v := range propertyValues(properties, o.Property) {
+		c := compareValues(v, result)
+		if i == 0 || (!o.Descending && c < 0) || (o.Descending && c > 0) {
+			result = v
+		}
+	}
+	return result
+}
+
+// Orders values as Datastore does; first by type, then by value.
+// Times are ordered among integers, by their value in microseconds.
+func compareValues(a, b interface{}) int {
+	a, b = timeValue(a), timeValue(b)
+
+	ra, rb := valueTypeRank(a), valueTypeRank(b)
+	if ra != rb {
+		if ra < rb {
+			return -1
+		}
+		return 1
+	}
+
+	switch av := a.(type) {
+	case int64:
+		bv := b.(int64)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+	case bool:
+		bv := b.(bool)
+		if !av && bv {
+			return -1
+		} else if av && !bv {
+			return 1
+		}
+	case string:
+		return strings.Compare(av, b.(string))
+	case float64:
+		bv := b.(float64)
+		if av < bv {
+			return -1
+		} else if av > bv {
+			return 1
+		}
+	}
+	return 0
+}
+
+func valueTypeRank(v interface{}) int {
+	switch v.(type) {
+	case int64:
+		return 1
+	case bool:
+		return 2
+	case string:
+		return 3
+	case float64:
+		return 4
+	}
+	return 0
+}
+
+// Converts times to microseconds since the epoch, as Datastore stores them; other values are returned unchanged.
+func timeValue(v interface{}) interface{} {
+	t, ok := v.(time.Time)
+	if !ok {
+		return v
+	}
+	return t.Unix()*1e6 + int64(t.Nanosecond()/1e3)
+}
@@ -0,0 +1,16 @@
+package data
+
+// TransactionOptions controls how a store runs a transaction.
+// The zero value gives the behaviour of Transact.
+type TransactionOptions struct {
+	// If true, the transaction may only read; writes within it fail.
+	ReadOnly bool
+
+	// Number of times the store attempts the transaction if it conflicts with a concurrent one.
+	// If zero, the store's default is used.
+	Attempts int
+
+	// If true, the transaction may touch only a single entity group, rather than crossing groups.
+	// Each entity is its own group, so this limits the transaction to a single entity.
+	SingleGroup bool
+}
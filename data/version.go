@@ -0,0 +1,40 @@
+package data
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+)
+
+// Returns a new random entity version.
+// Versions are never zero, which is the version of an entity which doesn't exist.
+func NewVersion() (int64, error) {
+	var b [8]byte
+	for {
+		_, err := rand.Read(b[:])
+		if err != nil {
+			return 0, errors.Wrap(err, "")
+		}
+
+		v := int64(binary.BigEndian.Uint64(b[:]) &^ (1 << 63))
+		if v != 0 {
+			return v, nil
+		}
+	}
+}
+
+// ErrInvalidETag is returned when an ETag given by a client is not one of the versions formatted as ETags.
+var ErrInvalidETag = errors.New("invalid etag")
+
+// VersionConflictError is returned by a conditional write if the entity's version was not the expected version.
+type VersionConflictError struct {
+	Kind     string
+	Key      string
+	Expected int64
+	Actual   int64
+}
+
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("version conflict on %s '%s': expected version %d, was %d", e.Kind, e.Key, e.Expected, e.Actual)
+}
@@ -0,0 +1,58 @@
+package datastoreutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+)
+
+// CursorSigner signs Datastore query cursors handed out to clients,
+// so clients can't forge cursors or reuse them against queries of another kind or namespace.
+// The signature is prepended to the Datastore cursor, and the whole base64 encoded.
+type CursorSigner struct {
+	// Key used to sign cursors. Cursors can't be signed or verified if unset.
+	Key []byte
+
+	Namespace string
+}
+
+// Signs a Datastore cursor for a query of the given kind, returning the cursor to hand to clients.
+func (s CursorSigner) Sign(kind, raw string) (string, error) {
+	if len(s.Key) == 0 {
+		return "", errors.New("unable to sign cursor: cursor key not configured")
+	}
+
+	signed := append(s.mac(kind, raw), raw...)
+	return base64.RawURLEncoding.EncodeToString(signed), nil
+}
+
+// Verifies a cursor from a client for a query of the given kind, returning the Datastore cursor it holds.
+// If it was not signed by Sign for the same kind and namespace, with the same key, data.ErrInvalidCursor is returned.
+func (s CursorSigner) Verify(kind, cursor string) (string, error) {
+	if len(s.Key) == 0 {
+		return "", errors.New("unable to verify cursor: cursor key not configured")
+	}
+
+	signed, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(signed) < sha256.Size {
+		return "", data.ErrInvalidCursor
+	}
+
+	mac, raw := signed[:sha256.Size], string(signed[sha256.Size:])
+	if !hmac.Equal(mac, s.mac(kind, raw)) {
+		return "", data.ErrInvalidCursor
+	}
+	return raw, nil
+}
+
+func (s CursorSigner) mac(kind, raw string) []byte {
+	h := hmac.New(sha256.New, s.Key)
+	h.Write([]byte(s.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(raw))
+	return h.Sum(nil)
+}
@@ -0,0 +1,111 @@
+package datastoreutil
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"testing"
+)
+
+func TestCursorSigner(t *testing.T) {
+	t.Parallel()
+
+	s := CursorSigner{
+		Key: []byte("bluh"),
+	}
+
+	cursor, err := s.Sign("Baz", "raw")
+	if err != nil {
+		t.Fatalf("Unexpected error signing cursor: %s", err)
+	}
+
+	raw, err := s.Verify("Baz", cursor)
+	if err != nil {
+		t.Fatalf("Unexpected error verifying cursor: %s", err)
+	}
+	if raw != "raw" {
+		t.Errorf("Expected verified cursor '%s', got '%s'", "raw", raw)
+	}
+}
+
+func TestCursorSigner_Invalid(t *testing.T) {
+	s := CursorSigner{
+		Key: []byte("bluh"),
+	}
+	cursor, err := s.Sign("Baz", "raw")
+	if err != nil {
+		t.Fatalf("Unexpected error signing cursor: %s", err)
+	}
+
+	tampered := []byte(cursor)
+	tampered[0] ^= 1
+
+	testCases := []struct {
+		Label  string
+		Signer CursorSigner
+		Kind   string
+		Cursor string
+	}{
+		{
+			Label:  "Tampered",
+			Signer: s,
+			Kind:   "Baz",
+			Cursor: string(tampered),
+		},
+		{
+			Label:  "OtherKind",
+			Signer: s,
+			Kind:   "Bar",
+			Cursor: cursor,
+		},
+		{
+			Label:  "OtherKey",
+			Signer: CursorSigner{Key: []byte("blah")},
+			Kind:   "Baz",
+			Cursor: cursor,
+		},
+		{
+			Label:  "OtherNamespace",
+			Signer: CursorSigner{Key: []byte("bluh"), Namespace: "Foo"},
+			Kind:   "Baz",
+			Cursor: cursor,
+		},
+		{
+			Label:  "Truncated",
+			Signer: s,
+			Kind:   "Baz",
+			Cursor: cursor[:10],
+		},
+		{
+			Label:  "NotBase64",
+			Signer: s,
+			Kind:   "Baz",
+			Cursor: "!!!",
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := testCase.Signer.Verify(testCase.Kind, testCase.Cursor)
+			if err != data.ErrInvalidCursor {
+				t.Errorf("Expected error '%s' verifying cursor, got '%s'", data.ErrInvalidCursor, err)
+			}
+		})
+	}
+}
+
+func TestCursorSigner_NoKey(t *testing.T) {
+	t.Parallel()
+
+	s := CursorSigner{}
+	_, err := s.Sign("Baz", "raw")
+	if err == nil {
+		t.Error("Expected error signing cursor with no key, got nil")
+	}
+
+	_, err = s.Verify("Baz", "bluh")
+	if err == nil {
+		t.Error("Expected error verifying cursor with no key, got nil")
+	}
+}
@@ -0,0 +1,139 @@
+// Package datastoreutil holds how entities are laid out in Datastore, shared by the App Engine and Cloud Datastore
+// stores so that either can read entities written by the other.
+//
+// An entity's properties are stored alongside reserved properties holding its serialized content and metadata.
+// Functions here work with properties as data.Property values; each store converts them to and from its
+// own client library's property type.
+package datastoreutil
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Splits the serialized content and reserved metadata properties out of a stored entity,
+// deserializing content into content, and returning its properties and version.
+// If the entity has expired, data.ErrNoSuchEntity is returned.
+func EntityFromProperties(format data.ContentFormat, kind, key string, stored []data.Property, content interface{}) ([]data.Property, int64, error) {
+	if Expired(stored, time.Now()) {
+		return nil, 0, data.ErrNoSuchEntity
+	}
+
+	var encoded data.EncodedContent
+	foundContent := false
+	for _, p := range stored {
+		switch p.Name {
+		case "Content":
+			contentBytes, ok := p.Value.([]byte)
+			if !ok {
+				return nil, 0, errors.New("entity contained content property with incorrect type")
+			}
+			encoded.Data = contentBytes
+			foundContent = true
+		case "ContentCodec":
+			encoded.Codec, _ = p.Value.(string)
+		case "ContentVersion":
+			encoded.Version, _ = p.Value.(int64)
+		}
+	}
+
+	if foundContent {
+		if content == nil {
+			return nil, 0, errors.New("entity contained content to deserialize, but content param was not set")
+		}
+
+		err := format.Decode(kind, key, encoded, content)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "unable to deserialize entity content")
+		}
+	} else if content != nil {
+		return nil, 0, errors.New("entity did not contain content to deserialize, but content param was set")
+	}
+
+	return UserProperties(stored), Version(stored), nil
+}
+
+// Builds the properties to store for an entity from its properties and version,
+// serializing content into a reserved property if non-nil.
+// The codec and schema version content was serialized with are stored alongside it, unless JSON and zero respectively.
+// If expiry is non-zero, it is stored in an indexed reserved property, so expired entities can be queried for.
+func EntityToProperties(format data.ContentFormat, kind, key string, properties []data.Property, content interface{}, version int64, expiry time.Time) ([]data.Property, error) {
+	err := data.ValidateProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := append([]data.Property(nil), properties...)
+	if content != nil {
+		encoded, err := format.Encode(kind, key, content)
+		if err != nil {
+			return nil, err
+		}
+
+		stored = append(stored, data.Property{
+			Name:    "Content",
+			Value:   encoded.Data,
+			NoIndex: true,
+		})
+		if encoded.Codec != "" {
+			stored = append(stored, data.Property{
+				Name:    "ContentCodec",
+				Value:   encoded.Codec,
+				NoIndex: true,
+			})
+		}
+		if encoded.Version != 0 {
+			stored = append(stored, data.Property{
+				Name:    "ContentVersion",
+				Value:   encoded.Version,
+				NoIndex: true,
+			})
+		}
+	}
+
+	stored = append(stored, data.Property{
+		Name:    "Version",
+		Value:   version,
+		NoIndex: true,
+	})
+	if !expiry.IsZero() {
+		stored = append(stored, data.Property{
+			Name:  "Expiry",
+			Value: expiry,
+		})
+	}
+	return stored, nil
+}
+
+// Returns a stored entity's properties, without its reserved properties.
+func UserProperties(stored []data.Property) (properties []data.Property) {
+	for _, p := range stored {
+		if !data.IsReservedPropertyName(p.Name) {
+			properties = append(properties, p)
+		}
+	}
+	return
+}
+
+// Returns a stored entity's version; entities last written before versions were introduced have version zero.
+func Version(stored []data.Property) int64 {
+	for _, p := range stored {
+		if p.Name == "Version" {
+			version, _ := p.Value.(int64)
+			return version
+		}
+	}
+	return 0
+}
+
+// Returns whether a stored entity has an expiry which has passed as of now.
+func Expired(stored []data.Property, now time.Time) bool {
+	for _, p := range stored {
+		if p.Name == "Expiry" {
+			expiry, ok := p.Value.(time.Time)
+			return ok && !now.Before(expiry)
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package datastoreutil
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func makeTestProperties() []data.Property {
+	return []data.Property{
+		{
+			Name:  "Foo1",
+			Value: "Bar",
+		},
+		{
+			Name:     "Tag",
+			Value:    "foo",
+			Multiple: true,
+		},
+		{
+			Name:     "Tag",
+			Value:    "bar",
+			Multiple: true,
+		},
+	}
+}
+
+func TestEntityToProperties_Invalid(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label         string
+		Modify        func(properties []data.Property)
+		ExpectedError string
+	}{
+		{
+			Label: "InvalidValue",
+			Modify: func(properties []data.Property) {
+				properties[0].Value = 7
+			},
+			ExpectedError: "property 'Foo1' had invalid type: int",
+		},
+		{
+			Label: "ContentName",
+			Modify: func(properties []data.Property) {
+				properties[0].Name = "Content"
+			},
+			ExpectedError: "property 'Content' had reserved name",
+		},
+		{
+			Label: "VersionName",
+			Modify: func(properties []data.Property) {
+				properties[0].Name = "Version"
+			},
+			ExpectedError: "property 'Version' had reserved name",
+		},
+		{
+			Label: "MultipleNotSet",
+			Modify: func(properties []data.Property) {
+				properties[2].Multiple = false
+			},
+			ExpectedError: "property 'Tag' had several values",
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			properties := makeTestProperties()
+			testCase.Modify(properties)
+
+			stored, err := EntityToProperties(data.ContentFormat{}, "Baz", "Bar", properties, nil, 7, time.Time{})
+			if err == nil || !strings.Contains(err.Error(), testCase.ExpectedError) {
+				t.Errorf("Expected error containing '%s' from EntityToProperties, got '%v'", testCase.ExpectedError, err)
+			}
+			if len(stored) != 0 {
+				t.Errorf("Expected no properties with error, got %v", stored)
+			}
+		})
+	}
+}
+
+func TestEntityToProperties_Reserved(t *testing.T) {
+	t.Parallel()
+
+	expiry := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	stored, err := EntityToProperties(data.ContentFormat{}, "Baz", "Bar", makeTestProperties(), &map[string]string{"Foo": "Bar"}, 7, expiry)
+	if err != nil {
+		t.Fatalf("Unexpected error from EntityToProperties: %s", err)
+	}
+
+	expected := append(makeTestProperties(),
+		data.Property{Name: "Content", Value: []byte(`{"Foo":"Bar"}`), NoIndex: true},
+		data.Property{Name: "Version", Value: int64(7), NoIndex: true},
+		data.Property{Name: "Expiry", Value: expiry},
+	)
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored properties %v, got %v", expected, stored)
+	}
+	if !Expired(stored, expiry) {
+		t.Error("Expected entity to be expired at its expiry")
+	}
+	if Expired(stored, expiry.Add(-time.Second)) {
+		t.Error("Expected entity not to be expired before its expiry")
+	}
+}
+
+func TestEntityFromProperties_Version(t *testing.T) {
+	t.Parallel()
+
+	stored := append(makeTestProperties(), data.Property{
+		Name:    "Version",
+		Value:   int64(7),
+		NoIndex: true,
+	})
+
+	properties, version, err := EntityFromProperties(data.ContentFormat{}, "Baz", "Bar", stored, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from EntityFromProperties: %s", err)
+	}
+	if version != 7 {
+		t.Errorf("Expected version %d, got %d", 7, version)
+	}
+	if !reflect.DeepEqual(properties, makeTestProperties()) {
+		t.Errorf("Expected properties %v with version removed, got %v", makeTestProperties(), properties)
+	}
+}
+
+func TestEntityFromProperties_Expiry(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label         string
+		Expiry        time.Time
+		ExpectedError error
+	}{
+		{
+			Label:  "NotExpired",
+			Expiry: time.Now().Add(time.Hour),
+		},
+		{
+			Label:         "Expired",
+			Expiry:        time.Now().Add(-time.Hour),
+			ExpectedError: data.ErrNoSuchEntity,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			stored := append(makeTestProperties(), data.Property{
+				Name:  "Expiry",
+				Value: testCase.Expiry,
+			})
+
+			properties, _, err := EntityFromProperties(data.ContentFormat{}, "Baz", "Bar", stored, nil)
+			if err != testCase.ExpectedError {
+				t.Fatalf("Expected error '%v' from EntityFromProperties, got '%v'", testCase.ExpectedError, err)
+			}
+			if err == nil && !reflect.DeepEqual(properties, makeTestProperties()) {
+				t.Errorf("Expected properties %v with expiry removed, got %v", makeTestProperties(), properties)
+			}
+		})
+	}
+}
+
+func TestEntityFromProperties_ContentParamWithNoContent(t *testing.T) {
+	t.Parallel()
+
+	var content map[string]string
+	_, _, err := EntityFromProperties(data.ContentFormat{}, "Baz", "Bar", makeTestProperties(), &content)
+	if err == nil {
+		t.Error("Expected error from EntityFromProperties with content param but no content, got nil")
+	}
+}
+
+func TestEntityProperties_ContentFormat(t *testing.T) {
+	t.Parallel()
+
+	format := data.ContentFormat{
+		Codec: data.GobCodec{},
+		Schemas: map[string]data.ContentSchema{
+			"Baz": {Migrations: []data.ContentMigration{
+				func(codec data.Codec, content []byte) ([]byte, error) {
+					return content, nil
+				},
+			}},
+		},
+	}
+
+	stored, err := EntityToProperties(format, "Baz", "Bar", makeTestProperties(), &map[string]string{"Foo": "Bar"}, 7, time.Time{})
+	if err != nil {
+		t.Fatalf("Unexpected error from EntityToProperties: %s", err)
+	}
+
+	var codec interface{}
+	var contentVersion interface{}
+	for _, p := range stored {
+		switch p.Name {
+		case "ContentCodec":
+			codec = p.Value
+		case "ContentVersion":
+			contentVersion = p.Value
+		}
+	}
+	if codec != "gob" {
+		t.Errorf("Expected content codec '%s', got '%v'", "gob", codec)
+	}
+	if contentVersion != int64(1) {
+		t.Errorf("Expected content version %d, got %v", 1, contentVersion)
+	}
+
+	var content map[string]string
+	properties, version, err := EntityFromProperties(format, "Baz", "Bar", stored, &content)
+	if err != nil {
+		t.Fatalf("Unexpected error from EntityFromProperties: %s", err)
+	}
+	if !reflect.DeepEqual(properties, makeTestProperties()) {
+		t.Errorf("Expected properties %v with metadata removed, got %v", makeTestProperties(), properties)
+	}
+	if version != 7 {
+		t.Errorf("Expected version %d, got %d", 7, version)
+	}
+	if content["Foo"] != "Bar" {
+		t.Errorf("Expected content to round trip, got %v", content)
+	}
+}
@@ -0,0 +1,187 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// Codec is a data.Codec encrypting content serialized by another codec, using envelope encryption.
+// Each value is encrypted with AES-256-GCM under a fresh data key, which is stored alongside it wrapped by the KeyProvider.
+// Rotating the KeyProvider's current key leaves content written under older keys readable, so long as the
+// KeyProvider can still unwrap with them; content is re-encrypted under the current key when next written.
+//
+// Entity content is bound to its entity's kind and key, authenticated as associated data,
+// so it can't be copied or swapped between entities.
+// As an exclusive codec, content in stores using it must have been written with it.
+type Codec struct {
+	// Codec serializing content before encryption; if nil, data.JSONCodec is used.
+	Inner data.Codec
+
+	Keys KeyProvider
+
+	// If true, content written before encryption was enabled, and encrypted content not bound to an entity,
+	// is read rather than rejected. Either can be forged by anyone able to write to the store,
+	// so this should only be set while existing content is rewritten.
+	Migrating bool
+}
+
+type envelope struct {
+	KeyID      string `json:"kid"`
+	WrappedKey []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ct"`
+
+	// Whether the entity's kind and key were authenticated as associated data.
+	Bound bool `json:"bound,omitempty"`
+}
+
+func (c Codec) Name() string {
+	return "aesgcm+" + c.inner().Name()
+}
+
+func (c Codec) Exclusive() bool {
+	return !c.Migrating
+}
+
+// Encrypts content not stored in an entity, such as cached values.
+func (c Codec) Marshal(v interface{}) ([]byte, error) {
+	return c.marshal(v, nil)
+}
+
+func (c Codec) MarshalEntity(kind, key string, v interface{}) ([]byte, error) {
+	return c.marshal(v, entityAdditionalData(kind, key))
+}
+
+func (c Codec) marshal(v interface{}, additionalData []byte) ([]byte, error) {
+	plaintext, err := c.inner().Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	keyID, wrappedKey, err := c.Keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to wrap data key")
+	}
+
+	nonce, ciphertext, err := seal(dataKey, plaintext, additionalData)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(&envelope{
+		KeyID:      keyID,
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+		Bound:      additionalData != nil,
+	})
+	return b, errors.Wrap(err, "")
+}
+
+// Decrypts content not stored in an entity, as encrypted by Marshal.
+func (c Codec) Unmarshal(b []byte, v interface{}) error {
+	var e envelope
+	err := json.Unmarshal(b, &e)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse encrypted content")
+	}
+	if e.Bound {
+		return errors.New("encrypted content is bound to an entity")
+	}
+	return c.unmarshal(e, nil, v)
+}
+
+func (c Codec) UnmarshalEntity(kind, key string, b []byte, v interface{}) error {
+	var e envelope
+	err := json.Unmarshal(b, &e)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse encrypted content")
+	}
+
+	var additionalData []byte
+	if e.Bound {
+		additionalData = entityAdditionalData(kind, key)
+	} else if !c.Migrating {
+		return errors.Errorf("encrypted content of %s '%s' is not bound to its entity", kind, key)
+	}
+	return c.unmarshal(e, additionalData, v)
+}
+
+func (c Codec) unmarshal(e envelope, additionalData []byte, v interface{}) error {
+	dataKey, err := c.Keys.UnwrapKey(e.KeyID, e.WrappedKey)
+	if err != nil {
+		return errors.Wrap(err, "unable to unwrap data key")
+	}
+
+	plaintext, err := open(dataKey, e.Nonce, e.Ciphertext, additionalData)
+	if err != nil {
+		return err
+	}
+
+	return c.inner().Unmarshal(plaintext, v)
+}
+
+// Encodes an entity's kind and key unambiguously, for authentication as associated data.
+func entityAdditionalData(kind, key string) []byte {
+	b, _ := json.Marshal([]string{kind, key})
+	return b
+}
+
+func (c Codec) inner() data.Codec {
+	if c.Inner == nil {
+		return data.JSONCodec{}
+	}
+	return c.Inner
+}
+
+// Encrypts plaintext with AES-GCM under key and a random nonce, authenticating additionalData.
+func seal(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, additionalData), nil
+}
+
+// Decrypts ciphertext sealed by seal, failing if it or additionalData has been altered.
+func open(key, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("encrypted content had invalid nonce")
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decrypt content")
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.Wrap(err, "")
+}
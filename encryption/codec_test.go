@@ -0,0 +1,228 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"testing"
+)
+
+type testContent struct {
+	Secret string
+}
+
+func makeTestKeyProvider() *LocalKeyProvider {
+	return &LocalKeyProvider{
+		Keys: map[string][]byte{
+			"k1": bytes.Repeat([]byte{1}, 32),
+			"k2": bytes.Repeat([]byte{2}, 32),
+		},
+		CurrentKeyID: "k1",
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+
+	b, err := c.Marshal(&testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Marshal: %s", err)
+	}
+	if bytes.Contains(b, []byte("bluh")) {
+		t.Errorf("Expected encrypted content not to contain plaintext, got %s", b)
+	}
+
+	var got testContent
+	err = c.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal: %s", err)
+	}
+	if got.Secret != "bluh" {
+		t.Errorf("Expected secret '%s', got '%s'", "bluh", got.Secret)
+	}
+}
+
+func TestCodec_Name(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Inner: data.GobCodec{},
+		Keys:  makeTestKeyProvider(),
+	}
+	if c.Name() != "aesgcm+gob" {
+		t.Errorf("Expected name '%s', got '%s'", "aesgcm+gob", c.Name())
+	}
+}
+
+func TestCodec_KeyRotation(t *testing.T) {
+	t.Parallel()
+
+	kp := makeTestKeyProvider()
+	c := Codec{
+		Keys: kp,
+	}
+
+	b, err := c.Marshal(&testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Marshal: %s", err)
+	}
+
+	kp.CurrentKeyID = "k2"
+	var got testContent
+	err = c.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatalf("Unexpected error from Unmarshal of content under an old key: %s", err)
+	}
+	if got.Secret != "bluh" {
+		t.Errorf("Expected secret '%s', got '%s'", "bluh", got.Secret)
+	}
+
+	// Once the old key is removed, content under it can no longer be read.
+	delete(kp.Keys, "k1")
+	err = c.Unmarshal(b, &got)
+	if err == nil {
+		t.Error("Expected error from Unmarshal of content under a removed key, got nil")
+	}
+}
+
+func TestCodec_Tampered(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+
+	b, err := c.Marshal(&testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Marshal: %s", err)
+	}
+
+	// Flip a bit in the ciphertext, re-encoding the envelope so it still parses.
+	var e envelope
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing envelope: %s", err)
+	}
+	e.Ciphertext[0] ^= 1
+	b, err = json.Marshal(&e)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding envelope: %s", err)
+	}
+
+	var got testContent
+	err = c.Unmarshal(b, &got)
+	if err == nil {
+		t.Error("Expected error from Unmarshal of tampered content, got nil")
+	}
+}
+
+func TestCodec_EntityRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+
+	b, err := c.MarshalEntity("Baz", "Bar", &testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from MarshalEntity: %s", err)
+	}
+
+	var got testContent
+	err = c.UnmarshalEntity("Baz", "Bar", b, &got)
+	if err != nil {
+		t.Fatalf("Unexpected error from UnmarshalEntity: %s", err)
+	}
+	if got.Secret != "bluh" {
+		t.Errorf("Expected secret '%s', got '%s'", "bluh", got.Secret)
+	}
+
+	err = c.Unmarshal(b, &got)
+	if err == nil {
+		t.Error("Expected error from Unmarshal of content bound to an entity, got nil")
+	}
+}
+
+func TestCodec_EntityMoved(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+
+	b, err := c.MarshalEntity("Baz", "Bar", &testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from MarshalEntity: %s", err)
+	}
+
+	testCases := []struct {
+		Label string
+		Kind  string
+		Key   string
+	}{
+		{Label: "OtherKey", Kind: "Baz", Key: "Other"},
+		{Label: "OtherKind", Kind: "Other", Key: "Bar"},
+		{Label: "Ambiguous", Kind: "Ba", Key: "zBar"},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			var got testContent
+			err := c.UnmarshalEntity(testCase.Kind, testCase.Key, b, &got)
+			if err == nil {
+				t.Error("Expected error from UnmarshalEntity of content moved from another entity, got nil")
+			}
+		})
+	}
+}
+
+func TestCodec_EntityUnbound(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+
+	b, err := c.Marshal(&testContent{Secret: "bluh"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Marshal: %s", err)
+	}
+
+	var got testContent
+	err = c.UnmarshalEntity("Baz", "Bar", b, &got)
+	if err == nil {
+		t.Error("Expected error from UnmarshalEntity of content not bound to an entity, got nil")
+	}
+
+	c.Migrating = true
+	err = c.UnmarshalEntity("Baz", "Bar", b, &got)
+	if err != nil {
+		t.Fatalf("Unexpected error from UnmarshalEntity while migrating: %s", err)
+	}
+	if got.Secret != "bluh" {
+		t.Errorf("Expected secret '%s', got '%s'", "bluh", got.Secret)
+	}
+}
+
+func TestCodec_Exclusive(t *testing.T) {
+	t.Parallel()
+
+	c := Codec{
+		Keys: makeTestKeyProvider(),
+	}
+	if !c.Exclusive() {
+		t.Error("Expected codec to be exclusive")
+	}
+
+	c.Migrating = true
+	if c.Exclusive() {
+		t.Error("Expected codec not to be exclusive while migrating")
+	}
+}
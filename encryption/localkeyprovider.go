@@ -0,0 +1,83 @@
+package encryption
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+// LocalKeyProvider holds key encryption keys in memory, wrapping data keys with AES-GCM.
+// It is intended for tests and local development; production deployments should use a key management service.
+type LocalKeyProvider struct {
+	// AES-256 keys by ID.
+	Keys map[string][]byte
+
+	// ID of the key new data keys are wrapped with. To rotate keys, add a new key and make it current;
+	// old keys must be kept until no content remains wrapped with them.
+	CurrentKeyID string
+}
+
+type localKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// Loads a LocalKeyProvider from a JSON file of the form:
+//
+//	{"current": "k2", "keys": {"k1": "<base64 key>", "k2": "<base64 key>"}}
+func LoadLocalKeyProvider(path string) (*LocalKeyProvider, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	var f localKeyFile
+	err = json.Unmarshal(b, &f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse key file '%s'", path)
+	}
+
+	kp := &LocalKeyProvider{
+		Keys:         f.Keys,
+		CurrentKeyID: f.Current,
+	}
+	for id, key := range kp.Keys {
+		if len(key) != 32 {
+			return nil, errors.Errorf("key '%s' in key file '%s' was %d bytes, must be 32", id, path, len(key))
+		}
+	}
+	if _, ok := kp.Keys[kp.CurrentKeyID]; !ok {
+		return nil, errors.Errorf("current key '%s' not found in key file '%s'", kp.CurrentKeyID, path)
+	}
+	return kp, nil
+}
+
+func (kp *LocalKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	key, ok := kp.Keys[kp.CurrentKeyID]
+	if !ok {
+		return "", nil, errors.Errorf("current key '%s' not found", kp.CurrentKeyID)
+	}
+
+	// The key ID is authenticated, so a wrapped key cannot be passed off as wrapped by another key.
+	nonce, ciphertext, err := seal(key, dataKey, []byte(kp.CurrentKeyID))
+	if err != nil {
+		return "", nil, err
+	}
+	return kp.CurrentKeyID, append(nonce, ciphertext...), nil
+}
+
+func (kp *LocalKeyProvider) UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	key, ok := kp.Keys[keyID]
+	if !ok {
+		return nil, errors.Errorf("key '%s' not found", keyID)
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, errors.New("wrapped key was too short")
+	}
+	return open(key, wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():], []byte(keyID))
+}
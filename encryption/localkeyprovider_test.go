@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestKeyFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	path := filepath.Join(dir, "keys.json")
+	err = ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("Unable to write key file: %s", err)
+	}
+	return path
+}
+
+func TestLoadLocalKeyProvider(t *testing.T) {
+	t.Parallel()
+
+	path := writeTestKeyFile(t, `{"current": "k2", "keys": {
+		"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE=",
+		"k2": "AgICAgICAgICAgICAgICAgICAgICAgICAgICAgICAgI="
+	}}`)
+
+	kp, err := LoadLocalKeyProvider(path)
+	if err != nil {
+		t.Fatalf("Unexpected error from LoadLocalKeyProvider: %s", err)
+	}
+	if kp.CurrentKeyID != "k2" {
+		t.Errorf("Expected current key '%s', got '%s'", "k2", kp.CurrentKeyID)
+	}
+	if !bytes.Equal(kp.Keys["k1"], bytes.Repeat([]byte{1}, 32)) {
+		t.Errorf("Key 'k1' did not match expected key, got %v", kp.Keys["k1"])
+	}
+}
+
+func TestLoadLocalKeyProvider_Invalid(t *testing.T) {
+	testCases := []struct {
+		Label         string
+		Contents      string
+		ExpectedError string
+	}{
+		{
+			Label:         "NotJSON",
+			Contents:      "bluh",
+			ExpectedError: "unable to parse key file",
+		},
+		{
+			Label:         "ShortKey",
+			Contents:      `{"current": "k1", "keys": {"k1": "AQEB"}}`,
+			ExpectedError: "key 'k1' in key file",
+		},
+		{
+			Label:         "NoCurrentKey",
+			Contents:      `{"current": "k2", "keys": {"k1": "AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE="}}`,
+			ExpectedError: "current key 'k2' not found",
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			path := writeTestKeyFile(t, testCase.Contents)
+			_, err := LoadLocalKeyProvider(path)
+			if err == nil || !strings.Contains(err.Error(), testCase.ExpectedError) {
+				t.Errorf("Expected error containing '%s', got '%v'", testCase.ExpectedError, err)
+			}
+		})
+	}
+}
+
+func TestLocalKeyProvider_WrongKeyID(t *testing.T) {
+	t.Parallel()
+
+	kp := makeTestKeyProvider()
+	keyID, wrapped, err := kp.WrapKey(bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatalf("Unexpected error from WrapKey: %s", err)
+	}
+	if keyID != "k1" {
+		t.Errorf("Expected key ID '%s', got '%s'", "k1", keyID)
+	}
+
+	// The key ID is authenticated, so unwrapping as another key fails even if that key is known.
+	kp.Keys["k2"] = kp.Keys["k1"]
+	_, err = kp.UnwrapKey("k2", wrapped)
+	if err == nil {
+		t.Error("Expected error unwrapping with the wrong key ID, got nil")
+	}
+}
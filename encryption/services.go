@@ -0,0 +1,10 @@
+package encryption
+
+// KeyProvider wraps and unwraps data keys with key encryption keys it holds, identified by key ID.
+type KeyProvider interface {
+	// Wraps a data key with the current key encryption key, returning its ID and the wrapped key.
+	WrapKey(dataKey []byte) (string, []byte, error)
+
+	// Unwraps a data key wrapped by WrapKey with the identified key, which need not still be current.
+	UnwrapKey(keyID string, wrappedKey []byte) ([]byte, error)
+}
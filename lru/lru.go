@@ -0,0 +1,248 @@
+package lru
+
+import (
+	"container/list"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// Cache is a process-local, size bounded cache, evicting the least recently used entries when full.
+// Entries expire TTL after being added, bounding how stale they can become when changed by other processes.
+//
+// Concurrent loads of the same key are deduplicated, so a burst of misses results in a single load.
+// It is safe for concurrent use; the zero value is an unbounded cache whose entries never expire.
+type Cache struct {
+	// Maximum number of entries held; if zero, there is no limit.
+	MaxEntries int
+
+	// How long entries are held before they expire; if zero, they expire only when evicted.
+	TTL time.Duration
+
+	// Returns the current time; if nil, time.Now is used.
+	NowFunc func() time.Time
+
+	lock     sync.Mutex
+	ll       *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*call
+}
+
+// Returned to callers waiting on a load which panicked.
+var errLoadPanicked = errors.New("load panicked")
+
+type entry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// An in-progress load of one or more keys.
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+
+	// Set if the key was removed while the load was in progress, so its result may be stale and must not be cached.
+	stale bool
+}
+
+// Returns the cached value for a key, and whether it was present and unexpired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.get(key)
+}
+
+// Adds a value to the cache, replacing any existing value for the key.
+func (c *Cache) Add(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.add(key, value)
+}
+
+// Removes a key from the cache. A load of the key already in progress will not cache its result.
+// This should be called whenever the value a key was loaded from changes, such as on revocation.
+func (c *Cache) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	if cl, ok := c.inflight[key]; ok {
+		cl.stale = true
+	}
+}
+
+// Returns the number of entries in the cache, including expired entries not yet evicted.
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ll == nil {
+		return 0
+	}
+	return c.ll.Len()
+}
+
+// Returns the cached value for a key, calling load to get and cache it if not present.
+// If a load of the key is already in progress, waits for and returns its result instead of loading again.
+// Errors are not cached.
+func (c *Cache) Load(key string, load func() (interface{}, error)) (interface{}, error) {
+	values, err := c.LoadMulti([]string{key}, func(keys []string) ([]interface{}, error) {
+		value, err := load()
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+// Returns the cached values for several keys, calling load once with the keys not present to get and cache them.
+// load must return a value for each key it is given, in the same order.
+// Keys already being loaded are waited for rather than loaded again. If any load fails, its error is returned.
+func (c *Cache) LoadMulti(keys []string, load func(keys []string) ([]interface{}, error)) ([]interface{}, error) {
+	values := make([]interface{}, len(keys))
+	waits := make(map[int]*call)
+	owned := make(map[string]*call)
+	var missKeys []string
+	var missIndexes []int
+
+	c.lock.Lock()
+	for i, key := range keys {
+		if value, ok := c.get(key); ok {
+			values[i] = value
+			continue
+		}
+		if cl, ok := c.inflight[key]; ok {
+			waits[i] = cl
+			continue
+		}
+		if cl, ok := owned[key]; ok {
+			// The key was repeated; it is loaded once, and the repeat waits for it.
+			waits[i] = cl
+			continue
+		}
+
+		cl := &call{done: make(chan struct{})}
+		if c.inflight == nil {
+			c.inflight = make(map[string]*call)
+		}
+		c.inflight[key] = cl
+		owned[key] = cl
+		missKeys = append(missKeys, key)
+		missIndexes = append(missIndexes, i)
+	}
+	c.lock.Unlock()
+
+	if len(missKeys) > 0 {
+		loaded, err := c.loadOwned(missKeys, owned, load)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range missIndexes {
+			values[i] = loaded[j]
+		}
+	}
+
+	for i, cl := range waits {
+		<-cl.done
+		if cl.err != nil {
+			return nil, cl.err
+		}
+		values[i] = cl.value
+	}
+	return values, nil
+}
+
+// Calls load for keys whose calls are owned by this caller, then finishes the calls, caching the loaded values.
+// The calls are finished even if load panics, so waiters get an error rather than blocking forever;
+// the panic then continues.
+func (c *Cache) loadOwned(keys []string, owned map[string]*call, load func(keys []string) ([]interface{}, error)) (loaded []interface{}, err error) {
+	err = errLoadPanicked
+	defer func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		for j, key := range keys {
+			cl := owned[key]
+			cl.err = err
+			if err == nil {
+				cl.value = loaded[j]
+				if !cl.stale {
+					c.add(key, cl.value)
+				}
+			}
+			delete(c.inflight, key)
+			close(cl.done)
+		}
+	}()
+
+	loaded, err = load(keys)
+	if err == nil && len(loaded) != len(keys) {
+		err = errors.Errorf("load returned %d values for %d keys", len(loaded), len(keys))
+	}
+	return loaded, err
+}
+
+// Gets an unexpired entry, marking it as recently used. The lock must be held.
+func (c *Cache) get(key string) (interface{}, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if c.TTL > 0 && !c.now().Before(e.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Adds an entry, evicting the least recently used entry if the cache is full. The lock must be held.
+func (c *Cache) add(key string, value interface{}) {
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.ll = list.New()
+	}
+
+	var expires time.Time
+	if c.TTL > 0 {
+		expires = c.now().Add(c.TTL)
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.ll.MoveToFront(el)
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		return
+	}
+
+	c.entries[key] = c.ll.PushFront(&entry{key: key, value: value, expires: expires})
+	if c.MaxEntries > 0 && c.ll.Len() > c.MaxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *Cache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.entries, el.Value.(*entry).key)
+}
+
+func (c *Cache) now() time.Time {
+	if c.NowFunc == nil {
+		return time.Now()
+	}
+	return c.NowFunc()
+}
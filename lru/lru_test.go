@@ -0,0 +1,301 @@
+package lru
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCache_AddGet(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	if _, ok := c.Get("foo"); ok {
+		t.Error("Expected empty cache not to contain key")
+	}
+
+	c.Add("foo", 1)
+	c.Add("foo", 2)
+	value, ok := c.Get("foo")
+	if !ok {
+		t.Fatal("Expected cache to contain added key")
+	}
+	if value != 2 {
+		t.Errorf("Expected value %d, got %v", 2, value)
+	}
+	if c.Len() != 1 {
+		t.Errorf("Expected %d entries, got %d", 1, c.Len())
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{MaxEntries: 2}
+	c.Add("a", 1)
+	c.Add("b", 2)
+
+	// Using a makes b the least recently used.
+	c.Get("a")
+	c.Add("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("Expected least recently used entry to be evicted")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Expected recently used entry to be kept")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Error("Expected newly added entry to be kept")
+	}
+	if c.Len() != 2 {
+		t.Errorf("Expected %d entries, got %d", 2, c.Len())
+	}
+}
+
+func TestCache_TTL(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	c := &Cache{
+		TTL: time.Minute,
+		NowFunc: func() time.Time {
+			return now
+		},
+	}
+	c.Add("foo", 1)
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get("foo"); !ok {
+		t.Error("Expected entry to be present before TTL elapsed")
+	}
+
+	now = now.Add(time.Second)
+	if _, ok := c.Get("foo"); ok {
+		t.Error("Expected entry to expire once TTL elapsed")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected expired entry to be removed, had %d entries", c.Len())
+	}
+}
+
+func TestCache_Remove(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	c.Remove("foo")
+	c.Add("foo", 1)
+	c.Remove("foo")
+	if _, ok := c.Get("foo"); ok {
+		t.Error("Expected removed entry not to be present")
+	}
+}
+
+func TestCache_Load(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	loadCount := 0
+	load := func() (interface{}, error) {
+		loadCount++
+		return "bar", nil
+	}
+
+	for i := 0; i < 2; i++ {
+		value, err := c.Load("foo", load)
+		if err != nil {
+			t.Fatalf("Unexpected error from Load: %s", err)
+		}
+		if value != "bar" {
+			t.Errorf("Expected value %q, got %v", "bar", value)
+		}
+	}
+	if loadCount != 1 {
+		t.Errorf("Expected load to be called %d times, called %d times", 1, loadCount)
+	}
+}
+
+func TestCache_Load_ErrNotCached(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	expectedErr := errors.New("bluh")
+	_, err := c.Load("foo", func() (interface{}, error) {
+		return nil, expectedErr
+	})
+	if err != expectedErr {
+		t.Errorf("Expected error %v from Load, got %v", expectedErr, err)
+	}
+	if _, ok := c.Get("foo"); ok {
+		t.Error("Expected failed load not to be cached")
+	}
+}
+
+func TestCache_Load_DeduplicatesConcurrentMisses(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var lock sync.Mutex
+	loadCount := 0
+	load := func() (interface{}, error) {
+		lock.Lock()
+		loadCount++
+		lock.Unlock()
+
+		close(started)
+		<-release
+		return "bar", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], _ = c.Load("foo", load)
+	}()
+	<-started
+
+	for i := 1; i < len(results); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = c.Load("foo", load)
+		}(i)
+	}
+
+	// Give the waiting loads a chance to find the one in progress before it completes.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if loadCount != 1 {
+		t.Errorf("Expected load to be called %d times, called %d times", 1, loadCount)
+	}
+	for i, r := range results {
+		if r != "bar" {
+			t.Errorf("Expected result %d to be %q, got %v", i, "bar", r)
+		}
+	}
+}
+
+func TestCache_Load_RemoveDuringLoad(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	value, err := c.Load("foo", func() (interface{}, error) {
+		c.Remove("foo")
+		return "stale", nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Load: %s", err)
+	}
+	if value != "stale" {
+		t.Errorf("Expected loaded value to be returned, got %v", value)
+	}
+	if _, ok := c.Get("foo"); ok {
+		t.Error("Expected value loaded while removed not to be cached")
+	}
+}
+
+func TestCache_LoadMulti(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	c.Add("a", 1)
+
+	var loadedKeys []string
+	values, err := c.LoadMulti([]string{"a", "b", "c", "b"}, func(keys []string) ([]interface{}, error) {
+		loadedKeys = keys
+		values := make([]interface{}, len(keys))
+		for i, k := range keys {
+			values[i] = k + "!"
+		}
+		return values, nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from LoadMulti: %s", err)
+	}
+
+	expectedLoaded := []string{"b", "c"}
+	if !reflect.DeepEqual(loadedKeys, expectedLoaded) {
+		t.Errorf("Expected keys %v to be loaded, got %v", expectedLoaded, loadedKeys)
+	}
+	expectedValues := []interface{}{1, "b!", "c!", "b!"}
+	if !reflect.DeepEqual(values, expectedValues) {
+		t.Errorf("Expected values %v, got %v", expectedValues, values)
+	}
+	if value, _ := c.Get("c"); value != "c!" {
+		t.Errorf("Expected loaded value to be cached, got %v", value)
+	}
+}
+
+func TestCache_LoadMulti_WrongValueCount(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	_, err := c.LoadMulti([]string{"a", "b"}, func(keys []string) ([]interface{}, error) {
+		return []interface{}{1}, nil
+	})
+	if err == nil {
+		t.Error("Expected error from LoadMulti when load returned too few values")
+	}
+	if c.Len() != 0 {
+		t.Errorf("Expected nothing to be cached, had %d entries", c.Len())
+	}
+}
+
+func TestCache_Load_Panic(t *testing.T) {
+	t.Parallel()
+
+	c := &Cache{}
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	panicked := make(chan interface{})
+	go func() {
+		defer func() {
+			panicked <- recover()
+		}()
+		c.Load("foo", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("bluh")
+		})
+	}()
+	<-started
+
+	waitErr := make(chan error)
+	go func() {
+		_, err := c.Load("foo", func() (interface{}, error) {
+			return "bar", nil
+		})
+		waitErr <- err
+	}()
+
+	// Give the waiting load a chance to find the one in progress before it panics.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+
+	if r := <-panicked; r != "bluh" {
+		t.Errorf("Expected panic '%s' to continue from Load, got '%v'", "bluh", r)
+	}
+	if err := <-waitErr; err != errLoadPanicked && err != nil {
+		t.Errorf("Expected error '%s' or nil from waiting Load, got '%v'", errLoadPanicked, err)
+	}
+
+	// The key is no longer in flight, so it can be loaded again.
+	value, err := c.Load("foo", func() (interface{}, error) {
+		return "baz", nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Load after panic: %s", err)
+	}
+	if value != "baz" && value != "bar" {
+		t.Errorf("Expected value to be loaded after panic, got %v", value)
+	}
+}
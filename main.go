@@ -1,32 +1,375 @@
 package main
 
 import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"database/sql"
 	"github.com/jbeshir/moonbird-auth-frontend/aengine"
 	"github.com/jbeshir/moonbird-auth-frontend/api"
+	"github.com/jbeshir/moonbird-auth-frontend/clouddatastore"
+	"github.com/jbeshir/moonbird-auth-frontend/config"
 	"github.com/jbeshir/moonbird-auth-frontend/controllers"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/encryption"
+	"github.com/jbeshir/moonbird-auth-frontend/lru"
+	"github.com/jbeshir/moonbird-auth-frontend/memstore"
+	"github.com/jbeshir/moonbird-auth-frontend/redisstore"
 	"github.com/jbeshir/moonbird-auth-frontend/responders"
+	"github.com/jbeshir/moonbird-auth-frontend/sqlstore"
+	"github.com/jbeshir/moonbird-auth-frontend/standalone"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
 	"google.golang.org/appengine"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
+// Configuration is read from the file at CONFIG_FILE, a local path or a "gs://bucket/path" URL, if set,
+// overridden by environment variables as described on config.Config.ApplyEnv.
 func main() {
-	authContext := &aengine.ContextMaker{
-		Namespace: "moonbird-auth",
+	loader := &config.Loader{
+		Source:    makeConfigSource(os.Getenv("CONFIG_FILE")),
+		LookupEnv: os.LookupEnv,
+	}
+	cfg, err := loader.Load(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	contentFormat, err := makeContentFormat(cfg.ContentKeyFile, cfg.ContentMigrating)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	b, err := makeBackends(cfg, contentFormat)
+	if err != nil {
+		log.Fatal(err)
 	}
 
+	retryMetrics := &storeutil.RetryCounters{}
+	persistentStore := &storeutil.RetryingStore{
+		PersistentStore: b.persistentStore(nil, nil),
+		Metrics:         retryMetrics,
+	}
+
+	endpoints := &api.EndpointTable{}
+	endpoints.Set(cfg.Endpoints)
+
+	limitedEndpointBiller := &api.EndpointBiller{
+		PersistentStore: persistentStore,
+		Endpoints:       endpoints,
+		UsageRetention:  time.Duration(cfg.Billing.UsageRetention),
+		LimitCache: &lru.Cache{
+			MaxEntries: 10000,
+			TTL:        time.Duration(cfg.Billing.LimitCacheTTL),
+		},
+	}
+	if cfg.Billing.UsageFlushBatch > 0 {
+		limitedEndpointBiller.UsageCounter = b.cacheStore("billing/")
+		limitedEndpointBiller.UsageFlushBatch = cfg.Billing.UsageFlushBatch
+		limitedEndpointBiller.UsageFlushMaxAge = time.Duration(cfg.Billing.UsageFlushMaxAge)
+	}
+
+	responder := &responders.WebApi{
+		ExposeErrors: cfg.ExposeErrors,
+	}
+
+	adminMux := http.NewServeMux()
+
+	admApiGetLimit := &controllers.AdminApiGetLimit{
+		Biller: limitedEndpointBiller,
+	}
+	adminMux.HandleFunc("/admin/api/get-limit", admApiGetLimit.HandleFunc(b.contextMaker, responder))
+
 	admApiSetLimit := &controllers.AdminApiSetLimit{
-		Biller: &api.EndpointBiller{
-			PersistentStore: &aengine.PersistentStore{},
+		Biller: limitedEndpointBiller,
+	}
+	adminMux.HandleFunc("/admin/api/set-limit", admApiSetLimit.HandleFunc(b.contextMaker, responder))
+
+	apiAuthenticator := &api.TokenAuthenticator{
+		Biller:  limitedEndpointBiller,
+		Wrapped: b.contextMaker,
+	}
+
+	projectPermissionChecker := &api.ProjectPermissionChecker{
+		PersistentStore: &storeutil.CachingStore{
+			PersistentStore: b.persistentStore([]byte(cfg.CursorKey), nil),
+			Cache:           b.cacheStore("ps/"),
+			Kinds:           []string{"ProjectAuth"},
+			TTL:             time.Duration(cfg.Auth.StoreCacheTTL),
+			ContentFormat:   contentFormat,
+		},
+		AuthCache: &lru.Cache{
+			MaxEntries: 10000,
+			TTL:        time.Duration(cfg.Auth.CacheTTL),
 		},
+		TokenAuthenticator: apiAuthenticator,
 	}
-	http.HandleFunc("/admin/api/set-limit", admApiSetLimit.HandleFunc(authContext, &responders.WebApi{}))
 
 	admApiCreateToken := &controllers.AdminApiCreateToken{
-		ProjectTokenLister: &api.ProjectPermissionChecker{
-			PersistentStore: &aengine.PersistentStore{},
+		ProjectTokenLister: projectPermissionChecker,
+	}
+	adminMux.HandleFunc("/admin/api/create-token", admApiCreateToken.HandleFunc(b.contextMaker, responder))
+
+	// Listing tokens hands out cursors, which can't be signed without a key.
+	if cfg.CursorKey != "" {
+		admApiListTokens := &controllers.AdminApiListTokens{
+			ProjectTokenLister: projectPermissionChecker,
+		}
+		adminMux.HandleFunc("/admin/api/list-tokens", admApiListTokens.HandleFunc(b.contextMaker, responder))
+	} else {
+		log.Print("cursorKey is not set, so /admin/api/list-tokens is not served")
+	}
+
+	admApiSweepExpired := &controllers.AdminApiSweepExpired{
+		Sweeper: &api.ExpirySweeper{
+			PersistentStore: persistentStore,
+			Kinds:           []string{"TokenUsage"},
 		},
 	}
-	http.HandleFunc("/admin/api/create-token", admApiCreateToken.HandleFunc(authContext, &responders.WebApi{}))
+	adminMux.HandleFunc("/admin/api/sweep-expired", admApiSweepExpired.HandleFunc(b.contextMaker, responder))
+
+	admApiRetryMetrics := &controllers.AdminApiRetryMetrics{
+		Metrics: retryMetrics,
+	}
+	adminMux.HandleFunc("/admin/api/retry-metrics", admApiRetryMetrics.HandleFunc(b.contextMaker, responder))
+
+	projectStore := &storeutil.RetryingStore{
+		PersistentStore: b.persistentStore(nil, projectPermissionChecker),
+		Metrics:         retryMetrics,
+	}
+	http.Handle("/api/", makePublicApiMux(apiAuthenticator, projectStore, responder))
+
+	if b.adminTokens == nil {
+		// On App Engine, app.yaml restricts admin handlers to admins.
+		http.Handle("/admin/", adminMux)
+		watchConfig(context.Background(), loader, cfg, endpoints)
+		appengine.Main()
+		return
+	}
+
+	http.Handle("/admin/", &standalone.AdminAuthenticator{
+		Tokens:  b.adminTokens,
+		Wrapped: adminMux,
+	})
+
+	server := &standalone.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: http.DefaultServeMux,
+	}
+	// Shutting down on SIGTERM lets in-flight requests complete when the process is stopped.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	watchConfig(ctx, loader, cfg, endpoints)
+
+	log.Printf("Listening on port %s", cfg.Port)
+	err = server.Run(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Makes the source of the configuration file at location, or nil if location is empty.
+func makeConfigSource(location string) config.Source {
+	if location == "" {
+		return nil
+	}
 
-	appengine.Main()
+	if strings.HasPrefix(location, "gs://") {
+		bucketAndPath := strings.SplitN(strings.TrimPrefix(location, "gs://"), "/", 2)
+		path := ""
+		if len(bucketAndPath) == 2 {
+			path = bucketAndPath[1]
+		}
+		return &config.StoreSource{
+			Store: &aengine.GcsFileStore{Bucket: bucketAndPath[0]},
+			Path:  path,
+		}
+	}
+	return &config.FileSource{Path: location}
+}
+
+// Reloads configuration in the background if a reload interval is set, applying changes to endpoints.
+// Other settings are applied only at startup, so changes to them are logged as needing a restart.
+func watchConfig(ctx context.Context, loader *config.Loader, cfg *config.Config, endpoints *api.EndpointTable) {
+	if cfg.ReloadInterval <= 0 || loader.Source == nil {
+		return
+	}
+
+	watcher := &config.Watcher{
+		Loader:   loader,
+		Interval: time.Duration(cfg.ReloadInterval),
+		OnChange: func(ctx context.Context, previous, current *config.Config) {
+			endpoints.Set(current.Endpoints)
+
+			p, c := *previous, *current
+			p.Endpoints, c.Endpoints = nil, nil
+			if !reflect.DeepEqual(p, c) {
+				log.Print("Configuration changed other than endpoints; restart to apply")
+			}
+		},
+	}
+	go watcher.Run(ctx, cfg)
+}
+
+// Checks whether entities may be read or written, as the stores' PermissionChecker interfaces do.
+type permissionChecker interface {
+	CheckRead(ctx context.Context, kind, key string) (bool, error)
+	CheckWrite(ctx context.Context, kind, key string) (bool, error)
+}
+
+// The services main wires handlers to, which differ between App Engine and standalone mode.
+type backends struct {
+	contextMaker controllers.ContextMaker
+
+	// Makes a store for entities, signing query cursors with cursorKey,
+	// and checking permission for each entity with permissionChecker if it is non-nil.
+	persistentStore func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore
+
+	// Makes a cache store whose keys don't collide with those of stores with other prefixes.
+	cacheStore func(prefix string) data.CacheStore
+
+	// Bearer tokens admitted to admin handlers. Nil if admin handlers are protected outside the process.
+	adminTokens []string
+}
+
+// Makes the backends selected by a validated configuration.
+// In standalone mode, caches held in process memory are not shared between instances,
+// so standalone mode should be run as a single instance unless caches are held in Redis.
+func makeBackends(cfg *config.Config, contentFormat data.ContentFormat) (*backends, error) {
+	b := &backends{}
+	if cfg.ServerMode == "appengine" {
+		b.contextMaker = &aengine.ContextMaker{
+			Namespace: cfg.Namespace,
+		}
+	} else {
+		b.contextMaker = &standalone.ContextMaker{}
+		b.adminTokens = cfg.AdminTokens
+	}
+
+	var err error
+	switch cfg.Store.Backend {
+	case "appengine":
+		b.persistentStore = func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore {
+			return &aengine.PersistentStore{
+				Prefix:            cfg.Store.Prefix,
+				PermissionChecker: permissionChecker,
+				CursorKey:         cursorKey,
+				ContentFormat:     contentFormat,
+			}
+		}
+	case "datastore":
+		b.persistentStore, err = makeDatastorePersistentStore(cfg, contentFormat)
+	case "sql":
+		b.persistentStore, err = makeSQLPersistentStore(cfg, contentFormat)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Cache.Backend {
+	case "appengine":
+		b.cacheStore = func(prefix string) data.CacheStore {
+			return &aengine.CacheStore{Prefix: cfg.Cache.Prefix + prefix}
+		}
+	case "memory":
+		b.cacheStore = func(prefix string) data.CacheStore {
+			return &memstore.CacheStore{MaxEntries: cfg.Cache.MaxEntries}
+		}
+	case "redis":
+		opts, err := redis.ParseURL(cfg.Cache.RedisURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse redis URL")
+		}
+		client := redis.NewClient(opts)
+		b.cacheStore = func(prefix string) data.CacheStore {
+			return &redisstore.CacheStore{
+				Client: client,
+				Prefix: cfg.Cache.Prefix + prefix,
+			}
+		}
+	}
+	return b, nil
+}
+
+// Stores entities in Cloud Datastore, in the configured project or one detected from the environment's credentials.
+func makeDatastorePersistentStore(cfg *config.Config, contentFormat data.ContentFormat) (func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore, error) {
+	projectID := cfg.Store.ProjectID
+	if projectID == "" {
+		projectID = datastore.DetectProjectID
+	}
+	client, err := datastore.NewClient(context.Background(), projectID)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to connect to datastore")
+	}
+
+	return func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore {
+		return &clouddatastore.PersistentStore{
+			Client:            client,
+			Prefix:            cfg.Store.Prefix,
+			PermissionChecker: permissionChecker,
+			Namespace:         cfg.Namespace,
+			CursorKey:         cursorKey,
+			ContentFormat:     contentFormat,
+		}
+	}, nil
+}
+
+// Stores entities in a SQL database, migrating its schema at startup.
+func makeSQLPersistentStore(cfg *config.Config, contentFormat data.ContentFormat) (func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore, error) {
+	dialect := sqlstore.SQLite
+	if cfg.Store.SQLDriver == "postgres" {
+		dialect = sqlstore.Postgres
+	}
+
+	db, err := sql.Open(cfg.Store.SQLDriver, cfg.Store.SQLDSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to open database")
+	}
+	err = sqlstore.Migrate(context.Background(), db, dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(cursorKey []byte, permissionChecker permissionChecker) storeutil.PersistentStore {
+		return &sqlstore.PersistentStore{
+			DB:                db,
+			Dialect:           dialect,
+			Prefix:            cfg.Store.Prefix,
+			PermissionChecker: permissionChecker,
+			Namespace:         cfg.Namespace,
+			CursorKey:         cursorKey,
+			ContentFormat:     contentFormat,
+		}
+	}, nil
+}
+
+// Makes the content format for stores, encrypting content with keys from keyFile if set.
+// Unencrypted content is only read if migrating.
+func makeContentFormat(keyFile string, migrating bool) (data.ContentFormat, error) {
+	if keyFile == "" {
+		return data.ContentFormat{}, nil
+	}
+
+	keys, err := encryption.LoadLocalKeyProvider(keyFile)
+	if err != nil {
+		return data.ContentFormat{}, err
+	}
+	return data.ContentFormat{
+		Codec: encryption.Codec{
+			Keys:      keys,
+			Migrating: migrating,
+		},
+	}, nil
 }
@@ -0,0 +1,362 @@
+package memstore
+
+import (
+	"container/list"
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CacheStore behaves as aengine.CacheStore does, but holds values in memory.
+// Values are serialized when set, so later changes to them are not seen by readers, as with memcache.
+// Counters are held as decimal strings, as memcache holds them, so values set by other methods cannot be
+// incremented, and counters cannot be read with Get.
+// The zero value is an empty, unbounded cache, serializing values with gob.
+type CacheStore struct {
+	// Maximum number of values held, evicting the least recently used when exceeded; if zero, there is no limit.
+	MaxEntries int
+
+	// Codec used to serialize values. If nil, data.GobCodec is used.
+	Codec data.Codec
+
+	// Returns the current time, for expiring values; if nil, time.Now is used.
+	NowFunc func() time.Time
+
+	lock    sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+
+	// Incremented on every write, to identify the version of a value for CompareAndSwap.
+	casSeq uint64
+}
+
+type cacheEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	casID   uint64
+}
+
+type casToken struct {
+	key   string
+	casID uint64
+}
+
+func (cs *CacheStore) Get(ctx context.Context, key string, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key}).Debug("memstore cache get")
+
+	cs.lock.Lock()
+	e := cs.get(key)
+	cs.lock.Unlock()
+
+	if e == nil {
+		return data.ErrCacheMiss
+	}
+	return cs.codec().Unmarshal(e.value, v)
+}
+
+func (cs *CacheStore) GetMulti(ctx context.Context, keys []string, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"keys": keys}).Debug("memstore cache get multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+
+	values := make([][]byte, len(keys))
+	cs.lock.Lock()
+	for i, key := range keys {
+		if e := cs.get(key); e != nil {
+			values[i] = e.value
+		}
+	}
+	cs.lock.Unlock()
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+	for i, value := range values {
+		if value == nil {
+			errs[i] = data.ErrCacheMiss
+			failed = true
+			continue
+		}
+
+		err := cs.codec().Unmarshal(value, v[i])
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (cs *CacheStore) Set(ctx context.Context, key string, v interface{}) error {
+	return cs.SetWithTTL(ctx, key, 0, v)
+}
+
+func (cs *CacheStore) SetWithTTL(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key, "ttl": ttl}).Debug("memstore cache set")
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.set(key, ttl, value)
+	return nil
+}
+
+func (cs *CacheStore) SetMulti(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"keys": keys, "ttl": ttl}).Debug("memstore cache set multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		var err error
+		values[i], err = cs.codec().Marshal(v[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	for i, key := range keys {
+		cs.set(key, ttl, values[i])
+	}
+	return nil
+}
+
+func (cs *CacheStore) Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key, "ttl": ttl}).Debug("memstore cache add")
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.get(key) != nil {
+		return data.ErrCacheNotStored
+	}
+	cs.set(key, ttl, value)
+	return nil
+}
+
+func (cs *CacheStore) GetForCAS(ctx context.Context, key string, v interface{}) (data.CASToken, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key}).Debug("memstore cache get for cas")
+
+	cs.lock.Lock()
+	e := cs.get(key)
+	cs.lock.Unlock()
+
+	if e == nil {
+		return nil, data.ErrCacheMiss
+	}
+
+	err := cs.codec().Unmarshal(e.value, v)
+	if err != nil {
+		return nil, err
+	}
+	return casToken{key: key, casID: e.casID}, nil
+}
+
+func (cs *CacheStore) CompareAndSwap(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key, "ttl": ttl}).Debug("memstore cache compare and swap")
+
+	t, ok := token.(casToken)
+	if !ok || t.key != key {
+		return errors.Errorf("cas token was not read for key '%s'", key)
+	}
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	e := cs.get(key)
+	if e == nil {
+		return data.ErrCacheNotStored
+	}
+	if e.casID != t.casID {
+		return data.ErrCacheCASConflict
+	}
+	cs.set(key, ttl, value)
+	return nil
+}
+
+func (cs *CacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return cs.IncrementWithTTL(ctx, key, 0, delta, initialValue)
+}
+
+func (cs *CacheStore) IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key, "delta": delta}).Debug("memstore cache increment")
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.get(key) == nil {
+		cs.set(key, ttl, []byte(strconv.FormatUint(initialValue, 10)))
+	}
+	return cs.increment(key, delta)
+}
+
+func (cs *CacheStore) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key, "delta": delta}).Debug("memstore cache increment existing")
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.get(key) == nil {
+		return 0, data.ErrCacheMiss
+	}
+	return cs.increment(key, delta)
+}
+
+func (cs *CacheStore) Delete(ctx context.Context, key string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"key": key}).Debug("memstore cache delete")
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	if cs.get(key) == nil {
+		return data.ErrCacheMiss
+	}
+	cs.removeElement(cs.entries[key])
+	return nil
+}
+
+// Removes every value and counter.
+func (cs *CacheStore) Flush(ctx context.Context) error {
+	l := ctxlogrus.Get(ctx)
+	l.Debug("memstore cache flush")
+
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+
+	cs.ll = nil
+	cs.entries = nil
+	return nil
+}
+
+// Adds delta to an existing counter, wrapping on overflow and stopping at zero on underflow, as memcache does.
+// The lock must be held.
+func (cs *CacheStore) increment(key string, delta int64) (uint64, error) {
+	e := cs.get(key)
+	value, err := strconv.ParseUint(string(e.value), 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("cannot increment non-numeric value of key '%s'", key)
+	}
+
+	if delta >= 0 {
+		value += uint64(delta)
+	} else if uint64(-delta) > value {
+		value = 0
+	} else {
+		value -= uint64(-delta)
+	}
+
+	// Incrementing keeps the counter's expiry, as memcache does.
+	cs.casSeq++
+	e.value = []byte(strconv.FormatUint(value, 10))
+	e.casID = cs.casSeq
+	return value, nil
+}
+
+// Gets an unexpired entry, marking it as recently used. The lock must be held.
+func (cs *CacheStore) get(key string) *cacheEntry {
+	el, ok := cs.entries[key]
+	if !ok {
+		return nil
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !e.expires.IsZero() && !cs.now().Before(e.expires) {
+		cs.removeElement(el)
+		return nil
+	}
+
+	cs.ll.MoveToFront(el)
+	return e
+}
+
+// Sets an entry, evicting the least recently used entry if the cache is full. The lock must be held.
+func (cs *CacheStore) set(key string, ttl time.Duration, value []byte) {
+	if cs.entries == nil {
+		cs.entries = make(map[string]*list.Element)
+		cs.ll = list.New()
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = cs.now().Add(ttl)
+	}
+
+	cs.casSeq++
+	e := &cacheEntry{
+		key:     key,
+		value:   value,
+		expires: expires,
+		casID:   cs.casSeq,
+	}
+
+	if el, ok := cs.entries[key]; ok {
+		el.Value = e
+		cs.ll.MoveToFront(el)
+		return
+	}
+
+	cs.entries[key] = cs.ll.PushFront(e)
+	if cs.MaxEntries > 0 && cs.ll.Len() > cs.MaxEntries {
+		cs.removeElement(cs.ll.Back())
+	}
+}
+
+func (cs *CacheStore) removeElement(el *list.Element) {
+	cs.ll.Remove(el)
+	delete(cs.entries, el.Value.(*cacheEntry).key)
+}
+
+func (cs *CacheStore) codec() data.Codec {
+	if cs.Codec == nil {
+		return data.GobCodec{}
+	}
+	return cs.Codec
+}
+
+func (cs *CacheStore) now() time.Time {
+	if cs.NowFunc == nil {
+		return time.Now()
+	}
+	return cs.NowFunc()
+}
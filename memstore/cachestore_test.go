@@ -0,0 +1,353 @@
+package memstore
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ data.CacheStore = (*CacheStore)(nil)
+
+func TestCacheStore_SetGet(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	var value string
+	err := cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get, got: %v", err)
+	}
+
+	setValue := map[string]int64{"bluh": 1}
+	err = cs.Set(ctx, "Foo", setValue)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	// Values are copied when set, so later changes must not be seen.
+	setValue["bluh"] = 2
+
+	var getValue map[string]int64
+	err = cs.Get(ctx, "Foo", &getValue)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if getValue["bluh"] != 1 {
+		t.Errorf("Expected value %d, got %d", 1, getValue["bluh"])
+	}
+
+	err = cs.Delete(ctx, "Foo")
+	if err != nil {
+		t.Errorf("Unexpected error from Delete: %s", err)
+	}
+	err = cs.Delete(ctx, "Foo")
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Delete of missing key, got: %v", err)
+	}
+	err = cs.Get(ctx, "Foo", &getValue)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_TTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	cs := &CacheStore{
+		NowFunc: func() time.Time {
+			return now
+		},
+	}
+
+	err := cs.SetWithTTL(ctx, "Foo", time.Minute, "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithTTL: %s", err)
+	}
+	err = cs.Set(ctx, "Bar", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	now = now.Add(time.Minute)
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after TTL, got: %v", err)
+	}
+	err = cs.Get(ctx, "Bar", &value)
+	if err != nil {
+		t.Errorf("Expected value without TTL not to expire, got: %v", err)
+	}
+
+	err = cs.Add(ctx, "Foo", 0, "again")
+	if err != nil {
+		t.Errorf("Expected Add of expired key to succeed, got: %v", err)
+	}
+}
+
+func TestCacheStore_EvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{MaxEntries: 2}
+	for _, key := range []string{"A", "B"} {
+		err := cs.Set(ctx, key, key)
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+
+	var value string
+	err := cs.Get(ctx, "A", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	err = cs.Set(ctx, "C", "C")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var a, b, c string
+	err = cs.GetMulti(ctx, []string{"A", "B", "C"}, []interface{}{&a, &b, &c})
+	expectedErr := data.MultiError{nil, data.ErrCacheMiss, nil}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error %v from GetMulti, got %v", expectedErr, err)
+	}
+	if a != "A" || c != "C" {
+		t.Errorf("Expected values %s and %s, got %s and %s", "A", "C", a, c)
+	}
+}
+
+func TestCacheStore_SetMulti(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{Codec: data.JSONCodec{}}
+
+	err := cs.SetMulti(ctx, []string{"A", "B"}, 0, []interface{}{"a", "b"})
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	var a, b string
+	err = cs.GetMulti(ctx, []string{"A", "B"}, []interface{}{&a, &b})
+	if err != nil {
+		t.Fatalf("Unexpected error from GetMulti: %s", err)
+	}
+	if a != "a" || b != "b" {
+		t.Errorf("Expected values %s and %s, got %s and %s", "a", "b", a, b)
+	}
+}
+
+func TestCacheStore_Add(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	err := cs.Add(ctx, "Foo", 0, "first")
+	if err != nil {
+		t.Errorf("Unexpected error from first Add: %s", err)
+	}
+	err = cs.Add(ctx, "Foo", 0, "second")
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from second Add, got: %v", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if value != "first" {
+		t.Errorf("Expected value %s, got %s", "first", value)
+	}
+}
+
+func TestCacheStore_CompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	var value int64
+	_, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from GetForCAS, got: %v", err)
+	}
+
+	err = cs.Set(ctx, "Foo", int64(1))
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	token, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+	staleToken, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+
+	err = cs.CompareAndSwap(ctx, "Bar", token, 0, value+1)
+	if err == nil {
+		t.Error("Expected error from CompareAndSwap with token for another key, got nil error")
+	}
+
+	err = cs.CompareAndSwap(ctx, "Foo", token, 0, value+1)
+	if err != nil {
+		t.Errorf("Unexpected error from CompareAndSwap: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Foo", staleToken, 0, value+1)
+	if err != data.ErrCacheCASConflict {
+		t.Errorf("Expected conflict error from stale CompareAndSwap, got: %v", err)
+	}
+
+	token, err = cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected value %d, got %d", 2, value)
+	}
+
+	err = cs.Delete(ctx, "Foo")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Foo", token, 0, value+1)
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from CompareAndSwap after Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_Increment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	_, err := cs.IncrementExisting(ctx, "Foo", 1)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from IncrementExisting, got: %v", err)
+	}
+
+	value, err := cs.Increment(ctx, "Foo", 2, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from Increment: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, got %d", 12, value)
+	}
+
+	value, err = cs.IncrementExisting(ctx, "Foo", -20)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected decrement below zero to leave value %d, got %d", 0, value)
+	}
+
+	err = cs.Set(ctx, "Bar", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	_, err = cs.Increment(ctx, "Bar", 1, 0)
+	if err == nil {
+		t.Error("Expected error incrementing non-numeric value, got nil error")
+	}
+}
+
+func TestCacheStore_Increment_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := cs.Increment(ctx, "Foo", 1, 0)
+				if err != nil {
+					t.Errorf("Unexpected error from Increment: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := cs.IncrementExisting(ctx, "Foo", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 1000 {
+		t.Errorf("Expected value %d, got %d", 1000, value)
+	}
+}
+
+func TestCacheStore_IncrementWithTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	now := time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC)
+	cs := &CacheStore{
+		NowFunc: func() time.Time {
+			return now
+		},
+	}
+
+	value, err := cs.IncrementWithTTL(ctx, "Foo", time.Minute, 2, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, got %d", 12, value)
+	}
+
+	// Incrementing an existing counter keeps the expiry it was created with.
+	now = now.Add(30 * time.Second)
+	_, err = cs.IncrementWithTTL(ctx, "Foo", time.Minute, 1, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+
+	now = now.Add(30 * time.Second)
+	_, err = cs.IncrementExisting(ctx, "Foo", 0)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from IncrementExisting after TTL, got: %v", err)
+	}
+}
+
+func TestCacheStore_Flush(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs := &CacheStore{}
+
+	err := cs.Set(ctx, "Foo", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = cs.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error from Flush: %s", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after Flush, got: %v", err)
+	}
+}
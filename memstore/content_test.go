@@ -0,0 +1,288 @@
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/encryption"
+	"testing"
+)
+
+type testCounter struct {
+	Count int64
+}
+
+type testCounterV1 struct {
+	Total int64
+}
+
+// Renames Count to Total in JSON content.
+func migrateTestCounter(codec data.Codec, content []byte) ([]byte, error) {
+	var old testCounter
+	err := codec.Unmarshal(content, &old)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Marshal(&testCounterV1{Total: old.Count})
+}
+
+func TestPersistentStore_ContentFormat_Gob(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+		ContentFormat: data.ContentFormat{
+			Codec: data.GobCodec{},
+		},
+	}
+
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var c testCounter
+	_, err = ps.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if c.Count != 7 {
+		t.Errorf("Expected count %d, got %d", 7, c.Count)
+	}
+
+	e := ps.Datastore.get(ps.makeKey("Baz", "Bar"))
+	if e.ContentCodec != "gob" {
+		t.Errorf("Expected content codec '%s', got '%s'", "gob", e.ContentCodec)
+	}
+	if json.Valid(e.Content) {
+		t.Errorf("Expected content not to be JSON, got %s", e.Content)
+	}
+}
+
+func TestPersistentStore_ContentFormat_ReadsOtherCodec(t *testing.T) {
+	t.Parallel()
+
+	ds := &Datastore{}
+	gobStore := &PersistentStore{
+		Datastore: ds,
+		ContentFormat: data.ContentFormat{
+			Codec: data.GobCodec{},
+		},
+	}
+	jsonStore := &PersistentStore{
+		Datastore: ds,
+	}
+
+	err := gobStore.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var c testCounter
+	_, err = jsonStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if c.Count != 7 {
+		t.Errorf("Expected count %d, got %d", 7, c.Count)
+	}
+}
+
+func TestPersistentStore_ContentFormat_Migration(t *testing.T) {
+	t.Parallel()
+
+	ds := &Datastore{}
+	oldStore := &PersistentStore{
+		Datastore: ds,
+	}
+	newStore := &PersistentStore{
+		Datastore: ds,
+		ContentFormat: data.ContentFormat{
+			Schemas: map[string]data.ContentSchema{
+				"Baz": {Migrations: []data.ContentMigration{migrateTestCounter}},
+			},
+		},
+	}
+
+	err := oldStore.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var c testCounterV1
+	_, err = newStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if c.Total != 7 {
+		t.Errorf("Expected migrated total %d, got %d", 7, c.Total)
+	}
+
+	// Content written at the current version is not migrated again.
+	err = newStore.Set(context.Background(), "Baz", "Bar", nil, &testCounterV1{Total: 8})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	_, err = newStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if c.Total != 8 {
+		t.Errorf("Expected total %d, got %d", 8, c.Total)
+	}
+
+	// Other kinds are unaffected by the schema.
+	err = newStore.Set(context.Background(), "Qux", "Bar", nil, &testCounter{Count: 9})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	var other testCounter
+	_, err = newStore.Get(context.Background(), "Qux", "Bar", &other)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if other.Count != 9 {
+		t.Errorf("Expected count %d, got %d", 9, other.Count)
+	}
+}
+
+func TestPersistentStore_ContentFormat_NewerVersion(t *testing.T) {
+	t.Parallel()
+
+	ds := &Datastore{}
+	oldStore := &PersistentStore{
+		Datastore: ds,
+	}
+	newStore := &PersistentStore{
+		Datastore: ds,
+		ContentFormat: data.ContentFormat{
+			Schemas: map[string]data.ContentSchema{
+				"Baz": {Migrations: []data.ContentMigration{migrateTestCounter}},
+			},
+		},
+	}
+
+	err := newStore.Set(context.Background(), "Baz", "Bar", nil, &testCounterV1{Total: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var c testCounter
+	_, err = oldStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err == nil {
+		t.Error("Expected error reading content with a newer schema version, got nil")
+	}
+}
+
+func TestPersistentStore_ContentFormat_Encrypted(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+		ContentFormat: data.ContentFormat{
+			Codec: encryption.Codec{
+				Keys: &encryption.LocalKeyProvider{
+					Keys:         map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+					CurrentKeyID: "k1",
+				},
+			},
+		},
+	}
+
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7654321})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	e := ps.Datastore.get(ps.makeKey("Baz", "Bar"))
+	if bytes.Contains(e.Content, []byte("7654321")) {
+		t.Errorf("Expected stored content to be encrypted, got %s", e.Content)
+	}
+
+	var c testCounter
+	_, err = ps.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if c.Count != 7654321 {
+		t.Errorf("Expected count %d, got %d", 7654321, c.Count)
+	}
+}
+
+func TestPersistentStore_ContentFormat_EncryptedRejectsPlaintext(t *testing.T) {
+	t.Parallel()
+
+	ds := &Datastore{}
+	plainStore := &PersistentStore{
+		Datastore: ds,
+	}
+	err := plainStore.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	codec := encryption.Codec{
+		Keys: &encryption.LocalKeyProvider{
+			Keys:         map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+			CurrentKeyID: "k1",
+		},
+	}
+	encryptedStore := &PersistentStore{
+		Datastore:     ds,
+		ContentFormat: data.ContentFormat{Codec: codec},
+	}
+
+	var c testCounter
+	_, err = encryptedStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err == nil {
+		t.Error("Expected error reading plaintext content with an encrypting codec, got nil")
+	}
+
+	codec.Migrating = true
+	encryptedStore.ContentFormat.Codec = codec
+	_, err = encryptedStore.Get(context.Background(), "Baz", "Bar", &c)
+	if err != nil {
+		t.Fatalf("Unexpected error reading plaintext content while migrating: %s", err)
+	}
+	if c.Count != 7 {
+		t.Errorf("Expected count %d, got %d", 7, c.Count)
+	}
+}
+
+func TestPersistentStore_ContentFormat_EncryptedMoved(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+		ContentFormat: data.ContentFormat{
+			Codec: encryption.Codec{
+				Keys: &encryption.LocalKeyProvider{
+					Keys:         map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+					CurrentKeyID: "k1",
+				},
+			},
+		},
+	}
+
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, &testCounter{Count: 7})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Set(context.Background(), "Baz", "Other", nil, &testCounter{Count: 8})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	// Copy the first entity's encrypted content over the second's, as someone with write access to the store could.
+	src := ps.Datastore.get(ps.makeKey("Baz", "Bar"))
+	dst := ps.Datastore.get(ps.makeKey("Baz", "Other"))
+	dst.Content = src.Content
+	ps.Datastore.put(ps.makeKey("Baz", "Other"), dst)
+
+	var c testCounter
+	_, err = ps.Get(context.Background(), "Baz", "Other", &c)
+	if err == nil {
+		t.Error("Expected error reading content copied from another entity, got nil")
+	}
+}
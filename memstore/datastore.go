@@ -0,0 +1,218 @@
+package memstore
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Datastore holds the entities of any number of PersistentStores sharing it.
+// The zero value is an empty datastore ready for use.
+type Datastore struct {
+	lock     sync.Mutex
+	entities map[entityKey]*entity
+
+	// Incremented on every committed write; used to detect conflicting transactions.
+	seq int64
+}
+
+type entityKey struct {
+	Namespace string
+	Kind      string
+	Key       string
+}
+
+type entity struct {
+	Properties []data.Property
+	Content    []byte
+	Version    int64
+
+	// Codec and schema version the content was serialized with, as stored alongside content by aengine.
+	ContentCodec   string
+	ContentVersion int64
+
+	// If non-zero, the entity is treated as not existing once this time has passed.
+	Expiry time.Time
+
+	// Deleted entities are retained as tombstones, so transactions can detect their deletion.
+	Deleted bool
+	ModSeq  int64
+}
+
+func (ds *Datastore) get(k entityKey) *entity {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	e := ds.entities[k]
+	if !e.exists(time.Now()) {
+		return nil
+	}
+	return e.clone()
+}
+
+func (ds *Datastore) put(k entityKey, e *entity) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	ds.putLocked(k, e)
+}
+
+func (ds *Datastore) putLocked(k entityKey, e *entity) {
+	if ds.entities == nil {
+		ds.entities = make(map[entityKey]*entity)
+	}
+
+	ds.seq++
+	e = e.clone()
+	e.ModSeq = ds.seq
+	ds.entities[k] = e
+}
+
+// Puts the entity only if the current entity's version is the expected version, atomically.
+// Returns the current entity's version, and whether the put was made.
+func (ds *Datastore) putIfVersion(k entityKey, version int64, e *entity) (int64, bool) {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	actual := ds.entities[k].version()
+	if actual != version {
+		return actual, false
+	}
+
+	ds.putLocked(k, e)
+	return actual, true
+}
+
+// Returns the keys of entities of a kind within the namespace and prefix which have expired.
+func (ds *Datastore) expiredKeys(namespace, prefix, kind string, now time.Time) []entityKey {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	var keys []entityKey
+	for k, e := range ds.entities {
+		if e.Deleted || k.Namespace != namespace || k.Kind != kind || !strings.HasPrefix(k.Key, prefix) {
+			continue
+		}
+		if !e.Expiry.IsZero() && !now.Before(e.Expiry) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// Deletes the entity if it is still expired, atomically, returning whether it was deleted.
+func (ds *Datastore) deleteIfExpired(k entityKey, now time.Time) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	e := ds.entities[k]
+	if e == nil || e.Deleted || e.exists(now) {
+		return false
+	}
+
+	ds.putLocked(k, &entity{
+		Deleted: true,
+	})
+	return true
+}
+
+func (ds *Datastore) currentSeq() int64 {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	return ds.seq
+}
+
+// Applies the transaction's writes if no entity it read or wrote has been modified since it began.
+// Returns false without applying anything otherwise.
+func (ds *Datastore) commit(tx *transaction) bool {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	for k := range tx.Touched {
+		e := ds.entities[k]
+		if e != nil && e.ModSeq > tx.StartSeq {
+			return false
+		}
+	}
+
+	for _, k := range tx.WriteOrder {
+		ds.putLocked(k, tx.Writes[k])
+	}
+	return true
+}
+
+// Returns the entity's version, or zero if it doesn't exist.
+func (e *entity) version() int64 {
+	if !e.exists(time.Now()) {
+		return 0
+	}
+	return e.Version
+}
+
+// Returns false if the entity is nil, deleted, or expired as of now.
+func (e *entity) exists(now time.Time) bool {
+	if e == nil || e.Deleted {
+		return false
+	}
+	return e.Expiry.IsZero() || now.Before(e.Expiry)
+}
+
+func (e *entity) clone() *entity {
+	c := *e
+	if e.Properties != nil {
+		c.Properties = make([]data.Property, len(e.Properties))
+		copy(c.Properties, e.Properties)
+		for i := range c.Properties {
+			if b, ok := c.Properties[i].Value.([]byte); ok {
+				value := make([]byte, len(b))
+				copy(value, b)
+				c.Properties[i].Value = value
+			}
+		}
+	}
+	if e.Content != nil {
+		c.Content = make([]byte, len(e.Content))
+		copy(c.Content, e.Content)
+	}
+	return &c
+}
+
+type transaction struct {
+	Datastore   *Datastore
+	StartSeq    int64
+	ReadOnly    bool
+	SingleGroup bool
+
+	Touched    map[entityKey]bool
+	Writes     map[entityKey]*entity
+	WriteOrder []entityKey
+}
+
+// Records that the transaction has read or written an entity, so its commit conflicts with concurrent writes to it.
+// Fails if the transaction is single group and has already touched a different entity.
+func (tx *transaction) touch(k entityKey) error {
+	if tx.SingleGroup && !tx.Touched[k] && len(tx.Touched) > 0 {
+		return errors.New("single group transaction cannot touch more than one entity group")
+	}
+	tx.Touched[k] = true
+	return nil
+}
+
+func (tx *transaction) write(k entityKey, e *entity) error {
+	if tx.ReadOnly {
+		return errors.New("cannot write within a read only transaction")
+	}
+
+	err := tx.touch(k)
+	if err != nil {
+		return err
+	}
+	if _, ok := tx.Writes[k]; !ok {
+		tx.WriteOrder = append(tx.WriteOrder, k)
+	}
+	tx.Writes[k] = e.clone()
+	return nil
+}
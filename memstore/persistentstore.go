@@ -0,0 +1,441 @@
+package memstore
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// PersistentStore behaves as aengine.PersistentStore does, but holds entities in memory.
+// Transactions are optimistic; a transaction conflicting with a concurrent write is retried.
+type PersistentStore struct {
+	Datastore         *Datastore
+	Prefix            string
+	PermissionChecker PermissionChecker
+	Namespace         string
+
+	// Number of times a conflicting transaction is attempted before failing.
+	// If zero, three attempts are made, matching App Engine's default.
+	TransactionAttempts int
+
+	// Controls how content is serialized, as aengine.PersistentStore's ContentFormat does.
+	ContentFormat data.ContentFormat
+}
+
+type transactionKey struct{}
+
+func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content interface{}) ([]data.Property, error) {
+	properties, _, err := ps.GetWithVersion(ctx, kind, key, content)
+	return properties, err
+}
+
+// Gets an entity along with its current version, for use with SetIfVersion.
+func (ps *PersistentStore) GetWithVersion(ctx context.Context, kind, key string, content interface{}) ([]data.Property, int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key}).Debug("memstore get")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckRead(ctx, kind, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// If permission is denied we simulate the non-existence of the entity.
+		// This provides robustness against enumeration attacks by default.
+		if !ok {
+			return nil, 0, data.ErrNoSuchEntity
+		}
+	}
+
+	k := ps.makeKey(kind, key)
+	tx := ps.transaction(ctx)
+	if tx != nil {
+		err := tx.touch(k)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	e := ps.Datastore.get(k)
+	if e == nil {
+		return nil, 0, data.ErrNoSuchEntity
+	}
+
+	if e.Content != nil {
+		if content == nil {
+			return nil, 0, errors.New("entity contained content to deserialize, but content param was not set")
+		}
+
+		err := ps.ContentFormat.Decode(kind, key, data.EncodedContent{
+			Data:    e.Content,
+			Codec:   e.ContentCodec,
+			Version: e.ContentVersion,
+		}, content)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "unable to deserialize entity content")
+		}
+	} else if content != nil {
+		return nil, 0, errors.New("entity did not contain content to deserialize, but content param was set")
+	}
+
+	return e.Properties, e.Version, nil
+}
+
+func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties []data.Property, content interface{}) error {
+	return ps.SetWithExpiry(ctx, kind, key, time.Time{}, properties, content)
+}
+
+// Sets an entity which is treated as not existing once expiry has passed, until it is removed by DeleteExpired.
+// A zero expiry never expires.
+func (ps *PersistentStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, content interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key, "expiry": expiry}).Debug("memstore set")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	e, err := ps.newEntity(kind, key, properties, content, expiry)
+	if err != nil {
+		return err
+	}
+
+	k := ps.makeKey(kind, key)
+	tx := ps.transaction(ctx)
+	if tx != nil {
+		return tx.write(k, e)
+	}
+	ps.Datastore.put(k, e)
+	return nil
+}
+
+// Gets multiple entities, with the same semantics as aengine.PersistentStore's GetMulti.
+func (ps *PersistentStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	if contents != nil && len(contents) != len(keys) {
+		return nil, errors.New("contents param must be nil or the same length as keys")
+	}
+
+	results := make([][]data.Property, len(keys))
+	errs := make(data.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		results[i], errs[i] = ps.Get(ctx, k.Kind, k.Key, content)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Sets multiple entities, with the same semantics as aengine.PersistentStore's SetMulti.
+func (ps *PersistentStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, contents []interface{}) error {
+	if properties != nil && len(properties) != len(keys) {
+		return errors.New("properties param must be nil or the same length as keys")
+	}
+	if contents != nil && len(contents) != len(keys) {
+		return errors.New("contents param must be nil or the same length as keys")
+	}
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+	for i, k := range keys {
+		var entityProperties []data.Property
+		if properties != nil {
+			entityProperties = properties[i]
+		}
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		errs[i] = ps.Set(ctx, k.Kind, k.Key, entityProperties, content)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// Sets an entity only if its current version is the expected version, returning its new version.
+// An expected version of zero requires that the entity not exist.
+// If the version does not match, a *data.VersionConflictError is returned.
+func (ps *PersistentStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, content interface{}) (int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key, "version": version}).Debug("memstore set if version")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			return 0, data.ErrWriteAccessDenied
+		}
+	}
+
+	e, err := ps.newEntity(kind, key, properties, content, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	k := ps.makeKey(kind, key)
+	tx := ps.transaction(ctx)
+	var actual int64
+	ok := false
+	if tx != nil {
+		err = tx.touch(k)
+		if err != nil {
+			return 0, err
+		}
+		actual = ps.Datastore.get(k).version()
+		if actual == version {
+			err = tx.write(k, e)
+			if err != nil {
+				return 0, err
+			}
+			ok = true
+		}
+	} else {
+		actual, ok = ps.Datastore.putIfVersion(k, version, e)
+	}
+
+	if !ok {
+		return 0, &data.VersionConflictError{
+			Kind:     kind,
+			Key:      key,
+			Expected: version,
+			Actual:   actual,
+		}
+	}
+	return e.Version, nil
+}
+
+func (ps *PersistentStore) Delete(ctx context.Context, kind, key string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind, "key": key}).Debug("memstore delete")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	k := ps.makeKey(kind, key)
+	e := &entity{
+		Deleted: true,
+	}
+	tx := ps.transaction(ctx)
+	if tx != nil {
+		return tx.write(k, e)
+	}
+	ps.Datastore.put(k, e)
+	return nil
+}
+
+// Deletes expired entities of a kind, with the same semantics as aengine.PersistentStore's DeleteExpired.
+// All expired entities are deleted at once; batchSize is only checked to be positive.
+func (ps *PersistentStore) DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, errors.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": kind}).Debug("memstore delete expired")
+
+	if ps.transaction(ctx) != nil {
+		return 0, errors.New("deleting expired entities is not supported within transactions")
+	}
+
+	now := time.Now()
+	deleted := 0
+	for _, k := range ps.Datastore.expiredKeys(ps.Namespace, ps.Prefix, kind, now) {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, strings.TrimPrefix(k.Key, ps.Prefix))
+			if err != nil {
+				return deleted, err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		if ps.Datastore.deleteIfExpired(k, now) {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Runs a query, with the same semantics as aengine.PersistentStore's Query.
+// Queries do not participate in transactions, and are rejected within one.
+func (ps *PersistentStore) Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "kind": q.Kind}).Debug("memstore query")
+
+	err := q.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if ps.transaction(ctx) != nil {
+		return nil, "", errors.New("queries are not supported within transactions")
+	}
+
+	offset := 0
+	if q.Cursor != "" {
+		offset, err = decodeCursor(q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var results []data.QueryResult
+	matches := ps.Datastore.query(ps.Namespace, ps.Prefix, q)
+	for ; offset < len(matches); offset++ {
+		if q.Limit != 0 && len(results) >= q.Limit {
+			return results, encodeCursor(offset), nil
+		}
+
+		m := matches[offset]
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, q.Kind, m.Key)
+			if err != nil {
+				return nil, "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		results = append(results, data.QueryResult{
+			Key:        m.Key,
+			Properties: m.Entity.Properties,
+		})
+	}
+	return results, "", nil
+}
+
+func (ps *PersistentStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return ps.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+// Runs f in a transaction with the given options.
+// Attempts in the options overrides the store's TransactionAttempts.
+func (ps *PersistentStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	if ps.transaction(ctx) != nil {
+		return errors.New("nested transactions are not supported")
+	}
+
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = ps.TransactionAttempts
+	}
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	l := ctxlogrus.Get(ctx)
+	for i := 0; i < attempts; i++ {
+		l.Debug("memstore transaction start")
+
+		tx := &transaction{
+			Datastore:   ps.Datastore,
+			StartSeq:    ps.Datastore.currentSeq(),
+			ReadOnly:    opts.ReadOnly,
+			SingleGroup: opts.SingleGroup,
+			Touched:     make(map[entityKey]bool),
+			Writes:      make(map[entityKey]*entity),
+		}
+		err := f(context.WithValue(ctx, transactionKey{}, tx))
+		if err != nil {
+			l.Debug("memstore transaction end")
+			return errors.Wrap(err, "")
+		}
+
+		ok := ps.Datastore.commit(tx)
+		l.Debug("memstore transaction end")
+		if ok {
+			return nil
+		}
+	}
+	return data.ErrConcurrentTransaction
+}
+
+// Returns the transaction the context is running in against this store's datastore, if any.
+func (ps *PersistentStore) transaction(ctx context.Context) *transaction {
+	tx, _ := ctx.Value(transactionKey{}).(*transaction)
+	if tx == nil || tx.Datastore != ps.Datastore {
+		return nil
+	}
+	return tx
+}
+
+func (ps *PersistentStore) newEntity(kind, key string, properties []data.Property, content interface{}, expiry time.Time) (*entity, error) {
+	err := data.ValidateProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := data.NewVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	// As in Datastore, []byte values are never indexed, so are read back as unindexed.
+	stored := append([]data.Property(nil), properties...)
+	for i := range stored {
+		stored[i].NoIndex = !stored[i].Indexed()
+	}
+
+	e := &entity{
+		Properties: stored,
+		Version:    version,
+		Expiry:     expiry,
+	}
+	if content != nil {
+		encoded, err := ps.ContentFormat.Encode(kind, key, content)
+		if err != nil {
+			return nil, err
+		}
+		e.Content = encoded.Data
+		e.ContentCodec = encoded.Codec
+		e.ContentVersion = encoded.Version
+	}
+	return e, nil
+}
+
+func (ps *PersistentStore) makeKey(kind, key string) entityKey {
+	return entityKey{
+		Namespace: ps.Namespace,
+		Kind:      kind,
+		Key:       ps.Prefix + key,
+	}
+}
@@ -0,0 +1,427 @@
+package memstore
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/storetest"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestPersistentStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (context.Context, func(opts storetest.Options) storeutil.PersistentStore) {
+		ds := &Datastore{}
+		return context.Background(), func(opts storetest.Options) storeutil.PersistentStore {
+			return &PersistentStore{
+				Datastore:         ds,
+				Prefix:            opts.Prefix,
+				Namespace:         opts.Namespace,
+				PermissionChecker: opts.PermissionChecker,
+			}
+		}
+	})
+}
+
+func TestPersistentStore_SetGet_Copies(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	properties := storetest.Properties()
+	err := ps.Set(context.Background(), "Baz", "Bar", properties, nil)
+	if err != nil {
+		t.Errorf("Unexpected error from Set: %s", err)
+	}
+	properties[0].Value = "Changed"
+
+	got, err := ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	got[1].Value = int64(8)
+
+	got, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	if !reflect.DeepEqual(got, storetest.Properties()) {
+		t.Errorf("Stored properties were modified through caller's slices")
+	}
+}
+
+func TestPersistentStore_SetGet_RichProperties(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	properties := storetest.RichProperties()
+	err := ps.Set(context.Background(), "Baz", "Bar", properties, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	properties[1].Value.([]byte)[0] = 9
+
+	got, err := ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	expected := storetest.RichProperties()
+	expected[1].NoIndex = true
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected properties %v, got %v", expected, got)
+	}
+}
+
+func TestPersistentStore_Get_Permission(t *testing.T) {
+	testCases := []struct {
+		Label       string
+		Ok          bool
+		Err         error
+		ExpectedErr error
+	}{
+		{
+			Label: "Permitted",
+			Ok:    true,
+		},
+		{
+			Label:       "Denied",
+			ExpectedErr: data.ErrNoSuchEntity,
+		},
+		{
+			Label:       "Error",
+			Err:         errors.New("bluh"),
+			ExpectedErr: errors.New("bluh"),
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ds := &Datastore{}
+			err := (&PersistentStore{Datastore: ds}).Set(context.Background(), "Baz", "Bar", nil, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error from Set: %s", err)
+			}
+
+			pc := testhelpers.NewPermissionChecker(t)
+			pc.CheckReadFunc = func(ctx context.Context, kind, key string) (b bool, e error) {
+				if kind != "Baz" || key != "Bar" {
+					t.Errorf("Expected permission check for 'Baz'/'Bar', got '%s'/'%s'", kind, key)
+				}
+				return testCase.Ok, testCase.Err
+			}
+			ps := &PersistentStore{
+				Datastore:         ds,
+				PermissionChecker: pc,
+			}
+
+			_, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+			if testCase.ExpectedErr == nil && err != nil {
+				t.Errorf("Expected nil error from Get, got '%s'", err)
+			}
+			if testCase.ExpectedErr != nil && (err == nil || err.Error() != testCase.ExpectedErr.Error()) {
+				t.Errorf("Expected error '%s' from Get, got '%s'", testCase.ExpectedErr, err)
+			}
+		})
+	}
+}
+
+func TestPersistentStore_Set_InvalidContent(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, &map[string]interface{}{
+		"Foo": math.NaN(),
+	})
+	if err == nil {
+		t.Errorf("Expected error from Set, got nil error.")
+	}
+}
+
+func TestPersistentStore_Transact(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	err := ps.Transact(context.Background(), func(ctx context.Context) error {
+		err := ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+		if err != data.ErrNoSuchEntity {
+			t.Errorf("Expected uncommitted write to be invisible outside transaction, got err '%s'", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from Transact, got %s", err)
+	}
+
+	properties, err := ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	if !reflect.DeepEqual(properties, storetest.Properties()) {
+		t.Errorf("Committed properties did not equal expected properties")
+	}
+}
+
+func TestPersistentStore_Transact_Conflict(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	callCount := 0
+	err := ps.Transact(context.Background(), func(ctx context.Context) error {
+		callCount++
+
+		var count int64
+		_, err := ps.Get(ctx, "Baz", "Bar", &count)
+		if err != nil && err != data.ErrNoSuchEntity {
+			return err
+		}
+
+		// Conflicting write outside the transaction, on the first attempt only.
+		if callCount == 1 {
+			otherCount := int64(10)
+			err = ps.Set(context.Background(), "Baz", "Bar", nil, &otherCount)
+			if err != nil {
+				return err
+			}
+		}
+
+		count++
+		return ps.Set(ctx, "Baz", "Bar", nil, &count)
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from Transact, got %s", err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected call count to be %d, was %d", 2, callCount)
+	}
+
+	var count int64
+	_, err = ps.Get(context.Background(), "Baz", "Bar", &count)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	if count != 11 {
+		t.Errorf("Expected count %d, got %d", 11, count)
+	}
+}
+
+func TestPersistentStore_Transact_ConflictAttemptsExhausted(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore:           &Datastore{},
+		TransactionAttempts: 2,
+	}
+
+	callCount := 0
+	err := ps.Transact(context.Background(), func(ctx context.Context) error {
+		callCount++
+
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		if err != nil && err != data.ErrNoSuchEntity {
+			return err
+		}
+		return ps.Set(context.Background(), "Baz", "Bar", nil, nil)
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected error '%s' from Transact, got '%s'", data.ErrConcurrentTransaction, err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected call count to be %d, was %d", 2, callCount)
+	}
+}
+
+func TestPersistentStore_Transact_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore:           &Datastore{},
+		TransactionAttempts: 1000,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := ps.Transact(context.Background(), func(ctx context.Context) error {
+				var count int64
+				_, err := ps.Get(ctx, "Baz", "Bar", &count)
+				if err != nil && err != data.ErrNoSuchEntity {
+					return err
+				}
+
+				count++
+				return ps.Set(ctx, "Baz", "Bar", nil, &count)
+			})
+			if err != nil {
+				t.Errorf("Expected nil error from Transact, got %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var count int64
+	_, err := ps.Get(context.Background(), "Baz", "Bar", &count)
+	if err != nil {
+		t.Errorf("Unexpected error from Get: %s", err)
+	}
+	if count != 20 {
+		t.Errorf("Expected count %d, got %d", 20, count)
+	}
+}
+
+func TestPersistentStore_TransactWithOptions_Attempts(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore:           &Datastore{},
+		TransactionAttempts: 5,
+	}
+
+	callCount := 0
+	err := ps.TransactWithOptions(context.Background(), data.TransactionOptions{Attempts: 1}, func(ctx context.Context) error {
+		callCount++
+
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		if err != nil && err != data.ErrNoSuchEntity {
+			return err
+		}
+		return ps.Set(context.Background(), "Baz", "Bar", nil, nil)
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected error '%s' from TransactWithOptions, got '%s'", data.ErrConcurrentTransaction, err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected call count to be %d, was %d", 1, callCount)
+	}
+}
+
+func TestPersistentStore_TransactWithOptions_ReadOnly(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	err = ps.TransactWithOptions(context.Background(), data.TransactionOptions{ReadOnly: true}, func(ctx context.Context) error {
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		if err != nil {
+			t.Errorf("Unexpected error from Get: %s", err)
+		}
+		return ps.Delete(ctx, "Baz", "Bar")
+	})
+	if err == nil {
+		t.Error("Expected error writing in read only transaction, got nil")
+	}
+
+	_, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Errorf("Expected entity to remain, got error from Get: %s", err)
+	}
+}
+
+func TestPersistentStore_TransactWithOptions_SingleGroup(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	err := ps.TransactWithOptions(context.Background(), data.TransactionOptions{SingleGroup: true}, func(ctx context.Context) error {
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		if err != data.ErrNoSuchEntity {
+			t.Errorf("Expected error '%s' from Get, got '%s'", data.ErrNoSuchEntity, err)
+		}
+
+		err = ps.Set(ctx, "Baz", "Bar", nil, nil)
+		if err != nil {
+			t.Errorf("Unexpected error from Set of the same entity: %s", err)
+		}
+
+		return ps.Set(ctx, "Baz", "Foo", nil, nil)
+	})
+	if err == nil {
+		t.Error("Expected error touching a second entity in single group transaction, got nil")
+	}
+
+	_, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected failed transaction not to commit, got error '%v' from Get", err)
+	}
+}
+
+func TestPersistentStore_Delete_ConflictsWithTransaction(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+	err := ps.Set(context.Background(), "Baz", "Bar", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	callCount := 0
+	err = ps.Transact(context.Background(), func(ctx context.Context) error {
+		callCount++
+
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		if err == data.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if callCount == 1 {
+			err = ps.Delete(context.Background(), "Baz", "Bar")
+			if err != nil {
+				return err
+			}
+		}
+		return ps.Set(ctx, "Baz", "Bar", storetest.Properties(), nil)
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from Transact, got %s", err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected call count to be %d, was %d", 2, callCount)
+	}
+
+	_, err = ps.Get(context.Background(), "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get, got '%s'", data.ErrNoSuchEntity, err)
+	}
+}
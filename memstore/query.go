@@ -0,0 +1,66 @@
+package memstore
+
+import (
+	"encoding/base64"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type queryEntity struct {
+	Key    string
+	Entity *entity
+}
+
+// Returns the entities matching the query's kind and filters, in the query's order.
+// Keys are returned with the prefix removed; entities outside the prefix are omitted.
+func (ds *Datastore) query(namespace, prefix string, q data.Query) []queryEntity {
+	now := time.Now()
+	ds.lock.Lock()
+	var matches []queryEntity
+	for k, e := range ds.entities {
+		if !e.exists(now) || k.Namespace != namespace || k.Kind != q.Kind || !strings.HasPrefix(k.Key, prefix) {
+			continue
+		}
+		if !q.Matches(e.Properties) {
+			continue
+		}
+
+		matches = append(matches, queryEntity{
+			Key:    strings.TrimPrefix(k.Key, prefix),
+			Entity: e.clone(),
+		})
+	}
+	ds.lock.Unlock()
+
+	// As in Datastore, results are ordered by key after any specified orders.
+	sort.Slice(matches, func(i, j int) bool {
+		c := q.Compare(matches[i].Entity.Properties, matches[j].Entity.Properties)
+		if c != 0 {
+			return c < 0
+		}
+		return matches[i].Key < matches[j].Key
+	})
+	return matches
+}
+
+// Cursors are offsets into the ordered results; unlike Datastore's,
+// they are not stable if matching entities are added or removed between queries.
+func encodeCursor(offset int) string {
+	return base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, data.ErrInvalidCursor
+	}
+
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, data.ErrInvalidCursor
+	}
+	return offset, nil
+}
@@ -0,0 +1,414 @@
+package memstore
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func makeQueryTestStore(t *testing.T) *PersistentStore {
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+		Prefix:    "Foo",
+	}
+
+	entities := []struct {
+		Key   string
+		Label string
+		Limit int64
+	}{
+		{"A", "x", 10},
+		{"B", "y", 30},
+		{"C", "x", 20},
+		{"D", "x", 40},
+	}
+	for _, e := range entities {
+		properties := []data.Property{
+			{Name: "Label", Value: e.Label},
+			{Name: "Limit", Value: e.Limit},
+		}
+		err := ps.Set(context.Background(), "Baz", e.Key, properties, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+
+	// Entities in another kind, prefix, or namespace, and entities without the properties, must never match.
+	err := ps.Set(context.Background(), "Other", "E", []data.Property{{Name: "Label", Value: "x"}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = (&PersistentStore{Datastore: ps.Datastore, Prefix: "Bar"}).Set(context.Background(), "Baz", "F", []data.Property{{Name: "Label", Value: "x"}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = (&PersistentStore{Datastore: ps.Datastore, Prefix: "Foo", Namespace: "N"}).Set(context.Background(), "Baz", "G", []data.Property{{Name: "Label", Value: "x"}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Set(context.Background(), "Baz", "H", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	return ps
+}
+
+func queryResultKeys(results []data.QueryResult) (keys []string) {
+	for _, r := range results {
+		keys = append(keys, r.Key)
+	}
+	return
+}
+
+func TestPersistentStore_Query(t *testing.T) {
+	testCases := []struct {
+		Label        string
+		Filters      []data.Filter
+		Orders       []data.Order
+		ExpectedKeys []string
+	}{
+		{
+			Label:        "Equal",
+			Filters:      []data.Filter{{Property: "Label", Op: data.FilterEqual, Value: "x"}},
+			ExpectedKeys: []string{"A", "C", "D"},
+		},
+		{
+			Label:        "EqualWrongType",
+			Filters:      []data.Filter{{Property: "Limit", Op: data.FilterEqual, Value: float64(10)}},
+			ExpectedKeys: nil,
+		},
+		{
+			Label:        "GreaterThan",
+			Filters:      []data.Filter{{Property: "Limit", Op: data.FilterGreaterThan, Value: int64(20)}},
+			ExpectedKeys: []string{"B", "D"},
+		},
+		{
+			Label:        "GreaterOrEqual",
+			Filters:      []data.Filter{{Property: "Limit", Op: data.FilterGreaterOrEqual, Value: int64(20)}},
+			ExpectedKeys: []string{"B", "C", "D"},
+		},
+		{
+			Label:        "LessThan",
+			Filters:      []data.Filter{{Property: "Limit", Op: data.FilterLessThan, Value: int64(20)}},
+			ExpectedKeys: []string{"A"},
+		},
+		{
+			Label:        "LessOrEqual",
+			Filters:      []data.Filter{{Property: "Limit", Op: data.FilterLessOrEqual, Value: int64(20)}},
+			ExpectedKeys: []string{"A", "C"},
+		},
+		{
+			Label: "Combined",
+			Filters: []data.Filter{
+				{Property: "Label", Op: data.FilterEqual, Value: "x"},
+				{Property: "Limit", Op: data.FilterGreaterThan, Value: int64(10)},
+			},
+			ExpectedKeys: []string{"C", "D"},
+		},
+		{
+			Label:        "Order",
+			Orders:       []data.Order{{Property: "Limit"}},
+			ExpectedKeys: []string{"A", "C", "B", "D"},
+		},
+		{
+			Label:        "OrderDescending",
+			Orders:       []data.Order{{Property: "Limit", Descending: true}},
+			ExpectedKeys: []string{"D", "B", "C", "A"},
+		},
+		{
+			Label: "OrderMultiple",
+			Orders: []data.Order{
+				{Property: "Label", Descending: true},
+				{Property: "Limit", Descending: true},
+			},
+			ExpectedKeys: []string{"B", "D", "C", "A"},
+		},
+		{
+			Label:        "NoFilters",
+			ExpectedKeys: []string{"A", "B", "C", "D", "H"},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ps := makeQueryTestStore(t)
+			results, cursor, err := ps.Query(context.Background(), data.Query{
+				Kind:    "Baz",
+				Filters: testCase.Filters,
+				Orders:  testCase.Orders,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error from Query: %s", err)
+			}
+			if cursor != "" {
+				t.Errorf("Expected empty cursor from Query, got '%s'", cursor)
+			}
+
+			keys := queryResultKeys(results)
+			if !reflect.DeepEqual(keys, testCase.ExpectedKeys) {
+				t.Errorf("Expected result keys %v, got %v", testCase.ExpectedKeys, keys)
+			}
+		})
+	}
+}
+
+func makeRichQueryTestStore(t *testing.T) *PersistentStore {
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	base := time.Date(2019, 06, 11, 0, 0, 0, 0, time.UTC)
+	entities := []struct {
+		Key     string
+		Tags    []int64
+		Created time.Time
+	}{
+		{"A", []int64{1, 5}, base},
+		{"B", []int64{3}, base.Add(time.Hour)},
+		{"C", []int64{2, 9}, base.Add(2 * time.Hour)},
+	}
+	for _, e := range entities {
+		properties := []data.Property{
+			{Name: "Created", Value: e.Created},
+			{Name: "Note", Value: "x", NoIndex: true},
+			{Name: "Blob", Value: []byte("x")},
+		}
+		for _, tag := range e.Tags {
+			properties = append(properties, data.Property{Name: "Tag", Value: tag, Multiple: true})
+		}
+		err := ps.Set(context.Background(), "Baz", e.Key, properties, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+	return ps
+}
+
+func TestPersistentStore_Query_RichProperties(t *testing.T) {
+	base := time.Date(2019, 06, 11, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		Label        string
+		Filters      []data.Filter
+		Orders       []data.Order
+		ExpectedKeys []string
+	}{
+		{
+			Label:        "TimeFilter",
+			Filters:      []data.Filter{{Property: "Created", Op: data.FilterGreaterThan, Value: base}},
+			ExpectedKeys: []string{"B", "C"},
+		},
+		{
+			Label:        "TimeOrder",
+			Orders:       []data.Order{{Property: "Created", Descending: true}},
+			ExpectedKeys: []string{"C", "B", "A"},
+		},
+		{
+			Label:        "MultipleEqualAnyValue",
+			Filters:      []data.Filter{{Property: "Tag", Op: data.FilterEqual, Value: int64(9)}},
+			ExpectedKeys: []string{"C"},
+		},
+		{
+			Label: "MultipleInequalitiesSameValue",
+			Filters: []data.Filter{
+				{Property: "Tag", Op: data.FilterGreaterThan, Value: int64(2)},
+				{Property: "Tag", Op: data.FilterLessThan, Value: int64(5)},
+			},
+			ExpectedKeys: []string{"B"},
+		},
+		{
+			Label:        "MultipleOrderAscendingByLowest",
+			Orders:       []data.Order{{Property: "Tag"}},
+			ExpectedKeys: []string{"A", "C", "B"},
+		},
+		{
+			Label:        "MultipleOrderDescendingByHighest",
+			Orders:       []data.Order{{Property: "Tag", Descending: true}},
+			ExpectedKeys: []string{"C", "A", "B"},
+		},
+		{
+			Label:   "NoIndexNeverMatches",
+			Filters: []data.Filter{{Property: "Note", Op: data.FilterEqual, Value: "x"}},
+		},
+		{
+			Label:  "NoIndexNeverOrders",
+			Orders: []data.Order{{Property: "Blob"}},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ps := makeRichQueryTestStore(t)
+			results, _, err := ps.Query(context.Background(), data.Query{
+				Kind:    "Baz",
+				Filters: testCase.Filters,
+				Orders:  testCase.Orders,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error from Query: %s", err)
+			}
+
+			keys := queryResultKeys(results)
+			if !reflect.DeepEqual(keys, testCase.ExpectedKeys) {
+				t.Errorf("Expected result keys %v, got %v", testCase.ExpectedKeys, keys)
+			}
+		})
+	}
+}
+
+func TestPersistentStore_Query_Properties(t *testing.T) {
+	t.Parallel()
+
+	ps := makeQueryTestStore(t)
+	results, _, err := ps.Query(context.Background(), data.Query{
+		Kind:    "Baz",
+		Filters: []data.Filter{{Property: "Limit", Op: data.FilterEqual, Value: int64(10)}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+
+	expectedResults := []data.QueryResult{
+		{
+			Key: "A",
+			Properties: []data.Property{
+				{Name: "Label", Value: "x"},
+				{Name: "Limit", Value: int64(10)},
+			},
+		},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("Expected results %v, got %v", expectedResults, results)
+	}
+}
+
+func TestPersistentStore_Query_LimitCursor(t *testing.T) {
+	t.Parallel()
+
+	ps := makeQueryTestStore(t)
+	q := data.Query{
+		Kind:   "Baz",
+		Orders: []data.Order{{Property: "Limit"}},
+		Limit:  3,
+	}
+
+	results, cursor, err := ps.Query(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+	expectedKeys := []string{"A", "C", "B"}
+	if keys := queryResultKeys(results); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Expected first page keys %v, got %v", expectedKeys, keys)
+	}
+	if cursor == "" {
+		t.Fatal("Expected non-empty cursor from first page")
+	}
+
+	q.Cursor = cursor
+	results, cursor, err = ps.Query(context.Background(), q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+	expectedKeys = []string{"D"}
+	if keys := queryResultKeys(results); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Expected second page keys %v, got %v", expectedKeys, keys)
+	}
+	if cursor != "" {
+		t.Errorf("Expected empty cursor from last page, got '%s'", cursor)
+	}
+}
+
+func TestPersistentStore_Query_Permission(t *testing.T) {
+	t.Parallel()
+
+	ps := makeQueryTestStore(t)
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckReadFunc = func(ctx context.Context, kind, key string) (b bool, e error) {
+		return key != "A" && key != "C", nil
+	}
+	ps.PermissionChecker = pc
+
+	// Denied results must not count toward the limit.
+	results, _, err := ps.Query(context.Background(), data.Query{
+		Kind:    "Baz",
+		Filters: []data.Filter{{Property: "Label", Op: data.FilterEqual, Value: "x"}},
+		Limit:   1,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+	expectedKeys := []string{"D"}
+	if keys := queryResultKeys(results); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("Expected result keys %v, got %v", expectedKeys, keys)
+	}
+}
+
+func TestPersistentStore_Query_Invalid(t *testing.T) {
+	testCases := []struct {
+		Label string
+		Query data.Query
+	}{
+		{
+			Label: "Operator",
+			Query: data.Query{Kind: "Baz", Filters: []data.Filter{{Property: "Limit", Op: "!=", Value: int64(1)}}},
+		},
+		{
+			Label: "FilterValue",
+			Query: data.Query{Kind: "Baz", Filters: []data.Filter{{Property: "Limit", Op: data.FilterEqual, Value: 1}}},
+		},
+		{
+			Label: "FilterContent",
+			Query: data.Query{Kind: "Baz", Filters: []data.Filter{{Property: "Content", Op: data.FilterEqual, Value: "x"}}},
+		},
+		{
+			Label: "OrderContent",
+			Query: data.Query{Kind: "Baz", Orders: []data.Order{{Property: "Content"}}},
+		},
+		{
+			Label: "Limit",
+			Query: data.Query{Kind: "Baz", Limit: -1},
+		},
+		{
+			Label: "Cursor",
+			Query: data.Query{Kind: "Baz", Cursor: "bluh"},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ps := makeQueryTestStore(t)
+			_, _, err := ps.Query(context.Background(), testCase.Query)
+			if err == nil {
+				t.Error("Expected error from Query, got nil")
+			}
+		})
+	}
+}
+
+func TestPersistentStore_Query_InTransaction(t *testing.T) {
+	t.Parallel()
+
+	ps := makeQueryTestStore(t)
+	err := ps.Transact(context.Background(), func(ctx context.Context) error {
+		_, _, err := ps.Query(ctx, data.Query{Kind: "Baz"})
+		if err == nil {
+			t.Error("Expected error from Query within transaction, got nil")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error from Transact: %s", err)
+	}
+}
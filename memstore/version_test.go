@@ -0,0 +1,51 @@
+package memstore
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"testing"
+)
+
+func TestPersistentStore_SetIfVersion_Transaction(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		Datastore: &Datastore{},
+	}
+
+	var version int64
+	err := ps.Transact(context.Background(), func(ctx context.Context) error {
+		var err error
+		version, err = ps.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Transact: %s", err)
+	}
+
+	_, gotVersion, err := ps.GetWithVersion(context.Background(), "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if gotVersion != version {
+		t.Errorf("Expected version %d after transaction, got %d", version, gotVersion)
+	}
+
+	// A concurrent write between the version check and commit must cause the transaction to be retried.
+	attempts := 0
+	err = ps.Transact(context.Background(), func(ctx context.Context) error {
+		attempts++
+		_, err := ps.SetIfVersion(ctx, "Baz", "Bar", version, nil, nil)
+		if attempts == 1 {
+			return (&PersistentStore{Datastore: ps.Datastore}).Set(context.Background(), "Baz", "Bar", nil, nil)
+		}
+		return err
+	})
+	if _, ok := errors.Cause(err).(*data.VersionConflictError); !ok {
+		t.Errorf("Expected version conflict error from retried transaction, got '%s'", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected transaction to be attempted %d times, was attempted %d times", 2, attempts)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/api"
+	"github.com/jbeshir/moonbird-auth-frontend/controllers"
+	"net/http"
+)
+
+// Makes the router for the public API, serving requests made with API tokens under /api/.
+// Every request is authenticated and billed by authenticator before reaching its handler,
+// so each path must be mapped to an endpoint in the configuration to be usable.
+// Handlers reach project data only through projectStore, which should check permission with a
+// ProjectPermissionChecker using the same authenticator, restricting tokens to their own project.
+func makePublicApiMux(authenticator *api.TokenAuthenticator, projectStore api.PersistentStore, responder controllers.WebApiResponder) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	valueStore := &api.ProjectValueStore{
+		PersistentStore: projectStore,
+	}
+
+	apiGetValue := &controllers.ApiGetValue{
+		ValueStore: valueStore,
+	}
+	mux.HandleFunc("/api/get-value", apiGetValue.HandleFunc(authenticator, responder))
+
+	apiSetValue := &controllers.ApiSetValue{
+		ValueStore: valueStore,
+	}
+	mux.HandleFunc("/api/set-value", apiSetValue.HandleFunc(authenticator, responder))
+
+	return mux
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/api"
+	"github.com/jbeshir/moonbird-auth-frontend/memstore"
+	"github.com/jbeshir/moonbird-auth-frontend/responders"
+	"github.com/jbeshir/moonbird-auth-frontend/standalone"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Wires the public API as main does, over an in-memory store.
+type testPublicApi struct {
+	Handler     http.Handler
+	Biller      *api.EndpointBiller
+	Permissions *api.ProjectPermissionChecker
+}
+
+func newTestPublicApi() *testPublicApi {
+	ds := &memstore.Datastore{}
+
+	endpoints := &api.EndpointTable{}
+	endpoints.Set(map[string]string{
+		"/api/get-value": "values",
+		"/api/set-value": "values",
+	})
+	biller := &api.EndpointBiller{
+		PersistentStore: &memstore.PersistentStore{Datastore: ds},
+		Endpoints:       endpoints,
+	}
+
+	authenticator := &api.TokenAuthenticator{
+		Biller:  biller,
+		Wrapped: &standalone.ContextMaker{},
+	}
+	permissions := &api.ProjectPermissionChecker{
+		PersistentStore:    &memstore.PersistentStore{Datastore: ds},
+		TokenAuthenticator: authenticator,
+	}
+	projectStore := &memstore.PersistentStore{
+		Datastore:         ds,
+		PermissionChecker: permissions,
+	}
+
+	return &testPublicApi{
+		Handler:     makePublicApiMux(authenticator, projectStore, &responders.WebApi{}),
+		Biller:      biller,
+		Permissions: permissions,
+	}
+}
+
+// Makes a token for a project, with a limit on the number of requests it may make.
+func (p *testPublicApi) newToken(t *testing.T, project string, limit int64) string {
+	token, err := p.Permissions.CreateToken(context.Background(), project)
+	if err != nil {
+		t.Fatalf("Unexpected error from CreateToken: %s", err)
+	}
+	err = p.Biller.SetLimit(context.Background(), token, "values", limit)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetLimit: %s", err)
+	}
+	return token
+}
+
+func (p *testPublicApi) post(path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	p.Handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestPublicApi_SetAndGetValue(t *testing.T) {
+	t.Parallel()
+
+	p := newTestPublicApi()
+	token := p.newToken(t, "foo", 10)
+
+	w := p.post("/api/set-value", url.Values{
+		"apitoken": {token},
+		"project":  {"foo"},
+		"name":     {"bar"},
+		"value":    {"baz"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d setting value, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w = p.post("/api/get-value", url.Values{
+		"apitoken": {token},
+		"project":  {"foo"},
+		"name":     {"bar"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d getting value, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	if w.Body.String() != "\"baz\"\n" {
+		t.Errorf("Expected body '%s', got '%s'", "\"baz\"\n", w.Body)
+	}
+}
+
+func TestPublicApi_Rejected(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label        string
+		Path         string
+		Token        string
+		Project      string
+		ExpectedCode int
+	}{
+		{
+			Label:        "NoToken",
+			Path:         "/api/get-value",
+			Project:      "foo",
+			ExpectedCode: http.StatusUnauthorized,
+		},
+		{
+			Label:        "UnknownToken",
+			Path:         "/api/get-value",
+			Token:        "bluh",
+			Project:      "foo",
+			ExpectedCode: http.StatusPaymentRequired,
+		},
+		{
+			Label:        "UnknownPath",
+			Path:         "/api/bluh",
+			Token:        "valid",
+			Project:      "foo",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Label:        "OtherProjectGet",
+			Path:         "/api/get-value",
+			Token:        "valid",
+			Project:      "other",
+			ExpectedCode: http.StatusNotFound,
+		},
+		{
+			Label:        "OtherProjectSet",
+			Path:         "/api/set-value",
+			Token:        "valid",
+			Project:      "other",
+			ExpectedCode: http.StatusForbidden,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			p := newTestPublicApi()
+			token := p.newToken(t, "foo", 10)
+
+			// The other project's value exists, so a denied read can only be due to permissions.
+			otherToken := p.newToken(t, "other", 10)
+			w := p.post("/api/set-value", url.Values{
+				"apitoken": {otherToken},
+				"project":  {"other"},
+				"name":     {"bar"},
+				"value":    {"baz"},
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d setting other project's value, got %d: %s", http.StatusOK, w.Code, w.Body)
+			}
+
+			form := url.Values{
+				"project": {testCase.Project},
+				"name":    {"bar"},
+				"value":   {"bluh"},
+			}
+			if testCase.Token == "valid" {
+				form.Set("apitoken", token)
+			} else if testCase.Token != "" {
+				form.Set("apitoken", testCase.Token)
+			}
+
+			w = p.post(testCase.Path, form)
+			if w.Code != testCase.ExpectedCode {
+				t.Errorf("Expected status %d, got %d: %s", testCase.ExpectedCode, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestPublicApi_BillsToLimit(t *testing.T) {
+	t.Parallel()
+
+	p := newTestPublicApi()
+	token := p.newToken(t, "foo", 2)
+
+	form := url.Values{
+		"apitoken": {token},
+		"project":  {"foo"},
+		"name":     {"bar"},
+		"value":    {"baz"},
+	}
+	for i := 0; i < 2; i++ {
+		w := p.post("/api/set-value", form)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d for request %d, got %d: %s", http.StatusOK, i+1, w.Code, w.Body)
+		}
+	}
+
+	w := p.post("/api/set-value", form)
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected status %d beyond limit, got %d: %s", http.StatusPaymentRequired, w.Code, w.Body)
+	}
+}
@@ -0,0 +1,446 @@
+package redisstore
+
+import (
+	"bytes"
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheStore behaves as aengine.CacheStore does, but stores values in Redis, under keys namespaced by Prefix.
+//
+// As with aengine.CacheStore, keys include a generation number held in Redis alongside them, so Flush can
+// invalidate every key under the prefix at once; values from old generations are left to expire or be evicted,
+// so should be given TTLs, or Redis configured with an eviction policy.
+//
+// Counters are held as decimal strings, as memcache holds them, so values set by other methods cannot be
+// incremented, and counters cannot be read with Get. Incrementing by a non-negative delta with Increment is a
+// single atomic command, suiting frequently updated counters; other increments are made with WATCH, and retried
+// if the counter changes concurrently.
+type CacheStore struct {
+	Client *redis.Client
+	Prefix string
+
+	// Codec used to serialize values. If nil, data.GobCodec is used.
+	Codec data.Codec
+}
+
+// Maximum number of times an operation using WATCH is attempted, if the key changes while it runs.
+const watchAttempts = 10
+
+type casToken struct {
+	fullKey string
+	value   []byte
+}
+
+func (cs *CacheStore) Get(ctx context.Context, key string, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("redis cache get")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	value, err := cs.Client.Get(ctx, fullKey).Bytes()
+	if err != nil {
+		return cacheError(err)
+	}
+	return cs.codec().Unmarshal(value, v)
+}
+
+func (cs *CacheStore) GetMulti(ctx context.Context, keys []string, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "keys": keys}).Debug("redis cache get multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	prefixedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		prefixedKeys[i] = keyPrefix + key
+	}
+
+	values, err := cs.Client.MGet(ctx, prefixedKeys...).Result()
+	if err != nil {
+		return cacheError(err)
+	}
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			errs[i] = data.ErrCacheMiss
+			failed = true
+			continue
+		}
+
+		err := cs.codec().Unmarshal([]byte(s), v[i])
+		if err != nil {
+			errs[i] = err
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (cs *CacheStore) Set(ctx context.Context, key string, v interface{}) error {
+	return cs.SetWithTTL(ctx, key, 0, v)
+}
+
+func (cs *CacheStore) SetWithTTL(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("redis cache set")
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return cacheError(cs.Client.Set(ctx, fullKey, value, ttl).Err())
+}
+
+func (cs *CacheStore) SetMulti(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "keys": keys, "ttl": ttl}).Debug("redis cache set multi")
+
+	if len(v) != len(keys) {
+		return errors.New("v param must be the same length as keys")
+	}
+
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		var err error
+		values[i], err = cs.codec().Marshal(v[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = cs.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			pipe.Set(ctx, keyPrefix+key, values[i], ttl)
+		}
+		return nil
+	})
+	return cacheError(err)
+}
+
+func (cs *CacheStore) Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("redis cache add")
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	stored, err := cs.Client.SetNX(ctx, fullKey, value, ttl).Result()
+	if err != nil {
+		return cacheError(err)
+	}
+	if !stored {
+		return data.ErrCacheNotStored
+	}
+	return nil
+}
+
+// Redis has no CAS IDs, so the token holds the value read, and CompareAndSwap detects changes by comparing it
+// with the current value. A value rewritten with the same serialized content is not seen as changed.
+func (cs *CacheStore) GetForCAS(ctx context.Context, key string, v interface{}) (data.CASToken, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("redis cache get for cas")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := cs.Client.Get(ctx, fullKey).Bytes()
+	if err != nil {
+		return nil, cacheError(err)
+	}
+
+	err = cs.codec().Unmarshal(value, v)
+	if err != nil {
+		return nil, err
+	}
+	return casToken{fullKey: fullKey, value: value}, nil
+}
+
+func (cs *CacheStore) CompareAndSwap(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "ttl": ttl}).Debug("redis cache compare and swap")
+
+	t, ok := token.(casToken)
+	if !ok || !strings.HasPrefix(t.fullKey, cs.Prefix) || !strings.HasSuffix(t.fullKey, "/"+key) {
+		return errors.Errorf("cas token was not read for key '%s'", key)
+	}
+
+	value, err := cs.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	// If the cache was flushed since the value was read, the value has been removed.
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	if t.fullKey != fullKey {
+		return data.ErrCacheNotStored
+	}
+
+	err = cs.Client.Watch(ctx, func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, fullKey).Bytes()
+		if err == redis.Nil {
+			return data.ErrCacheNotStored
+		}
+		if err != nil {
+			return cacheError(err)
+		}
+		if !bytes.Equal(current, t.value) {
+			return data.ErrCacheCASConflict
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, fullKey, value, ttl)
+			return nil
+		})
+		return err
+	}, fullKey)
+	if err == redis.TxFailedErr {
+		return data.ErrCacheCASConflict
+	}
+	return cacheError(err)
+}
+
+func (cs *CacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return cs.IncrementWithTTL(ctx, key, 0, delta, initialValue)
+}
+
+func (cs *CacheStore) IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "delta": delta}).Debug("redis cache increment")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Redis counters are signed, so only counters within int64's range can be incremented by Redis itself.
+	if delta < 0 || initialValue > uint64(1<<63-1) {
+		return cs.increment(ctx, fullKey, delta, true, initialValue, ttl)
+	}
+
+	var incr *redis.IntCmd
+	_, err = cs.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, fullKey, strconv.FormatUint(initialValue, 10), ttl)
+		incr = pipe.IncrBy(ctx, fullKey, delta)
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to increment key '%s'", key)
+	}
+	return uint64(incr.Val()), nil
+}
+
+func (cs *CacheStore) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key, "delta": delta}).Debug("redis cache increment existing")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	// Incrementing by zero reads the counter, which needs no transaction.
+	if delta == 0 {
+		value, err := cs.Client.Get(ctx, fullKey).Result()
+		if err != nil {
+			return 0, cacheError(err)
+		}
+		return parseCounter(fullKey, value)
+	}
+	return cs.increment(ctx, fullKey, delta, false, 0, 0)
+}
+
+func (cs *CacheStore) Delete(ctx context.Context, key string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix, "key": key}).Debug("redis cache delete")
+
+	fullKey, err := cs.fullKey(ctx, key)
+	if err != nil {
+		return err
+	}
+	deleted, err := cs.Client.Del(ctx, fullKey).Result()
+	if err != nil {
+		return cacheError(err)
+	}
+	if deleted == 0 {
+		return data.ErrCacheMiss
+	}
+	return nil
+}
+
+// Invalidates every value and counter under the prefix, leaving other users of Redis unaffected.
+func (cs *CacheStore) Flush(ctx context.Context) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": cs.Prefix}).Debug("redis cache flush")
+
+	_, err := cs.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, cs.generationKey(), initialGeneration(), 0)
+		pipe.Incr(ctx, cs.generationKey())
+		return nil
+	})
+	return cacheError(err)
+}
+
+// Adds delta to a counter within a WATCH transaction, wrapping on overflow and stopping at zero on underflow,
+// as memcache does. If the counter is not present, it is created with initialValue if create is set,
+// or ErrCacheMiss is returned if not. Incrementing keeps the counter's TTL.
+func (cs *CacheStore) increment(ctx context.Context, fullKey string, delta int64, create bool, initialValue uint64, ttl time.Duration) (uint64, error) {
+	var result uint64
+	for i := 0; i < watchAttempts; i++ {
+		err := cs.Client.Watch(ctx, func(tx *redis.Tx) error {
+			exists := true
+			current, err := tx.Get(ctx, fullKey).Result()
+			if err == redis.Nil && create {
+				exists = false
+				current = strconv.FormatUint(initialValue, 10)
+			} else if err != nil {
+				return cacheError(err)
+			}
+
+			value, err := parseCounter(fullKey, current)
+			if err != nil {
+				return err
+			}
+			if delta >= 0 {
+				value += uint64(delta)
+			} else if uint64(-delta) > value {
+				value = 0
+			} else {
+				value -= uint64(-delta)
+			}
+			result = value
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if exists {
+					pipe.SetArgs(ctx, fullKey, strconv.FormatUint(value, 10), redis.SetArgs{KeepTTL: true})
+				} else {
+					pipe.Set(ctx, fullKey, strconv.FormatUint(value, 10), ttl)
+				}
+				return nil
+			})
+			return err
+		}, fullKey)
+
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return 0, cacheError(err)
+		}
+		return result, nil
+	}
+	return 0, errors.Errorf("counter '%s' changed concurrently in each of %d attempts", fullKey, watchAttempts)
+}
+
+// Returns the prefix for keys in the current generation.
+func (cs *CacheStore) keyPrefix(ctx context.Context) (string, error) {
+	var get *redis.StringCmd
+	_, err := cs.Client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, cs.generationKey(), initialGeneration(), 0)
+		get = pipe.Get(ctx, cs.generationKey())
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(cacheError(err), "unable to read cache generation")
+	}
+
+	generation, err := get.Uint64()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read cache generation")
+	}
+	return cs.Prefix + strconv.FormatUint(generation, 36) + "/", nil
+}
+
+func (cs *CacheStore) fullKey(ctx context.Context, key string) (string, error) {
+	keyPrefix, err := cs.keyPrefix(ctx)
+	if err != nil {
+		return "", err
+	}
+	return keyPrefix + key, nil
+}
+
+func (cs *CacheStore) generationKey() string {
+	return cs.Prefix + "#generation"
+}
+
+// If the generation is evicted, it restarts from the current time, so it does not return to an old generation
+// whose values may still be present.
+func initialGeneration() int64 {
+	return time.Now().UnixNano()
+}
+
+func (cs *CacheStore) codec() data.Codec {
+	if cs.Codec == nil {
+		return data.GobCodec{}
+	}
+	return cs.Codec
+}
+
+func parseCounter(fullKey, value string) (uint64, error) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("cannot increment non-numeric value of key '%s'", fullKey)
+	}
+	return n, nil
+}
+
+// Maps Redis errors to their data package equivalents, so callers needn't depend on Redis.
+func cacheError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case redis.Nil:
+		return data.ErrCacheMiss
+	case data.ErrCacheMiss, data.ErrCacheNotStored, data.ErrCacheCASConflict:
+		return err
+	}
+	return errors.Wrap(err, "")
+}
@@ -0,0 +1,477 @@
+package redisstore
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/jbeshir/moonbird-auth-frontend/api"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/redis/go-redis/v9"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var _ data.CacheStore = (*CacheStore)(nil)
+var _ api.UsageCounter = (*CacheStore)(nil)
+
+// Starts an in-process Redis server, stopped when the test ends.
+func newTestStore(t *testing.T) (*miniredis.Miniredis, *CacheStore) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return mr, &CacheStore{
+		Client: client,
+		Prefix: "Foo/",
+	}
+}
+
+func TestCacheStore_SetGet(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	var value string
+	err := cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get, got: %v", err)
+	}
+
+	err = cs.Set(ctx, "Foo", map[string]int64{"bluh": 1})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var getValue map[string]int64
+	err = cs.Get(ctx, "Foo", &getValue)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if getValue["bluh"] != 1 {
+		t.Errorf("Expected value %d, got %d", 1, getValue["bluh"])
+	}
+
+	err = cs.Delete(ctx, "Foo")
+	if err != nil {
+		t.Errorf("Unexpected error from Delete: %s", err)
+	}
+	err = cs.Delete(ctx, "Foo")
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Delete of missing key, got: %v", err)
+	}
+	err = cs.Get(ctx, "Foo", &getValue)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_Prefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	err := cs.Set(ctx, "Foo", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	other := &CacheStore{Client: cs.Client, Prefix: "Bar/"}
+	var value string
+	err = other.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get with other prefix, got: %v", err)
+	}
+}
+
+func TestCacheStore_TTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr, cs := newTestStore(t)
+
+	err := cs.SetWithTTL(ctx, "Foo", time.Minute, "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithTTL: %s", err)
+	}
+	err = cs.Set(ctx, "Bar", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	mr.FastForward(time.Minute)
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after TTL, got: %v", err)
+	}
+	err = cs.Get(ctx, "Bar", &value)
+	if err != nil {
+		t.Errorf("Expected value without TTL not to expire, got: %v", err)
+	}
+
+	err = cs.Add(ctx, "Foo", 0, "again")
+	if err != nil {
+		t.Errorf("Expected Add of expired key to succeed, got: %v", err)
+	}
+}
+
+func TestCacheStore_SetMultiGetMulti(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr, cs := newTestStore(t)
+
+	err := cs.SetMulti(ctx, []string{"A", "B"}, time.Minute, []interface{}{"A", "B"})
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	var a, b, c string
+	err = cs.GetMulti(ctx, []string{"A", "B", "C"}, []interface{}{&a, &b, &c})
+	expectedErr := data.MultiError{nil, nil, data.ErrCacheMiss}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error %v from GetMulti, got %v", expectedErr, err)
+	}
+	if a != "A" || b != "B" {
+		t.Errorf("Expected values %s and %s, got %s and %s", "A", "B", a, b)
+	}
+
+	mr.FastForward(time.Minute)
+	err = cs.GetMulti(ctx, []string{"A"}, []interface{}{&a})
+	expectedErr = data.MultiError{data.ErrCacheMiss}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error %v from GetMulti after TTL, got %v", expectedErr, err)
+	}
+
+	err = cs.SetMulti(ctx, []string{"A"}, 0, nil)
+	if err == nil {
+		t.Error("Expected error from SetMulti with mismatched values, got nil error")
+	}
+}
+
+func TestCacheStore_Add(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	err := cs.Add(ctx, "Foo", 0, "first")
+	if err != nil {
+		t.Fatalf("Unexpected error from Add: %s", err)
+	}
+	err = cs.Add(ctx, "Foo", 0, "second")
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from Add of present key, got: %v", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if value != "first" {
+		t.Errorf("Expected value %s, got %s", "first", value)
+	}
+}
+
+func TestCacheStore_CompareAndSwap(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	var value int64
+	_, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from GetForCAS, got: %v", err)
+	}
+
+	err = cs.Set(ctx, "Foo", int64(1))
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	token, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+	staleToken, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+
+	err = cs.CompareAndSwap(ctx, "Bar", token, 0, value+1)
+	if err == nil {
+		t.Error("Expected error from CompareAndSwap with token for another key, got nil error")
+	}
+
+	err = cs.CompareAndSwap(ctx, "Foo", token, 0, value+1)
+	if err != nil {
+		t.Errorf("Unexpected error from CompareAndSwap: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Foo", staleToken, 0, value+1)
+	if err != data.ErrCacheCASConflict {
+		t.Errorf("Expected conflict error from stale CompareAndSwap, got: %v", err)
+	}
+
+	token, err = cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+	if value != 2 {
+		t.Errorf("Expected value %d, got %d", 2, value)
+	}
+
+	err = cs.Delete(ctx, "Foo")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Foo", token, 0, value+1)
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from CompareAndSwap after Delete, got: %v", err)
+	}
+}
+
+func TestCacheStore_CompareAndSwap_AfterFlush(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	err := cs.Set(ctx, "Foo", int64(1))
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var value int64
+	token, err := cs.GetForCAS(ctx, "Foo", &value)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetForCAS: %s", err)
+	}
+
+	err = cs.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error from Flush: %s", err)
+	}
+	err = cs.CompareAndSwap(ctx, "Foo", token, 0, value+1)
+	if err != data.ErrCacheNotStored {
+		t.Errorf("Expected not stored error from CompareAndSwap after Flush, got: %v", err)
+	}
+}
+
+func TestCacheStore_Increment(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	_, err := cs.IncrementExisting(ctx, "Foo", 1)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from IncrementExisting, got: %v", err)
+	}
+	_, err = cs.IncrementExisting(ctx, "Foo", 0)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from IncrementExisting by zero, got: %v", err)
+	}
+
+	value, err := cs.Increment(ctx, "Foo", 2, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from Increment: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, got %d", 12, value)
+	}
+
+	value, err = cs.IncrementExisting(ctx, "Foo", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, got %d", 12, value)
+	}
+
+	value, err = cs.IncrementExisting(ctx, "Foo", -20)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected decrement below zero to leave value %d, got %d", 0, value)
+	}
+
+	value, err = cs.Increment(ctx, "Bar", -1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from Increment: %s", err)
+	}
+	if value != 9 {
+		t.Errorf("Expected value %d, got %d", 9, value)
+	}
+
+	err = cs.Set(ctx, "Baz", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	_, err = cs.Increment(ctx, "Baz", 1, 0)
+	if err == nil {
+		t.Error("Expected error incrementing non-numeric value, got nil error")
+	}
+	_, err = cs.IncrementExisting(ctx, "Baz", -1)
+	if err == nil {
+		t.Error("Expected error decrementing non-numeric value, got nil error")
+	}
+}
+
+func TestCacheStore_IncrementWithTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr, cs := newTestStore(t)
+
+	value, err := cs.IncrementWithTTL(ctx, "Foo", time.Minute, 2, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+	if value != 12 {
+		t.Errorf("Expected value %d, got %d", 12, value)
+	}
+
+	// Decrements are applied by a transaction rather than by Redis, and must set the TTL too.
+	value, err = cs.IncrementWithTTL(ctx, "Bar", time.Minute, -1, 10)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementWithTTL: %s", err)
+	}
+	if value != 9 {
+		t.Errorf("Expected value %d, got %d", 9, value)
+	}
+
+	// Incrementing an existing counter keeps the expiry it was created with.
+	mr.FastForward(30 * time.Second)
+	for _, key := range []string{"Foo", "Bar"} {
+		_, err = cs.IncrementWithTTL(ctx, key, time.Minute, -1, 0)
+		if err != nil {
+			t.Fatalf("Unexpected error from IncrementWithTTL: %s", err)
+		}
+	}
+
+	mr.FastForward(30 * time.Second)
+	for _, key := range []string{"Foo", "Bar"} {
+		_, err = cs.IncrementExisting(ctx, key, 0)
+		if err != data.ErrCacheMiss {
+			t.Errorf("Expected cache miss error from IncrementExisting of '%s' after TTL, got: %v", key, err)
+		}
+	}
+}
+
+func TestCacheStore_Increment_Unsigned(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	// Counters beyond int64's range wrap as memcache's do.
+	value, err := cs.Increment(ctx, "Foo", 1, 1<<64-1)
+	if err != nil {
+		t.Fatalf("Unexpected error from Increment: %s", err)
+	}
+	if value != 0 {
+		t.Errorf("Expected value %d, got %d", 0, value)
+	}
+}
+
+func TestCacheStore_Increment_KeepsTTL(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	mr, cs := newTestStore(t)
+
+	err := cs.SetWithTTL(ctx, "Foo", time.Minute, "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithTTL: %s", err)
+	}
+	fullKey, err := cs.fullKey(ctx, "Foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Counters are stored as decimal strings, so one set directly can be incremented.
+	mr.Set(fullKey, "5")
+	mr.SetTTL(fullKey, time.Minute)
+
+	value, err := cs.IncrementExisting(ctx, "Foo", -1)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 4 {
+		t.Errorf("Expected value %d, got %d", 4, value)
+	}
+	if ttl := mr.TTL(fullKey); ttl != time.Minute {
+		t.Errorf("Expected TTL %s to be kept, got %s", time.Minute, ttl)
+	}
+}
+
+func TestCacheStore_Increment_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, err := cs.Increment(ctx, "Foo", 1, 0)
+				if err != nil {
+					t.Errorf("Unexpected error from Increment: %s", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := cs.IncrementExisting(ctx, "Foo", 0)
+	if err != nil {
+		t.Fatalf("Unexpected error from IncrementExisting: %s", err)
+	}
+	if value != 1000 {
+		t.Errorf("Expected value %d, got %d", 1000, value)
+	}
+}
+
+func TestCacheStore_Flush(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	_, cs := newTestStore(t)
+
+	err := cs.Set(ctx, "Foo", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	other := &CacheStore{Client: cs.Client, Prefix: "Bar/"}
+	err = other.Set(ctx, "Foo", "bluh")
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	err = cs.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error from Flush: %s", err)
+	}
+
+	var value string
+	err = cs.Get(ctx, "Foo", &value)
+	if err != data.ErrCacheMiss {
+		t.Errorf("Expected cache miss error from Get after Flush, got: %v", err)
+	}
+	err = other.Get(ctx, "Foo", &value)
+	if err != nil {
+		t.Errorf("Expected value under other prefix to survive Flush, got: %v", err)
+	}
+}
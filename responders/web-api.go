@@ -5,14 +5,28 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
 	"net/http"
+	"reflect"
 )
 
 type WebApi struct {
 	ExposeErrors bool
 }
 
+// Requests without exactly one API token are rejected as unauthorized,
+// and those refused by billing as requiring payment.
 func (r *WebApi) OnContextError(w http.ResponseWriter, err error) {
+	switch errors.Cause(err) {
+	case data.ErrInvalidApiToken:
+		http.Error(w, "Unauthorized: expected exactly one api token", 401)
+		return
+	case data.ErrOutOfCredit:
+		http.Error(w, "Payment Required: no credit available", 402)
+		return
+	}
+
 	if r.ExposeErrors {
 		http.Error(w, fmt.Sprintf("Internal Server Error: %s", err), 500)
 	} else {
@@ -22,6 +36,39 @@ func (r *WebApi) OnContextError(w http.ResponseWriter, err error) {
 
 func (r *WebApi) OnError(ctx context.Context, w http.ResponseWriter, err error) {
 	l := ctxlogrus.Get(ctx)
+
+	cause := errors.Cause(err)
+	if cause == data.ErrInvalidCursor {
+		l.Info(err)
+		http.Error(w, "Bad Request: invalid cursor", 400)
+		return
+	}
+	if cause == data.ErrInvalidETag {
+		l.Info(err)
+		http.Error(w, "Bad Request: invalid etag", 400)
+		return
+	}
+	if cause == data.ErrPreconditionFailed {
+		l.Info(err)
+		http.Error(w, "Precondition Failed", 412)
+		return
+	}
+	if cause == data.ErrNoSuchEntity {
+		l.Info(err)
+		http.Error(w, "Not Found", 404)
+		return
+	}
+	if cause == data.ErrWriteAccessDenied {
+		l.Info(err)
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if _, ok := cause.(*data.VersionConflictError); ok {
+		l.Info(err)
+		http.Error(w, "Precondition Failed", 412)
+		return
+	}
+
 	l.Error(err)
 
 	if r.ExposeErrors {
@@ -35,3 +82,16 @@ func (r *WebApi) OnSuccess(w http.ResponseWriter, v interface{}) {
 	encoder := json.NewEncoder(w)
 	encoder.Encode(v)
 }
+
+// Pages are written as an object with the page's items and the cursor for the next page, if any.
+// A page with no items has an empty list of items, rather than null.
+func (r *WebApi) OnSuccessPage(w http.ResponseWriter, page data.Page) {
+	items := reflect.ValueOf(page.Items)
+	if !items.IsValid() {
+		page.Items = []interface{}{}
+	} else if items.Kind() == reflect.Slice && items.IsNil() {
+		page.Items = reflect.MakeSlice(items.Type(), 0, 0).Interface()
+	}
+
+	r.OnSuccess(w, page)
+}
@@ -0,0 +1,60 @@
+package sqlstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+)
+
+// Cursors hold the position of the last result read, as JSON, signed as aengine.PersistentStore's are,
+// so clients can't forge cursors or reuse them against queries of another kind.
+// As with Datastore's, queries continue after the position, unaffected by entities added or removed before it.
+func (ps *PersistentStore) encodeCursor(kind string, position *queryPosition) (string, error) {
+	if len(ps.CursorKey) == 0 {
+		return "", errors.New("unable to sign cursor: cursor key not configured")
+	}
+
+	b, err := json.Marshal(position)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	raw := string(b)
+	signed := append(ps.signCursor(kind, raw), raw...)
+	return base64.RawURLEncoding.EncodeToString(signed), nil
+}
+
+func (ps *PersistentStore) decodeCursor(kind, cursor string) (*queryPosition, error) {
+	if len(ps.CursorKey) == 0 {
+		return nil, errors.New("unable to verify cursor: cursor key not configured")
+	}
+
+	signed, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(signed) < sha256.Size {
+		return nil, data.ErrInvalidCursor
+	}
+
+	mac, raw := signed[:sha256.Size], string(signed[sha256.Size:])
+	if !hmac.Equal(mac, ps.signCursor(kind, raw)) {
+		return nil, data.ErrInvalidCursor
+	}
+
+	var position queryPosition
+	err = json.Unmarshal([]byte(raw), &position)
+	if err != nil {
+		return nil, data.ErrInvalidCursor
+	}
+	return &position, nil
+}
+
+func (ps *PersistentStore) signCursor(kind, raw string) []byte {
+	h := hmac.New(sha256.New, ps.CursorKey)
+	h.Write([]byte(ps.Namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(raw))
+	return h.Sum(nil)
+}
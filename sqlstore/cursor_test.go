@@ -0,0 +1,113 @@
+package sqlstore
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"reflect"
+	"testing"
+)
+
+func TestPersistentStore_Cursor(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{
+		CursorKey: []byte("bluh"),
+	}
+
+	cursor, err := ps.encodeCursor("Baz", &queryPosition{OrderValues: [][]byte{indexValue(int64(42))}, Key: "FooBar"})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding cursor: %s", err)
+	}
+
+	decoded, err := ps.decodeCursor("Baz", cursor)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding cursor: %s", err)
+	}
+	expected := &queryPosition{OrderValues: [][]byte{indexValue(int64(42))}, Key: "FooBar"}
+	if !reflect.DeepEqual(decoded, expected) {
+		t.Errorf("Expected decoded position %v, got %v", expected, decoded)
+	}
+}
+
+func TestPersistentStore_Cursor_Invalid(t *testing.T) {
+	ps := &PersistentStore{
+		CursorKey: []byte("bluh"),
+	}
+	cursor, err := ps.encodeCursor("Baz", &queryPosition{OrderValues: [][]byte{indexValue(int64(42))}, Key: "FooBar"})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding cursor: %s", err)
+	}
+
+	tampered := []byte(cursor)
+	tampered[0] ^= 1
+
+	testCases := []struct {
+		Label  string
+		Store  *PersistentStore
+		Kind   string
+		Cursor string
+	}{
+		{
+			Label:  "Tampered",
+			Store:  ps,
+			Kind:   "Baz",
+			Cursor: string(tampered),
+		},
+		{
+			Label:  "OtherKind",
+			Store:  ps,
+			Kind:   "Bar",
+			Cursor: cursor,
+		},
+		{
+			Label:  "OtherKey",
+			Store:  &PersistentStore{CursorKey: []byte("blah")},
+			Kind:   "Baz",
+			Cursor: cursor,
+		},
+		{
+			Label:  "OtherNamespace",
+			Store:  &PersistentStore{CursorKey: []byte("bluh"), Namespace: "Foo"},
+			Kind:   "Baz",
+			Cursor: cursor,
+		},
+		{
+			Label:  "Truncated",
+			Store:  ps,
+			Kind:   "Baz",
+			Cursor: cursor[:10],
+		},
+		{
+			Label:  "NotBase64",
+			Store:  ps,
+			Kind:   "Baz",
+			Cursor: "!!!",
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := testCase.Store.decodeCursor(testCase.Kind, testCase.Cursor)
+			if err != data.ErrInvalidCursor {
+				t.Errorf("Expected error '%s' decoding cursor, got '%s'", data.ErrInvalidCursor, err)
+			}
+		})
+	}
+}
+
+func TestPersistentStore_Cursor_NoKey(t *testing.T) {
+	t.Parallel()
+
+	ps := &PersistentStore{}
+	_, err := ps.encodeCursor("Baz", &queryPosition{OrderValues: [][]byte{indexValue(int64(42))}, Key: "FooBar"})
+	if err == nil {
+		t.Error("Expected error encoding cursor with no key, got nil")
+	}
+
+	_, err = ps.decodeCursor("Baz", "bluh")
+	if err == nil {
+		t.Error("Expected error decoding cursor with no key, got nil")
+	}
+}
@@ -0,0 +1,133 @@
+package sqlstore
+
+import "strings"
+
+// Dialect holds what differs between the SQL databases PersistentStore supports.
+// Queries are written with $1-style placeholders, which both SQLite and Postgres accept.
+type Dialect struct {
+	Name string
+
+	// Schema migrations, applied in order of version by Migrate.
+	Migrations []Migration
+
+	// Returns whether an error means a transaction conflicted with a concurrent one, and may succeed if retried.
+	IsConflict func(err error) bool
+}
+
+// SQLite is the dialect for SQLite 3.24 or later, as provided by modernc.org/sqlite or github.com/mattn/go-sqlite3.
+// Concurrent writers conflict rather than waiting unless the connection sets a busy timeout,
+// such as with "_pragma=busy_timeout(5000)" in modernc.org/sqlite's data source name.
+var SQLite = &Dialect{
+	Name: "sqlite",
+	Migrations: []Migration{
+		{
+			Version: 1,
+			Statements: []string{
+				`CREATE TABLE entities (
+					namespace TEXT NOT NULL,
+					kind TEXT NOT NULL,
+					entity_key TEXT NOT NULL,
+					properties TEXT NOT NULL,
+					content BLOB,
+					content_codec TEXT NOT NULL DEFAULT '',
+					content_version INTEGER NOT NULL DEFAULT 0,
+					version INTEGER NOT NULL,
+					expiry INTEGER,
+					PRIMARY KEY (namespace, kind, entity_key)
+				)`,
+				`CREATE INDEX entities_expiry ON entities (namespace, kind, expiry)`,
+			},
+		},
+		{
+			Version: 2,
+			Statements: []string{
+				`CREATE TABLE entity_properties (
+					namespace TEXT NOT NULL,
+					kind TEXT NOT NULL,
+					entity_key TEXT NOT NULL,
+					name TEXT NOT NULL,
+					value BLOB NOT NULL
+				)`,
+				`CREATE INDEX entity_properties_entity ON entity_properties (namespace, kind, entity_key, name, value)`,
+				`CREATE INDEX entity_properties_value ON entity_properties (namespace, kind, name, value)`,
+			},
+			Apply: indexEntities,
+		},
+	},
+	IsConflict: isSQLiteConflict,
+}
+
+// Postgres is the dialect for PostgreSQL 9.5 or later, as provided by github.com/lib/pq or github.com/jackc/pgx.
+var Postgres = &Dialect{
+	Name: "postgres",
+	Migrations: []Migration{
+		{
+			Version: 1,
+			Statements: []string{
+				`CREATE TABLE entities (
+					namespace TEXT NOT NULL,
+					kind TEXT NOT NULL,
+					entity_key TEXT NOT NULL,
+					properties TEXT NOT NULL,
+					content BYTEA,
+					content_codec TEXT NOT NULL DEFAULT '',
+					content_version BIGINT NOT NULL DEFAULT 0,
+					version BIGINT NOT NULL,
+					expiry BIGINT,
+					PRIMARY KEY (namespace, kind, entity_key)
+				)`,
+				`CREATE INDEX entities_expiry ON entities (namespace, kind, expiry)`,
+			},
+		},
+		{
+			Version: 2,
+			Statements: []string{
+				// Keys are ordered bytewise, as in Datastore, rather than by the database's locale.
+				`ALTER TABLE entities ALTER COLUMN entity_key TYPE TEXT COLLATE "C"`,
+				`CREATE TABLE entity_properties (
+					namespace TEXT NOT NULL,
+					kind TEXT NOT NULL,
+					entity_key TEXT COLLATE "C" NOT NULL,
+					name TEXT NOT NULL,
+					value BYTEA NOT NULL
+				)`,
+				`CREATE INDEX entity_properties_entity ON entity_properties (namespace, kind, entity_key, name, value)`,
+				`CREATE INDEX entity_properties_value ON entity_properties (namespace, kind, name, value)`,
+			},
+			Apply: indexEntities,
+		},
+	},
+	IsConflict: isPostgresConflict,
+}
+
+// SQLite reports a transaction which would deadlock with another as busy, rather than waiting.
+func isSQLiteConflict(err error) bool {
+	const (
+		sqliteBusy   = 5
+		sqliteLocked = 6
+	)
+
+	if coded, ok := err.(interface{ Code() int }); ok {
+		code := coded.Code() & 0xff
+		return code == sqliteBusy || code == sqliteLocked
+	}
+
+	// Not every driver exposes its error codes through a method, so we fall back to their messages.
+	msg := err.Error()
+	return strings.Contains(msg, "database is locked") || strings.Contains(msg, "database table is locked")
+}
+
+// Postgres reports serializable transactions which conflict as serialization failures or deadlocks.
+func isPostgresConflict(err error) bool {
+	stated, ok := err.(interface{ SQLState() string })
+	if !ok {
+		return false
+	}
+
+	switch stated.SQLState() {
+	case "40001", "40P01":
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,185 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"math"
+	"strings"
+	"time"
+)
+
+// Each indexed value of an entity's properties is also held in a row of the entity_properties table,
+// so queries can filter and order by them in SQL.
+// Values are encoded such that they sort bytewise in the order Datastore sorts them,
+// letting a single column hold values of every type.
+
+// Type ranks, the first byte of an encoded value, ordering values of different types as Datastore does.
+// Times are ranked with integers, as they are ordered among them.
+const (
+	indexRankInt    = 1
+	indexRankBool   = 2
+	indexRankString = 3
+	indexRankFloat  = 4
+)
+
+// Encodes a value to be compared with those in the entity_properties table.
+// Values which are never indexed, such as []byte, encode as nil.
+func indexValue(v interface{}) []byte {
+	switch v := v.(type) {
+	case int64:
+		return encodeIndexInt(v)
+	case time.Time:
+		return encodeIndexInt(v.Unix()*1e6 + int64(v.Nanosecond()/1e3))
+	case bool:
+		if v {
+			return []byte{indexRankBool, 1}
+		}
+		return []byte{indexRankBool, 0}
+	case string:
+		return append([]byte{indexRankString}, v...)
+	case float64:
+		// Negative zero equals zero, so is encoded the same.
+		if v == 0 {
+			v = 0
+		}
+
+		// Flipping the sign bit of positive floats, and every bit of negative ones, orders them as unsigned integers.
+		bits := math.Float64bits(v)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+
+		b := make([]byte, 9)
+		b[0] = indexRankFloat
+		binary.BigEndian.PutUint64(b[1:], bits)
+		return b
+	}
+	return nil
+}
+
+func encodeIndexInt(v int64) []byte {
+	b := make([]byte, 9)
+	b[0] = indexRankInt
+	binary.BigEndian.PutUint64(b[1:], uint64(v)^(1<<63))
+	return b
+}
+
+// Replaces the index rows of an entity, by its full key, with those for its properties.
+func (ps *PersistentStore) indexProperties(ctx context.Context, q querier, kind, fullKey string, properties []data.Property) error {
+	err := ps.unindex(ctx, q, kind, []string{fullKey})
+	if err != nil {
+		return err
+	}
+	return insertIndexRows(ctx, q, ps.Namespace, kind, fullKey, properties)
+}
+
+// Removes the index rows of entities by their full keys.
+func (ps *PersistentStore) unindex(ctx context.Context, q querier, kind string, fullKeys []string) error {
+	args := []interface{}{ps.Namespace, kind}
+	placeholders := make([]string, len(fullKeys))
+	for i, k := range fullKeys {
+		placeholders[i] = placeholder(len(args) + 1)
+		args = append(args, k)
+	}
+
+	_, err := q.ExecContext(ctx,
+		`DELETE FROM entity_properties WHERE namespace = $1 AND kind = $2 AND entity_key IN (`+strings.Join(placeholders, ", ")+`)`,
+		args...)
+	return errors.Wrap(err, "")
+}
+
+func insertIndexRows(ctx context.Context, q querier, namespace, kind, fullKey string, properties []data.Property) error {
+	var rows [][]interface{}
+	for _, p := range properties {
+		if v := indexValue(p.Value); p.Indexed() && v != nil {
+			rows = append(rows, []interface{}{namespace, kind, fullKey, p.Name, v})
+		}
+	}
+
+	// Rows are inserted several at a time, keeping within databases' limits on parameters.
+	const rowsPerStatement = maxBatchKeys / 5
+	for start := 0; start < len(rows); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(rows) {
+			end = len(rows)
+		}
+
+		var args []interface{}
+		values := make([]string, end-start)
+		for i, row := range rows[start:end] {
+			placeholders := make([]string, len(row))
+			for j, arg := range row {
+				args = append(args, arg)
+				placeholders[j] = placeholder(len(args))
+			}
+			values[i] = "(" + strings.Join(placeholders, ", ") + ")"
+		}
+
+		_, err := q.ExecContext(ctx,
+			`INSERT INTO entity_properties (namespace, kind, entity_key, name, value) VALUES `+strings.Join(values, ", "),
+			args...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	return nil
+}
+
+// Migrates entities written before the entity_properties table was introduced, indexing their properties.
+// Entities are read in batches, as not every driver allows statements while rows are being read.
+func indexEntities(ctx context.Context, tx *sql.Tx) error {
+	args := []interface{}{maxBatchKeys}
+	after := ""
+	for {
+		rows, err := tx.QueryContext(ctx,
+			`SELECT namespace, kind, entity_key, properties FROM entities `+after+`
+			ORDER BY namespace, kind, entity_key LIMIT $1`,
+			args...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+
+		type entity struct {
+			Namespace, Kind, Key string
+			Properties           []data.Property
+		}
+		var batch []entity
+		for rows.Next() {
+			var e entity
+			var encoded string
+			err = rows.Scan(&e.Namespace, &e.Kind, &e.Key, &encoded)
+			if err == nil {
+				e.Properties, err = decodeProperties(encoded)
+			}
+			if err != nil {
+				rows.Close()
+				return errors.Wrap(err, "")
+			}
+			batch = append(batch, e)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+
+		for _, e := range batch {
+			err = insertIndexRows(ctx, tx, e.Namespace, e.Kind, e.Key, e.Properties)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < maxBatchKeys {
+			return nil
+		}
+		last := batch[len(batch)-1]
+		args = []interface{}{maxBatchKeys, last.Namespace, last.Kind, last.Key}
+		after = `WHERE namespace > $2 OR (namespace = $2 AND kind > $3) OR (namespace = $2 AND kind = $3 AND entity_key > $4)`
+	}
+}
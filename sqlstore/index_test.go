@@ -0,0 +1,81 @@
+package sqlstore
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIndexValue_Order(t *testing.T) {
+	t.Parallel()
+
+	// Values in the order Datastore sorts them.
+	values := []interface{}{
+		int64(math.MinInt64),
+		int64(-1),
+		time.Unix(0, 0),
+		int64(1),
+		time.Unix(1, 0),
+		int64(math.MaxInt64),
+		false,
+		true,
+		"",
+		"a",
+		"ab",
+		"b",
+		math.Inf(-1),
+		float64(-1.5),
+		float64(0),
+		float64(1e-300),
+		float64(2),
+		math.Inf(1),
+	}
+
+	for i := 1; i < len(values); i++ {
+		a, b := indexValue(values[i-1]), indexValue(values[i])
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("Expected %v to sort before %v, got encodings %x and %x", values[i-1], values[i], a, b)
+		}
+	}
+}
+
+func TestIndexValue_Equal(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label string
+		A, B  interface{}
+	}{
+		{
+			Label: "TimeMicroseconds",
+			A:     time.Unix(1, 2500),
+			B:     int64(1000002),
+		},
+		{
+			Label: "NegativeZero",
+			A:     math.Copysign(0, -1),
+			B:     float64(0),
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			a, b := indexValue(testCase.A), indexValue(testCase.B)
+			if !bytes.Equal(a, b) {
+				t.Errorf("Expected %v and %v to encode the same, got %x and %x", testCase.A, testCase.B, a, b)
+			}
+		})
+	}
+}
+
+func TestIndexValue_Bytes(t *testing.T) {
+	t.Parallel()
+
+	if v := indexValue([]byte{1, 2, 3}); v != nil {
+		t.Errorf("Expected []byte value not to be indexed, got %x", v)
+	}
+}
@@ -0,0 +1,87 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Migration is a change to the schema, made by running its statements in a transaction.
+type Migration struct {
+	// Versions are positive and increasing; the schema_migrations table records those applied.
+	Version    int64
+	Statements []string
+
+	// If set, run in the same transaction after the statements, to migrate existing rows.
+	Apply func(ctx context.Context, tx *sql.Tx) error
+}
+
+// Brings the database's schema up to date, applying the dialect's migrations not yet applied.
+// Each migration is applied in its own transaction along with its record in schema_migrations,
+// so a failed migration leaves the schema as it was before it, and running Migrate again retries it.
+func Migrate(ctx context.Context, db *sql.DB, dialect *Dialect) error {
+	l := ctxlogrus.Get(ctx)
+
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version BIGINT PRIMARY KEY)`)
+	if err != nil {
+		return errors.Wrap(err, "unable to create schema_migrations table")
+	}
+
+	var current int64
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "unable to read schema version")
+	}
+
+	previous := int64(0)
+	for _, m := range dialect.Migrations {
+		if m.Version <= previous {
+			return errors.Errorf("migration version %d did not follow version %d", m.Version, previous)
+		}
+		previous = m.Version
+
+		if m.Version <= current {
+			continue
+		}
+
+		err = applyMigration(ctx, db, m)
+		if err != nil {
+			return errors.Wrapf(err, "unable to apply migration %d", m.Version)
+		}
+		l.WithFields(logrus.Fields{"dialect": dialect.Name, "version": m.Version}).Info("applied schema migration")
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	for _, statement := range m.Statements {
+		_, err = tx.ExecContext(ctx, statement)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Wrap(err, "")
+		}
+	}
+
+	if m.Apply != nil {
+		err = m.Apply(ctx, tx)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// If another process applied the migration concurrently, this fails on the primary key, and ours is rolled back.
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, m.Version)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Wrap(err, "")
+	}
+	return errors.Wrap(tx.Commit(), "")
+}
@@ -0,0 +1,166 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", "file:"+filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	return db
+}
+
+func schemaVersions(t *testing.T, db *sql.DB) []int64 {
+	rows, err := db.Query(`SELECT version FROM schema_migrations ORDER BY version`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var versions []int64
+	for rows.Next() {
+		var v int64
+		err = rows.Scan(&v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	db := openTestDB(t)
+
+	dialect := &Dialect{
+		Name: "test",
+		Migrations: []Migration{
+			{Version: 1, Statements: []string{`CREATE TABLE foo (a INTEGER)`}},
+		},
+	}
+	err := Migrate(context.Background(), db, dialect)
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate: %s", err)
+	}
+
+	// Applied migrations are not run again, so the table isn't recreated.
+	dialect.Migrations = append(dialect.Migrations, Migration{Version: 3, Statements: []string{`ALTER TABLE foo ADD COLUMN b INTEGER`}})
+	err = Migrate(context.Background(), db, dialect)
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate with new migration: %s", err)
+	}
+
+	_, err = db.Exec(`INSERT INTO foo (a, b) VALUES (1, 2)`)
+	if err != nil {
+		t.Errorf("Expected migrated schema to have new column, got error: %s", err)
+	}
+	versions := schemaVersions(t, db)
+	if len(versions) != 2 || versions[0] != 1 || versions[1] != 3 {
+		t.Errorf("Expected applied versions [1 3], got %v", versions)
+	}
+}
+
+func TestMigrate_Failure(t *testing.T) {
+	t.Parallel()
+	db := openTestDB(t)
+
+	dialect := &Dialect{
+		Name: "test",
+		Migrations: []Migration{
+			{Version: 1, Statements: []string{`CREATE TABLE foo (a INTEGER)`, `NOT SQL`}},
+		},
+	}
+	err := Migrate(context.Background(), db, dialect)
+	if err == nil {
+		t.Fatal("Expected error from Migrate with invalid statement, got nil")
+	}
+
+	// The failed migration's earlier statements are rolled back along with it.
+	dialect.Migrations[0].Statements = dialect.Migrations[0].Statements[:1]
+	err = Migrate(context.Background(), db, dialect)
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate after fixing migration: %s", err)
+	}
+	versions := schemaVersions(t, db)
+	if len(versions) != 1 || versions[0] != 1 {
+		t.Errorf("Expected applied versions [1], got %v", versions)
+	}
+}
+
+func TestMigrate_OutOfOrder(t *testing.T) {
+	t.Parallel()
+	db := openTestDB(t)
+
+	dialect := &Dialect{
+		Name: "test",
+		Migrations: []Migration{
+			{Version: 2, Statements: []string{`CREATE TABLE foo (a INTEGER)`}},
+			{Version: 1, Statements: []string{`CREATE TABLE bar (a INTEGER)`}},
+		},
+	}
+	err := Migrate(context.Background(), db, dialect)
+	if err == nil {
+		t.Error("Expected error from Migrate with out of order versions, got nil")
+	}
+}
+
+func TestMigrate_SQLite(t *testing.T) {
+	t.Parallel()
+	db := openTestDB(t)
+
+	for i := 0; i < 2; i++ {
+		err := Migrate(context.Background(), db, SQLite)
+		if err != nil {
+			t.Fatalf("Unexpected error from Migrate run %d: %s", i+1, err)
+		}
+	}
+}
+
+func TestMigrate_SQLite_IndexesEntities(t *testing.T) {
+	t.Parallel()
+	db := openTestDB(t)
+
+	err := Migrate(context.Background(), db, &Dialect{Name: "sqlite", Migrations: SQLite.Migrations[:1]})
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate: %s", err)
+	}
+	for _, key := range []string{"FooA", "FooB"} {
+		_, err = db.Exec(`INSERT INTO entities (namespace, kind, entity_key, properties, version) VALUES ($1, $2, $3, $4, $5)`,
+			"Qux", "Baz", key, `[{"Name":"Rank","Type":"int","Value":"7"},{"Name":"Note","Type":"string","Value":"x","NoIndex":true}]`, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = Migrate(context.Background(), db, SQLite)
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate: %s", err)
+	}
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM entity_properties WHERE namespace = $1 AND kind = $2 AND name = $3 AND value = $4`,
+		"Qux", "Baz", "Rank", indexValue(int64(7))).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("Expected %d existing entities indexed, got %d", 2, count)
+	}
+
+	err = db.QueryRow(`SELECT COUNT(*) FROM entity_properties WHERE name = $1`, "Note").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Expected unindexed property not to be indexed, got %d rows", count)
+	}
+}
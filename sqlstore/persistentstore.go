@@ -0,0 +1,920 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// PersistentStore stores entities in a SQL database, with the same semantics as aengine.PersistentStore.
+// Entities of every kind are held in a single table, created by Migrate, keyed by namespace, kind and key,
+// with their properties as JSON alongside their serialized content.
+//
+// Indexed property values are also held in an entity_properties table, which queries filter and order by.
+//
+// Transactions are serializable, and retried if they conflict with a concurrent one.
+type PersistentStore struct {
+	DB                *sql.DB
+	Dialect           *Dialect
+	Prefix            string
+	PermissionChecker PermissionChecker
+	Namespace         string
+
+	// Key used to sign query cursors handed out to clients.
+	// Queries requiring a cursor fail if unset.
+	CursorKey []byte
+
+	// Controls how content is serialized, and how content written under older schemas is migrated on read.
+	ContentFormat data.ContentFormat
+}
+
+// Maximum number of keys read or deleted by a single statement, keeping within databases' limits on parameters.
+const maxBatchKeys = 100
+
+type transactionKey struct{}
+
+type transaction struct {
+	DB *sql.DB
+	Tx *sql.Tx
+}
+
+// The methods common to *sql.DB and *sql.Tx, so statements can be run within a transaction or outside one.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// An entity as stored in its row.
+type entityRow struct {
+	Properties []data.Property
+	Content    data.EncodedContent
+	HasContent bool
+	Version    int64
+	Expiry     time.Time
+}
+
+func (ps *PersistentStore) Get(ctx context.Context, kind, key string, content interface{}) ([]data.Property, error) {
+	properties, _, err := ps.GetWithVersion(ctx, kind, key, content)
+	return properties, err
+}
+
+// Gets an entity along with its current version, for use with SetIfVersion.
+func (ps *PersistentStore) GetWithVersion(ctx context.Context, kind, key string, content interface{}) ([]data.Property, int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key}).Debug("sql get")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckRead(ctx, kind, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// If permission is denied we simulate the non-existence of the entity.
+		// This provides robustness against enumeration attacks by default.
+		if !ok {
+			return nil, 0, data.ErrNoSuchEntity
+		}
+	}
+
+	row, err := ps.getRow(ctx, kind, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entityFromRow(ps.ContentFormat, kind, key, row, content)
+}
+
+func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties []data.Property, content interface{}) error {
+	return ps.SetWithExpiry(ctx, kind, key, time.Time{}, properties, content)
+}
+
+// Sets an entity which is treated as not existing once expiry has passed, until it is removed by DeleteExpired.
+// A zero expiry never expires.
+func (ps *PersistentStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, content interface{}) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key, "expiry": expiry}).Debug("sql set")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	version, err := data.NewVersion()
+	if err != nil {
+		return err
+	}
+	row, err := entityToRow(ps.ContentFormat, kind, key, properties, content, version, expiry)
+	if err != nil {
+		return err
+	}
+
+	return ps.putRow(ctx, kind, key, row)
+}
+
+// Sets an entity only if its current version is the expected version, returning its new version.
+// An expected version of zero requires that the entity not exist.
+// If the version does not match, a *data.VersionConflictError is returned.
+func (ps *PersistentStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, content interface{}) (int64, error) {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key, "version": version}).Debug("sql set if version")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if !ok {
+			return 0, data.ErrWriteAccessDenied
+		}
+	}
+
+	newVersion, err := data.NewVersion()
+	if err != nil {
+		return 0, err
+	}
+	row, err := entityToRow(ps.ContentFormat, kind, key, properties, content, newVersion, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+
+	err = ps.runInTransaction(ctx, func(ctx context.Context) error {
+		actual := int64(0)
+		current, err := ps.getRow(ctx, kind, key)
+		if err != nil && err != data.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && !expired(current, time.Now()) {
+			actual = current.Version
+		}
+
+		if actual != version {
+			return &data.VersionConflictError{
+				Kind:     kind,
+				Key:      key,
+				Expected: version,
+				Actual:   actual,
+			}
+		}
+
+		return ps.putRow(ctx, kind, key, row)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+// Gets multiple entities in a single batch.
+// contents must be nil, or have one element per key, each being nil or a value to deserialize content into.
+// If any key fails, a data.MultiError is returned holding each key's error, alongside the results of those which succeeded.
+func (ps *PersistentStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	if contents != nil && len(contents) != len(keys) {
+		return nil, errors.New("contents param must be nil or the same length as keys")
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "count": len(keys)}).Debug("sql get multi")
+
+	results := make([][]data.Property, len(keys))
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	var readKeys []data.EntityKey
+	var indexes []int
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckRead(ctx, k.Kind, k.Key)
+			if err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+
+			// As in Get, denied entities appear not to exist.
+			if !ok {
+				errs[i] = data.ErrNoSuchEntity
+				failed = true
+				continue
+			}
+		}
+
+		readKeys = append(readKeys, k)
+		indexes = append(indexes, i)
+	}
+
+	rows, err := ps.getRows(ctx, readKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range indexes {
+		row, ok := rows[readKeys[j]]
+		if !ok {
+			errs[i] = data.ErrNoSuchEntity
+			failed = true
+			continue
+		}
+
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		results[i], _, errs[i] = entityFromRow(ps.ContentFormat, keys[i].Kind, keys[i].Key, row, content)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return results, errs
+	}
+	return results, nil
+}
+
+// Sets multiple entities in a single batch.
+// properties and contents must each be nil, or have one element per key.
+// If any key fails, a data.MultiError is returned holding each key's error; entities for other keys are still written,
+// unless within a transaction, where a failed write may abort the transaction.
+func (ps *PersistentStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, contents []interface{}) error {
+	if properties != nil && len(properties) != len(keys) {
+		return errors.New("properties param must be nil or the same length as keys")
+	}
+	if contents != nil && len(contents) != len(keys) {
+		return errors.New("contents param must be nil or the same length as keys")
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "count": len(keys)}).Debug("sql set multi")
+
+	errs := make(data.MultiError, len(keys))
+	failed := false
+
+	for i, k := range keys {
+		if ps.PermissionChecker != nil {
+			ok, err := ps.PermissionChecker.CheckWrite(ctx, k.Kind, k.Key)
+			if err != nil {
+				errs[i] = err
+				failed = true
+				continue
+			}
+
+			if !ok {
+				errs[i] = data.ErrWriteAccessDenied
+				failed = true
+				continue
+			}
+		}
+
+		var entityProperties []data.Property
+		if properties != nil {
+			entityProperties = properties[i]
+		}
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+		version, err := data.NewVersion()
+		if err != nil {
+			return err
+		}
+		row, err := entityToRow(ps.ContentFormat, k.Kind, k.Key, entityProperties, content, version, time.Time{})
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+
+		errs[i] = ps.putRow(ctx, k.Kind, k.Key, row)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func (ps *PersistentStore) Delete(ctx context.Context, kind, key string) error {
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind, "key": key}).Debug("sql delete")
+
+	if ps.PermissionChecker != nil {
+		ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, key)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			return data.ErrWriteAccessDenied
+		}
+	}
+
+	return ps.runInTransaction(ctx, func(ctx context.Context) error {
+		q := ps.querier(ctx)
+		_, err := q.ExecContext(ctx,
+			`DELETE FROM entities WHERE namespace = $1 AND kind = $2 AND entity_key = $3`,
+			ps.Namespace, kind, ps.Prefix+key)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		return ps.unindex(ctx, q, kind, []string{ps.Prefix + key})
+	})
+}
+
+// Deletes entities of a kind whose expiry has passed, returning how many were deleted.
+// Expired entities are found and deleted batchSize at a time, until none remain or the context is done.
+// Entities outside the store's prefix, or which the PermissionChecker denies writing, are left in place.
+// Entities rewritten with a later expiry after being found are not deleted.
+func (ps *PersistentStore) DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return 0, errors.Errorf("invalid batch size: %d", batchSize)
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": kind}).Debug("sql delete expired")
+
+	now := time.Now().UnixNano()
+	deleted := 0
+	after := ""
+	for {
+		// Entities we leave in place are skipped by continuing from the last key seen, rather than found again.
+		keys, err := ps.expiredKeys(ctx, kind, now, after, batchSize)
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+		after = keys[len(keys)-1]
+
+		var batch []string
+		for _, k := range keys {
+			if !strings.HasPrefix(k, ps.Prefix) {
+				continue
+			}
+			if ps.PermissionChecker != nil {
+				ok, err := ps.PermissionChecker.CheckWrite(ctx, kind, strings.TrimPrefix(k, ps.Prefix))
+				if err != nil {
+					return deleted, err
+				}
+				if !ok {
+					continue
+				}
+			}
+			batch = append(batch, k)
+		}
+
+		if len(batch) > 0 {
+			n, err := ps.deleteExpiredKeys(ctx, kind, now, batch)
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+			l.WithFields(logrus.Fields{"kind": kind, "count": n}).Debug("deleted expired batch")
+		}
+
+		if len(keys) < batchSize {
+			return deleted, nil
+		}
+		if ctx.Err() != nil {
+			return deleted, errors.Wrap(ctx.Err(), "")
+		}
+	}
+}
+
+// Runs a query against entities of a kind, returning matching entities without their content,
+// along with a cursor to continue from, or an empty cursor if there are no more results.
+// Entities outside the store's prefix, or which the PermissionChecker denies reading, are omitted.
+// Within a transaction, the query reads from the transaction's snapshot.
+func (ps *PersistentStore) Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, "", err
+	}
+
+	l := ctxlogrus.Get(ctx)
+	l.WithFields(logrus.Fields{"prefix": ps.Prefix, "namespace": ps.Namespace, "kind": q.Kind}).Debug("sql query")
+
+	var after *queryPosition
+	if q.Cursor != "" {
+		after, err = ps.decodeCursor(q.Kind, q.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(after.OrderValues) != len(q.Orders) {
+			return nil, "", data.ErrInvalidCursor
+		}
+	}
+
+	var results []data.QueryResult
+	for {
+		// Matches the PermissionChecker denies don't count towards the limit, so we may need several batches.
+		// Each reads one more match than needed, to tell whether there are more to continue from.
+		batchSize := 0
+		if q.Limit != 0 {
+			batchSize = q.Limit - len(results) + 1
+		}
+		matches, err := ps.queryMatches(ctx, q, after, batchSize)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for i := range matches {
+			if q.Limit != 0 && len(results) >= q.Limit {
+				cursor, err := ps.encodeCursor(q.Kind, after)
+				if err != nil {
+					return nil, "", err
+				}
+				return results, cursor, nil
+			}
+
+			m := &matches[i]
+			after = &m.Position
+			if ps.PermissionChecker != nil {
+				ok, err := ps.PermissionChecker.CheckRead(ctx, q.Kind, m.Key)
+				if err != nil {
+					return nil, "", err
+				}
+				if !ok {
+					continue
+				}
+			}
+			results = append(results, m.QueryResult)
+		}
+
+		if batchSize == 0 || len(matches) < batchSize {
+			return results, "", nil
+		}
+	}
+}
+
+func (ps *PersistentStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return ps.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+// Runs f in a serializable transaction with the given options, retrying it if it conflicts with a concurrent one.
+// If the transaction still conflicts after its attempts, data.ErrConcurrentTransaction is returned.
+// SingleGroup is ignored, as SQL transactions are not limited by entity group.
+func (ps *PersistentStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	if ps.transaction(ctx) != nil {
+		return errors.New("nested transactions are not supported")
+	}
+
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = 3
+	}
+
+	l := ctxlogrus.Get(ctx)
+	for i := 0; i < attempts; i++ {
+		l.Debug("sql transaction start")
+		err := ps.runTransaction(ctx, opts.ReadOnly, f)
+		l.Debug("sql transaction end")
+
+		if err == nil {
+			return nil
+		}
+		if !ps.Dialect.IsConflict(errors.Cause(err)) {
+			return errors.Wrap(err, "")
+		}
+	}
+	return data.ErrConcurrentTransaction
+}
+
+func (ps *PersistentStore) runTransaction(ctx context.Context, readOnly bool, f func(ctx context.Context) error) error {
+	tx, err := ps.DB.BeginTx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  readOnly,
+	})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	err = f(context.WithValue(ctx, transactionKey{}, &transaction{DB: ps.DB, Tx: tx}))
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "")
+}
+
+// Runs f in a transaction, or directly if the context is already within a transaction started by Transact.
+func (ps *PersistentStore) runInTransaction(ctx context.Context, f func(ctx context.Context) error) error {
+	if ps.transaction(ctx) != nil {
+		return f(ctx)
+	}
+
+	err := ps.Transact(ctx, f)
+	if cause := errors.Cause(err); cause != err {
+		if _, ok := cause.(*data.VersionConflictError); ok {
+			return cause
+		}
+	}
+	return err
+}
+
+// Returns the transaction the context is running in against this store's database, if any.
+func (ps *PersistentStore) transaction(ctx context.Context) *transaction {
+	tx, _ := ctx.Value(transactionKey{}).(*transaction)
+	if tx == nil || tx.DB != ps.DB {
+		return nil
+	}
+	return tx
+}
+
+// Returns the context's transaction to run statements in, or the database if it has none.
+func (ps *PersistentStore) querier(ctx context.Context) querier {
+	if tx := ps.transaction(ctx); tx != nil {
+		return tx.Tx
+	}
+	return ps.DB
+}
+
+const entityColumns = `properties, content, content_codec, content_version, version, expiry`
+
+func (ps *PersistentStore) getRow(ctx context.Context, kind, key string) (*entityRow, error) {
+	row := ps.querier(ctx).QueryRowContext(ctx,
+		`SELECT `+entityColumns+` FROM entities WHERE namespace = $1 AND kind = $2 AND entity_key = $3`,
+		ps.Namespace, kind, ps.Prefix+key)
+
+	r, err := scanRow(row)
+	if err == sql.ErrNoRows {
+		return nil, data.ErrNoSuchEntity
+	}
+	return r, err
+}
+
+// Reads the rows for several keys, returning those found by key.
+func (ps *PersistentStore) getRows(ctx context.Context, keys []data.EntityKey) (map[data.EntityKey]*entityRow, error) {
+	found := make(map[data.EntityKey]*entityRow)
+	for start := 0; start < len(keys); start += maxBatchKeys {
+		end := start + maxBatchKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		args := []interface{}{ps.Namespace}
+		var conditions []string
+		for _, k := range keys[start:end] {
+			conditions = append(conditions, "(kind = "+placeholder(len(args)+1)+" AND entity_key = "+placeholder(len(args)+2)+")")
+			args = append(args, k.Kind, ps.Prefix+k.Key)
+		}
+
+		rows, err := ps.querier(ctx).QueryContext(ctx,
+			`SELECT kind, entity_key, `+entityColumns+` FROM entities WHERE namespace = $1 AND (`+strings.Join(conditions, " OR ")+`)`,
+			args...)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+
+		for rows.Next() {
+			var kind, key string
+			r, err := scanRow(rows, &kind, &key)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			found[data.EntityKey{Kind: kind, Key: strings.TrimPrefix(key, ps.Prefix)}] = r
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	return found, nil
+}
+
+// Writes an entity's row and its index rows, in a transaction if the context is not already within one.
+func (ps *PersistentStore) putRow(ctx context.Context, kind, key string, row *entityRow) error {
+	properties, err := encodeProperties(row.Properties)
+	if err != nil {
+		return err
+	}
+
+	var content []byte
+	if row.HasContent {
+		// A nil slice would be stored as NULL, which means the entity has no content.
+		content = append([]byte{}, row.Content.Data...)
+	}
+	var expiry sql.NullInt64
+	if !row.Expiry.IsZero() {
+		expiry = sql.NullInt64{Int64: row.Expiry.UnixNano(), Valid: true}
+	}
+
+	return ps.runInTransaction(ctx, func(ctx context.Context) error {
+		q := ps.querier(ctx)
+		_, err := q.ExecContext(ctx,
+			`INSERT INTO entities (namespace, kind, entity_key, `+entityColumns+`)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (namespace, kind, entity_key) DO UPDATE SET
+				properties = excluded.properties,
+				content = excluded.content,
+				content_codec = excluded.content_codec,
+				content_version = excluded.content_version,
+				version = excluded.version,
+				expiry = excluded.expiry`,
+			ps.Namespace, kind, ps.Prefix+key, properties, content, row.Content.Codec, row.Content.Version, row.Version, expiry)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		return ps.indexProperties(ctx, q, kind, ps.Prefix+key, row.Properties)
+	})
+}
+
+// Returns up to limit keys of expired entities of a kind, in order, starting after the given key.
+func (ps *PersistentStore) expiredKeys(ctx context.Context, kind string, now int64, after string, limit int) ([]string, error) {
+	rows, err := ps.DB.QueryContext(ctx,
+		`SELECT entity_key FROM entities
+		WHERE namespace = $1 AND kind = $2 AND expiry <= $3 AND entity_key > $4
+		ORDER BY entity_key LIMIT $5`,
+		ps.Namespace, kind, now, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		err = rows.Scan(&k)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		keys = append(keys, k)
+	}
+	return keys, errors.Wrap(rows.Err(), "")
+}
+
+// Deletes entities by their full keys if they are still expired, returning how many were deleted.
+func (ps *PersistentStore) deleteExpiredKeys(ctx context.Context, kind string, now int64, keys []string) (int, error) {
+	args := []interface{}{ps.Namespace, kind, now}
+	placeholders := make([]string, len(keys))
+	for i, k := range keys {
+		placeholders[i] = placeholder(len(args) + 1)
+		args = append(args, k)
+	}
+
+	n := int64(0)
+	err := ps.runInTransaction(ctx, func(ctx context.Context) error {
+		q := ps.querier(ctx)
+		_, err := q.ExecContext(ctx,
+			`DELETE FROM entity_properties WHERE namespace = $1 AND kind = $2 AND entity_key IN (
+				SELECT entity_key FROM entities
+				WHERE namespace = $1 AND kind = $2 AND expiry <= $3 AND entity_key IN (`+strings.Join(placeholders, ", ")+`)
+			)`,
+			args...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+
+		result, err := q.ExecContext(ctx,
+			`DELETE FROM entities WHERE namespace = $1 AND kind = $2 AND expiry <= $3 AND entity_key IN (`+strings.Join(placeholders, ", ")+`)`,
+			args...)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+
+		n, err = result.RowsAffected()
+		return errors.Wrap(err, "")
+	})
+	return int(n), err
+}
+
+// A query result along with its position in the query's order, to continue the query from.
+type queryMatch struct {
+	data.QueryResult
+	Position queryPosition
+}
+
+// A position in a query's order; its values for each of the query's orders, encoded as in entity_properties,
+// followed by its full key.
+type queryPosition struct {
+	OrderValues [][]byte
+	Key         string
+}
+
+// Returns up to limit unexpired entities within the prefix matching the query's kind and filters, in the query's order,
+// starting after the given position if non-nil. If limit is zero, every match is returned.
+//
+// Each filter is an EXISTS condition on the entity's index rows; inequality filters on the same property share one,
+// so the same value must satisfy them all. Each order sorts by the lowest or highest of the entity's values.
+func (ps *PersistentStore) queryMatches(ctx context.Context, q data.Query, after *queryPosition, limit int) ([]queryMatch, error) {
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return placeholder(len(args))
+	}
+	indexRows := func(name string) string {
+		return `FROM entity_properties p WHERE p.namespace = e.namespace AND p.kind = e.kind AND p.entity_key = e.entity_key AND p.name = ` + arg(name)
+	}
+
+	columns := []string{"e.entity_key", "e.properties"}
+	var orderBy []string
+	for i, o := range q.Orders {
+		column := "order_" + strconv.Itoa(i)
+		if o.Descending {
+			columns = append(columns, `(SELECT MAX(p.value) `+indexRows(o.Property)+`) AS `+column)
+			orderBy = append(orderBy, column+" DESC")
+		} else {
+			columns = append(columns, `(SELECT MIN(p.value) `+indexRows(o.Property)+`) AS `+column)
+			orderBy = append(orderBy, column)
+		}
+	}
+	orderBy = append(orderBy, "entity_key")
+
+	conditions := []string{
+		"e.namespace = " + arg(ps.Namespace),
+		"e.kind = " + arg(q.Kind),
+		"(e.expiry IS NULL OR e.expiry > " + arg(time.Now().UnixNano()) + ")",
+	}
+	if ps.Prefix != "" {
+		conditions = append(conditions, "substr(e.entity_key, 1, "+arg(utf8.RuneCountInString(ps.Prefix))+") = "+arg(ps.Prefix))
+	}
+	var inequalities []string
+	inequalityFilters := make(map[string][]data.Filter)
+	for _, f := range q.Filters {
+		if f.Op != data.FilterEqual {
+			if _, ok := inequalityFilters[f.Property]; !ok {
+				inequalities = append(inequalities, f.Property)
+			}
+			inequalityFilters[f.Property] = append(inequalityFilters[f.Property], f)
+			continue
+		}
+		conditions = append(conditions, `EXISTS (SELECT 1 `+indexRows(f.Property)+` AND p.value = `+arg(indexValue(f.Value))+`)`)
+	}
+	for _, name := range inequalities {
+		condition := `EXISTS (SELECT 1 ` + indexRows(name)
+		for _, f := range inequalityFilters[name] {
+			condition += ` AND p.value ` + string(f.Op) + ` ` + arg(indexValue(f.Value))
+		}
+		conditions = append(conditions, condition+`)`)
+	}
+
+	// Entities without a value for an order are excluded, and those up to the position skipped.
+	var matchedConditions []string
+	for i := range q.Orders {
+		matchedConditions = append(matchedConditions, "order_"+strconv.Itoa(i)+" IS NOT NULL")
+	}
+	if after != nil {
+		matchedConditions = append(matchedConditions, afterCondition(q.Orders, after, arg))
+	}
+
+	statement := `SELECT * FROM (SELECT ` + strings.Join(columns, ", ") + ` FROM entities e WHERE ` + strings.Join(conditions, " AND ") + `) matched`
+	if len(matchedConditions) != 0 {
+		statement += ` WHERE ` + strings.Join(matchedConditions, " AND ")
+	}
+	statement += ` ORDER BY ` + strings.Join(orderBy, ", ")
+	if limit != 0 {
+		statement += ` LIMIT ` + arg(limit)
+	}
+
+	rows, err := ps.querier(ctx).QueryContext(ctx, statement, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	defer rows.Close()
+
+	var matches []queryMatch
+	for rows.Next() {
+		var encoded string
+		m := queryMatch{Position: queryPosition{OrderValues: make([][]byte, len(q.Orders))}}
+		dest := []interface{}{&m.Position.Key, &encoded}
+		for i := range m.Position.OrderValues {
+			dest = append(dest, &m.Position.OrderValues[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+
+		m.Key = strings.TrimPrefix(m.Position.Key, ps.Prefix)
+		m.Properties, err = decodeProperties(encoded)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, errors.Wrap(rows.Err(), "")
+}
+
+// Returns a condition matching entities after a position in the orders, then key, they are sorted by.
+func afterCondition(orders []data.Order, after *queryPosition, arg func(v interface{}) string) string {
+	var alternatives []string
+	var equal []string
+	for i, o := range orders {
+		column := "order_" + strconv.Itoa(i)
+		op := " > "
+		if o.Descending {
+			op = " < "
+		}
+		alternatives = append(alternatives, "("+strings.Join(append(equal, column+op+arg(after.OrderValues[i])), " AND ")+")")
+		equal = append(equal, column+" = "+arg(after.OrderValues[i]))
+	}
+	alternatives = append(alternatives, "("+strings.Join(append(equal, "entity_key > "+arg(after.Key)), " AND ")+")")
+	return "(" + strings.Join(alternatives, " OR ") + ")"
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scans an entity's columns, after any leading columns scanned into dest.
+func scanRow(s scanner, dest ...interface{}) (*entityRow, error) {
+	var properties string
+	var content []byte
+	var expiry sql.NullInt64
+	r := &entityRow{}
+	dest = append(dest, &properties, &content, &r.Content.Codec, &r.Content.Version, &r.Version, &expiry)
+
+	err := s.Scan(dest...)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	r.Properties, err = decodeProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		r.Content.Data = content
+		r.HasContent = true
+	}
+	if expiry.Valid {
+		r.Expiry = time.Unix(0, expiry.Int64)
+	}
+	return r, nil
+}
+
+// Deserializes an entity's content into content, returning its properties and version.
+// If the entity has expired, data.ErrNoSuchEntity is returned.
+func entityFromRow(format data.ContentFormat, kind, key string, row *entityRow, content interface{}) ([]data.Property, int64, error) {
+	if expired(row, time.Now()) {
+		return nil, 0, data.ErrNoSuchEntity
+	}
+
+	if row.HasContent {
+		if content == nil {
+			return nil, 0, errors.New("entity contained content to deserialize, but content param was not set")
+		}
+
+		err := format.Decode(kind, key, row.Content, content)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "unable to deserialize entity content")
+		}
+	} else if content != nil {
+		return nil, 0, errors.New("entity did not contain content to deserialize, but content param was set")
+	}
+
+	return row.Properties, row.Version, nil
+}
+
+// Builds an entity's row from properties and its version, serializing content if non-nil.
+func entityToRow(format data.ContentFormat, kind, key string, properties []data.Property, content interface{}, version int64, expiry time.Time) (*entityRow, error) {
+	err := data.ValidateProperties(properties)
+	if err != nil {
+		return nil, err
+	}
+
+	row := &entityRow{
+		Properties: properties,
+		Version:    version,
+		Expiry:     expiry,
+	}
+	if content != nil {
+		row.Content, err = format.Encode(kind, key, content)
+		if err != nil {
+			return nil, err
+		}
+		row.HasContent = true
+	}
+	return row, nil
+}
+
+// Returns whether the entity has an expiry which has passed as of now.
+func expired(row *entityRow, now time.Time) bool {
+	return !row.Expiry.IsZero() && !now.Before(row.Expiry)
+}
+
+func placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
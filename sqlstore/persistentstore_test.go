@@ -0,0 +1,259 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/storetest"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+// Opens a migrated SQLite database in a temporary directory, removed when the test ends.
+func newTestDB(t *testing.T) *sql.DB {
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	err = Migrate(context.Background(), db, SQLite)
+	if err != nil {
+		t.Fatalf("Unexpected error from Migrate: %s", err)
+	}
+	return db
+}
+
+func newTestStore(t *testing.T) (context.Context, *PersistentStore) {
+	return context.Background(), &PersistentStore{
+		DB:        newTestDB(t),
+		Dialect:   SQLite,
+		Prefix:    "Foo",
+		Namespace: "Qux",
+		CursorKey: []byte("bluh"),
+	}
+}
+
+func TestPersistentStore_Conformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) (context.Context, func(opts storetest.Options) storeutil.PersistentStore) {
+		db := newTestDB(t)
+		return context.Background(), func(opts storetest.Options) storeutil.PersistentStore {
+			return &PersistentStore{
+				DB:                db,
+				Dialect:           SQLite,
+				Prefix:            opts.Prefix,
+				Namespace:         opts.Namespace,
+				PermissionChecker: opts.PermissionChecker,
+				CursorKey:         []byte("bluh"),
+			}
+		}
+	})
+}
+
+func TestPersistentStore_GetMulti_Batches(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	keys := make([]data.EntityKey, maxBatchKeys*2+1)
+	properties := make([][]data.Property, len(keys))
+	for i := range keys {
+		keys[i] = data.EntityKey{Kind: "Baz", Key: strconv.Itoa(i)}
+		properties[i] = []data.Property{{Name: "Index", Value: int64(i)}}
+	}
+	err := ps.SetMulti(ctx, keys, properties, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	results, err := ps.GetMulti(ctx, keys, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetMulti: %s", err)
+	}
+	if !reflect.DeepEqual(results, properties) {
+		t.Errorf("Expected GetMulti results to match those set")
+	}
+}
+
+func TestPersistentStore_Transact_Conflict(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	conflict := &testConflictError{}
+	dialect := *SQLite
+	dialect.IsConflict = func(err error) bool {
+		return err == conflict
+	}
+	ps.Dialect = &dialect
+
+	callCount := 0
+	err := ps.TransactWithOptions(ctx, data.TransactionOptions{Attempts: 2}, func(ctx context.Context) error {
+		callCount++
+		return conflict
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected error '%s' from Transact, got '%v'", data.ErrConcurrentTransaction, err)
+	}
+	if callCount != 2 {
+		t.Errorf("Expected call count to be %d, was %d", 2, callCount)
+	}
+}
+
+func TestPersistentStore_Transact_Concurrent(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	const workers = 4
+	const increments = 5
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < increments; j++ {
+				err := ps.TransactWithOptions(ctx, data.TransactionOptions{Attempts: 100}, func(ctx context.Context) error {
+					properties, err := ps.Get(ctx, "Baz", "Counter", nil)
+					if err != nil && err != data.ErrNoSuchEntity {
+						return err
+					}
+					count := int64(0)
+					if len(properties) == 1 {
+						count = properties[0].Value.(int64)
+					}
+					return ps.Set(ctx, "Baz", "Counter", []data.Property{{Name: "Count", Value: count + 1}}, nil)
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		err := <-errs
+		if err != nil {
+			t.Fatalf("Unexpected error from concurrent Transact: %s", err)
+		}
+	}
+
+	properties, err := ps.Get(ctx, "Baz", "Counter", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if properties[0].Value != int64(workers*increments) {
+		t.Errorf("Expected count %d after concurrent increments, got %v", workers*increments, properties[0].Value)
+	}
+}
+
+type testConflictError struct{}
+
+func (e *testConflictError) Error() string {
+	return "conflict"
+}
+
+func TestPersistentStore_Query_CursorStable(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	for i, key := range []string{"A", "C", "E"} {
+		err := ps.Set(ctx, "Baz", key, []data.Property{{Name: "Rank", Value: int64(i * 2)}}, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+
+	q := data.Query{Kind: "Baz", Orders: []data.Order{{Property: "Rank"}}, Limit: 2}
+	results, cursor, err := ps.Query(ctx, q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+	if len(results) != 2 || cursor == "" {
+		t.Fatalf("Expected two results and a cursor from first page, got %v and '%s'", results, cursor)
+	}
+
+	// Entities added before the cursor's position don't shift the results after it.
+	err = ps.Set(ctx, "Baz", "B", []data.Property{{Name: "Rank", Value: int64(1)}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Delete(ctx, "Baz", "A")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+
+	q.Cursor = cursor
+	results, cursor, err = ps.Query(ctx, q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+
+	expectedResults := []data.QueryResult{
+		{Key: "E", Properties: []data.Property{{Name: "Rank", Value: int64(4)}}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("Expected second page results %v, got %v", expectedResults, results)
+	}
+	if cursor != "" {
+		t.Errorf("Expected empty cursor from last page, got '%s'", cursor)
+	}
+}
+
+func TestPersistentStore_Query_CursorOtherOrders(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	cursor, err := ps.encodeCursor("Baz", &queryPosition{Key: "FooBar"})
+	if err != nil {
+		t.Fatalf("Unexpected error encoding cursor: %s", err)
+	}
+
+	_, _, err = ps.Query(ctx, data.Query{Kind: "Baz", Orders: []data.Order{{Property: "Rank"}}, Cursor: cursor})
+	if err != data.ErrInvalidCursor {
+		t.Errorf("Expected error '%s' from Query, got '%v'", data.ErrInvalidCursor, err)
+	}
+}
+
+func TestPersistentStore_Set_Reindexes(t *testing.T) {
+	t.Parallel()
+	ctx, ps := newTestStore(t)
+
+	err := ps.Set(ctx, "Baz", "Bar", []data.Property{{Name: "Rank", Value: int64(1)}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Set(ctx, "Baz", "Bar", []data.Property{{Name: "Rank", Value: int64(2)}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	results, _, err := ps.Query(ctx, data.Query{
+		Kind:    "Baz",
+		Filters: []data.Filter{{Property: "Rank", Op: data.FilterEqual, Value: int64(1)}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Expected no results matching overwritten value, got %v", results)
+	}
+
+	err = ps.Delete(ctx, "Baz", "Bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+
+	var count int
+	err = ps.DB.QueryRow(`SELECT COUNT(*) FROM entity_properties`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no index rows after Delete, got %d", count)
+	}
+}
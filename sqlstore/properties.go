@@ -0,0 +1,105 @@
+package sqlstore
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// Properties are stored as a JSON list, each value held as a string alongside its type,
+// so values of every type round trip exactly, including integers too large for a JSON number
+// and floats JSON can't represent.
+type jsonProperty struct {
+	Name     string
+	Type     string
+	Value    string `json:",omitempty"`
+	NoIndex  bool   `json:",omitempty"`
+	Multiple bool   `json:",omitempty"`
+}
+
+func encodeProperties(properties []data.Property) (string, error) {
+	err := data.ValidateProperties(properties)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := make([]jsonProperty, len(properties))
+	for i, p := range properties {
+		encoded[i] = jsonProperty{
+			Name:     p.Name,
+			NoIndex:  !p.Indexed(),
+			Multiple: p.Multiple,
+		}
+
+		switch v := p.Value.(type) {
+		case int64:
+			encoded[i].Type = "int"
+			encoded[i].Value = strconv.FormatInt(v, 10)
+		case bool:
+			encoded[i].Type = "bool"
+			encoded[i].Value = strconv.FormatBool(v)
+		case string:
+			encoded[i].Type = "string"
+			encoded[i].Value = v
+		case float64:
+			encoded[i].Type = "float"
+			encoded[i].Value = strconv.FormatFloat(v, 'g', -1, 64)
+		case time.Time:
+			encoded[i].Type = "time"
+			encoded[i].Value = v.Format(time.RFC3339Nano)
+		case []byte:
+			encoded[i].Type = "bytes"
+			encoded[i].Value = base64.StdEncoding.EncodeToString(v)
+		}
+	}
+
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return string(b), nil
+}
+
+func decodeProperties(s string) ([]data.Property, error) {
+	var encoded []jsonProperty
+	err := json.Unmarshal([]byte(s), &encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode entity properties")
+	}
+
+	var properties []data.Property
+	for _, p := range encoded {
+		var value interface{}
+		var err error
+		switch p.Type {
+		case "int":
+			value, err = strconv.ParseInt(p.Value, 10, 64)
+		case "bool":
+			value, err = strconv.ParseBool(p.Value)
+		case "string":
+			value = p.Value
+		case "float":
+			value, err = strconv.ParseFloat(p.Value, 64)
+		case "time":
+			value, err = time.Parse(time.RFC3339Nano, p.Value)
+		case "bytes":
+			value, err = base64.StdEncoding.DecodeString(p.Value)
+		default:
+			return nil, errors.Errorf("property '%s' had unknown type: %s", p.Name, p.Type)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to decode property '%s'", p.Name)
+		}
+
+		properties = append(properties, data.Property{
+			Name:     p.Name,
+			Value:    value,
+			NoIndex:  p.NoIndex,
+			Multiple: p.Multiple,
+		})
+	}
+	return properties, nil
+}
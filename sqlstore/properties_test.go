@@ -0,0 +1,87 @@
+package sqlstore
+
+import (
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEncodeProperties(t *testing.T) {
+	t.Parallel()
+
+	properties := []data.Property{
+		{Name: "Int", Value: int64(math.MaxInt64)},
+		{Name: "Bool", Value: true},
+		{Name: "String", Value: "foo", NoIndex: true},
+		{Name: "Float", Value: math.Inf(-1)},
+		{Name: "Time", Value: time.Date(2019, 06, 11, 23, 45, 12, 5, time.UTC)},
+		{Name: "Bytes", Value: []byte{1, 2, 3}},
+		{Name: "Tag", Value: "foo", Multiple: true},
+		{Name: "Tag", Value: "bar", Multiple: true},
+	}
+
+	encoded, err := encodeProperties(properties)
+	if err != nil {
+		t.Fatalf("Unexpected error from encodeProperties: %s", err)
+	}
+	decoded, err := decodeProperties(encoded)
+	if err != nil {
+		t.Fatalf("Unexpected error from decodeProperties: %s", err)
+	}
+
+	// Byte slices are never indexed, so are decoded as unindexed.
+	properties[5].NoIndex = true
+	if !reflect.DeepEqual(decoded, properties) {
+		t.Errorf("Expected properties %v, got %v", properties, decoded)
+	}
+}
+
+func TestEncodeProperties_Invalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := encodeProperties([]data.Property{{Name: "Foo", Value: 7}})
+	if err == nil {
+		t.Error("Expected error encoding property with invalid value type, got nil")
+	}
+
+	_, err = encodeProperties([]data.Property{{Name: "Content", Value: "foo"}})
+	if err == nil {
+		t.Error("Expected error encoding property with reserved name, got nil")
+	}
+}
+
+func TestDecodeProperties_Invalid(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label   string
+		Encoded string
+	}{
+		{
+			Label:   "NotJSON",
+			Encoded: "bluh",
+		},
+		{
+			Label:   "UnknownType",
+			Encoded: `[{"Name":"Foo","Type":"complex","Value":"1"}]`,
+		},
+		{
+			Label:   "InvalidValue",
+			Encoded: `[{"Name":"Foo","Type":"int","Value":"bar"}]`,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := decodeProperties(testCase.Encoded)
+			if err == nil {
+				t.Error("Expected error decoding properties, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+package standalone
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"net/http"
+	"strings"
+)
+
+// AdminAuthenticator protects admin handlers in standalone mode, in place of app.yaml's "login: admin".
+// Requests must carry one of Tokens as a bearer token in their Authorization header;
+// others are rejected with 401 Unauthorized before reaching Wrapped.
+// If Tokens is empty, every request is rejected.
+type AdminAuthenticator struct {
+	Tokens  []string
+	Wrapped http.Handler
+}
+
+func (a *AdminAuthenticator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authenticate(r) {
+		ctxlogrus.Get(r.Context()).WithField("path", r.URL.Path).Warn("rejected unauthenticated admin request")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	a.Wrapped.ServeHTTP(w, r)
+}
+
+func (a *AdminAuthenticator) authenticate(r *http.Request) bool {
+	const scheme = "Bearer "
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) {
+		return false
+	}
+
+	// Tokens are compared by digest, so the comparison takes the same time whatever their lengths,
+	// and every token is compared, so timing doesn't reveal which came closest to matching.
+	given := sha256.Sum256([]byte(header[len(scheme):]))
+	ok := 0
+	for _, token := range a.Tokens {
+		if token == "" {
+			continue
+		}
+		expected := sha256.Sum256([]byte(token))
+		ok |= subtle.ConstantTimeCompare(given[:], expected[:])
+	}
+	return ok == 1
+}
@@ -0,0 +1,93 @@
+package standalone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminAuthenticator(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label         string
+		Tokens        []string
+		Authorization string
+		ExpectedCode  int
+	}{
+		{
+			Label:         "Valid",
+			Tokens:        []string{"foo", "bar"},
+			Authorization: "Bearer bar",
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			Label:         "SchemeCase",
+			Tokens:        []string{"foo"},
+			Authorization: "bearer foo",
+			ExpectedCode:  http.StatusOK,
+		},
+		{
+			Label:         "WrongToken",
+			Tokens:        []string{"foo"},
+			Authorization: "Bearer fo",
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+		{
+			Label:         "NoHeader",
+			Tokens:        []string{"foo"},
+			Authorization: "",
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+		{
+			Label:         "WrongScheme",
+			Tokens:        []string{"foo"},
+			Authorization: "Basic foo",
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+		{
+			Label:         "EmptyToken",
+			Tokens:        []string{""},
+			Authorization: "Bearer ",
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+		{
+			Label:         "NoTokens",
+			Tokens:        nil,
+			Authorization: "Bearer foo",
+			ExpectedCode:  http.StatusUnauthorized,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			called := false
+			a := &AdminAuthenticator{
+				Tokens: testCase.Tokens,
+				Wrapped: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					called = true
+				}),
+			}
+
+			r := httptest.NewRequest("GET", "/admin/api/get-limit", nil)
+			if testCase.Authorization != "" {
+				r.Header.Set("Authorization", testCase.Authorization)
+			}
+			w := httptest.NewRecorder()
+			a.ServeHTTP(w, r)
+
+			if w.Code != testCase.ExpectedCode {
+				t.Errorf("Expected status code %d, got %d", testCase.ExpectedCode, w.Code)
+			}
+			if called != (testCase.ExpectedCode == http.StatusOK) {
+				t.Errorf("Expected wrapped handler called to be %v, was %v", testCase.ExpectedCode == http.StatusOK, called)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected WWW-Authenticate header on rejected request")
+			}
+		})
+	}
+}
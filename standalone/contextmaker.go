@@ -0,0 +1,30 @@
+package standalone
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+// ContextMaker makes contexts for requests served outside App Engine, derived from the request's own context,
+// so they are cancelled if the client goes away or the server shuts down.
+// Unlike aengine.ContextMaker it does not set a namespace; stores are given their namespace directly.
+type ContextMaker struct {
+	// Logger request logs are written to. If nil, the logrus standard logger is used.
+	Logger *logrus.Logger
+}
+
+func (cm *ContextMaker) MakeContext(r *http.Request) (context.Context, error) {
+	logger := cm.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	ctx := ctxlogrus.WithLogger(r.Context(), logrus.NewEntry(logger))
+	ctx = ctxlogrus.WithFields(ctx, logrus.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	})
+	return ctx, nil
+}
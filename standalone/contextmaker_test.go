@@ -0,0 +1,43 @@
+package standalone
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContextMaker_MakeContext(t *testing.T) {
+	t.Parallel()
+
+	logger, hook := test.NewNullLogger()
+	cm := &ContextMaker{Logger: logger}
+
+	r := httptest.NewRequest("GET", "/admin/api/get-limit", nil)
+	reqCtx, cancel := context.WithCancel(r.Context())
+	r = r.WithContext(reqCtx)
+
+	ctx, err := cm.MakeContext(r)
+	if err != nil {
+		t.Fatalf("Unexpected error from MakeContext: %s", err)
+	}
+
+	ctxlogrus.Get(ctx).Info("bluh")
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("Expected log entry to be written to logger")
+	}
+	if entry.Data["path"] != "/admin/api/get-limit" {
+		t.Errorf("Expected log entry to have path field '%s', got '%v'", "/admin/api/get-limit", entry.Data["path"])
+	}
+	if entry.Level != logrus.InfoLevel {
+		t.Errorf("Expected log entry level %s, got %s", logrus.InfoLevel, entry.Level)
+	}
+
+	cancel()
+	if ctx.Err() == nil {
+		t.Error("Expected context to be cancelled with the request's context")
+	}
+}
@@ -0,0 +1,72 @@
+package standalone
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long Server waits for in-flight requests to complete when shutting down,
+// if ShutdownTimeout is unset.
+const DefaultShutdownTimeout = 10 * time.Second
+
+// Server serves HTTP until its context is done, then shuts down gracefully,
+// ceasing to accept connections and waiting for in-flight requests to complete.
+type Server struct {
+	Addr    string
+	Handler http.Handler
+
+	// How long to wait for in-flight requests when shutting down, before closing their connections.
+	// If zero, DefaultShutdownTimeout is used.
+	ShutdownTimeout time.Duration
+}
+
+// Listens on Addr and serves until ctx is done.
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serves on l until ctx is done, returning once shutdown has completed.
+// A nil error is returned if the server shut down because ctx was done, and every request completed in time.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{
+		Handler:           s.Handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-served:
+		return errors.Wrap(err, "")
+	case <-ctx.Done():
+	}
+
+	timeout := s.ShutdownTimeout
+	if timeout == 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		_ = srv.Close()
+		return errors.Wrap(err, "unable to shut down gracefully")
+	}
+
+	// Serve returns ErrServerClosed as soon as Shutdown begins.
+	if err := <-served; err != http.ErrServerClosed {
+		return errors.Wrap(err, "")
+	}
+	return nil
+}
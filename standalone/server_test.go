@@ -0,0 +1,116 @@
+package standalone
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServer_Serve(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			_, _ = w.Write([]byte("bluh"))
+		}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+
+	type response struct {
+		body string
+		err  error
+	}
+	responded := make(chan response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			responded <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responded <- response{body: string(body), err: err}
+	}()
+
+	// Shutting down while a request is in flight waits for it to complete.
+	<-started
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatalf("Expected Serve to wait for in-flight request, returned '%v'", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+
+	r := <-responded
+	if r.err != nil {
+		t.Fatalf("Unexpected error from in-flight request: %s", r.err)
+	}
+	if r.body != "bluh" {
+		t.Errorf("Expected body '%s', got '%s'", "bluh", r.body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected nil error from Serve after shutdown, got '%s'", err)
+	}
+
+	_, err = http.Get("http://" + l.Addr().String() + "/")
+	if err == nil {
+		t.Error("Expected request after shutdown to fail")
+	}
+}
+
+func TestServer_Serve_ShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	s := &Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}),
+		ShutdownTimeout: 10 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(ctx, l)
+	}()
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	cancel()
+	if err := <-served; err == nil {
+		t.Error("Expected error from Serve when in-flight requests outlast the shutdown timeout")
+	}
+}
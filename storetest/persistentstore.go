@@ -0,0 +1,517 @@
+package storetest
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testSetGet(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", RichProperties(), &map[string]interface{}{"Foo": "Bar"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var d map[string]interface{}
+	properties, err := ps.Get(ctx, "Baz", "Bar", &d)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+
+	expected := RichProperties()
+	expected[1].NoIndex = true
+	if !EqualProperties(expected, properties) {
+		t.Errorf("Expected properties %v, got %v", expected, properties)
+	}
+	if d["Foo"] != "Bar" {
+		t.Errorf("Expected content to round trip, got %v", d)
+	}
+}
+
+func testSetOverwrites(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", Properties(), &map[string]interface{}{"Foo": "Bar"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Set(ctx, "Baz", "Bar", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	properties, err := ps.Get(ctx, "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if len(properties) != 0 {
+		t.Errorf("Expected no properties after overwrite, got %v", properties)
+	}
+}
+
+func testSetInvalidProperty(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	testCases := []struct {
+		Label      string
+		Properties []data.Property
+	}{
+		{
+			Label:      "InvalidType",
+			Properties: []data.Property{{Name: "Foo", Value: 7}},
+		},
+		{
+			Label:      "ReservedName",
+			Properties: []data.Property{{Name: "Content", Value: "Bar"}},
+		},
+		{
+			Label:      "ReservedVersion",
+			Properties: []data.Property{{Name: "Version", Value: int64(1)}},
+		},
+		{
+			Label:      "MultipleNotSet",
+			Properties: []data.Property{{Name: "Foo", Value: "Bar"}, {Name: "Foo", Value: "Baz"}},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			err := ps.Set(ctx, "Baz", testCase.Label, testCase.Properties, nil)
+			if err == nil {
+				t.Error("Expected error from Set with invalid properties, got nil")
+			}
+
+			_, err = ps.Get(ctx, "Baz", testCase.Label, nil)
+			if err != data.ErrNoSuchEntity {
+				t.Errorf("Expected error '%s' reading entity with invalid properties, got '%v'", data.ErrNoSuchEntity, err)
+			}
+		})
+	}
+}
+
+func testGetNoEntity(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	_, err := ps.Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get, got '%v'", data.ErrNoSuchEntity, err)
+	}
+}
+
+func testGetContentMismatch(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "NoContent", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Set(ctx, "Baz", "Content", nil, &map[string]interface{}{"Foo": "Bar"})
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	var d map[string]interface{}
+	_, err = ps.Get(ctx, "Baz", "NoContent", &d)
+	if err == nil {
+		t.Error("Expected error from Get with content param for entity without content, got nil")
+	}
+	_, err = ps.Get(ctx, "Baz", "Content", nil)
+	if err == nil {
+		t.Error("Expected error from Get without content param for entity with content, got nil")
+	}
+}
+
+func testPrefixNamespace(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	_, err = store(Options{Prefix: "Foo", Namespace: "Other"}).Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get in other namespace, got '%v'", data.ErrNoSuchEntity, err)
+	}
+	_, err = store(Options{Prefix: "Other", Namespace: "Qux"}).Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get with other prefix, got '%v'", data.ErrNoSuchEntity, err)
+	}
+
+	// Prefixes are prepended to keys, so entities are readable under another prefix with the difference moved to their key.
+	properties, err := store(Options{Namespace: "Qux"}).Get(ctx, "Baz", "FooBar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get without prefix: %s", err)
+	}
+	if !reflect.DeepEqual(properties, Properties()) {
+		t.Errorf("Expected properties %v from Get without prefix, got %v", Properties(), properties)
+	}
+}
+
+func testPermission(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckReadFunc = func(ctx context.Context, kind, key string) (bool, error) {
+		return false, nil
+	}
+	pc.CheckWriteFunc = func(ctx context.Context, kind, key string) (bool, error) {
+		return false, nil
+	}
+	denied := store(Options{Prefix: "Foo", Namespace: "Qux", PermissionChecker: pc})
+
+	// Entities which can't be read appear not to exist, so they can't be enumerated.
+	_, err = denied.Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get without permission, got '%v'", data.ErrNoSuchEntity, err)
+	}
+	err = denied.Set(ctx, "Baz", "Bar", nil, nil)
+	if err != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' from Set without permission, got '%v'", data.ErrWriteAccessDenied, err)
+	}
+	_, err = denied.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+	if err != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' from SetIfVersion without permission, got '%v'", data.ErrWriteAccessDenied, err)
+	}
+	err = denied.Delete(ctx, "Baz", "Bar")
+	if err != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' from Delete without permission, got '%v'", data.ErrWriteAccessDenied, err)
+	}
+
+	properties, err := ps.Get(ctx, "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if !reflect.DeepEqual(properties, Properties()) {
+		t.Errorf("Expected properties %v unchanged by denied writes, got %v", Properties(), properties)
+	}
+}
+
+func testSetIfVersion(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	version, err := ps.SetIfVersion(ctx, "Baz", "Bar", 0, Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetIfVersion creating entity: %s", err)
+	}
+
+	properties, gotVersion, err := ps.GetWithVersion(ctx, "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if gotVersion != version {
+		t.Errorf("Expected version %d from GetWithVersion, got %d", version, gotVersion)
+	}
+	if !reflect.DeepEqual(properties, Properties()) {
+		t.Errorf("Expected properties %v from GetWithVersion, got %v", Properties(), properties)
+	}
+
+	_, err = ps.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+	expectedErr := &data.VersionConflictError{
+		Kind:     "Baz",
+		Key:      "Bar",
+		Expected: 0,
+		Actual:   version,
+	}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error '%s' from SetIfVersion creating existing entity, got '%v'", expectedErr, err)
+	}
+
+	newVersion, err := ps.SetIfVersion(ctx, "Baz", "Bar", version, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetIfVersion updating entity: %s", err)
+	}
+
+	_, err = ps.SetIfVersion(ctx, "Baz", "Bar", version, nil, nil)
+	expectedErr = &data.VersionConflictError{
+		Kind:     "Baz",
+		Key:      "Bar",
+		Expected: version,
+		Actual:   newVersion,
+	}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Expected error '%s' from stale SetIfVersion, got '%v'", expectedErr, err)
+	}
+
+	// Deleted entities don't exist, so may be created again.
+	err = ps.Delete(ctx, "Baz", "Bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+	_, err = ps.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+	if err != nil {
+		t.Errorf("Unexpected error from SetIfVersion creating deleted entity: %s", err)
+	}
+}
+
+func testSetIfVersionExpired(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.SetWithExpiry(ctx, "Baz", "Bar", time.Now().Add(-time.Hour), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+
+	// Expired entities don't exist, so may be created over.
+	_, err = ps.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+	if err != nil {
+		t.Errorf("Unexpected error from SetIfVersion over expired entity: %s", err)
+	}
+}
+
+func testSetIfVersionInTransaction(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	var version int64
+	err := ps.Transact(ctx, func(ctx context.Context) error {
+		var err error
+		version, err = ps.SetIfVersion(ctx, "Baz", "Bar", 0, nil, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Transact: %s", err)
+	}
+
+	_, gotVersion, err := ps.GetWithVersion(ctx, "Baz", "Bar", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if gotVersion != version {
+		t.Errorf("Expected version %d after transaction, got %d", version, gotVersion)
+	}
+}
+
+func testSetMultiGetMulti(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	keys := []data.EntityKey{
+		{Kind: "Baz", Key: "Bar"},
+		{Kind: "Quux", Key: "Bar"},
+	}
+	err := ps.SetMulti(ctx, keys, [][]data.Property{Properties(), nil}, []interface{}{nil, &map[string]interface{}{"Foo": "Bar"}})
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	keys = append(keys, data.EntityKey{Kind: "Baz", Key: "Missing"})
+	var d map[string]interface{}
+	results, err := ps.GetMulti(ctx, keys, []interface{}{nil, &d, nil})
+	errs, ok := err.(data.MultiError)
+	if !ok {
+		t.Fatalf("Expected multi error from GetMulti, got '%v'", err)
+	}
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("Expected nil errors for written keys, got '%v' and '%v'", errs[0], errs[1])
+	}
+	if errs[2] != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' for missing key, got '%v'", data.ErrNoSuchEntity, errs[2])
+	}
+	if !reflect.DeepEqual(results[0], Properties()) {
+		t.Errorf("Expected properties %v for first key, got %v", Properties(), results[0])
+	}
+	if d["Foo"] != "Bar" {
+		t.Errorf("Expected content for second key to round trip, got %v", d)
+	}
+
+	_, err = ps.GetMulti(ctx, keys, []interface{}{nil})
+	if err == nil {
+		t.Error("Expected error from GetMulti with contents of a different length to keys, got nil")
+	}
+}
+
+func testGetMultiNoPermission(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	keys := []data.EntityKey{
+		{Kind: "Baz", Key: "Denied"},
+		{Kind: "Baz", Key: "Bar"},
+	}
+	err := ps.SetMulti(ctx, keys, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetMulti: %s", err)
+	}
+
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckReadFunc = func(ctx context.Context, kind, key string) (bool, error) {
+		return key != "Denied", nil
+	}
+	denied := store(Options{Prefix: "Foo", Namespace: "Qux", PermissionChecker: pc})
+
+	_, err = denied.GetMulti(ctx, keys, nil)
+	errs, ok := err.(data.MultiError)
+	if !ok {
+		t.Fatalf("Expected multi error from GetMulti, got '%v'", err)
+	}
+	if errs[0] != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' for denied key, got '%v'", data.ErrNoSuchEntity, errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("Expected nil error for permitted key, got '%v'", errs[1])
+	}
+}
+
+func testSetMultiNoPermission(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckWriteFunc = func(ctx context.Context, kind, key string) (bool, error) {
+		return key != "Denied", nil
+	}
+	denied := store(Options{Prefix: "Foo", Namespace: "Qux", PermissionChecker: pc})
+
+	keys := []data.EntityKey{
+		{Kind: "Baz", Key: "Denied"},
+		{Kind: "Baz", Key: "Bar"},
+	}
+	err := denied.SetMulti(ctx, keys, nil, nil)
+	errs, ok := err.(data.MultiError)
+	if !ok {
+		t.Fatalf("Expected multi error from SetMulti, got '%v'", err)
+	}
+	if errs[0] != data.ErrWriteAccessDenied {
+		t.Errorf("Expected error '%s' for denied key, got '%v'", data.ErrWriteAccessDenied, errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("Expected nil error for permitted key, got '%v'", errs[1])
+	}
+
+	_, err = ps.Get(ctx, "Baz", "Denied", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' reading denied key, got '%v'", data.ErrNoSuchEntity, err)
+	}
+	_, err = ps.Get(ctx, "Baz", "Bar", nil)
+	if err != nil {
+		t.Errorf("Unexpected error reading permitted key: %s", err)
+	}
+}
+
+func testDelete(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.Delete(ctx, "Baz", "Bar")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+
+	_, err = ps.Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' from Get after Delete, got '%v'", data.ErrNoSuchEntity, err)
+	}
+
+	// Deleting an entity which doesn't exist succeeds, as in Datastore.
+	err = ps.Delete(ctx, "Baz", "Bar")
+	if err != nil {
+		t.Errorf("Unexpected error from Delete of missing entity: %s", err)
+	}
+}
+
+func testSetWithExpiry(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.SetWithExpiry(ctx, "Baz", "Future", time.Now().Add(time.Hour), Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+	err = ps.SetWithExpiry(ctx, "Baz", "Past", time.Now().Add(-time.Hour), Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+
+	properties, err := ps.Get(ctx, "Baz", "Future", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error reading unexpired entity: %s", err)
+	}
+	if !reflect.DeepEqual(properties, Properties()) {
+		t.Errorf("Expected properties %v without expiry, got %v", Properties(), properties)
+	}
+
+	_, err = ps.Get(ctx, "Baz", "Past", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' reading expired entity, got '%v'", data.ErrNoSuchEntity, err)
+	}
+	results, err := ps.GetMulti(ctx, []data.EntityKey{{Kind: "Baz", Key: "Past"}}, nil)
+	if errs, ok := err.(data.MultiError); !ok || errs[0] != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' reading expired entity with GetMulti, got '%v' and %v", data.ErrNoSuchEntity, err, results)
+	}
+}
+
+func testDeleteExpired(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	past := time.Now().Add(-time.Hour)
+	for _, key := range []string{"a", "b", "c", "denied"} {
+		err := ps.SetWithExpiry(ctx, "Baz", key, past, nil, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+		}
+	}
+	err := ps.SetWithExpiry(ctx, "Baz", "d", time.Now().Add(time.Hour), nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+	err = store(Options{Prefix: "Other", Namespace: "Qux"}).SetWithExpiry(ctx, "Baz", "e", past, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+	err = ps.SetWithExpiry(ctx, "Quux", "f", past, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckWriteFunc = func(ctx context.Context, kind, key string) (bool, error) {
+		return key != "denied", nil
+	}
+	checked := store(Options{Prefix: "Foo", Namespace: "Qux", PermissionChecker: pc})
+
+	deleted, err := checked.DeleteExpired(ctx, "Baz", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error from DeleteExpired: %s", err)
+	}
+	if deleted != 3 {
+		t.Errorf("Expected %d entities deleted, got %d", 3, deleted)
+	}
+
+	// Expired entities outside the prefix, or which can't be written, are left in place.
+	deleted, err = store(Options{Namespace: "Qux"}).DeleteExpired(ctx, "Baz", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error from DeleteExpired: %s", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected %d entities left to delete, got %d", 2, deleted)
+	}
+
+	_, err = ps.Get(ctx, "Baz", "d", nil)
+	if err != nil {
+		t.Errorf("Unexpected error reading unexpired entity: %s", err)
+	}
+
+	// Entities of other kinds are left in place too.
+	deleted, err = ps.DeleteExpired(ctx, "Quux", 2)
+	if err != nil {
+		t.Fatalf("Unexpected error from DeleteExpired: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("Expected %d entity of other kind left to delete, got %d", 1, deleted)
+	}
+
+	_, err = ps.DeleteExpired(ctx, "Baz", 0)
+	if err == nil {
+		t.Error("Expected error from DeleteExpired with zero batch size, got nil")
+	}
+}
@@ -0,0 +1,210 @@
+package storetest
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testQuery(t *testing.T, factory Factory) {
+	ctx, store, ps := newStore(t, factory)
+
+	for i, key := range []string{"A", "B", "C", "D"} {
+		properties := []data.Property{{Name: "Limit", Value: int64(i)}}
+		err := ps.Set(ctx, "Baz", key, properties, &map[string]interface{}{"Foo": "Bar"})
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+	err := store(Options{Prefix: "Bar", Namespace: "Qux"}).Set(ctx, "Baz", "E", []data.Property{{Name: "Limit", Value: int64(5)}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	err = ps.SetWithExpiry(ctx, "Baz", "F", time.Now().Add(-time.Hour), []data.Property{{Name: "Limit", Value: int64(6)}}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+
+	pc := testhelpers.NewPermissionChecker(t)
+	pc.CheckReadFunc = func(ctx context.Context, kind, key string) (b bool, e error) {
+		return key != "B", nil
+	}
+	checked := store(Options{Prefix: "Foo", Namespace: "Qux", PermissionChecker: pc})
+
+	q := data.Query{
+		Kind:    "Baz",
+		Filters: []data.Filter{{Property: "Limit", Op: data.FilterGreaterOrEqual, Value: int64(0)}},
+		Orders:  []data.Order{{Property: "Limit", Descending: true}},
+		Limit:   2,
+	}
+	results, cursor, err := checked.Query(ctx, q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+
+	expectedResults := []data.QueryResult{
+		{Key: "D", Properties: []data.Property{{Name: "Limit", Value: int64(3)}}},
+		{Key: "C", Properties: []data.Property{{Name: "Limit", Value: int64(2)}}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("Expected first page results %v, got %v", expectedResults, results)
+	}
+	if cursor == "" {
+		t.Fatal("Expected non-empty cursor from first page")
+	}
+
+	// Entities the PermissionChecker denies are omitted without counting towards the limit.
+	q.Cursor = cursor
+	results, cursor, err = checked.Query(ctx, q)
+	if err != nil {
+		t.Fatalf("Unexpected error from Query: %s", err)
+	}
+
+	expectedResults = []data.QueryResult{
+		{Key: "A", Properties: []data.Property{{Name: "Limit", Value: int64(0)}}},
+	}
+	if !reflect.DeepEqual(results, expectedResults) {
+		t.Errorf("Expected second page results %v, got %v", expectedResults, results)
+	}
+	if cursor != "" {
+		t.Errorf("Expected empty cursor from last page, got '%s'", cursor)
+	}
+}
+
+func testQueryFilters(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	entities := map[string][]data.Property{
+		"A": {
+			{Name: "Score", Value: int64(1), Multiple: true},
+			{Name: "Score", Value: int64(9), Multiple: true},
+			{Name: "Name", Value: "alpha"},
+		},
+		"B": {
+			{Name: "Score", Value: int64(5)},
+			{Name: "Name", Value: "beta"},
+		},
+		"C": {
+			{Name: "Score", Value: "five"},
+			{Name: "Name", Value: "gamma", NoIndex: true},
+		},
+		"D": {
+			{Name: "Score", Value: float64(-2.5)},
+		},
+		"E": {
+			{Name: "Name", Value: "epsilon"},
+		},
+	}
+	for key, properties := range entities {
+		err := ps.Set(ctx, "Baz", key, properties, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Set: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		Label        string
+		Filters      []data.Filter
+		Orders       []data.Order
+		ExpectedKeys []string
+	}{
+		{
+			Label:        "NoFilters",
+			ExpectedKeys: []string{"A", "B", "C", "D", "E"},
+		},
+		{
+			Label:        "EqualAnyValue",
+			Filters:      []data.Filter{{Property: "Score", Op: data.FilterEqual, Value: int64(9)}},
+			ExpectedKeys: []string{"A"},
+		},
+		{
+			Label: "InequalitiesSameValue",
+			Filters: []data.Filter{
+				{Property: "Score", Op: data.FilterGreaterThan, Value: int64(2)},
+				{Property: "Score", Op: data.FilterLessThan, Value: int64(8)},
+			},
+			ExpectedKeys: []string{"B"},
+		},
+		{
+			Label:        "InequalityOrdersTypes",
+			Filters:      []data.Filter{{Property: "Score", Op: data.FilterGreaterThan, Value: "a"}},
+			ExpectedKeys: []string{"C", "D"},
+		},
+		{
+			Label:        "UnindexedExcluded",
+			Filters:      []data.Filter{{Property: "Name", Op: data.FilterEqual, Value: "gamma"}},
+			ExpectedKeys: nil,
+		},
+		{
+			Label:        "OrderAscendingByLowest",
+			Orders:       []data.Order{{Property: "Score"}},
+			ExpectedKeys: []string{"A", "B", "C", "D"},
+		},
+		{
+			Label:        "OrderDescendingByHighest",
+			Orders:       []data.Order{{Property: "Score", Descending: true}},
+			ExpectedKeys: []string{"D", "C", "A", "B"},
+		},
+		{
+			Label:        "OrderExcludesMissing",
+			Orders:       []data.Order{{Property: "Name", Descending: true}},
+			ExpectedKeys: []string{"E", "B", "A"},
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			q := data.Query{Kind: "Baz", Filters: testCase.Filters, Orders: testCase.Orders}
+			results, _, err := ps.Query(ctx, q)
+			if err != nil {
+				t.Fatalf("Unexpected error from Query: %s", err)
+			}
+
+			var keys []string
+			for _, r := range results {
+				keys = append(keys, r.Key)
+
+				// Results are those the query matches, ordered as it compares them.
+				if !q.Matches(r.Properties) {
+					t.Errorf("Expected result %s to match query", r.Key)
+				}
+			}
+			if !reflect.DeepEqual(keys, testCase.ExpectedKeys) {
+				t.Errorf("Expected result keys %v, got %v", testCase.ExpectedKeys, keys)
+			}
+		})
+	}
+}
+
+func testQueryInvalidCursor(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	_, _, err := ps.Query(ctx, data.Query{Kind: "Baz", Cursor: "bluh"})
+	if err != data.ErrInvalidCursor {
+		t.Errorf("Expected error '%s' from Query, got '%v'", data.ErrInvalidCursor, err)
+	}
+}
+
+func testQueryReservedOrder(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.SetWithExpiry(ctx, "Baz", "Bar", time.Now().Add(time.Hour), Properties(), &map[string]interface{}{"Foo": "Bar"})
+	if err != nil {
+		t.Fatalf("Unexpected error from SetWithExpiry: %s", err)
+	}
+
+	// Orders on the properties stores keep their own metadata in are rejected, as backends store them differently.
+	for _, name := range []string{"Content", "ContentCodec", "ContentVersion", "Version", "Expiry"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			_, _, err := ps.Query(ctx, data.Query{Kind: "Baz", Orders: []data.Order{{Property: name}}})
+			if err == nil {
+				t.Error("Expected error from Query ordered on reserved property, got nil")
+			}
+		})
+	}
+}
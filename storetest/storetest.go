@@ -0,0 +1,142 @@
+// Package storetest is a conformance suite for storeutil.PersistentStore implementations,
+// checking that each backend has the same semantics as aengine.PersistentStore.
+// Each backend's tests run it with a Factory making stores over fresh storage.
+package storetest
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/storeutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Options are the settings every backend's stores have, which tests vary.
+type Options struct {
+	Prefix            string
+	Namespace         string
+	PermissionChecker PermissionChecker
+}
+
+// Factory makes fresh storage for a test, returning the context to use it with,
+// and a function making stores over that storage with the given options.
+// Stores should sign cursors with a key, if they sign them. Factories skip the test if their backend is unavailable.
+type Factory func(t *testing.T) (context.Context, func(opts Options) storeutil.PersistentStore)
+
+// Runs the conformance suite against stores made by factory, each test as a parallel subtest.
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		Name string
+		Test func(t *testing.T, factory Factory)
+	}{
+		{"SetGet", testSetGet},
+		{"Set_Overwrites", testSetOverwrites},
+		{"Set_InvalidProperty", testSetInvalidProperty},
+		{"Get_NoEntity", testGetNoEntity},
+		{"Get_ContentMismatch", testGetContentMismatch},
+		{"PrefixNamespace", testPrefixNamespace},
+		{"Permission", testPermission},
+		{"SetIfVersion", testSetIfVersion},
+		{"SetIfVersion_Expired", testSetIfVersionExpired},
+		{"SetIfVersion_InTransaction", testSetIfVersionInTransaction},
+		{"SetMultiGetMulti", testSetMultiGetMulti},
+		{"GetMulti_NoPermission", testGetMultiNoPermission},
+		{"SetMulti_NoPermission", testSetMultiNoPermission},
+		{"Delete", testDelete},
+		{"SetWithExpiry", testSetWithExpiry},
+		{"DeleteExpired", testDeleteExpired},
+		{"Query", testQuery},
+		{"Query_Filters", testQueryFilters},
+		{"Query_InvalidCursor", testQueryInvalidCursor},
+		{"Query_ReservedOrder", testQueryReservedOrder},
+		{"Transact", testTransact},
+		{"Transact_WithError", testTransactWithError},
+		{"Transact_Nested", testTransactNested},
+		{"TransactWithOptions_ReadOnly", testTransactWithOptionsReadOnly},
+	}
+
+	for i := range tests {
+		test := tests[i]
+		t.Run(test.Name, func(t *testing.T) {
+			t.Parallel()
+			test.Test(t, factory)
+		})
+	}
+}
+
+// Returns a property of each basic type.
+func Properties() []data.Property {
+	return []data.Property{
+		{
+			Name:  "Foo1",
+			Value: "Bar",
+		},
+		{
+			Name:  "Foo2",
+			Value: int64(7),
+		},
+		{
+			Name:  "Foo3",
+			Value: true,
+		},
+		{
+			Name:  "Foo4",
+			Value: float64(0.3),
+		},
+	}
+}
+
+// Returns properties exercising times, []byte values, unindexed properties, and multi-valued properties.
+// The []byte value is read back as unindexed, as such values never are.
+func RichProperties() []data.Property {
+	return []data.Property{
+		{
+			Name:  "Created",
+			Value: time.Date(2019, 06, 11, 23, 45, 12, 0, time.UTC),
+		},
+		{
+			Name:  "Blob",
+			Value: []byte{1, 2, 3},
+		},
+		{
+			Name:    "Note",
+			Value:   "unindexed",
+			NoIndex: true,
+		},
+		{
+			Name:     "Tag",
+			Value:    "foo",
+			Multiple: true,
+		},
+		{
+			Name:     "Tag",
+			Value:    "bar",
+			Multiple: true,
+		},
+	}
+}
+
+// Returns whether properties read back from a store equal those expected.
+// Some backends read times back in the local time zone, so times are compared as instants.
+func EqualProperties(expected, got []data.Property) bool {
+	if len(expected) != len(got) {
+		return false
+	}
+
+	normalized := make([]data.Property, len(got))
+	copy(normalized, got)
+	for i := range normalized {
+		if expectedTime, ok := expected[i].Value.(time.Time); ok {
+			if gotTime, ok := normalized[i].Value.(time.Time); ok && gotTime.Equal(expectedTime) {
+				normalized[i].Value = expectedTime
+			}
+		}
+	}
+	return reflect.DeepEqual(expected, normalized)
+}
+
+func newStore(t *testing.T, factory Factory) (context.Context, func(opts Options) storeutil.PersistentStore, storeutil.PersistentStore) {
+	ctx, store := factory(t)
+	return ctx, store, store(Options{Prefix: "Foo", Namespace: "Qux"})
+}
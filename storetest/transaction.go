@@ -0,0 +1,101 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"testing"
+)
+
+func testTransact(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	callCount := 0
+	err := ps.Transact(ctx, func(txCtx context.Context) error {
+		callCount++
+
+		err := ps.Set(txCtx, "Baz", "Bar", nil, nil)
+		if err != nil {
+			return err
+		}
+		return ps.Set(txCtx, "Baz", "Bar2", nil, nil)
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from Transact, got %s", err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected call count to be %d, was %d", 1, callCount)
+	}
+
+	for _, key := range []string{"Bar", "Bar2"} {
+		_, err = ps.Get(ctx, "Baz", key, nil)
+		if err != nil {
+			t.Errorf("Unexpected error reading '%s' after transaction: %s", key, err)
+		}
+	}
+}
+
+func testTransactWithError(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	expectedErr := errors.New("bluh")
+	err := ps.Transact(ctx, func(ctx context.Context) error {
+		err := ps.Set(ctx, "Baz", "Bar", nil, nil)
+		if err != nil {
+			return err
+		}
+		return expectedErr
+	})
+	if err == nil {
+		t.Errorf("Expected non-nil error from Transact, got nil error")
+	}
+
+	_, err = ps.Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' reading entity written in failed transaction, got '%v'", data.ErrNoSuchEntity, err)
+	}
+}
+
+func testTransactNested(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Transact(ctx, func(ctx context.Context) error {
+		called := false
+		err := ps.Transact(ctx, func(ctx context.Context) error {
+			called = true
+			return ps.Set(ctx, "Baz", "Bar", nil, nil)
+		})
+		if err == nil {
+			t.Error("Expected error from nested Transact, got nil")
+		}
+		if called {
+			t.Error("Expected nested transaction not to be run")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Unexpected error from Transact: %s", err)
+	}
+
+	_, err = ps.Get(ctx, "Baz", "Bar", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' reading entity written in nested transaction, got '%v'", data.ErrNoSuchEntity, err)
+	}
+}
+
+func testTransactWithOptionsReadOnly(t *testing.T, factory Factory) {
+	ctx, _, ps := newStore(t, factory)
+
+	err := ps.Set(ctx, "Baz", "Bar", Properties(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+
+	err = ps.TransactWithOptions(ctx, data.TransactionOptions{ReadOnly: true}, func(ctx context.Context) error {
+		_, err := ps.Get(ctx, "Baz", "Bar", nil)
+		return err
+	})
+	if err != nil {
+		t.Errorf("Unexpected error from read-only Transact: %s", err)
+	}
+}
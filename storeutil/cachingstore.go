@@ -0,0 +1,343 @@
+package storeutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"sync"
+	"time"
+)
+
+func init() {
+	// Property values are held in interfaces, so types not built into gob must be registered to be cached.
+	gob.Register(time.Time{})
+}
+
+// CachingStore wraps a PersistentStore, caching entities read with Get, GetWithVersion and GetMulti in a CacheStore.
+// Entities which don't exist are cached too, so repeated lookups of absent entities are also fast.
+// Cached entities are invalidated when written or deleted through this store; writes made any other way,
+// including by DeleteExpired or expiry, are not seen until the cached entity's TTL passes, so kinds which are
+// written elsewhere or expire should not be cached.
+//
+// Entities are cached with Add, so a read racing a write cannot replace the write's invalidation with a
+// newer entry; it can at worst restore the entry the write invalidated, and the TTL bounds how long that lasts.
+//
+// Within a transaction, reads bypass the cache, and invalidation is deferred until the transaction completes.
+// Content is cached serialized with ContentFormat, which should match the wrapped store's,
+// so content encrypted in the wrapped store is encrypted in the cache too.
+//
+// Cached reads bypass any PermissionChecker the wrapped store applies, so it must not have one.
+type CachingStore struct {
+	PersistentStore
+	Cache CacheStore
+
+	// Kinds to cache; if empty, all kinds are cached.
+	Kinds []string
+
+	// How long entities are cached for; if zero, a minute is used.
+	// A read racing a write can restore the entry the write invalidated for this long, so it should be short.
+	TTL time.Duration
+
+	// Format cached content is serialized with.
+	ContentFormat data.ContentFormat
+}
+
+type cacheEntry struct {
+	Exists     bool
+	Properties []data.Property
+	Version    int64
+	Content    *data.EncodedContent
+}
+
+type cachingTransactionKey struct{}
+
+// Keys to invalidate once a transaction completes.
+type pendingInvalidations struct {
+	lock sync.Mutex
+	keys []data.EntityKey
+}
+
+func (cs *CachingStore) Get(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error) {
+	properties, _, err := cs.GetWithVersion(ctx, kind, key, v)
+	return properties, err
+}
+
+func (cs *CachingStore) GetWithVersion(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+	if !cs.cached(ctx, kind) {
+		return cs.PersistentStore.GetWithVersion(ctx, kind, key, v)
+	}
+
+	entry, ok := cs.getCached(ctx, kind, key)
+	if ok && (!entry.Exists || entry.Version >= 0) {
+		return cs.unpack(kind, key, entry, v)
+	}
+
+	properties, version, err := cs.PersistentStore.GetWithVersion(ctx, kind, key, v)
+	if err != nil && err != data.ErrNoSuchEntity {
+		return nil, 0, err
+	}
+
+	cs.setCached(ctx, kind, key, err == nil, properties, version, v)
+	return properties, version, err
+}
+
+// Gets entities from the cache where possible, fetching the rest from the wrapped store in a single batch.
+func (cs *CachingStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	if contents != nil && len(contents) != len(keys) {
+		return nil, errors.New("contents param must be nil or the same length as keys")
+	}
+
+	results := make([][]data.Property, len(keys))
+	errs := make(data.MultiError, len(keys))
+	var missKeys []data.EntityKey
+	var missContents []interface{}
+	var missIndexes []int
+	for i, k := range keys {
+		var content interface{}
+		if contents != nil {
+			content = contents[i]
+		}
+
+		if cs.cached(ctx, k.Kind) {
+			entry, ok := cs.getCached(ctx, k.Kind, k.Key)
+			if ok {
+				results[i], _, errs[i] = cs.unpack(k.Kind, k.Key, entry, content)
+				continue
+			}
+		}
+
+		missKeys = append(missKeys, k)
+		missContents = append(missContents, content)
+		missIndexes = append(missIndexes, i)
+	}
+
+	if len(missKeys) > 0 {
+		if contents == nil {
+			missContents = nil
+		}
+
+		missResults, err := cs.PersistentStore.GetMulti(ctx, missKeys, missContents)
+		missErrs, isMulti := err.(data.MultiError)
+		if err != nil && !isMulti {
+			return nil, err
+		}
+
+		for j, i := range missIndexes {
+			results[i] = missResults[j]
+			if missErrs != nil {
+				errs[i] = missErrs[j]
+			}
+			if errs[i] != nil && errs[i] != data.ErrNoSuchEntity {
+				continue
+			}
+
+			if cs.cached(ctx, keys[i].Kind) {
+				var content interface{}
+				if contents != nil {
+					content = contents[i]
+				}
+
+				// Versions aren't returned by GetMulti, so the entity must be read again to learn it.
+				cs.setCached(ctx, keys[i].Kind, keys[i].Key, errs[i] == nil, results[i], -1, content)
+			}
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return results, errs
+		}
+	}
+	return results, nil
+}
+
+func (cs *CachingStore) Set(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+	err := cs.PersistentStore.Set(ctx, kind, key, properties, v)
+	return cs.invalidate(ctx, err, data.EntityKey{Kind: kind, Key: key})
+}
+
+func (cs *CachingStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error {
+	err := cs.PersistentStore.SetWithExpiry(ctx, kind, key, expiry, properties, v)
+	return cs.invalidate(ctx, err, data.EntityKey{Kind: kind, Key: key})
+}
+
+func (cs *CachingStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error) {
+	newVersion, err := cs.PersistentStore.SetIfVersion(ctx, kind, key, version, properties, v)
+	return newVersion, cs.invalidate(ctx, err, data.EntityKey{Kind: kind, Key: key})
+}
+
+func (cs *CachingStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error {
+	err := cs.PersistentStore.SetMulti(ctx, keys, properties, v)
+	return cs.invalidate(ctx, err, keys...)
+}
+
+func (cs *CachingStore) Delete(ctx context.Context, kind, key string) error {
+	err := cs.PersistentStore.Delete(ctx, kind, key)
+	return cs.invalidate(ctx, err, data.EntityKey{Kind: kind, Key: key})
+}
+
+func (cs *CachingStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return cs.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+// Runs f in a transaction, invalidating entities it wrote once the transaction completes.
+// Entities are invalidated even if the transaction fails, as it may have committed regardless.
+func (cs *CachingStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	pending := &pendingInvalidations{}
+	err := cs.PersistentStore.TransactWithOptions(ctx, opts, func(ctx context.Context) error {
+		return f(context.WithValue(ctx, cachingTransactionKey{}, pending))
+	})
+
+	pending.lock.Lock()
+	keys := pending.keys
+	pending.lock.Unlock()
+
+	invalidateErr := cs.invalidate(ctx, nil, keys...)
+	if err != nil {
+		return err
+	}
+	return invalidateErr
+}
+
+// Invalidates cached entities after a write, returning the write's error if any.
+// The entities are invalidated even if the write failed, as it may have been applied regardless.
+// Within a transaction, invalidation is deferred until the transaction completes.
+func (cs *CachingStore) invalidate(ctx context.Context, writeErr error, keys ...data.EntityKey) error {
+	if pending, ok := ctx.Value(cachingTransactionKey{}).(*pendingInvalidations); ok {
+		pending.lock.Lock()
+		pending.keys = append(pending.keys, keys...)
+		pending.lock.Unlock()
+		return writeErr
+	}
+
+	var invalidateErr error
+	for _, k := range keys {
+		if !cs.isCachedKind(k.Kind) {
+			continue
+		}
+
+		// Entities not cached need no invalidation.
+		err := cs.Cache.Delete(ctx, cacheKey(k.Kind, k.Key))
+		if errors.Cause(err) == data.ErrCacheMiss {
+			continue
+		}
+		if err != nil && invalidateErr == nil {
+			invalidateErr = errors.Wrapf(err, "unable to invalidate cached %s '%s'", k.Kind, k.Key)
+		}
+	}
+
+	if writeErr != nil {
+		return writeErr
+	}
+	return invalidateErr
+}
+
+// Returns whether reads of a kind should use the cache; they never do within a transaction.
+func (cs *CachingStore) cached(ctx context.Context, kind string) bool {
+	if ctx.Value(cachingTransactionKey{}) != nil {
+		return false
+	}
+	return cs.isCachedKind(kind)
+}
+
+func (cs *CachingStore) isCachedKind(kind string) bool {
+	if len(cs.Kinds) == 0 {
+		return true
+	}
+	for _, k := range cs.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Gets an entity from the cache. Cache failures are logged and treated as misses, falling back to the wrapped store.
+func (cs *CachingStore) getCached(ctx context.Context, kind, key string) (*cacheEntry, bool) {
+	l := ctxlogrus.Get(ctx)
+
+	var b []byte
+	err := cs.Cache.Get(ctx, cacheKey(kind, key), &b)
+	if err != nil {
+		if errors.Cause(err) != data.ErrCacheMiss {
+			l.WithFields(logrus.Fields{"kind": kind, "key": key}).Warn(errors.Wrap(err, "cache get failed"))
+		}
+		return nil, false
+	}
+
+	entry := &cacheEntry{}
+	err = gob.NewDecoder(bytes.NewReader(b)).Decode(entry)
+	if err != nil {
+		l.WithFields(logrus.Fields{"kind": kind, "key": key}).Warn(errors.Wrap(err, "cached entity was invalid"))
+		return nil, false
+	}
+	return entry, true
+}
+
+// Caches an entity read from the wrapped store, unless already cached. Failures are logged, as the read itself succeeded.
+// A version of -1 marks the version as unknown, so GetWithVersion will not be served from the entry.
+func (cs *CachingStore) setCached(ctx context.Context, kind, key string, exists bool, properties []data.Property, version int64, v interface{}) {
+	l := ctxlogrus.Get(ctx)
+
+	entry := &cacheEntry{
+		Exists:     exists,
+		Properties: properties,
+		Version:    version,
+	}
+	if exists && v != nil {
+		content, err := cs.ContentFormat.Encode(kind, key, v)
+		if err != nil {
+			l.WithFields(logrus.Fields{"kind": kind, "key": key}).Warn(errors.Wrap(err, "unable to cache entity content"))
+			return
+		}
+		entry.Content = &content
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(entry)
+	if err != nil {
+		l.WithFields(logrus.Fields{"kind": kind, "key": key}).Warn(errors.Wrap(err, "unable to cache entity"))
+		return
+	}
+
+	ttl := cs.TTL
+	if ttl == 0 {
+		ttl = time.Minute
+	}
+
+	// An entry already present is left alone; it is no older than this one, as writes delete it.
+	err = cs.Cache.Add(ctx, cacheKey(kind, key), ttl, buf.Bytes())
+	if err != nil && errors.Cause(err) != data.ErrCacheNotStored {
+		l.WithFields(logrus.Fields{"kind": kind, "key": key}).Warn(errors.Wrap(err, "cache set failed"))
+	}
+}
+
+// Returns the cached entity, deserializing its content into v, as the wrapped store's GetWithVersion would.
+func (cs *CachingStore) unpack(kind, key string, e *cacheEntry, v interface{}) ([]data.Property, int64, error) {
+	if !e.Exists {
+		return nil, 0, data.ErrNoSuchEntity
+	}
+
+	if e.Content != nil {
+		if v == nil {
+			return nil, 0, errors.New("entity contained content to deserialize, but content param was not set")
+		}
+
+		err := cs.ContentFormat.Decode(kind, key, *e.Content, v)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "unable to deserialize cached entity content")
+		}
+	} else if v != nil {
+		return nil, 0, errors.New("entity did not contain content to deserialize, but content param was set")
+	}
+	return e.Properties, e.Version, nil
+}
+
+func cacheKey(kind, key string) string {
+	return url.PathEscape(kind) + "/" + key
+}
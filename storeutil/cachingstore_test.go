@@ -0,0 +1,545 @@
+package storeutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/encryption"
+	"github.com/jbeshir/moonbird-auth-frontend/memstore"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testContent struct {
+	Name string
+}
+
+// In-memory CacheStore recording how often each operation is called.
+type mapCache struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+	ttls    map[string]time.Duration
+	gets    int
+	sets    int
+	deletes int
+}
+
+func (c *mapCache) Get(ctx context.Context, key string, v interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gets++
+	b, ok := c.entries[key]
+	if !ok {
+		return data.ErrCacheMiss
+	}
+	*v.(*[]byte) = b
+	return nil
+}
+
+func (c *mapCache) Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		return data.ErrCacheNotStored
+	}
+
+	c.sets++
+	if c.entries == nil {
+		c.entries = make(map[string][]byte)
+		c.ttls = make(map[string]time.Duration)
+	}
+	c.entries[key] = v.([]byte)
+	c.ttls[key] = ttl
+	return nil
+}
+
+func (c *mapCache) Delete(ctx context.Context, key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deletes++
+	if _, ok := c.entries[key]; !ok {
+		return data.ErrCacheMiss
+	}
+	delete(c.entries, key)
+	return nil
+}
+
+func makeTestCachingStore() (*CachingStore, *memstore.PersistentStore, *mapCache) {
+	ps := &memstore.PersistentStore{Datastore: &memstore.Datastore{}}
+	cache := &mapCache{}
+	return &CachingStore{PersistentStore: ps, Cache: cache}, ps, cache
+}
+
+func TestCachingStore_Get_ReadThrough(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, ps, cache := makeTestCachingStore()
+
+	properties := []data.Property{{Name: "Foo", Value: "bar"}}
+	err := ps.Set(ctx, "Kind", "key", properties, &testContent{Name: "first"})
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	var content testContent
+	result, version, err := cs.GetWithVersion(ctx, "Kind", "key", &content)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if cache.sets != 1 {
+		t.Errorf("Expected entity to be cached once, was cached %d times", cache.sets)
+	}
+
+	// Bypass the cache, so a second read must be served from it to see the old entity.
+	err = ps.Set(ctx, "Kind", "key", nil, &testContent{Name: "second"})
+	if err != nil {
+		t.Fatalf("Unexpected error updating store: %s", err)
+	}
+
+	var cachedContent testContent
+	cachedResult, cachedVersion, err := cs.GetWithVersion(ctx, "Kind", "key", &cachedContent)
+	if err != nil {
+		t.Fatalf("Unexpected error from cached GetWithVersion: %s", err)
+	}
+	if !reflect.DeepEqual(cachedResult, result) {
+		t.Errorf("Expected cached properties %v, got %v", result, cachedResult)
+	}
+	if cachedVersion != version {
+		t.Errorf("Expected cached version %d, got %d", version, cachedVersion)
+	}
+	if cachedContent != content {
+		t.Errorf("Expected cached content %v, got %v", content, cachedContent)
+	}
+}
+
+func TestCachingStore_Get_NegativeCaching(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, ps, _ := makeTestCachingStore()
+
+	_, err := cs.Get(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from Get, got: %v", err)
+	}
+
+	err = ps.Set(ctx, "Kind", "key", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	_, err = cs.Get(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected cached no such entity error from Get, got: %v", err)
+	}
+}
+
+func TestCachingStore_Set_Invalidates(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, _, cache := makeTestCachingStore()
+
+	_, err := cs.Get(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from Get, got: %v", err)
+	}
+
+	properties := []data.Property{{Name: "Foo", Value: "bar"}}
+	err = cs.Set(ctx, "Kind", "key", properties, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	if cache.deletes != 1 {
+		t.Errorf("Expected %d cache deletes, got %d", 1, cache.deletes)
+	}
+
+	result, err := cs.Get(ctx, "Kind", "key", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if !reflect.DeepEqual(result, properties) {
+		t.Errorf("Expected properties %v, got %v", properties, result)
+	}
+
+	err = cs.Delete(ctx, "Kind", "key")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+
+	_, err = cs.Get(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected no such entity error from Get after Delete, got: %v", err)
+	}
+}
+
+func TestCachingStore_SetIfVersion_Invalidates(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, _, _ := makeTestCachingStore()
+
+	_, version, err := cs.GetWithVersion(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from GetWithVersion, got: %v", err)
+	}
+
+	newVersion, err := cs.SetIfVersion(ctx, "Kind", "key", version, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from SetIfVersion: %s", err)
+	}
+
+	_, version, err = cs.GetWithVersion(ctx, "Kind", "key", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if version != newVersion {
+		t.Errorf("Expected version %d, got %d", newVersion, version)
+	}
+}
+
+func TestCachingStore_Kinds(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, _, cache := makeTestCachingStore()
+	cs.Kinds = []string{"Cached"}
+
+	_, err := cs.Get(ctx, "Uncached", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from Get, got: %v", err)
+	}
+	err = cs.Set(ctx, "Uncached", "key", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Set: %s", err)
+	}
+	if cache.gets != 0 || cache.sets != 0 || cache.deletes != 0 {
+		t.Errorf("Expected cache to be unused for uncached kind; got %d gets, %d sets, %d deletes", cache.gets, cache.sets, cache.deletes)
+	}
+
+	_, err = cs.Get(ctx, "Cached", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from Get, got: %v", err)
+	}
+	if cache.sets != 1 {
+		t.Errorf("Expected %d cache sets for cached kind, got %d", 1, cache.sets)
+	}
+}
+
+func TestCachingStore_GetMulti(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, ps, _ := makeTestCachingStore()
+
+	err := ps.Set(ctx, "Kind", "a", nil, &testContent{Name: "a"})
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	// Cache one of the entities first, so results are combined from the cache and the store.
+	var first testContent
+	_, err = cs.Get(ctx, "Kind", "a", &first)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+
+	keys := []data.EntityKey{{Kind: "Kind", Key: "a"}, {Kind: "Kind", Key: "b"}}
+	contents := []interface{}{&testContent{}, &testContent{}}
+	_, err = cs.GetMulti(ctx, keys, contents)
+	multiErr, ok := err.(data.MultiError)
+	if !ok {
+		t.Fatalf("Expected MultiError from GetMulti, got: %v", err)
+	}
+	if multiErr[0] != nil {
+		t.Errorf("Expected nil error for cached entity, got: %s", multiErr[0])
+	}
+	if multiErr[1] != data.ErrNoSuchEntity {
+		t.Errorf("Expected no such entity error for missing entity, got: %v", multiErr[1])
+	}
+	if contents[0].(*testContent).Name != "a" {
+		t.Errorf("Expected content %q for cached entity, got %q", "a", contents[0].(*testContent).Name)
+	}
+
+	// Entities cached by GetMulti have no version, so GetWithVersion must read through to learn it.
+	_, version, err := cs.GetWithVersion(ctx, "Kind", "a", &testContent{})
+	if err != nil {
+		t.Fatalf("Unexpected error from GetWithVersion: %s", err)
+	}
+	if version <= 0 {
+		t.Errorf("Expected positive version, got %d", version)
+	}
+}
+
+func TestCachingStore_Transact_BypassesAndDefersInvalidation(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, ps, cache := makeTestCachingStore()
+
+	_, err := cs.Get(ctx, "Kind", "key", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Fatalf("Expected no such entity error from Get, got: %v", err)
+	}
+	err = ps.Set(ctx, "Kind", "key", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	err = cs.Transact(ctx, func(ctx context.Context) error {
+		// The cache holds a stale negative entry, which transactional reads must not see.
+		_, err := cs.Get(ctx, "Kind", "key", nil)
+		if err != nil {
+			return err
+		}
+
+		err = cs.Set(ctx, "Kind", "key", []data.Property{{Name: "Foo", Value: "bar"}}, nil)
+		if err != nil {
+			return err
+		}
+		if cache.deletes != 0 {
+			t.Errorf("Expected invalidation to be deferred until the transaction completed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error from Transact: %s", err)
+	}
+	if cache.deletes != 1 {
+		t.Errorf("Expected %d cache deletes after transaction, got %d", 1, cache.deletes)
+	}
+
+	result, err := cs.Get(ctx, "Kind", "key", nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if len(result) != 1 {
+		t.Errorf("Expected 1 property after transaction, got %d", len(result))
+	}
+}
+
+func TestCachingStore_Transact_FailureInvalidates(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cache := &mapCache{}
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+		err := f(ctx)
+		if err != nil {
+			return err
+		}
+		return data.ErrConcurrentTransaction
+	}
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		return nil
+	}
+	cs := &CachingStore{PersistentStore: ps, Cache: cache}
+
+	err := cs.Transact(ctx, func(ctx context.Context) error {
+		return cs.Set(ctx, "Kind", "key", nil, nil)
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected concurrent transaction error from Transact, got: %v", err)
+	}
+	if cache.deletes != 1 {
+		t.Errorf("Expected %d cache deletes after failed transaction, got %d", 1, cache.deletes)
+	}
+}
+
+func TestCachingStore_CacheError_FallsThrough(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ps := &memstore.PersistentStore{Datastore: &memstore.Datastore{}}
+	cache := testhelpers.NewCacheStore(t)
+	cache.GetFunc = func(ctx context.Context, key string, v interface{}) error {
+		return errors.New("cache unavailable")
+	}
+	cache.AddFunc = func(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+		return errors.New("cache unavailable")
+	}
+	cs := &CachingStore{PersistentStore: ps, Cache: cache}
+
+	err := ps.Set(ctx, "Kind", "key", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	_, err = cs.Get(ctx, "Kind", "key", nil)
+	if err != nil {
+		t.Errorf("Unexpected error from Get with failing cache: %s", err)
+	}
+}
+
+func TestCachingStore_FillDoesNotReplace(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, _, cache := makeTestCachingStore()
+
+	// Cached by another read since this one's; a fill must not replace it.
+	cached := []byte("racing")
+	cache.entries = map[string][]byte{cacheKey("Kind", "key"): cached}
+
+	cs.setCached(ctx, "Kind", "key", true, nil, 1, &testContent{Name: "first"})
+
+	if !bytes.Equal(cache.entries[cacheKey("Kind", "key")], cached) {
+		t.Errorf("Expected existing cache entry to be left in place, was replaced")
+	}
+}
+
+// PersistentStore pausing GetMulti after reading, until resumed.
+type pausingStore struct {
+	PersistentStore
+	read   chan struct{}
+	resume chan struct{}
+}
+
+func (ps *pausingStore) GetMulti(ctx context.Context, keys []data.EntityKey, contents []interface{}) ([][]data.Property, error) {
+	results, err := ps.PersistentStore.GetMulti(ctx, keys, contents)
+	close(ps.read)
+	<-ps.resume
+	return results, err
+}
+
+func TestCachingStore_FillRacingDelete(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cs, ps, cache := makeTestCachingStore()
+	cs.TTL = 5 * time.Second
+
+	keys := []data.EntityKey{{Kind: "ProjectAuth", Key: "project/token/foo"}}
+	err := ps.Set(ctx, "ProjectAuth", "project/token/foo", nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	pausing := &pausingStore{PersistentStore: ps, read: make(chan struct{}), resume: make(chan struct{})}
+	cs.PersistentStore = pausing
+
+	filled := make(chan error)
+	go func() {
+		_, err := cs.GetMulti(ctx, keys, nil)
+		filled <- err
+	}()
+
+	// Revoke the token after the fill has read it, but before it is cached.
+	<-pausing.read
+	err = cs.Delete(ctx, "ProjectAuth", "project/token/foo")
+	if err != nil {
+		t.Fatalf("Unexpected error from Delete: %s", err)
+	}
+	close(pausing.resume)
+
+	err = <-filled
+	if err != nil {
+		t.Fatalf("Unexpected error from GetMulti: %s", err)
+	}
+
+	// The fill restores the entry the revocation invalidated, so only its TTL bounds how long the token is accepted.
+	key := cacheKey("ProjectAuth", "project/token/foo")
+	if _, ok := cache.entries[key]; !ok {
+		t.Fatal("Expected racing fill to cache the entity it read")
+	}
+	if ttl := cache.ttls[key]; ttl != cs.TTL {
+		t.Errorf("Expected racing fill to be cached for TTL %s, got %s", cs.TTL, ttl)
+	}
+
+	delete(cache.entries, key)
+	_, err = cs.Get(ctx, "ProjectAuth", "project/token/foo", nil)
+	if err != data.ErrNoSuchEntity {
+		t.Errorf("Expected error '%s' once racing fill expired, got '%v'", data.ErrNoSuchEntity, err)
+	}
+}
+
+func TestCachingStore_TTL(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		Label       string
+		TTL         time.Duration
+		ExpectedTTL time.Duration
+	}{
+		{
+			Label:       "Default",
+			ExpectedTTL: time.Minute,
+		},
+		{
+			Label:       "Set",
+			TTL:         time.Second,
+			ExpectedTTL: time.Second,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			cs, _, cache := makeTestCachingStore()
+			cs.TTL = testCase.TTL
+
+			_, err := cs.Get(ctx, "Kind", "key", nil)
+			if err != data.ErrNoSuchEntity {
+				t.Fatalf("Expected error '%s' from Get, got '%v'", data.ErrNoSuchEntity, err)
+			}
+			if ttl := cache.ttls[cacheKey("Kind", "key")]; ttl != testCase.ExpectedTTL {
+				t.Errorf("Expected TTL %s, got %s", testCase.ExpectedTTL, ttl)
+			}
+		})
+	}
+}
+
+func TestCachingStore_ContentFormat_Encrypted(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	format := data.ContentFormat{
+		Codec: encryption.Codec{
+			Keys: &encryption.LocalKeyProvider{
+				Keys:         map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)},
+				CurrentKeyID: "k1",
+			},
+		},
+	}
+	ps := &memstore.PersistentStore{Datastore: &memstore.Datastore{}, ContentFormat: format}
+	cache := &mapCache{}
+	cs := &CachingStore{PersistentStore: ps, Cache: cache, ContentFormat: format}
+
+	err := ps.Set(ctx, "Kind", "key", nil, &testContent{Name: "secret"})
+	if err != nil {
+		t.Fatalf("Unexpected error seeding store: %s", err)
+	}
+
+	var content testContent
+	_, err = cs.Get(ctx, "Kind", "key", &content)
+	if err != nil {
+		t.Fatalf("Unexpected error from Get: %s", err)
+	}
+	if bytes.Contains(cache.entries[cacheKey("Kind", "key")], []byte("secret")) {
+		t.Errorf("Expected cached content not to contain plaintext")
+	}
+
+	var cachedContent testContent
+	_, err = cs.Get(ctx, "Kind", "key", &cachedContent)
+	if err != nil {
+		t.Fatalf("Unexpected error from cached Get: %s", err)
+	}
+	if cachedContent.Name != "secret" {
+		t.Errorf("Expected cached content '%s', got '%s'", "secret", cachedContent.Name)
+	}
+	if cache.gets != 2 || cache.sets != 1 {
+		t.Errorf("Expected second Get to be served from cache; got %d gets, %d sets", cache.gets, cache.sets)
+	}
+}
@@ -0,0 +1,266 @@
+package storeutil
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"strings"
+	"testing"
+)
+
+func TestHelper_EnsureNotExists_GetErr(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	expectedErr := errors.New("bluh")
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Get to called in transaction, was not called in transaction")
+		}
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return nil, expectedErr
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsureNotExists(context.Background(), "bluh", "bar/baz", true)
+	if !getCalled {
+		t.Error("Expected EnsureNotExists to call Get, not called")
+	}
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected EnsureNotExists to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestHelper_EnsureNotExists_DeleteErr(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+		return nil, nil
+	}
+
+	expectedErr := errors.New("bluh")
+	deleteCalled := false
+	ps.DeleteFunc = func(ctx context.Context, kind, key string) error {
+		deleteCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Delete to called in transaction, was not called in transaction")
+		}
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return expectedErr
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsureNotExists(context.Background(), "bluh", "bar/baz", true)
+	if !getCalled {
+		t.Error("Expected EnsureNotExists to call Get, not called")
+	}
+	if !deleteCalled {
+		t.Error("Expected EnsureNotExists to call Delete, not called")
+	}
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected EnsureNotExists to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestHelper_EnsureNotExists_AlreadyAbsent(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Get to called in transaction, was not called in transaction")
+		}
+
+		return nil, data.ErrNoSuchEntity
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsureNotExists(context.Background(), "bluh", "bar/baz", true)
+	if !getCalled {
+		t.Error("Expected EnsureNotExists to call Get, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected EnsureNotExists to return nil error, got '%s'", err)
+	}
+}
+
+func TestHelper_EnsureNotExists_EntityPresent(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	deleteCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Get to called in transaction, was not called in transaction")
+		}
+
+		return []data.Property{
+			{
+				Name:  "a",
+				Value: "b",
+			},
+		}, nil
+	}
+
+	ps.DeleteFunc = func(ctx context.Context, kind, key string) error {
+		deleteCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Delete to called in transaction, was not called in transaction")
+		}
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return nil
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsureNotExists(context.Background(), "bluh", "bar/baz", true)
+	if !getCalled {
+		t.Error("Expected EnsureNotExists to call Get, not called")
+	}
+	if !deleteCalled {
+		t.Error("Expected EnsureNotExists to call Delete, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected EnsureNotExists to return nil error, got '%s'", err)
+	}
+}
+
+func TestHelper_EnsureNotExists_EntityPresent_NoTransact(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	deleteCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+		return nil, nil
+	}
+
+	ps.DeleteFunc = func(ctx context.Context, kind, key string) error {
+		deleteCalled = true
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return nil
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsureNotExists(context.Background(), "bluh", "bar/baz", false)
+	if !getCalled {
+		t.Error("Expected EnsureNotExists to call Get, not called")
+	}
+	if !deleteCalled {
+		t.Error("Expected EnsureNotExists to call Delete, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected EnsureNotExists to return nil error, got '%s'", err)
+	}
+}
@@ -0,0 +1,271 @@
+package storeutil
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHelper_EnsurePropertyRemoved_GetErr(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	expectedErr := errors.New("bluh")
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Get to called in transaction, was not called in transaction")
+		}
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		return nil, expectedErr
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsurePropertyRemoved(context.Background(), "bluh", "bar/baz", "a", true)
+	if !getCalled {
+		t.Error("Expected EnsurePropertyRemoved to call Get, not called")
+	}
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected EnsurePropertyRemoved to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestHelper_EnsurePropertyRemoved_SetErr(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		return f(ctx)
+	}
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		return []data.Property{
+			{
+				Name:  "a",
+				Value: "b",
+			},
+		}, nil
+	}
+
+	expectedErr := errors.New("bluh")
+	setCalled := false
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		setCalled = true
+		return expectedErr
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsurePropertyRemoved(context.Background(), "bluh", "bar/baz", "a", true)
+	if !setCalled {
+		t.Error("Expected EnsurePropertyRemoved to call Set, not called")
+	}
+	if err == nil || !strings.Contains(err.Error(), expectedErr.Error()) {
+		t.Errorf("Expected EnsurePropertyRemoved to return error '%s', got '%s'", expectedErr, err)
+	}
+}
+
+func TestHelper_EnsurePropertyRemoved_Unchanged(t *testing.T) {
+	testCases := []struct {
+		Label      string
+		Properties []data.Property
+		Err        error
+	}{
+		{
+			Label: "PropertyAbsent",
+			Properties: []data.Property{
+				{
+					Name:  "c",
+					Value: "d",
+				},
+			},
+		},
+		{
+			Label: "EntityAbsent",
+			Err:   data.ErrNoSuchEntity,
+		},
+	}
+
+	for i := range testCases {
+		testCase := testCases[i]
+		t.Run(testCase.Label, func(t *testing.T) {
+			t.Parallel()
+
+			getCalled := false
+			ps := testhelpers.NewPersistentStore(t)
+
+			ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+				return f(ctx)
+			}
+
+			ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+				getCalled = true
+				return testCase.Properties, testCase.Err
+			}
+
+			h := &Helper{
+				Store: ps,
+			}
+
+			err := h.EnsurePropertyRemoved(context.Background(), "bluh", "bar/baz", "a", true)
+			if !getCalled {
+				t.Error("Expected EnsurePropertyRemoved to call Get, not called")
+			}
+			if err != nil {
+				t.Errorf("Expected EnsurePropertyRemoved to return nil error, got '%s'", err)
+			}
+		})
+	}
+}
+
+func TestHelper_EnsurePropertyRemoved(t *testing.T) {
+	t.Parallel()
+
+	getCalled := false
+	setCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+
+	inTransaction := false
+	ps.TransactFunc = func(ctx context.Context, f func(ctx context.Context) error) error {
+		inTransaction = true
+		defer func() {
+			inTransaction = false
+		}()
+		return f(ctx)
+	}
+
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		getCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Get to called in transaction, was not called in transaction")
+		}
+
+		return []data.Property{
+			{
+				Name:  "c",
+				Value: "d",
+			},
+			{
+				Name:  "a",
+				Value: "b",
+			},
+		}, nil
+	}
+
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		setCalled = true
+
+		if !inTransaction {
+			t.Error("Expected Set to called in transaction, was not called in transaction")
+		}
+
+		expectedKind := "bluh"
+		if kind != expectedKind {
+			t.Errorf("Expected kind '%s', got '%s'", expectedKind, kind)
+		}
+
+		expectedKey := "bar/baz"
+		if key != expectedKey {
+			t.Errorf("Expected key '%s', got '%s'", expectedKey, key)
+		}
+
+		expectedProperties := []data.Property{
+			{
+				Name:  "c",
+				Value: "d",
+			},
+		}
+		if !reflect.DeepEqual(properties, expectedProperties) {
+			t.Error("Properties did not match expected properties")
+		}
+
+		return nil
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsurePropertyRemoved(context.Background(), "bluh", "bar/baz", "a", true)
+	if !getCalled {
+		t.Error("Expected EnsurePropertyRemoved to call Get, not called")
+	}
+	if !setCalled {
+		t.Error("Expected EnsurePropertyRemoved to call Set, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected EnsurePropertyRemoved to return nil error, got '%s'", err)
+	}
+}
+
+func TestHelper_EnsurePropertyRemoved_MultiValued(t *testing.T) {
+	t.Parallel()
+
+	setCalled := false
+	ps := testhelpers.NewPersistentStore(t)
+	ps.GetFunc = func(ctx context.Context, kind, key string, v interface{}) (properties []data.Property, e error) {
+		return []data.Property{
+			{Name: "a", Value: "b", Multiple: true},
+			{Name: "c", Value: "d"},
+			{Name: "a", Value: "e", Multiple: true},
+			{Name: "a", Value: "f", Multiple: true},
+		}, nil
+	}
+
+	ps.SetFunc = func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error {
+		setCalled = true
+
+		expectedProperties := []data.Property{
+			{Name: "c", Value: "d"},
+		}
+		if !reflect.DeepEqual(properties, expectedProperties) {
+			t.Errorf("Expected properties %v, got %v", expectedProperties, properties)
+		}
+		return nil
+	}
+
+	h := &Helper{
+		Store: ps,
+	}
+
+	err := h.EnsurePropertyRemoved(context.Background(), "bluh", "bar/baz", "a", false)
+	if !setCalled {
+		t.Error("Expected EnsurePropertyRemoved to call Set, not called")
+	}
+	if err != nil {
+		t.Errorf("Expected EnsurePropertyRemoved to return nil error, got '%s'", err)
+	}
+}
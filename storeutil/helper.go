@@ -39,6 +39,30 @@ func (h *Helper) EnsureProperty(ctx context.Context, kind, key, name, value stri
 	}, transact)
 }
 
+func (h *Helper) EnsurePropertyRemoved(ctx context.Context, kind, key, name string, transact bool) error {
+	return h.maybeTransact(ctx, func(ctx context.Context) error {
+		properties, err := h.Store.Get(ctx, kind, key, nil)
+		if err != nil {
+			if err == data.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+
+		// Multi-valued properties are stored as several properties with the same name, all of which are removed.
+		remaining := make([]data.Property, 0, len(properties))
+		for _, p := range properties {
+			if p.Name != name {
+				remaining = append(remaining, p)
+			}
+		}
+		if len(remaining) == len(properties) {
+			return nil
+		}
+		return h.Store.Set(ctx, kind, key, remaining, nil)
+	}, transact)
+}
+
 func (h *Helper) EnsureExists(ctx context.Context, kind, key string, transact bool) error {
 	return h.maybeTransact(ctx, func(ctx context.Context) error {
 		_, err := h.Store.Get(ctx, kind, key, nil)
@@ -50,6 +74,20 @@ func (h *Helper) EnsureExists(ctx context.Context, kind, key string, transact bo
 	}, transact)
 }
 
+func (h *Helper) EnsureNotExists(ctx context.Context, kind, key string, transact bool) error {
+	return h.maybeTransact(ctx, func(ctx context.Context) error {
+		_, err := h.Store.Get(ctx, kind, key, nil)
+		if err != nil {
+			if err == data.ErrNoSuchEntity {
+				return nil
+			}
+			return err
+		}
+
+		return h.Store.Delete(ctx, kind, key)
+	}, transact)
+}
+
 func (h *Helper) maybeTransact(ctx context.Context, f func(context.Context) error, transact bool) error {
 	if transact {
 		return h.Store.Transact(ctx, f)
@@ -0,0 +1,119 @@
+package storeutil
+
+import (
+	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/ctxlogrus"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RetryingStore wraps a PersistentStore, retrying transactions which fail with data.ErrConcurrentTransaction.
+// Retries wait with exponential backoff and full jitter, so contending callers spread out.
+// Other methods are passed through to the wrapped store.
+//
+// The wrapped store is asked to make a single attempt each run, so it doesn't retry without backoff itself,
+// and a transaction is attempted at most Attempts times in total.
+type RetryingStore struct {
+	PersistentStore
+
+	// Number of times a transaction is run before giving up. If zero, three attempts are made.
+	// Attempts given in a transaction's options take precedence.
+	Attempts int
+
+	// Upper bound of the wait before the first retry, doubling for each subsequent one.
+	// If zero, 10ms is used.
+	BaseDelay time.Duration
+
+	// Cap on the upper bound of the wait before a retry. If zero, one second is used.
+	MaxDelay time.Duration
+
+	// If set, notified of retries and of transactions which exhaust their attempts.
+	Metrics RetryMetrics
+}
+
+func (rs *RetryingStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
+	return rs.TransactWithOptions(ctx, data.TransactionOptions{}, f)
+}
+
+func (rs *RetryingStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	attempts := opts.Attempts
+	if attempts <= 0 {
+		attempts = rs.Attempts
+	}
+	if attempts <= 0 {
+		attempts = 3
+	}
+	opts.Attempts = 1
+	baseDelay := rs.BaseDelay
+	if baseDelay <= 0 {
+		baseDelay = 10 * time.Millisecond
+	}
+	maxDelay := rs.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = time.Second
+	}
+
+	l := ctxlogrus.Get(ctx)
+	bound := baseDelay
+	for attempt := 1; ; attempt++ {
+		err := rs.PersistentStore.TransactWithOptions(ctx, opts, f)
+		if errors.Cause(err) != data.ErrConcurrentTransaction {
+			return err
+		}
+
+		if attempt >= attempts {
+			if rs.Metrics != nil {
+				rs.Metrics.TransactionExhausted(ctx)
+			}
+			return err
+		}
+
+		delay := time.Duration(rand.Int63n(int64(bound) + 1))
+		l.WithFields(logrus.Fields{"attempt": attempt, "delay": delay}).Info("retrying conflicting transaction")
+		if rs.Metrics != nil {
+			rs.Metrics.TransactionRetried(ctx, attempt)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return errors.Wrap(ctx.Err(), "")
+		case <-t.C:
+		}
+
+		bound *= 2
+		if bound > maxDelay {
+			bound = maxDelay
+		}
+	}
+}
+
+// RetryCounters is a RetryMetrics counting retries and exhausted transactions.
+// The zero value is ready for use, and it is safe for concurrent use.
+type RetryCounters struct {
+	retried   int64
+	exhausted int64
+}
+
+func (c *RetryCounters) TransactionRetried(ctx context.Context, attempt int) {
+	atomic.AddInt64(&c.retried, 1)
+}
+
+func (c *RetryCounters) TransactionExhausted(ctx context.Context) {
+	atomic.AddInt64(&c.exhausted, 1)
+}
+
+// Returns the number of transaction retries made.
+func (c *RetryCounters) Retried() int64 {
+	return atomic.LoadInt64(&c.retried)
+}
+
+// Returns the number of transactions which still conflicted after all their attempts.
+func (c *RetryCounters) Exhausted() int64 {
+	return atomic.LoadInt64(&c.exhausted)
+}
@@ -0,0 +1,188 @@
+package storeutil
+
+import (
+	"context"
+	"errors"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"github.com/jbeshir/moonbird-auth-frontend/testhelpers"
+	"testing"
+	"time"
+)
+
+func TestRetryingStore_Transact_RetriesConflicts(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = testhelpers.ContendedTransactWithOptions(2)
+
+	metrics := &RetryCounters{}
+	rs := &RetryingStore{
+		PersistentStore: ps,
+		BaseDelay:       time.Microsecond,
+		Metrics:         metrics,
+	}
+
+	callCount := 0
+	err := rs.Transact(context.Background(), func(ctx context.Context) error {
+		callCount++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from Transact, got %s", err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected call count to be %d, was %d", 1, callCount)
+	}
+	if metrics.Retried() != 2 {
+		t.Errorf("Expected %d retries to be counted, got %d", 2, metrics.Retried())
+	}
+	if metrics.Exhausted() != 0 {
+		t.Errorf("Expected %d exhausted transactions to be counted, got %d", 0, metrics.Exhausted())
+	}
+}
+
+func TestRetryingStore_Transact_AttemptsExhausted(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = testhelpers.ContendedTransactWithOptions(5)
+
+	metrics := &RetryCounters{}
+	rs := &RetryingStore{
+		PersistentStore: ps,
+		Attempts:        3,
+		BaseDelay:       time.Microsecond,
+		Metrics:         metrics,
+	}
+
+	err := rs.Transact(context.Background(), func(ctx context.Context) error {
+		t.Error("Expected transaction function not to be called")
+		return nil
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected error '%s' from Transact, got '%s'", data.ErrConcurrentTransaction, err)
+	}
+	if metrics.Retried() != 2 {
+		t.Errorf("Expected %d retries to be counted, got %d", 2, metrics.Retried())
+	}
+	if metrics.Exhausted() != 1 {
+		t.Errorf("Expected %d exhausted transactions to be counted, got %d", 1, metrics.Exhausted())
+	}
+}
+
+func TestRetryingStore_Transact_OtherErrorNotRetried(t *testing.T) {
+	t.Parallel()
+
+	expectedErr := errors.New("bluh")
+	callCount := 0
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+		callCount++
+		return f(ctx)
+	}
+
+	rs := &RetryingStore{
+		PersistentStore: ps,
+		BaseDelay:       time.Microsecond,
+	}
+
+	err := rs.Transact(context.Background(), func(ctx context.Context) error {
+		return expectedErr
+	})
+	if err != expectedErr {
+		t.Errorf("Expected error '%s' from Transact, got '%s'", expectedErr, err)
+	}
+	if callCount != 1 {
+		t.Errorf("Expected call count to be %d, was %d", 1, callCount)
+	}
+}
+
+func TestRetryingStore_TransactWithOptions_PassesOptions(t *testing.T) {
+	t.Parallel()
+
+	opts := data.TransactionOptions{
+		ReadOnly:    true,
+		Attempts:    7,
+		SingleGroup: true,
+	}
+
+	// The wrapped store makes a single attempt each run, leaving retries to the retrying store.
+	expectedOpts := data.TransactionOptions{
+		ReadOnly:    true,
+		Attempts:    1,
+		SingleGroup: true,
+	}
+
+	called := false
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+		called = true
+		if opts != expectedOpts {
+			t.Errorf("Expected options %+v, got %+v", expectedOpts, opts)
+		}
+		return f(ctx)
+	}
+
+	rs := &RetryingStore{
+		PersistentStore: ps,
+	}
+
+	err := rs.TransactWithOptions(context.Background(), opts, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected nil error from TransactWithOptions, got %s", err)
+	}
+	if !called {
+		t.Error("Expected wrapped TransactWithOptions to be called, was not called")
+	}
+}
+
+func TestRetryingStore_Transact_ContextCancelled(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = testhelpers.ContendedTransactWithOptions(1)
+
+	rs := &RetryingStore{
+		PersistentStore: ps,
+		BaseDelay:       time.Hour,
+		MaxDelay:        time.Hour,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := rs.Transact(ctx, func(ctx context.Context) error {
+		t.Error("Expected transaction function not to be called")
+		return nil
+	})
+	if err == nil {
+		t.Error("Expected error from Transact with cancelled context, got nil")
+	}
+}
+
+func TestRetryingStore_TransactWithOptions_AttemptsOverride(t *testing.T) {
+	t.Parallel()
+
+	ps := testhelpers.NewPersistentStore(t)
+	ps.TransactWithOptionsFunc = testhelpers.ContendedTransactWithOptions(10)
+
+	metrics := &RetryCounters{}
+	rs := &RetryingStore{
+		PersistentStore: ps,
+		Attempts:        3,
+		BaseDelay:       time.Microsecond,
+		Metrics:         metrics,
+	}
+
+	err := rs.TransactWithOptions(context.Background(), data.TransactionOptions{Attempts: 5}, func(ctx context.Context) error {
+		return nil
+	})
+	if err != data.ErrConcurrentTransaction {
+		t.Errorf("Expected error '%s' from TransactWithOptions, got '%s'", data.ErrConcurrentTransaction, err)
+	}
+	if metrics.Retried() != 4 {
+		t.Errorf("Expected %d retries to be counted, got %d", 4, metrics.Retried())
+	}
+}
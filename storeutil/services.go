@@ -3,10 +3,31 @@ package storeutil
 import (
 	"context"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
+	"time"
 )
 
 type PersistentStore interface {
 	Get(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error)
 	Set(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error
+	SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error
+	GetWithVersion(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error)
+	SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error)
+	GetMulti(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error)
+	SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error
+	Delete(ctx context.Context, kind, key string) error
+	DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error)
+	Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error)
 	Transact(ctx context.Context, f func(ctx context.Context) error) error
+	TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error
+}
+
+type CacheStore interface {
+	Get(ctx context.Context, key string, v interface{}) error
+	Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+	Delete(ctx context.Context, key string) error
+}
+
+type RetryMetrics interface {
+	TransactionRetried(ctx context.Context, attempt int)
+	TransactionExhausted(ctx context.Context)
 }
@@ -2,13 +2,26 @@ package testhelpers
 
 import (
 	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"testing"
+	"time"
 )
 
+var _ data.CacheStore = (*CacheStore)(nil)
+
 type CacheStore struct {
-	GetFunc    func(ctx context.Context, key string, v interface{}) error
-	SetFunc    func(ctx context.Context, key string, v interface{}) error
-	DeleteFunc func(ctx context.Context, key string) error
+	GetFunc               func(ctx context.Context, key string, v interface{}) error
+	GetMultiFunc          func(ctx context.Context, keys []string, v []interface{}) error
+	SetFunc               func(ctx context.Context, key string, v interface{}) error
+	SetWithTTLFunc        func(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+	SetMultiFunc          func(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error
+	AddFunc               func(ctx context.Context, key string, ttl time.Duration, v interface{}) error
+	GetForCASFunc         func(ctx context.Context, key string, v interface{}) (data.CASToken, error)
+	CompareAndSwapFunc    func(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error
+	IncrementFunc         func(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error)
+	IncrementWithTTLFunc  func(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error)
+	IncrementExistingFunc func(ctx context.Context, key string, delta int64) (uint64, error)
+	DeleteFunc            func(ctx context.Context, key string) error
 }
 
 func NewCacheStore(t *testing.T) *CacheStore {
@@ -17,10 +30,46 @@ func NewCacheStore(t *testing.T) *CacheStore {
 			t.Error("Get should not be called")
 			return nil
 		},
+		GetMultiFunc: func(ctx context.Context, keys []string, v []interface{}) error {
+			t.Error("GetMulti should not be called")
+			return nil
+		},
 		SetFunc: func(ctx context.Context, key string, v interface{}) error {
 			t.Error("Set should not be called")
 			return nil
 		},
+		SetWithTTLFunc: func(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+			t.Error("SetWithTTL should not be called")
+			return nil
+		},
+		SetMultiFunc: func(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error {
+			t.Error("SetMulti should not be called")
+			return nil
+		},
+		AddFunc: func(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+			t.Error("Add should not be called")
+			return nil
+		},
+		GetForCASFunc: func(ctx context.Context, key string, v interface{}) (data.CASToken, error) {
+			t.Error("GetForCAS should not be called")
+			return nil, nil
+		},
+		CompareAndSwapFunc: func(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error {
+			t.Error("CompareAndSwap should not be called")
+			return nil
+		},
+		IncrementFunc: func(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+			t.Error("Increment should not be called")
+			return 0, nil
+		},
+		IncrementWithTTLFunc: func(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error) {
+			t.Error("IncrementWithTTL should not be called")
+			return 0, nil
+		},
+		IncrementExistingFunc: func(ctx context.Context, key string, delta int64) (uint64, error) {
+			t.Error("IncrementExisting should not be called")
+			return 0, nil
+		},
 		DeleteFunc: func(ctx context.Context, key string) error {
 			t.Error("Delete should not be called")
 			return nil
@@ -32,10 +81,46 @@ func (cs *CacheStore) Get(ctx context.Context, key string, v interface{}) error
 	return cs.GetFunc(ctx, key, v)
 }
 
+func (cs *CacheStore) GetMulti(ctx context.Context, keys []string, v []interface{}) error {
+	return cs.GetMultiFunc(ctx, keys, v)
+}
+
 func (cs *CacheStore) Set(ctx context.Context, key string, v interface{}) error {
 	return cs.SetFunc(ctx, key, v)
 }
 
+func (cs *CacheStore) SetWithTTL(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	return cs.SetWithTTLFunc(ctx, key, ttl, v)
+}
+
+func (cs *CacheStore) SetMulti(ctx context.Context, keys []string, ttl time.Duration, v []interface{}) error {
+	return cs.SetMultiFunc(ctx, keys, ttl, v)
+}
+
+func (cs *CacheStore) Add(ctx context.Context, key string, ttl time.Duration, v interface{}) error {
+	return cs.AddFunc(ctx, key, ttl, v)
+}
+
+func (cs *CacheStore) GetForCAS(ctx context.Context, key string, v interface{}) (data.CASToken, error) {
+	return cs.GetForCASFunc(ctx, key, v)
+}
+
+func (cs *CacheStore) CompareAndSwap(ctx context.Context, key string, token data.CASToken, ttl time.Duration, v interface{}) error {
+	return cs.CompareAndSwapFunc(ctx, key, token, ttl, v)
+}
+
+func (cs *CacheStore) Increment(ctx context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+	return cs.IncrementFunc(ctx, key, delta, initialValue)
+}
+
+func (cs *CacheStore) IncrementWithTTL(ctx context.Context, key string, ttl time.Duration, delta int64, initialValue uint64) (uint64, error) {
+	return cs.IncrementWithTTLFunc(ctx, key, ttl, delta, initialValue)
+}
+
+func (cs *CacheStore) IncrementExisting(ctx context.Context, key string, delta int64) (uint64, error) {
+	return cs.IncrementExistingFunc(ctx, key, delta)
+}
+
 func (cs *CacheStore) Delete(ctx context.Context, key string) error {
 	return cs.DeleteFunc(ctx, key)
 }
@@ -4,12 +4,23 @@ import (
 	"context"
 	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"testing"
+	"time"
 )
 
 type PersistentStore struct {
-	GetFunc      func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error)
-	SetFunc      func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error
-	TransactFunc func(ctx context.Context, f func(ctx context.Context) error) error
+	GetFunc            func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, error)
+	SetFunc            func(ctx context.Context, kind, key string, properties []data.Property, v interface{}) error
+	GetWithVersionFunc func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error)
+	SetIfVersionFunc   func(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error)
+	GetMultiFunc       func(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error)
+	SetMultiFunc       func(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error
+	DeleteFunc         func(ctx context.Context, kind, key string) error
+	QueryFunc          func(ctx context.Context, q data.Query) ([]data.QueryResult, string, error)
+	TransactFunc       func(ctx context.Context, f func(ctx context.Context) error) error
+
+	TransactWithOptionsFunc func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error
+	SetWithExpiryFunc       func(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error
+	DeleteExpiredFunc       func(ctx context.Context, kind string, batchSize int) (int, error)
 }
 
 func NewPersistentStore(t *testing.T) *PersistentStore {
@@ -22,10 +33,46 @@ func NewPersistentStore(t *testing.T) *PersistentStore {
 			t.Error("Set should not be called")
 			return nil
 		},
+		GetWithVersionFunc: func(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+			t.Error("GetWithVersion should not be called")
+			return nil, 0, nil
+		},
+		SetIfVersionFunc: func(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error) {
+			t.Error("SetIfVersion should not be called")
+			return 0, nil
+		},
+		GetMultiFunc: func(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error) {
+			t.Error("GetMulti should not be called")
+			return nil, nil
+		},
+		SetMultiFunc: func(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error {
+			t.Error("SetMulti should not be called")
+			return nil
+		},
+		DeleteFunc: func(ctx context.Context, kind, key string) error {
+			t.Error("Delete should not be called")
+			return nil
+		},
+		QueryFunc: func(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+			t.Error("Query should not be called")
+			return nil, "", nil
+		},
 		TransactFunc: func(ctx context.Context, f func(ctx context.Context) error) error {
 			t.Error("Transact should not be called")
 			return nil
 		},
+		TransactWithOptionsFunc: func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+			t.Error("TransactWithOptions should not be called")
+			return nil
+		},
+		SetWithExpiryFunc: func(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error {
+			t.Error("SetWithExpiry should not be called")
+			return nil
+		},
+		DeleteExpiredFunc: func(ctx context.Context, kind string, batchSize int) (int, error) {
+			t.Error("DeleteExpired should not be called")
+			return 0, nil
+		},
 	}
 }
 
@@ -37,6 +84,62 @@ func (ps *PersistentStore) Set(ctx context.Context, kind, key string, properties
 	return ps.SetFunc(ctx, kind, key, properties, v)
 }
 
+func (ps *PersistentStore) GetWithVersion(ctx context.Context, kind, key string, v interface{}) ([]data.Property, int64, error) {
+	return ps.GetWithVersionFunc(ctx, kind, key, v)
+}
+
+func (ps *PersistentStore) SetIfVersion(ctx context.Context, kind, key string, version int64, properties []data.Property, v interface{}) (int64, error) {
+	return ps.SetIfVersionFunc(ctx, kind, key, version, properties, v)
+}
+
+func (ps *PersistentStore) GetMulti(ctx context.Context, keys []data.EntityKey, v []interface{}) ([][]data.Property, error) {
+	return ps.GetMultiFunc(ctx, keys, v)
+}
+
+func (ps *PersistentStore) SetMulti(ctx context.Context, keys []data.EntityKey, properties [][]data.Property, v []interface{}) error {
+	return ps.SetMultiFunc(ctx, keys, properties, v)
+}
+
+func (ps *PersistentStore) Delete(ctx context.Context, kind, key string) error {
+	return ps.DeleteFunc(ctx, kind, key)
+}
+
+func (ps *PersistentStore) Query(ctx context.Context, q data.Query) ([]data.QueryResult, string, error) {
+	return ps.QueryFunc(ctx, q)
+}
+
 func (ps *PersistentStore) Transact(ctx context.Context, f func(ctx context.Context) error) error {
 	return ps.TransactFunc(ctx, f)
 }
+
+func (ps *PersistentStore) TransactWithOptions(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	return ps.TransactWithOptionsFunc(ctx, opts, f)
+}
+
+func (ps *PersistentStore) SetWithExpiry(ctx context.Context, kind, key string, expiry time.Time, properties []data.Property, v interface{}) error {
+	return ps.SetWithExpiryFunc(ctx, kind, key, expiry, properties, v)
+}
+
+func (ps *PersistentStore) DeleteExpired(ctx context.Context, kind string, batchSize int) (int, error) {
+	return ps.DeleteExpiredFunc(ctx, kind, batchSize)
+}
+
+// Returns a TransactFunc simulating contention, which fails with data.ErrConcurrentTransaction
+// without running f for the first conflicts calls, then runs f directly.
+func ContendedTransact(conflicts int) func(ctx context.Context, f func(ctx context.Context) error) error {
+	return func(ctx context.Context, f func(ctx context.Context) error) error {
+		if conflicts > 0 {
+			conflicts--
+			return data.ErrConcurrentTransaction
+		}
+		return f(ctx)
+	}
+}
+
+// As ContendedTransact, but returning a TransactWithOptionsFunc.
+func ContendedTransactWithOptions(conflicts int) func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+	transact := ContendedTransact(conflicts)
+	return func(ctx context.Context, opts data.TransactionOptions, f func(ctx context.Context) error) error {
+		return transact(ctx, f)
+	}
+}
@@ -6,8 +6,10 @@ import (
 )
 
 type StoreHelper struct {
-	EnsureExistsFunc   func(ctx context.Context, kind, key string, transact bool) error
-	EnsurePropertyFunc func(ctx context.Context, kind, key, name, value string, transact bool) error
+	EnsureExistsFunc          func(ctx context.Context, kind, key string, transact bool) error
+	EnsureNotExistsFunc       func(ctx context.Context, kind, key string, transact bool) error
+	EnsurePropertyFunc        func(ctx context.Context, kind, key, name, value string, transact bool) error
+	EnsurePropertyRemovedFunc func(ctx context.Context, kind, key, name string, transact bool) error
 }
 
 func NewStoreHelper(t *testing.T) *StoreHelper {
@@ -16,10 +18,18 @@ func NewStoreHelper(t *testing.T) *StoreHelper {
 			t.Error("EnsureExists should not be called")
 			return nil
 		},
+		EnsureNotExistsFunc: func(ctx context.Context, kind, key string, transact bool) error {
+			t.Error("EnsureNotExists should not be called")
+			return nil
+		},
 		EnsurePropertyFunc: func(ctx context.Context, kind, key, name, value string, transact bool) error {
 			t.Error("EnsureProperty should not be called")
 			return nil
 		},
+		EnsurePropertyRemovedFunc: func(ctx context.Context, kind, key, name string, transact bool) error {
+			t.Error("EnsurePropertyRemoved should not be called")
+			return nil
+		},
 	}
 }
 
@@ -30,3 +40,11 @@ func (h *StoreHelper) EnsureExists(ctx context.Context, kind, key string, transa
 func (h *StoreHelper) EnsureProperty(ctx context.Context, kind, key, name, value string, transact bool) error {
 	return h.EnsurePropertyFunc(ctx, kind, key, name, value, transact)
 }
+
+func (h *StoreHelper) EnsureNotExists(ctx context.Context, kind, key string, transact bool) error {
+	return h.EnsureNotExistsFunc(ctx, kind, key, transact)
+}
+
+func (h *StoreHelper) EnsurePropertyRemoved(ctx context.Context, kind, key, name string, transact bool) error {
+	return h.EnsurePropertyRemovedFunc(ctx, kind, key, name, transact)
+}
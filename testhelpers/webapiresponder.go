@@ -2,6 +2,7 @@ package testhelpers
 
 import (
 	"context"
+	"github.com/jbeshir/moonbird-auth-frontend/data"
 	"net/http"
 	"testing"
 )
@@ -17,6 +18,9 @@ func NewWebApiResponder(t *testing.T) *WebApiResponder {
 		OnSuccessFunc: func(w http.ResponseWriter, v interface{}) {
 			t.Error("OnSuccessFunc should not be called")
 		},
+		OnSuccessPageFunc: func(w http.ResponseWriter, page data.Page) {
+			t.Error("OnSuccessPageFunc should not be called")
+		},
 	}
 }
 
@@ -24,6 +28,7 @@ type WebApiResponder struct {
 	OnContextErrorFunc func(w http.ResponseWriter, err error)
 	OnErrorFunc        func(ctx context.Context, w http.ResponseWriter, err error)
 	OnSuccessFunc      func(w http.ResponseWriter, v interface{})
+	OnSuccessPageFunc  func(w http.ResponseWriter, page data.Page)
 }
 
 func (r *WebApiResponder) OnContextError(w http.ResponseWriter, err error) {
@@ -37,3 +42,7 @@ func (r *WebApiResponder) OnError(ctx context.Context, w http.ResponseWriter, er
 func (r *WebApiResponder) OnSuccess(w http.ResponseWriter, v interface{}) {
 	r.OnSuccessFunc(w, v)
 }
+
+func (r *WebApiResponder) OnSuccessPage(w http.ResponseWriter, page data.Page) {
+	r.OnSuccessPageFunc(w, page)
+}